@@ -2,10 +2,16 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
+	"fmt"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/chi/middleware"
@@ -39,7 +45,6 @@ func routes() *chi.Mux {
 
 	router.Use(
 		render.SetContentType(render.ContentTypeJSON), // Set content-Type headers as application/json
-		middleware.RealIP, // Set req.RemoteAddr correctly even behind proxy
 		middleware.Logger, // Log API request calls
 		cors.Handler,
 		ngauth.LanguageDetector,
@@ -57,6 +62,12 @@ func routes() *chi.Mux {
 	router.Get("/", IndexHandler)
 	router.Get("/health", Health)
 
+	//public keys for verifying tokens, empty for HS256
+	router.Get("/.well-known/jwks.json", JWKS)
+
+	//OpenID Connect discovery
+	router.Get("/.well-known/openid-configuration", OpenIDConfiguration)
+
 	//registration steps
 	router.Post("/generate_otp", GenerateOTP)
 	router.Post("/verify_otp", VerifyOTP)
@@ -65,17 +76,72 @@ func routes() *chi.Mux {
 	//login
 	router.Post("/login", Login)
 
+	//login second step, when two-factor authentication is enabled
+	router.Post("/login/2fa", LoginTOTP)
+	router.Post("/login/otp", LoginOTP)
+
+	//passkey login, /login/webauthn/options first
+	router.Post("/login/webauthn/options", WebAuthnLoginOptions)
+	router.Post("/login/webauthn", WebAuthnLogin)
+
 	//get a new access token
 	router.Post("/token", Token)
 
+	//oauth 2.0 authorization server, login/consent page and token endpoint
+	router.Get("/oauth/authorize", OAuthAuthorize)
+	router.Post("/oauth/authorize", OAuthAuthorizeLogin)
+	router.Post("/oauth/token", OAuthToken)
+
+	//device authorization grant, the device polls /oauth/token while the user approves it at /device
+	router.Post("/device/code", DeviceAuthorization)
+	router.Get("/device", DeviceVerify)
+	router.Post("/device", DeviceVerifyLogin)
+
+	//token introspection and revocation, for the oauth clients
+	router.Post("/introspect", IntrospectToken)
+	router.Post("/revoke", RevokeToken)
+
+	//logout, revokes the refresh token
+	router.Post("/logout", Logout)
+
 	//reset password, use generate_otp and verify_otp prior to this
 	router.Post("/reset_password", ResetPassword)
 
-	//change password, token required
-	router.Post("/change_password", ChangePassword)
+	//unlock account locked after failed logins, use generate_otp and verify_otp prior to this
+	router.Post("/unlock_account", UnlockAccount)
+
+	//token required
+	router.Group(func(r chi.Router) {
+		r.Use(ngauth.RequireAuth)
+
+		//account management, not with the tokens of oauth clients
+		r.Group(func(r chi.Router) {
+			r.Use(ngauth.RequireFirstParty)
+
+			//logout from all devices
+			r.Post("/logout_all", LogoutAll)
+
+			//change password
+			r.Post("/change_password", ChangePassword)
 
-	//push token
-	router.Post("/update_push_token", UpdatePushToken)
+			//two-factor authentication (TOTP)
+			r.Post("/2fa/enroll", EnrollTOTP)
+			r.Post("/2fa/confirm", ConfirmTOTP)
+			r.Post("/2fa/disable", DisableTOTP)
+			r.Post("/2fa/recovery_codes", RegenerateRecoveryCodes)
+
+			//passkeys (WebAuthn), /webauthn/register/options first
+			r.Post("/webauthn/register/options", WebAuthnRegisterOptions)
+			r.Post("/webauthn/register", WebAuthnRegister)
+		})
+
+		//OpenID Connect, access tokens with the openid scope
+		r.Get("/userinfo", UserInfo)
+		r.Post("/userinfo", UserInfo)
+	})
+
+	//push token, token is optional
+	router.With(ngauth.OptionalAuth).Post("/update_push_token", UpdatePushToken)
 
 	//public routes
 	router.Route("/pb", func(r chi.Router) {
@@ -89,6 +155,8 @@ func routes() *chi.Mux {
 
 	//private routes - access token authentication done first, then proxy the request
 	router.Route("/pt", func(r chi.Router) {
+		r.Use(ngauth.RequireAuth)
+		r.Use(ngauth.RequireScope(config.UpstreamPrivateScope))
 		r.Get("/*", HandleAllPrivate)
 		r.Post("/*", HandleAllPrivate)
 		r.Put("/*", HandleAllPrivate)
@@ -108,6 +176,23 @@ func main() {
 	//initialize the database
 	initDB()
 
+	//register an oauth client and exit, eg
+	//ngauth oauth_client -name "My App" -redirect_uris "https://app.example.com/callback" -public
+	//ngauth oauth_client -name "Billing" -grant_types client_credentials -scopes "invoices:read"
+	//ngauth oauth_client -name "TV App" -grant_types "urn:ietf:params:oauth:grant-type:device_code refresh_token" -public
+	if len(os.Args) > 1 && os.Args[1] == "oauth_client" {
+		registerOAuthClient(os.Args[2:])
+		return
+	}
+
+	//deliver queued emails, sms and push notifications
+	dispatcher := ngauth.NewNotificationDispatcher(db, &config)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	//promote signing keys without a restart
+	go reloadKeyringOnSignal()
+
 	//create the routes
 	router := routes()
 
@@ -129,7 +214,11 @@ func main() {
 func initDB() {
 
 	//easily swap repository implementation here
-	db = &ngauth.SQLRepository{}
+	if config.DBDriver == "memory" {
+		db = &ngauth.MemoryRepository{}
+	} else {
+		db = &ngauth.SQLRepository{}
+	}
 
 	err := db.Init(&config)
 	if err != nil {
@@ -137,6 +226,49 @@ func initDB() {
 	}
 }
 
+// registerOAuthClient - registers an oauth client from the command line arguments and prints it
+func registerOAuthClient(args []string) {
+
+	flags := flag.NewFlagSet("oauth_client", flag.ExitOnError)
+	name := flags.String("name", "", "name shown on the login page")
+	redirectURIs := flags.String("redirect_uris", "", "space separated redirect uris")
+	scopes := flags.String("scopes", "", "space separated scopes the client can request, empty for any")
+	public := flags.Bool("public", false, "public client without a secret, eg a SPA or mobile app")
+	grantTypes := flags.String("grant_types", "", "space separated grant types, client_credentials for machine clients (default authorization_code refresh_token)")
+	flags.Parse(args)
+
+	params := map[string]interface{}{"name": *name, "redirect_uris": *redirectURIs, "scopes": *scopes, "public": *public, "grant_types": *grantTypes}
+
+	response, err := ngauth.RegisterOAuthClient(db, ngauth.LanguageEN, params)
+	if err != nil {
+		log.Fatalf("OAuth: registering client failed: %s", err.Message)
+	}
+
+	output, _ := json.MarshalIndent(response, "", "  ")
+	fmt.Println(string(output))
+}
+
+// reloadKeyringOnSignal - reloads the keyring file on SIGHUP
+func reloadKeyringOnSignal() {
+
+	//the keyring was loaded at startup, ngauth does not start otherwise
+	if ngauth.IsEmptyString(config.JWTKeyringFile) {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		err := config.JWTKeyring.Reload(config.JWTKeyringFile)
+		if err != nil {
+			ngauth.LogErrorf("Keyring: reload failed: %s \n", err.Error())
+			continue
+		}
+		ngauth.LogInfo("Keyring: reloaded, current kid: " + config.JWTKeyring.Current().ID)
+	}
+}
+
 // ###################### http handlers ##############
 
 // GenerateOTP - generates otp and sends it
@@ -185,7 +317,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 func Login(w http.ResponseWriter, r *http.Request) {
 
 	lang, receivedData := getParams(r)
-	receivedData["ip_addr"] = r.RemoteAddr
+	receivedData["ip_addr"] = ngauth.ClientIP(r)
 	receivedData["user_agent"] = r.UserAgent()
 
 	response, err := ngauth.Login(db, lang, receivedData, hashCheck)
@@ -197,26 +329,34 @@ func Login(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, response)
 }
 
-// ResetPassword - reset user password
-func ResetPassword(w http.ResponseWriter, r *http.Request) {
+// LoginTOTP - login with the mfa_token returned by Login and a TOTP code
+func LoginTOTP(w http.ResponseWriter, r *http.Request) {
 
 	lang, receivedData := getParams(r)
+	receivedData["ip_addr"] = ngauth.ClientIP(r)
+	receivedData["user_agent"] = r.UserAgent()
 
-	response, err := ngauth.ResetPassword(db, lang, receivedData, hashMake)
+	response, err := ngauth.LoginTOTP(db, lang, receivedData, hashCheck)
 	if err != nil {
-		ngauth.ErrorResponse(w, err.Message, err.Code)
+		if err.Code == ngauth.ErrorInvalidToken {
+			ngauth.HTTPErrorResponse(w, err.Message, http.StatusUnauthorized)
+		} else {
+			ngauth.ErrorResponse(w, err.Message, err.Code)
+		}
 		return
 	}
 
 	render.JSON(w, r, response)
 }
 
-// ChangePassword - changes user's password
-func ChangePassword(w http.ResponseWriter, r *http.Request) {
+// LoginOTP - passwordless login with a magic link token or an otp_for LOGIN code
+func LoginOTP(w http.ResponseWriter, r *http.Request) {
 
-	// Validate access token
-	accessToken := ngauth.GetTokenFromHeader(r)
-	_, err := ngauth.IsValidToken(accessToken)
+	lang, receivedData := getParams(r)
+	receivedData["ip_addr"] = ngauth.ClientIP(r)
+	receivedData["user_agent"] = r.UserAgent()
+
+	response, err := ngauth.LoginOTP(db, lang, receivedData)
 	if err != nil {
 		if err.Code == ngauth.ErrorInvalidToken {
 			ngauth.HTTPErrorResponse(w, err.Message, http.StatusUnauthorized)
@@ -226,6 +366,177 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	render.JSON(w, r, response)
+}
+
+// WebAuthnLoginOptions - challenge for a passkey login
+func WebAuthnLoginOptions(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+
+	response, err := ngauth.WebAuthnLoginOptions(db, lang, receivedData)
+	if err != nil {
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// WebAuthnLogin - login with a passkey
+func WebAuthnLogin(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+	receivedData["ip_addr"] = ngauth.ClientIP(r)
+	receivedData["user_agent"] = r.UserAgent()
+
+	response, err := ngauth.WebAuthnLogin(db, lang, receivedData)
+	if err != nil {
+		if err.Code == ngauth.ErrorWebAuthnFailed {
+			ngauth.HTTPErrorResponse(w, err.Message, http.StatusUnauthorized)
+		} else {
+			ngauth.ErrorResponse(w, err.Message, err.Code)
+		}
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// WebAuthnRegisterOptions - challenge for registering a passkey of the logged in user
+func WebAuthnRegisterOptions(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+
+	//IMPORTANT - user id comes from the access token only
+	receivedData["loggedin_user_id"] = ngauth.UserIDFromContext(r.Context())
+
+	response, err := ngauth.WebAuthnRegisterOptions(db, lang, receivedData)
+	if err != nil {
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// WebAuthnRegister - saves a passkey of the logged in user
+func WebAuthnRegister(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+
+	//IMPORTANT - user id comes from the access token only
+	receivedData["loggedin_user_id"] = ngauth.UserIDFromContext(r.Context())
+
+	response, err := ngauth.WebAuthnRegister(db, lang, receivedData)
+	if err != nil {
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// EnrollTOTP - generates a TOTP secret for the logged in user
+func EnrollTOTP(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+
+	//IMPORTANT - user id comes from the access token only
+	receivedData["loggedin_user_id"] = ngauth.UserIDFromContext(r.Context())
+
+	response, err := ngauth.EnrollTOTP(db, lang, receivedData)
+	if err != nil {
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// ConfirmTOTP - enables TOTP for the logged in user
+func ConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+
+	//IMPORTANT - user id comes from the access token only
+	receivedData["loggedin_user_id"] = ngauth.UserIDFromContext(r.Context())
+
+	response, err := ngauth.ConfirmTOTP(db, lang, receivedData, hashMake)
+	if err != nil {
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// DisableTOTP - disables TOTP for the logged in user
+func DisableTOTP(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+
+	//IMPORTANT - user id comes from the access token only
+	receivedData["loggedin_user_id"] = ngauth.UserIDFromContext(r.Context())
+	receivedData["ip_addr"] = ngauth.ClientIP(r)
+
+	response, err := ngauth.DisableTOTP(db, lang, receivedData, hashCheck)
+	if err != nil {
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// RegenerateRecoveryCodes - replaces the recovery codes of the logged in user
+func RegenerateRecoveryCodes(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+
+	//IMPORTANT - user id comes from the access token only
+	receivedData["loggedin_user_id"] = ngauth.UserIDFromContext(r.Context())
+
+	response, err := ngauth.RegenerateRecoveryCodes(db, lang, receivedData, hashMake)
+	if err != nil {
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// ResetPassword - reset user password
+func ResetPassword(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+
+	response, err := ngauth.ResetPassword(db, lang, receivedData, hashMake)
+	if err != nil {
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// UnlockAccount - unlocks an account locked after failed logins
+func UnlockAccount(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+
+	response, err := ngauth.UnlockAccount(db, lang, receivedData)
+	if err != nil {
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// ChangePassword - changes user's password
+func ChangePassword(w http.ResponseWriter, r *http.Request) {
+
 	lang, receivedData := getParams(r)
 
 	response, err := ngauth.ChangePassword(db, lang, receivedData, hashCheck, hashMake)
@@ -241,6 +552,8 @@ func ChangePassword(w http.ResponseWriter, r *http.Request) {
 func Token(w http.ResponseWriter, r *http.Request) {
 
 	lang, receivedData := getParams(r)
+	receivedData["ip_addr"] = ngauth.ClientIP(r)
+	receivedData["user_agent"] = r.UserAgent()
 
 	response, err := ngauth.Token(db, lang, receivedData)
 	if err != nil {
@@ -255,26 +568,278 @@ func Token(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, response)
 }
 
-// UpdatePushToken - updates push token
-func UpdatePushToken(w http.ResponseWriter, r *http.Request) {
+// OAuthAuthorize - authorization endpoint, shows the login/consent page.
+// Errors of the client_id and redirect_uri are shown on the page, the others are sent to the redirect_uri
+func OAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+
+	lang := ngauth.LangFromContext(r.Context())
+	params := formParams(r.URL.Query())
+
+	request, err := ngauth.ParseAuthorizeRequest(db, lang, params)
+	if err != nil {
+		renderAuthorizePage(w, http.StatusBadRequest, ngauth.AuthorizePage{Lang: lang, Error: err.Message})
+		return
+	}
+
+	if err = request.Validate(lang); err != nil {
+		http.Redirect(w, r, request.ErrorURL(err), http.StatusFound)
+		return
+	}
+
+	renderAuthorizePage(w, http.StatusOK, authorizePage(lang, request))
+}
+
+// OAuthAuthorizeLogin - login posted by the login/consent page, redirects to the client with an authorization code
+func OAuthAuthorizeLogin(w http.ResponseWriter, r *http.Request) {
+
+	lang := ngauth.LangFromContext(r.Context())
+	r.ParseForm()
+	params := formParams(r.PostForm)
+	params["ip_addr"] = ngauth.ClientIP(r)
+
+	request, err := ngauth.ParseAuthorizeRequest(db, lang, params)
+	if err != nil {
+		renderAuthorizePage(w, http.StatusBadRequest, ngauth.AuthorizePage{Lang: lang, Error: err.Message})
+		return
+	}
+
+	if err = request.Validate(lang); err != nil {
+		http.Redirect(w, r, request.ErrorURL(err), http.StatusFound)
+		return
+	}
+
+	if params["action"] == "deny" {
+		http.Redirect(w, r, request.ErrorURL(ngauth.NewError(lang, ngauth.ErrorAccessDenied)), http.StatusFound)
+		return
+	}
+
+	redirectURL, err := ngauth.Authorize(db, lang, request, params, hashCheck)
+	if err != nil {
+		page := authorizePage(lang, request)
+		page.Username = ngauth.GetStringOrEmpty(params["username"])
+		//a wrong code only comes from the second factor
+		page.TOTPRequired = err.Code == ngauth.ErrorTOTPRequired || err.Code == ngauth.ErrorInvalidOTPCode
+		page.Error = err.Message
+		renderAuthorizePage(w, http.StatusOK, page)
+		return
+	}
+
+	http.Redirect(w, r, redirectURL, http.StatusFound)
+}
+
+// OAuthToken - oauth token endpoint, the client authenticates with http basic auth or
+// client_id and client_secret in the form
+func OAuthToken(w http.ResponseWriter, r *http.Request) {
+
+	lang := ngauth.LangFromContext(r.Context())
+	params := clientParams(r)
+
+	response, err := ngauth.OAuthToken(db, lang, params, hashCheck)
+	if err != nil {
+		ngauth.OAuthErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	render.JSON(w, r, response)
+}
+
+// DeviceAuthorization - issues the device_code and user_code of the device authorization grant,
+// the client authenticates like at the token endpoint
+func DeviceAuthorization(w http.ResponseWriter, r *http.Request) {
+
+	lang := ngauth.LangFromContext(r.Context())
+	params := clientParams(r)
+
+	response, err := ngauth.DeviceAuthorization(db, lang, params, hashCheck)
+	if err != nil {
+		ngauth.OAuthErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	render.JSON(w, r, response)
+}
+
+// IntrospectToken - state and claims of an access or refresh token, for confidential clients
+func IntrospectToken(w http.ResponseWriter, r *http.Request) {
+
+	lang := ngauth.LangFromContext(r.Context())
+	params := clientParams(r)
+
+	response, err := ngauth.IntrospectToken(db, lang, params, hashCheck)
+	if err != nil {
+		ngauth.OAuthErrorResponse(w, err)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	render.JSON(w, r, response)
+}
+
+// RevokeToken - revokes an access or refresh token of the client, the response has no body
+func RevokeToken(w http.ResponseWriter, r *http.Request) {
+
+	lang := ngauth.LangFromContext(r.Context())
+	params := clientParams(r)
+
+	err := ngauth.RevokeToken(db, lang, params, hashCheck)
+	if err != nil {
+		ngauth.OAuthErrorResponse(w, err)
+		return
+	}
 
-	// Get access token if available
-	accessToken := ngauth.GetTokenFromHeader(r)
-	claims, errAccessToken := ngauth.IsValidToken(accessToken)
+	w.WriteHeader(http.StatusOK)
+}
+
+// DeviceVerify - verification page, asks for the user code unless it is in the url
+func DeviceVerify(w http.ResponseWriter, r *http.Request) {
+
+	lang := ngauth.LangFromContext(r.Context())
+	params := formParams(r.URL.Query())
+
+	if ngauth.IsEmptyString(ngauth.GetStringOrEmpty(params["user_code"])) {
+		renderAuthorizePage(w, http.StatusOK, ngauth.AuthorizePage{Lang: lang, UserCodeRequired: true})
+		return
+	}
+
+	request, err := ngauth.ParseDeviceRequest(db, lang, params)
+	if err != nil {
+		renderAuthorizePage(w, http.StatusOK, ngauth.AuthorizePage{Lang: lang, UserCodeRequired: true, Error: err.Message})
+		return
+	}
+
+	renderAuthorizePage(w, http.StatusOK, devicePage(lang, request))
+}
+
+// DeviceVerifyLogin - login posted by the verification page, approves or denies the device
+func DeviceVerifyLogin(w http.ResponseWriter, r *http.Request) {
+
+	lang := ngauth.LangFromContext(r.Context())
+	r.ParseForm()
+	params := formParams(r.PostForm)
+	params["ip_addr"] = ngauth.ClientIP(r)
+
+	request, err := ngauth.ParseDeviceRequest(db, lang, params)
+	if err != nil {
+		renderAuthorizePage(w, http.StatusOK, ngauth.AuthorizePage{Lang: lang, UserCodeRequired: true, Error: err.Message})
+		return
+	}
+
+	if params["action"] == "deny" {
+		if err = ngauth.DenyDevice(db, lang, request); err != nil {
+			renderAuthorizePage(w, http.StatusOK, ngauth.AuthorizePage{Lang: lang, UserCodeRequired: true, Error: err.Message})
+			return
+		}
+		renderAuthorizePage(w, http.StatusOK, ngauth.AuthorizePage{Lang: lang, Result: "denied"})
+		return
+	}
+
+	err = ngauth.AuthorizeDevice(db, lang, request, params, hashCheck)
+	if err != nil {
+		page := devicePage(lang, request)
+		page.Username = ngauth.GetStringOrEmpty(params["username"])
+		//a wrong code only comes from the second factor
+		page.TOTPRequired = err.Code == ngauth.ErrorTOTPRequired || err.Code == ngauth.ErrorInvalidOTPCode
+		page.Error = err.Message
+		renderAuthorizePage(w, http.StatusOK, page)
+		return
+	}
+
+	renderAuthorizePage(w, http.StatusOK, ngauth.AuthorizePage{Lang: lang, Result: "approved"})
+}
+
+// clientParams - form parameters of the token and device authorization endpoints, with the
+// client credentials of the basic auth header
+func clientParams(r *http.Request) map[string]interface{} {
+
+	r.ParseForm()
+	params := formParams(r.PostForm)
+	params["ip_addr"] = ngauth.ClientIP(r)
+	params["user_agent"] = r.UserAgent()
+
+	//basic auth credentials are form encoded (RFC 6749 section 2.3.1)
+	if clientID, clientSecret, ok := r.BasicAuth(); ok {
+		params["client_id"], _ = url.QueryUnescape(clientID)
+		params["client_secret"], _ = url.QueryUnescape(clientSecret)
+	}
+
+	return params
+}
+
+// devicePage - login page of the device request
+func devicePage(lang string, request *ngauth.DeviceRequest) ngauth.AuthorizePage {
+	return ngauth.AuthorizePage{Lang: lang, ClientName: request.Client.Name, Scopes: strings.Fields(request.DeviceCode.Scope), Params: request.Params()}
+}
+
+// authorizePage - login/consent page of the authorization request
+func authorizePage(lang string, request *ngauth.AuthorizeRequest) ngauth.AuthorizePage {
+	return ngauth.AuthorizePage{Lang: lang, ClientName: request.Client.Name, Scopes: strings.Fields(request.Scope), Params: request.Params()}
+}
+
+// renderAuthorizePage - writes the login/consent page, it can not be framed by other sites
+func renderAuthorizePage(w http.ResponseWriter, status int, page ngauth.AuthorizePage) {
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+
+	if err := ngauth.RenderAuthorizePage(w, page); err != nil {
+		ngauth.LogErrorf("OAuth: error rendering login page: %s", err.Error())
+	}
+}
+
+// Logout - revokes a refresh token
+func Logout(w http.ResponseWriter, r *http.Request) {
 
 	lang, receivedData := getParams(r)
-	receivedData["ip_addr"] = r.RemoteAddr
-	receivedData["user_agent"] = r.UserAgent()
 
-	//set current loggedin_user_id if access_token present
-	if errAccessToken != nil {
+	response, err := ngauth.Logout(db, lang, receivedData)
+	if err != nil {
+		if err.Code == ngauth.ErrorInvalidToken {
+			ngauth.HTTPErrorResponse(w, err.Message, http.StatusUnauthorized)
+		} else {
+			ngauth.ErrorResponse(w, err.Message, err.Code)
+		}
+		return
+	}
 
-		//IMPORTANT - unset any loggedin_user_id set by the client
-		receivedData["loggedin_user_id"] = nil
-	} else {
-		receivedData["loggedin_user_id"] = claims["id"]
+	render.JSON(w, r, response)
+}
+
+// LogoutAll - revokes all refresh tokens of the user
+func LogoutAll(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+
+	//IMPORTANT - user id comes from the access token only
+	receivedData["loggedin_user_id"] = ngauth.UserIDFromContext(r.Context())
+
+	response, err := ngauth.LogoutAll(db, lang, receivedData)
+	if err != nil {
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
 	}
 
+	render.JSON(w, r, response)
+}
+
+// UpdatePushToken - updates push token
+func UpdatePushToken(w http.ResponseWriter, r *http.Request) {
+
+	lang, receivedData := getParams(r)
+	receivedData["ip_addr"] = ngauth.ClientIP(r)
+	receivedData["user_agent"] = r.UserAgent()
+
+	//IMPORTANT - loggedin_user_id set by the client is overwritten,
+	//nil if no valid access token is present
+	receivedData["loggedin_user_id"] = ngauth.UserIDFromContext(r.Context())
+
 	response, err := ngauth.UpdatePushToken(db, lang, receivedData)
 	if err != nil {
 		ngauth.ErrorResponse(w, err.Message, err.Code)
@@ -284,8 +849,11 @@ func UpdatePushToken(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, response)
 }
 
-func sendOTPCallback(email string, phoneNo string, code string) {
-	ngauth.AsyncSendVerifCode(email, code)
+func sendOTPCallback(message ngauth.OTPMessage) {
+	err := ngauth.QueueOTP(db, message)
+	if err != nil {
+		ngauth.LogErrorf("Notifications: error queueing otp: %s", err.Message)
+	}
 }
 
 func getParams(r *http.Request) (string, map[string]interface{}) {
@@ -296,9 +864,25 @@ func getParams(r *http.Request) (string, map[string]interface{}) {
 	var receivedData map[string]interface{}
 	json.NewDecoder(r.Body).Decode(&receivedData)
 
+	//empty body
+	if receivedData == nil {
+		receivedData = make(map[string]interface{})
+	}
+
 	return lang, receivedData
 }
 
+// formParams - first value of each form/query parameter
+func formParams(values url.Values) map[string]interface{} {
+
+	params := make(map[string]interface{})
+	for k := range values {
+		params[k] = values.Get(k)
+	}
+
+	return params
+}
+
 //##### password callbacks
 func hashMake(plainPassword string) string {
 	return ngauth.BcryptHashMake(plainPassword)
@@ -319,6 +903,51 @@ func Health(w http.ResponseWriter, r *http.Request) {
 	render.JSON(w, r, response)
 }
 
+// JWKS - public keys used to sign tokens
+func JWKS(w http.ResponseWriter, r *http.Request) {
+	render.JSON(w, r, ngauth.JWKS())
+}
+
+// OpenIDConfiguration - OpenID Connect provider metadata
+func OpenIDConfiguration(w http.ResponseWriter, r *http.Request) {
+
+	lang := ngauth.LangFromContext(r.Context())
+
+	response, err := ngauth.OpenIDConfiguration(lang)
+	if err != nil {
+		ngauth.HTTPErrorResponse(w, err.Message, http.StatusNotFound)
+		return
+	}
+
+	render.JSON(w, r, response)
+}
+
+// UserInfo - OpenID Connect claims of the logged in user
+func UserInfo(w http.ResponseWriter, r *http.Request) {
+
+	lang := ngauth.LangFromContext(r.Context())
+	receivedData := make(map[string]interface{})
+
+	//IMPORTANT - user id and scope come from the access token only
+	claims := ngauth.ClaimsFromContext(r.Context())
+	receivedData["loggedin_user_id"] = claims.UserID
+	receivedData["scope"] = claims.Raw["scope"]
+
+	response, err := ngauth.UserInfo(db, lang, receivedData)
+	if err != nil {
+		//no openid scope (RFC 6750 insufficient_scope)
+		if err.Code == ngauth.ErrorNotAuthorized {
+			ngauth.HTTPErrorResponse(w, err.Message, http.StatusForbidden)
+			return
+		}
+		ngauth.ErrorResponse(w, err.Message, err.Code)
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	render.JSON(w, r, response)
+}
+
 // IndexHandler - index handler
 func IndexHandler(w http.ResponseWriter, r *http.Request) {
 	//Prepare the response
@@ -345,18 +974,8 @@ func HandleAllPrivate(w http.ResponseWriter, r *http.Request) {
 	//we need to re-create another r.Body for the proxy
 	lang := "en"
 
-	// Validate access token
-	accessToken := ngauth.GetTokenFromHeader(r)
-	_, err := ngauth.IsValidToken(accessToken)
-	if err != nil {
-		if err.Code == ngauth.ErrorInvalidToken {
-			ngauth.HTTPErrorResponse(w, err.Message, http.StatusUnauthorized)
-		} else {
-			ngauth.ErrorResponse(w, err.Message, err.Code)
-		}
-		return
-	}
-
+	//access token is validated by RequireAuth, tokens of users and of oauth clients with UpstreamPrivateScope
+	//are accepted, upstream tells them apart by the id and client_id claims
 	handleAllUpstream(lang, config.UpstreamPrivateURL, w, r)
 }
 
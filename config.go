@@ -1,6 +1,7 @@
 package ngauth
 
 import (
+	"time"
 
 	// mysql dialect for gorm (wrapper for go-sql-driver)
 	_ "github.com/jinzhu/gorm/dialects/mysql"
@@ -11,6 +12,9 @@ import (
 	//mssql dialet for gorm
 	_ "github.com/jinzhu/gorm/dialects/mssql"
 
+	//sqlite dialet for gorm
+	_ "github.com/jinzhu/gorm/dialects/sqlite"
+
 	"github.com/spf13/viper"
 )
 
@@ -29,10 +33,14 @@ type Configuration struct {
 	DBConnectionString string
 
 	//DBDriver for database/sql,eg values mysql,postgres,mssql,sqlite3
+	//use memory for the in-memory database (tests, local development)
 	DBDriver           string
 	DBPoolMaxIdleConns int
 	DBPoolMaxOpenConns int
 
+	//DBAutoMigrate - create/update tables on Init
+	DBAutoMigrate bool
+
 	UsersTableName    string
 	OTPTableName      string
 	SessionsTableName string
@@ -44,25 +52,170 @@ type Configuration struct {
 	SMTPPassword string
 	SMTPFrom     string
 
+	//EmailTemplatesDir - overrides the built-in email templates, see EmailTemplates
+	EmailTemplatesDir string
+	EmailTemplates    *EmailTemplates
+
+	//LoginAlertEmails - email users after every login
+	LoginAlertEmails bool
+
+	//SMSProvider - log (default), file, twilio, africastalking or vonage,
+	//phone number otp codes are sent with SMSSender
+	SMSProvider string
+	SMSFrom     string
+	SMSFilePath string
+
+	//SMSBaseURL - overrides the gateway url, eg for a sandbox
+	SMSBaseURL string
+
+	TwilioAccountSID       string
+	TwilioAuthToken        string
+	AfricasTalkingUsername string
+	AfricasTalkingAPIKey   string
+	VonageAPIKey           string
+	VonageAPISecret        string
+
+	//SMSSender - created from SMSProvider, can be replaced with a custom sender
+	SMSSender SMSSender
+
+	//FCMServerKey - firebase cloud messaging server key, for push notifications
+	FCMServerKey string
+
+	//notifications outbox, see NotificationDispatcher. Times are in seconds
+	NotificationWorkers      int
+	NotificationPollInterval int64
+	NotificationMaxAttempts  int
+	NotificationRetryTime    int64
+	NotificationMaxRetryTime int64
+
 	//SignKey for generating JWT Tokens
 	SignKey              []byte
 	JWTAccessExpireMins  int
 	JWTRefreshExpireMins int
 
+	//JWTIssuer, JWTAudience - iss and aud claims of issued tokens,
+	//tokens with a different iss/aud are rejected. Empty to skip
+	JWTIssuer   string
+	JWTAudience string
+
+	//JWTAcceptLegacyTokens - accept tokens issued before the token_use, iss and aud claims were added,
+	//so users stay logged in after upgrading. Can be turned off JWTRefreshExpireMins after the upgrade
+	JWTAcceptLegacyTokens bool
+
+	//JWTRefreshRotation - issue a new refresh token on every /token call,
+	//reusing an old refresh token revokes all tokens issued from the same login
+	JWTRefreshRotation bool
+
+	//JWTSigningAlg - HS256 (default, uses SignKey), RS256, PS256, ES256, EdDSA etc
+	//asymmetric algorithms load the private key from JWTPrivateKeyFile (PEM)
+	JWTSigningAlg     string
+	JWTPrivateKeyFile string
+
+	//JWTKeyID - kid header, defaults to the key thumbprint for asymmetric keys
+	JWTKeyID string
+
+	//JWTKeyringFile - json file with the current and retired signing keys, see keyring.go
+	//takes precedence over JWTSigningAlg/JWTPrivateKeyFile. Reload it to promote a new key
+	JWTKeyringFile string
+
+	//JWTKeyRetentionMins - how long retired keys still verify tokens, defaults to JWTRefreshExpireMins
+	JWTKeyRetentionMins int
+
+	//JWTKeyring - loaded from JWTKeyringFile or JWTPrivateKeyFile
+	JWTKeyring *Keyring
+
+	//TOTPIssuer - issuer shown in authenticator apps
+	TOTPIssuer string
+
+	//TOTPSkew - number of 30s steps before/after now accepted, for clock drift
+	TOTPSkew int
+
+	//RecoveryCodesCount - number of recovery codes generated when TOTP is enabled
+	RecoveryCodesCount int
+
+	//MFATokenExpireMins - how long the mfa_token returned by Login can be used at /login/2fa
+	MFATokenExpireMins int
+
+	//OTPHashKey - secret of the keys hashing otp codes and encrypting notification bodies, defaults to SignKey
+	OTPHashKey []byte
+
 	//otp
 	OTPExpireTime int64
 	OTPBanTime    int64
 	OTPFindTime   int64
 	OTPMaxRetry   int
 
+	//VerificationExpireTime - seconds a verification_id from verify_otp can be used
+	VerificationExpireTime int64
+
+	//OTPMaxAttempts - wrong codes allowed per otp, the otp is invalidated after that
+	OTPMaxAttempts int
+
+	//OTPLockoutAttempts - wrong codes allowed per email/phone number within OTPLockoutTime (seconds),
+	//generate_otp and verify_otp are refused until the oldest failures age out
+	OTPLockoutAttempts int
+	OTPLockoutTime     int64
+
+	//LoginMaxFailures - failed logins before the account is locked for LoginLockoutTime (seconds),
+	//every further failure doubles the lockout, up to LoginMaxLockoutTime. 0 to disable
+	LoginMaxFailures    int
+	LoginLockoutTime    int64
+	LoginMaxLockoutTime int64
+
+	//LoginMaxFailuresPerIP - failed logins from one ip address within LoginFindTime (seconds). 0 to disable
+	LoginMaxFailuresPerIP int
+	LoginFindTime         int64
+
+	//TrustedProxies - ip addresses or CIDRs of the reverse proxies, X-Forwarded-For is ignored
+	//for requests from anywhere else, see ClientIP
+	TrustedProxies []string
+
 	//only register verified users
 	VerifyBeforeRegister bool
 
+	//MagicLinkURL - page of the web client that posts the token query parameter to /login/otp,
+	//emailed with the otp_for LOGIN code. Empty to send the code only
+	MagicLinkURL string
+
+	//WebAuthn (passkeys) relying party, WebAuthnRPID is the domain of the web client, eg example.com
+	WebAuthnRPID   string
+	WebAuthnRPName string
+
+	//WebAuthnOrigins - origins allowed to use passkeys, defaults to https://<WebAuthnRPID>
+	WebAuthnOrigins []string
+
+	//WebAuthnTimeout - seconds a registration/login challenge can be used
+	WebAuthnTimeout int64
+
+	//WebAuthnUserVerification - required, preferred or discouraged
+	WebAuthnUserVerification string
+
+	//OAuthCodeExpireMins - authorization codes have to be exchanged at the token endpoint within this time
+	OAuthCodeExpireMins int64
+
+	//DeviceVerificationURL - page where users enter the user code of the device authorization grant, ie /device
+	DeviceVerificationURL string
+
+	//DeviceCodeExpireMins - the user has to approve the device within this time
+	DeviceCodeExpireMins int64
+
+	//DeviceCodeInterval - seconds devices wait between polls of the token endpoint
+	DeviceCodeInterval int
+
 	//proxy
 	UpstreamPublicURL  string
 	UpstreamPrivateURL string
+
+	//UpstreamPrivateScope - scope oauth access tokens need for the private routes, without it they are refused
+	UpstreamPrivateScope string
 }
 
+// defaultSignKey - SIGN_KEY if none is configured
+const defaultSignKey = "g4k591b582367a97acd7d1e5dc260729"
+
+// exampleOTPHashKey - OTP_HASH_KEY of .config.example.yaml
+const exampleOTPHashKey = "change-me"
+
 // Config holds configuration variables
 var Config *Configuration
 
@@ -87,21 +240,62 @@ func ParseConfig(inConfig *Configuration) {
 	viper.SetDefault("DB_DRIVER", "mysql")
 	viper.SetDefault("DB_POOL_MAX_IDLE_CONNS", "-1")
 	viper.SetDefault("DB_POOL_MAX_OPEN_CONNS", "-1")
+	viper.SetDefault("DB_AUTO_MIGRATE", "true")
 
 	viper.SetDefault("USERS_TABLE_NAME", "users")
 	viper.SetDefault("OTP_TABLE_NAME", "otp")
 	viper.SetDefault("SESSIONS_TABLE_NAME", "sessions")
 
+	viper.SetDefault("LOGIN_ALERT_EMAILS", "false")
+
+	viper.SetDefault("NOTIFICATION_WORKERS", "4")
+	viper.SetDefault("NOTIFICATION_POLL_INTERVAL", "5")
+	viper.SetDefault("NOTIFICATION_MAX_ATTEMPTS", "6")
+	viper.SetDefault("NOTIFICATION_RETRY_TIME", "30")       //doubles after every failure
+	viper.SetDefault("NOTIFICATION_MAX_RETRY_TIME", "3600") //default 1 hour
+
 	viper.SetDefault("OTP_EXPIRE_TIME", "300") //default 5mins
 	viper.SetDefault("OTP_BAN_TIME", "300")    //default 5mins
 	viper.SetDefault("OTP_FIND_TIME", "300")   //default 5mins
 	viper.SetDefault("OTP_MAX_RETRY", "3")
+	viper.SetDefault("VERIFICATION_EXPIRE_TIME", "600") //default 10mins
+	viper.SetDefault("OTP_MAX_ATTEMPTS", "5")
+	viper.SetDefault("OTP_LOCKOUT_ATTEMPTS", "10")
+	viper.SetDefault("OTP_LOCKOUT_TIME", "900") //default 15mins
+
+	viper.SetDefault("LOGIN_MAX_FAILURES", "5")
+	viper.SetDefault("LOGIN_LOCKOUT_TIME", "300")       //default 5mins
+	viper.SetDefault("LOGIN_MAX_LOCKOUT_TIME", "86400") //default 1 day
+	viper.SetDefault("LOGIN_FIND_TIME", "900")          //default 15mins
+
+	//behind a proxy without TRUSTED_PROXIES every client has the ip of the proxy,
+	//throttling it would lock everyone out
+	if len(viper.GetStringSlice("TRUSTED_PROXIES")) > 0 {
+		viper.SetDefault("LOGIN_MAX_FAILURES_PER_IP", "20")
+	} else {
+		viper.SetDefault("LOGIN_MAX_FAILURES_PER_IP", "0")
+	}
 
 	//at least 32 byte long for security
-	viper.SetDefault("SIGN_KEY", "g4k591b582367a97acd7d1e5dc260729")
+	viper.SetDefault("SIGN_KEY", defaultSignKey)
 	viper.SetDefault("JWT_ACCESS_EXPIRE_MINS", "15")
 	viper.SetDefault("JWT_REFRESH_EXPIRE_MINS", "1440")
+	viper.SetDefault("JWT_REFRESH_ROTATION", "false")
+	viper.SetDefault("JWT_ACCEPT_LEGACY_TOKENS", "false")
+	viper.SetDefault("JWT_SIGNING_ALG", "HS256")
+	viper.SetDefault("TOTP_ISSUER", "ngauth")
+	viper.SetDefault("TOTP_SKEW", "1")
+	viper.SetDefault("MFA_TOKEN_EXPIRE_MINS", "5")
+	viper.SetDefault("RECOVERY_CODES_COUNT", "10")
 	viper.SetDefault("VERIFY_BEFORE_REGISTER", "true")
+	viper.SetDefault("WEBAUTHN_RP_ID", "localhost")
+	viper.SetDefault("WEBAUTHN_RP_NAME", "ngauth")
+	viper.SetDefault("WEBAUTHN_TIMEOUT", "300") //default 5mins
+	viper.SetDefault("WEBAUTHN_USER_VERIFICATION", "preferred")
+	viper.SetDefault("OAUTH_CODE_EXPIRE_MINS", "2")
+	viper.SetDefault("DEVICE_VERIFICATION_URL", "http://localhost:8080/device")
+	viper.SetDefault("DEVICE_CODE_EXPIRE_MINS", "10")
+	viper.SetDefault("DEVICE_CODE_INTERVAL", "5")
 
 	//############### GET VALUES FROM ENV
 	inConfig.Port = viper.GetString("PORT")
@@ -109,24 +303,143 @@ func ParseConfig(inConfig *Configuration) {
 	inConfig.DBDriver = viper.GetString("DB_DRIVER")
 	inConfig.DBPoolMaxIdleConns = viper.GetInt("DB_POOL_MAX_IDLE_CONNS")
 	inConfig.DBPoolMaxOpenConns = viper.GetInt("DB_POOL_MAX_OPEN_CONNS")
+	inConfig.DBAutoMigrate = viper.GetBool("DB_AUTO_MIGRATE")
 
 	inConfig.UsersTableName = viper.GetString("USERS_TABLE_NAME")
 	inConfig.OTPTableName = viper.GetString("OTP_TABLE_NAME")
 	inConfig.SessionsTableName = viper.GetString("SESSIONS_TABLE_NAME")
 
+	inConfig.EmailTemplatesDir = viper.GetString("EMAIL_TEMPLATES_DIR")
+	inConfig.EmailTemplates = NewEmailTemplates(inConfig.EmailTemplatesDir)
+	inConfig.LoginAlertEmails = viper.GetBool("LOGIN_ALERT_EMAILS")
+
+	inConfig.SMSProvider = viper.GetString("SMS_PROVIDER")
+	inConfig.SMSFrom = viper.GetString("SMS_FROM")
+	inConfig.SMSFilePath = viper.GetString("SMS_FILE_PATH")
+	inConfig.SMSBaseURL = viper.GetString("SMS_BASE_URL")
+	inConfig.TwilioAccountSID = viper.GetString("TWILIO_ACCOUNT_SID")
+	inConfig.TwilioAuthToken = viper.GetString("TWILIO_AUTH_TOKEN")
+	inConfig.AfricasTalkingUsername = viper.GetString("AFRICASTALKING_USERNAME")
+	inConfig.AfricasTalkingAPIKey = viper.GetString("AFRICASTALKING_API_KEY")
+	inConfig.VonageAPIKey = viper.GetString("VONAGE_API_KEY")
+	inConfig.VonageAPISecret = viper.GetString("VONAGE_API_SECRET")
+
+	//no default sender, log prints the codes and is only for development
+	smsSender, err := NewSMSSender(inConfig)
+	if err != nil {
+		LogErrorf("Config: error creating SMS sender: %s \n", err)
+	} else if smsSender == nil {
+		LogInfo("Config: SMS_PROVIDER not set, sms are not sent")
+	} else {
+		inConfig.SMSSender = smsSender
+		LogInfof("Config: SMS provider: %s", inConfig.SMSProvider)
+	}
+
+	inConfig.FCMServerKey = viper.GetString("FCM_SERVER_KEY")
+	inConfig.NotificationWorkers = viper.GetInt("NOTIFICATION_WORKERS")
+	inConfig.NotificationPollInterval = viper.GetInt64("NOTIFICATION_POLL_INTERVAL")
+	inConfig.NotificationMaxAttempts = viper.GetInt("NOTIFICATION_MAX_ATTEMPTS")
+	inConfig.NotificationRetryTime = viper.GetInt64("NOTIFICATION_RETRY_TIME")
+	inConfig.NotificationMaxRetryTime = viper.GetInt64("NOTIFICATION_MAX_RETRY_TIME")
+
+	inConfig.OTPHashKey = []byte(viper.GetString("OTP_HASH_KEY"))
+
+	//anyone with the key can test every code against the saved hashes and read queued notifications
+	if string(inConfig.OTPHashKey) == exampleOTPHashKey {
+		LogFatalf("Config: OTP_HASH_KEY is the example value, set a random secret \n")
+	}
 	inConfig.OTPExpireTime = viper.GetInt64("OTP_EXPIRE_TIME")
 	inConfig.OTPBanTime = viper.GetInt64("OTP_BAN_TIME")
 	inConfig.OTPFindTime = viper.GetInt64("OTP_FIND_TIME")
 	inConfig.OTPMaxRetry = viper.GetInt("OTP_MAX_RETRY")
+	inConfig.VerificationExpireTime = viper.GetInt64("VERIFICATION_EXPIRE_TIME")
+	inConfig.OTPMaxAttempts = viper.GetInt("OTP_MAX_ATTEMPTS")
+	inConfig.OTPLockoutAttempts = viper.GetInt("OTP_LOCKOUT_ATTEMPTS")
+	inConfig.OTPLockoutTime = viper.GetInt64("OTP_LOCKOUT_TIME")
+
+	inConfig.LoginMaxFailures = viper.GetInt("LOGIN_MAX_FAILURES")
+	inConfig.LoginLockoutTime = viper.GetInt64("LOGIN_LOCKOUT_TIME")
+	inConfig.LoginMaxLockoutTime = viper.GetInt64("LOGIN_MAX_LOCKOUT_TIME")
+	inConfig.LoginMaxFailuresPerIP = viper.GetInt("LOGIN_MAX_FAILURES_PER_IP")
+	inConfig.LoginFindTime = viper.GetInt64("LOGIN_FIND_TIME")
+	inConfig.TrustedProxies = viper.GetStringSlice("TRUSTED_PROXIES")
+
+	if inConfig.LoginMaxFailuresPerIP > 0 && len(inConfig.TrustedProxies) == 0 {
+		LogError("Config: LOGIN_MAX_FAILURES_PER_IP is set without TRUSTED_PROXIES, behind a reverse proxy or load balancer all clients share its ip address and are throttled together")
+	}
 
 	inConfig.SignKey = []byte(viper.GetString("SIGN_KEY"))
+
+	if len(inConfig.OTPHashKey) == 0 && string(inConfig.SignKey) == defaultSignKey {
+		LogError("Config: OTP_HASH_KEY and SIGN_KEY are not set, otp codes and queued notifications are hashed and encrypted with a public key")
+	}
 	inConfig.JWTAccessExpireMins = viper.GetInt("JWT_ACCESS_EXPIRE_MINS")
 	inConfig.JWTRefreshExpireMins = viper.GetInt("JWT_REFRESH_EXPIRE_MINS")
+	inConfig.JWTRefreshRotation = viper.GetBool("JWT_REFRESH_ROTATION")
+	inConfig.JWTIssuer = viper.GetString("JWT_ISSUER")
+	inConfig.JWTAudience = viper.GetString("JWT_AUDIENCE")
+	inConfig.JWTAcceptLegacyTokens = viper.GetBool("JWT_ACCEPT_LEGACY_TOKENS")
+	inConfig.JWTSigningAlg = viper.GetString("JWT_SIGNING_ALG")
+	inConfig.JWTPrivateKeyFile = viper.GetString("JWT_PRIVATE_KEY_FILE")
+	inConfig.JWTKeyID = viper.GetString("JWT_KEY_ID")
+	inConfig.JWTKeyringFile = viper.GetString("JWT_KEYRING_FILE")
+	inConfig.JWTKeyRetentionMins = viper.GetInt("JWT_KEY_RETENTION_MINS")
+
+	if inConfig.JWTKeyRetentionMins <= 0 {
+		inConfig.JWTKeyRetentionMins = inConfig.JWTRefreshExpireMins
+	}
+	retention := time.Duration(inConfig.JWTKeyRetentionMins) * time.Minute
+
+	//signing keys, without them every token would be refused, don't start
+	if !IsEmptyString(inConfig.JWTKeyringFile) {
+		keyring, err := LoadKeyring(inConfig.JWTKeyringFile, retention)
+		if err != nil {
+			LogFatalf("Config: error loading JWT keyring: %s \n", err)
+		}
+		inConfig.JWTKeyring = keyring
+		LogInfof("Config: JWT keyring loaded, current kid: %s", keyring.Current().ID)
+	} else if !IsEmptyString(inConfig.JWTPrivateKeyFile) {
+		key, err := LoadSigningKey(inConfig.JWTSigningAlg, inConfig.JWTKeyID, inConfig.JWTPrivateKeyFile)
+		if err != nil {
+			LogFatalf("Config: error loading JWT private key: %s \n", err)
+		}
+		inConfig.JWTKeyring = NewKeyring(key, retention)
+		LogInfof("Config: JWT signing key loaded, alg: %s kid: %s", inConfig.JWTSigningAlg, key.ID)
+	} else if _, err := NewHMACSigningKey(inConfig.JWTSigningAlg, "", inConfig.SignKey); !IsEmptyString(inConfig.JWTSigningAlg) && err != nil {
+		LogFatalf("Config: JWT_SIGNING_ALG %s: %s, set JWT_PRIVATE_KEY_FILE for asymmetric algorithms \n", inConfig.JWTSigningAlg, err)
+	}
+
+	//tokens signed with SIGN_KEY before the keyring have no kid, they are verified until they age out.
+	//not the default SIGN_KEY, it is public
+	if inConfig.JWTKeyring != nil && string(inConfig.SignKey) != defaultSignKey {
+		legacyKey, err := NewHMACSigningKey("HS256", "", inConfig.SignKey)
+		if err == nil {
+			inConfig.JWTKeyring.SetLegacyKey(legacyKey, TimeNow())
+		}
+	}
+
+	inConfig.TOTPIssuer = viper.GetString("TOTP_ISSUER")
+	inConfig.TOTPSkew = viper.GetInt("TOTP_SKEW")
+	inConfig.MFATokenExpireMins = viper.GetInt("MFA_TOKEN_EXPIRE_MINS")
+	inConfig.RecoveryCodesCount = viper.GetInt("RECOVERY_CODES_COUNT")
+
 	inConfig.VerifyBeforeRegister = viper.GetBool("VERIFY_BEFORE_REGISTER")
+	inConfig.MagicLinkURL = viper.GetString("MAGIC_LINK_URL")
+
+	inConfig.WebAuthnRPID = viper.GetString("WEBAUTHN_RP_ID")
+	inConfig.WebAuthnRPName = viper.GetString("WEBAUTHN_RP_NAME")
+	inConfig.WebAuthnOrigins = viper.GetStringSlice("WEBAUTHN_ORIGINS")
+	inConfig.WebAuthnTimeout = viper.GetInt64("WEBAUTHN_TIMEOUT")
+	inConfig.WebAuthnUserVerification = viper.GetString("WEBAUTHN_USER_VERIFICATION")
+	inConfig.OAuthCodeExpireMins = viper.GetInt64("OAUTH_CODE_EXPIRE_MINS")
+	inConfig.DeviceVerificationURL = viper.GetString("DEVICE_VERIFICATION_URL")
+	inConfig.DeviceCodeExpireMins = viper.GetInt64("DEVICE_CODE_EXPIRE_MINS")
+	inConfig.DeviceCodeInterval = viper.GetInt("DEVICE_CODE_INTERVAL")
 
 	//proxy
 	inConfig.UpstreamPublicURL = viper.GetString("UPSTREAM_PUBLIC_URL")
 	inConfig.UpstreamPrivateURL = viper.GetString("UPSTREAM_PRIVATE_URL")
+	inConfig.UpstreamPrivateScope = viper.GetString("UPSTREAM_PRIVATE_SCOPE")
 
 	LogInfo("Config: parsing config completed")
 
@@ -1,15 +1,29 @@
 package ngauth
 
+import (
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
 // Database - Database interface, all db need to implement this
 type Database interface {
 	Init(config *Configuration) error
 	Close() error
 	//GetID(id interface{}) interface{}
 
-	//GetUser(userID interface{}, lang string) (*User, *Error)
+	GetUserByID(userID interface{}, lang string) (*User, *Error)
 	GetUserBy(email string, phoneNo string, lang string) (*User, *Error)
 	CreateUser(user User, lang string) (interface{}, *Error)
 	UpdateUserByID(userID interface{}, columns interface{}, lang string) *Error
+	// IncrementFailedLogins - counts a failed login for the user, returns the new count
+	IncrementFailedLogins(userID interface{}, lang string) (int, *Error)
+	// UpdateUserTOTP - sets the TOTP secret, enabledAt is null until the secret is confirmed.
+	// an empty secret disables TOTP
+	UpdateUserTOTP(userID interface{}, secret string, enabledAt null.Time, lang string) *Error
+	// UpdateUserTOTPStep - saves the time step of an accepted TOTP code,
+	// returns ErrorInvalidOTPCode if the step or a later one was accepted already
+	UpdateUserTOTPStep(userID interface{}, step int64, lang string) *Error
 
 	//###########  OTP
 	// GetOTP - returns the most current otp
@@ -18,10 +32,105 @@ type Database interface {
 	// CreateOTP - save otp to db
 	CreateOTP(otp OTP, lang string) (interface{}, *Error)
 	UpdateOTPByID(otpID interface{}, columns interface{}, lang string) *Error
+	// UseOTP - marks the otp verified, returns ErrorAlreadyVerified if it was verified already
+	UseOTP(otpID interface{}, lang string) *Error
+	// GetOTPByVerificationID - returns the otp verified with the verification id
+	GetOTPByVerificationID(verificationID string, lang string) (*OTP, *Error)
+	// UseVerification - marks the verification id of the otp used,
+	// returns ErrorVerificationUsed if it was used already
+	UseVerification(otpID interface{}, lang string) *Error
+	// IncrementOTPFailedAttempts - counts an attempt at the code of the otp before it is checked, unless the otp
+	// has maxAttempts already (0 for no limit). Returns the new count, 0 if the attempt was not counted
+	IncrementOTPFailedAttempts(otpID interface{}, maxAttempts int, lang string) (int, *Error)
+	// DecrementOTPFailedAttempts - takes back the attempt of a correct code
+	DecrementOTPFailedAttempts(otpID interface{}, lang string) *Error
+	// GetOTPFailedAttempts - total wrong codes for the email/phoneNo since the given time, for all otp_for values
+	GetOTPFailedAttempts(email string, phoneNo string, since time.Time, lang string) (int64, *Error)
 
 	//########### Sessions
 	CreateSession(session Session, lang string) (interface{}, *Error)
 	GetSession(refreshToken string, lang string) (*Session, *Error)
+	// RevokeSession - revokes the session of a refresh token, ie. logout
+	RevokeSession(refreshToken string, lang string) *Error
+	// RevokeUserSessions - revokes all sessions of a user, ie. logout everywhere
+	RevokeUserSessions(userID interface{}, lang string) *Error
+	// RevokeClientSessions - revokes the sessions of a user issued to an oauth client
+	RevokeClientSessions(userID interface{}, clientID string, lang string) *Error
+	// RotateSession - marks the session as rotated and creates its successor,
+	// returns ErrorInvalidToken if the session was already rotated or revoked
+	RotateSession(sessionID interface{}, newSession Session, lang string) (interface{}, *Error)
+	// RevokeSessionFamily - revokes all sessions rotated from the same login
+	RevokeSessionFamily(familyID string, lang string) *Error
+
+	//########### Login Failures
+	CreateLoginFailure(loginFailure LoginFailure, lang string) *Error
+	// CountLoginFailures - failed logins from the ip address since the given time
+	CountLoginFailures(ipAddr string, since time.Time, lang string) (int64, *Error)
+	// DeleteLoginFailures - deletes failed logins older than the given time
+	DeleteLoginFailures(before time.Time, lang string) *Error
+
+	//########### Used Tokens
+	// UseToken - saves the jti of a single use token, returns ErrorInvalidToken if it was used already.
+	// expired tokens are deleted
+	UseToken(jti string, expiresAt time.Time, lang string) *Error
+	// IsTokenUsed - true if the jti was saved with UseToken
+	IsTokenUsed(jti string, lang string) (bool, *Error)
+
+	//########### Recovery Codes
+	// ReplaceRecoveryCodes - deletes all recovery codes of the user and saves the new ones
+	ReplaceRecoveryCodes(userID interface{}, codes []RecoveryCode, lang string) *Error
+	// GetRecoveryCodes - returns the unused recovery codes of the user
+	GetRecoveryCodes(userID interface{}, lang string) ([]RecoveryCode, *Error)
+	// UseRecoveryCode - marks the code used, returns ErrorInvalidOTPCode if it was used already
+	UseRecoveryCode(codeID interface{}, lang string) *Error
+
+	//########### Notifications
+	CreateNotification(notification Notification, lang string) (interface{}, *Error)
+	// GetDueNotifications - pending notifications and claims that were not finished, with next_attempt_at before now
+	GetDueNotifications(now time.Time, limit int, lang string) ([]Notification, *Error)
+	// ClaimNotification - marks the notification sending until leaseUntil and counts the attempt,
+	// returns false if another worker claimed it first (attempts changed)
+	ClaimNotification(notificationID interface{}, attempts int, leaseUntil time.Time, lang string) (bool, *Error)
+	UpdateNotificationByID(notificationID interface{}, columns interface{}, lang string) *Error
+	// ExpireNotifications - marks the undelivered notifications expired before now and clears their bodies
+	ExpireNotifications(now time.Time, lang string) *Error
+	// GetNotifications - newest first, empty status for all
+	GetNotifications(status string, offset int64, limit int64, lang string) ([]Notification, *Error)
+
+	//########### WebAuthn
+	CreateWebAuthnCredential(credential WebAuthnCredential, lang string) (interface{}, *Error)
+	// GetWebAuthnCredential - returns the credential with the base64url credential id
+	GetWebAuthnCredential(credentialID string, lang string) (*WebAuthnCredential, *Error)
+	GetWebAuthnCredentials(userID interface{}, lang string) ([]WebAuthnCredential, *Error)
+	UpdateWebAuthnCredentialByID(credentialID interface{}, columns interface{}, lang string) *Error
+	CreateWebAuthnChallenge(challenge WebAuthnChallenge, lang string) (interface{}, *Error)
+	GetWebAuthnChallenge(challenge string, lang string) (*WebAuthnChallenge, *Error)
+	// UseWebAuthnChallenge - marks the challenge used, returns ErrorWebAuthnChallenge if it was used already
+	UseWebAuthnChallenge(challengeID interface{}, lang string) *Error
+
+	//########### OAuth
+	CreateOAuthClient(client OAuthClient, lang string) (interface{}, *Error)
+	// GetOAuthClient - returns nil if there is no client with the client_id
+	GetOAuthClient(clientID string, lang string) (*OAuthClient, *Error)
+	CreateOAuthCode(code OAuthCode, lang string) (interface{}, *Error)
+	// GetOAuthCode - returns the code with the hash, used or not
+	GetOAuthCode(codeHash string, lang string) (*OAuthCode, *Error)
+	// UseOAuthCode - marks the code used, returns ErrorInvalidGrant if it was used already
+	UseOAuthCode(codeID interface{}, lang string) *Error
+
+	//########### Device Authorization
+	CreateDeviceCode(deviceCode DeviceCode, lang string) (interface{}, *Error)
+	// GetDeviceCode - returns the device code with the hash, nil if there is none
+	GetDeviceCode(deviceCodeHash string, lang string) (*DeviceCode, *Error)
+	// GetPendingDeviceCode - returns the unexpired device code of the user code that was neither approved nor denied
+	GetPendingDeviceCode(userCode string, lang string) (*DeviceCode, *Error)
+	// ApproveDeviceCode, DenyDeviceCode - return ErrorInvalidUserCode if the device code was approved/denied already
+	ApproveDeviceCode(codeID interface{}, userID interface{}, lang string) *Error
+	DenyDeviceCode(codeID interface{}, lang string) *Error
+	// PollDeviceCode - saves the poll time and the interval of the next poll
+	PollDeviceCode(codeID interface{}, pollInterval int, lang string) *Error
+	// UseDeviceCode - marks the approved device code used, returns ErrorInvalidGrant if it was used already
+	UseDeviceCode(codeID interface{}, lang string) *Error
 
 	//########### Push Tokens
 	CreateOrUpdatePushToken(pushToken PushToken, lang string) *Error
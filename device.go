@@ -0,0 +1,263 @@
+package ngauth
+
+import (
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// OAuth 2.0 Device Authorization Grant, https://tools.ietf.org/html/rfc8628
+// the device gets a device_code and a user_code from DeviceAuthorization and shows the user_code with
+// Config.DeviceVerificationURL. The user logs in at that page on a phone or computer and approves the device,
+// meanwhile the device polls the token endpoint with the device_code until it gets a session and its tokens
+
+// slowDownSeconds - added to the poll interval of a device that polls too fast
+const slowDownSeconds = 5
+
+// DeviceAuthorization - device authorization endpoint, issues a device_code and user_code to the client.
+// The response is the RFC 8628 device authorization response, errors are sent with OAuthErrorResponse
+func DeviceAuthorization(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) (map[string]interface{}, *Error) {
+
+	if pwdCheckCallback == nil {
+		return nil, NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	client, err := authenticateOAuthClient(db, lang, params, pwdCheckCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	//not registered for the grant type
+	if !ArrayContains(GrantTypeDeviceCode, strings.Fields(client.GrantTypes)) {
+		return nil, NewError(lang, ErrorUnauthorizedClient)
+	}
+
+	//OpenID Connect scopes are allowed for every client
+	scope := strings.Join(strings.Fields(GetStringOrEmpty(params["scope"])), " ")
+	if !scopesAllowed(withoutOIDCScopes(scope), client.Scopes) || !oidcScopesAllowed(scope) {
+		return nil, NewError(lang, ErrorInvalidScope)
+	}
+
+	//user codes are short, they have to be unique among the pending requests only
+	userCode := GenerateUserCode()
+	for i := 0; i < 3; i++ {
+		pending, err := db.GetPendingDeviceCode(userCode, lang)
+		if err != nil {
+			return nil, err
+		}
+		if pending == nil {
+			break
+		}
+		userCode = GenerateUserCode()
+	}
+
+	deviceCode := generateOAuthToken()
+	record := DeviceCode{
+		DeviceCodeHash: hashOAuthCode(deviceCode),
+		UserCode:       userCode,
+		ClientID:       client.ClientID,
+		Scope:          scope,
+		PollInterval:   Config.DeviceCodeInterval,
+		ExpiresAt:      null.TimeFrom(TimeNow().Add(time.Duration(Config.DeviceCodeExpireMins) * time.Minute)),
+		CreatedAt:      null.TimeFrom(TimeNow()),
+	}
+
+	_, err = db.CreateDeviceCode(record, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["device_code"] = deviceCode
+	response["user_code"] = FormatUserCode(userCode)
+	response["verification_uri"] = Config.DeviceVerificationURL
+	response["verification_uri_complete"] = verificationURIComplete(userCode)
+	response["expires_in"] = Config.DeviceCodeExpireMins * 60
+	response["interval"] = Config.DeviceCodeInterval
+
+	return response, nil
+}
+
+// verificationURIComplete - verification url with the user_code, for QR codes
+func verificationURIComplete(userCode string) string {
+
+	u, err := url.Parse(Config.DeviceVerificationURL)
+	if err != nil {
+		return Config.DeviceVerificationURL
+	}
+
+	query := u.Query()
+	query.Set("user_code", FormatUserCode(userCode))
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// deviceCodesPurgeTime - device codes that expired before it are deleted when a new one is created,
+// they expired one DeviceCodeExpireMins ago
+func deviceCodesPurgeTime() time.Time {
+	return TimeNow().Add(-time.Duration(Config.DeviceCodeExpireMins) * time.Minute)
+}
+
+//######## VERIFICATION PAGE
+
+// DeviceRequest - device authorization request of a user code, shown on the verification page
+type DeviceRequest struct {
+	Client     *OAuthClient
+	DeviceCode *DeviceCode
+}
+
+// ParseDeviceRequest - finds the request of the user_code, returns ErrorInvalidUserCode
+// if it is unknown, expired or the user approved/denied it already
+func ParseDeviceRequest(db Database, lang string, params map[string]interface{}) (*DeviceRequest, *Error) {
+
+	userCode := NormalizeUserCode(GetStringOrEmpty(params["user_code"]))
+
+	if IsEmptyString(userCode) {
+		return nil, NewError(lang, ErrorInvalidUserCode)
+	}
+
+	deviceCode, err := db.GetPendingDeviceCode(userCode, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if deviceCode == nil {
+		return nil, NewError(lang, ErrorInvalidUserCode)
+	}
+
+	client, err := db.GetOAuthClient(deviceCode.ClientID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if client == nil {
+		return nil, NewError(lang, ErrorInvalidClient)
+	}
+
+	return &DeviceRequest{Client: client, DeviceCode: deviceCode}, nil
+}
+
+// Params - parameters of the request, posted back by the verification page
+func (r *DeviceRequest) Params() map[string]string {
+	return map[string]string{"user_code": FormatUserCode(r.DeviceCode.UserCode)}
+}
+
+// AuthorizeDevice - logs the user in with the credentials posted by the verification page (see Authorize)
+// and approves the device, it gets the tokens at its next poll of the token endpoint
+func AuthorizeDevice(db Database, lang string, request *DeviceRequest, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) *Error {
+
+	if request == nil || pwdCheckCallback == nil {
+		return NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	user, err := loginPageUser(db, lang, params, pwdCheckCallback)
+	if err != nil {
+		return err
+	}
+
+	return db.ApproveDeviceCode(request.DeviceCode.ID, user.ID, lang)
+}
+
+// DenyDevice - the user denied the device, it gets access_denied at its next poll
+func DenyDevice(db Database, lang string, request *DeviceRequest) *Error {
+
+	if request == nil {
+		return NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	return db.DenyDeviceCode(request.DeviceCode.ID, lang)
+}
+
+//######## TOKEN ENDPOINT
+
+// oauthDeviceCodeGrant - polled by the device until the user approves or denies it, authorization_pending
+// while waiting and slow_down when polled again within the interval. Approved device codes are used once
+func oauthDeviceCodeGrant(db Database, lang string, client *OAuthClient, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	deviceCode := GetStringOrEmpty(params["device_code"])
+
+	//check for empty fields
+	if IsEmptyTextContent(deviceCode) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	record, err := db.GetDeviceCode(hashOAuthCode(deviceCode), lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//unknown, issued to another client or used already
+	if record == nil || record.ClientID != client.ClientID || record.UsedAt.Valid {
+		return nil, NewError(lang, ErrorInvalidGrant)
+	}
+
+	if record.ExpiresAt.Time.Before(TimeNow()) {
+		return nil, NewError(lang, ErrorExpiredToken)
+	}
+
+	if record.DeniedAt.Valid {
+		return nil, NewError(lang, ErrorAccessDenied)
+	}
+
+	if !record.ApprovedAt.Valid {
+
+		pollInterval := record.PollInterval
+		slowDown := record.LastPolledAt.Valid && TimeNow().Before(record.LastPolledAt.Time.Add(time.Duration(pollInterval)*time.Second))
+		if slowDown {
+			pollInterval += slowDownSeconds
+		}
+
+		err = db.PollDeviceCode(record.ID, pollInterval, lang)
+		if err != nil {
+			return nil, err
+		}
+
+		if slowDown {
+			return nil, NewError(lang, ErrorSlowDown)
+		}
+		return nil, NewError(lang, ErrorAuthorizationPending)
+	}
+
+	err = db.UseDeviceCode(record.ID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := db.GetUserByID(record.UserID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	//locked after the device was approved
+	if user.LockedUntil.Valid && user.LockedUntil.Time.After(TimeNow()) {
+		return nil, accountLockedError(lang, user.LockedUntil.Time)
+	}
+
+	//refresh token
+	refreshToken, err := GenerateRefreshToken(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	//save refresh token to db
+	session := Session{UserID: user.ID, RefreshToken: refreshToken, FamilyID: GenerateUUID(), CreatedAt: null.TimeFrom(TimeNow()), ClientID: client.ClientID, Scope: record.Scope,
+		IPAddr: GetStringOrEmpty(params["ip_addr"]), UserAgent: GetStringOrEmpty(params["user_agent"])}
+	_, err = db.CreateSession(session, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//the user logged in when the device was approved
+	return oauthTokenResponse(&session, user, "", record.ApprovedAt.Time.Unix())
+}
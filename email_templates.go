@@ -0,0 +1,328 @@
+package ngauth
+
+import (
+	"bytes"
+	"errors"
+	htmltemplate "html/template"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	texttemplate "text/template"
+	"time"
+)
+
+// Email template names, otp templates are named otp_<otp_for> eg otp_register
+// and fall back to otp when there is no template for the purpose
+const (
+	TemplateOTP        = "otp"
+	TemplateLoginAlert = "login_alert"
+)
+
+// errTemplateNotFound - no template in the templates directory or the built-in ones
+var errTemplateNotFound = errors.New("Email template not found")
+
+// OTPMessage - otp code to send, passed to the sendOTPCallback of GenerateOTP
+type OTPMessage struct {
+	Lang        string
+	OTPFor      string
+	Email       string
+	PhoneNumber string
+	Code        string
+
+	//Link - magic link of otp_for LOGIN, empty for the other purposes
+	Link string
+
+	ExpiresAt  time.Time
+	ExpireMins int64
+}
+
+// LoginAlert - sent to the user's email after a login, see Config.LoginAlertEmails
+type LoginAlert struct {
+	Lang      string
+	Email     string
+	Name      string
+	IPAddr    string
+	UserAgent string
+	Time      string
+}
+
+// RenderedEmail - subject, html and text bodies of a template,
+// SMS is the sms block of the template or the text body
+type RenderedEmail struct {
+	Subject string
+	HTML    string
+	Text    string
+	SMS     string
+}
+
+// EmailTemplates - renders templates from Dir, falling back to the built-in templates.
+// A template file is <Dir>/<lang>/<name>.tmpl and defines the subject, html and text blocks
+// (and optionally sms), eg
+//
+//	{{define "subject"}}Verification Code{{end}}
+//	{{define "html"}}<p>Your verification code is <b>{{.Code}}</b></p>{{end}}
+//	{{define "text"}}Your verification code is {{.Code}}{{end}}
+//
+// the html block is rendered with html/template, the others with text/template
+type EmailTemplates struct {
+	Dir string
+
+	mu    sync.RWMutex
+	cache map[string]*parsedTemplate
+}
+
+// parsedTemplate - the same source parsed for html and text output
+type parsedTemplate struct {
+	html *htmltemplate.Template
+	text *texttemplate.Template
+}
+
+// NewEmailTemplates - creates templates overridable from dir, empty dir for the built-in templates only
+func NewEmailTemplates(dir string) *EmailTemplates {
+	return &EmailTemplates{Dir: dir, cache: make(map[string]*parsedTemplate)}
+}
+
+// defaultTemplates - used when Config.EmailTemplates is not set
+var defaultTemplates = NewEmailTemplates("")
+
+// emailTemplates - configured templates or the built-in ones
+func emailTemplates() *EmailTemplates {
+	if Config != nil && Config.EmailTemplates != nil {
+		return Config.EmailTemplates
+	}
+	return defaultTemplates
+}
+
+// Reload - clears parsed templates, edited files are read again on the next Render
+func (t *EmailTemplates) Reload() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.cache = make(map[string]*parsedTemplate)
+}
+
+// Render - renders the template in lang, falls back to english
+func (t *EmailTemplates) Render(lang string, name string, data interface{}) (*RenderedEmail, error) {
+
+	tmpl, err := t.lookup(lang, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered RenderedEmail
+	var buf bytes.Buffer
+
+	if err = tmpl.text.ExecuteTemplate(&buf, "subject", data); err != nil {
+		return nil, err
+	}
+	rendered.Subject = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err = tmpl.html.ExecuteTemplate(&buf, "html", data); err != nil {
+		return nil, err
+	}
+	rendered.HTML = strings.TrimSpace(buf.String())
+
+	buf.Reset()
+	if err = tmpl.text.ExecuteTemplate(&buf, "text", data); err != nil {
+		return nil, err
+	}
+	rendered.Text = strings.TrimSpace(buf.String())
+
+	rendered.SMS = rendered.Text
+	if tmpl.text.Lookup("sms") != nil {
+		buf.Reset()
+		if err = tmpl.text.ExecuteTemplate(&buf, "sms", data); err != nil {
+			return nil, err
+		}
+		rendered.SMS = strings.TrimSpace(buf.String())
+	}
+
+	return &rendered, nil
+}
+
+// lookup - parsed template from the cache, parses it on first use
+func (t *EmailTemplates) lookup(lang string, name string) (*parsedTemplate, error) {
+
+	if !ArrayContains(lang, supportedLanguages[:]) {
+		lang = LanguageEN
+	}
+	key := lang + "/" + name
+
+	t.mu.RLock()
+	tmpl, ok := t.cache[key]
+	t.mu.RUnlock()
+	if ok {
+		return tmpl, nil
+	}
+
+	source, err := t.source(lang, name)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpl = &parsedTemplate{}
+	if tmpl.html, err = htmltemplate.New(name).Parse(source); err != nil {
+		return nil, err
+	}
+	if tmpl.text, err = texttemplate.New(name).Parse(source); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	if t.cache == nil {
+		t.cache = make(map[string]*parsedTemplate)
+	}
+	t.cache[key] = tmpl
+	t.mu.Unlock()
+
+	return tmpl, nil
+}
+
+// source - template file in lang, built-in template in lang, then the same in english
+func (t *EmailTemplates) source(lang string, name string) (string, error) {
+
+	langs := []string{lang}
+	if lang != LanguageEN {
+		langs = append(langs, LanguageEN)
+	}
+
+	for _, l := range langs {
+
+		if !IsEmptyString(t.Dir) {
+			data, err := ioutil.ReadFile(filepath.Join(t.Dir, l, name+".tmpl"))
+			if err == nil {
+				return string(data), nil
+			}
+			if !os.IsNotExist(err) {
+				return "", err
+			}
+		}
+
+		if source, ok := builtinTemplates[l][name]; ok {
+			return source, nil
+		}
+	}
+
+	return "", errTemplateNotFound
+}
+
+// RenderOTPMessage - renders the otp_<otp_for> template, or the otp template if there is none for the purpose
+func RenderOTPMessage(message OTPMessage) (*RenderedEmail, error) {
+
+	templates := emailTemplates()
+
+	if !IsEmptyString(message.OTPFor) {
+		rendered, err := templates.Render(message.Lang, TemplateOTP+"_"+strings.ToLower(message.OTPFor), message)
+		if err != errTemplateNotFound {
+			return rendered, err
+		}
+	}
+
+	return templates.Render(message.Lang, TemplateOTP, message)
+}
+
+// builtinTemplates - lang -> name -> template source
+var builtinTemplates = map[string]map[string]string{
+
+	LanguageEN: {
+		TemplateOTP: `{{define "subject"}}Verification Code{{end}}
+{{define "html"}}<p>Your verification code is <b>{{.Code}}</b>.</p><p>It expires in {{.ExpireMins}} minutes.</p>{{end}}
+{{define "text"}}Your verification code is {{.Code}}. It expires in {{.ExpireMins}} minutes.{{end}}
+{{define "sms"}}Your verification code is {{.Code}}{{end}}`,
+
+		"otp_register": `{{define "subject"}}Confirm your registration{{end}}
+{{define "html"}}<p>Use the code <b>{{.Code}}</b> to complete your registration.</p><p>It expires in {{.ExpireMins}} minutes.</p>{{end}}
+{{define "text"}}Use the code {{.Code}} to complete your registration. It expires in {{.ExpireMins}} minutes.{{end}}
+{{define "sms"}}Your registration code is {{.Code}}{{end}}`,
+
+		"otp_reset": `{{define "subject"}}Reset your password{{end}}
+{{define "html"}}<p>Use the code <b>{{.Code}}</b> to reset your password.</p><p>It expires in {{.ExpireMins}} minutes. If you did not ask to reset your password, ignore this email.</p>{{end}}
+{{define "text"}}Use the code {{.Code}} to reset your password. It expires in {{.ExpireMins}} minutes. If you did not ask to reset your password, ignore this email.{{end}}
+{{define "sms"}}Your password reset code is {{.Code}}{{end}}`,
+
+		"otp_unlock": `{{define "subject"}}Unlock your account{{end}}
+{{define "html"}}<p>Your account was locked after too many failed logins. Use the code <b>{{.Code}}</b> to unlock it.</p><p>It expires in {{.ExpireMins}} minutes.</p>{{end}}
+{{define "text"}}Your account was locked after too many failed logins. Use the code {{.Code}} to unlock it. It expires in {{.ExpireMins}} minutes.{{end}}
+{{define "sms"}}Your account unlock code is {{.Code}}{{end}}`,
+
+		"otp_login": `{{define "subject"}}Log in to your account{{end}}
+{{define "html"}}{{if .Link}}<p><a href="{{.Link}}">Log in</a></p><p>Or use the code <b>{{.Code}}</b> to log in.</p>{{else}}<p>Use the code <b>{{.Code}}</b> to log in.</p>{{end}}<p>It expires in {{.ExpireMins}} minutes. If you did not try to log in, ignore this email.</p>{{end}}
+{{define "text"}}{{if .Link}}Log in: {{.Link}}
+
+Or use the code {{.Code}} to log in.{{else}}Use the code {{.Code}} to log in.{{end}} It expires in {{.ExpireMins}} minutes. If you did not try to log in, ignore this email.{{end}}
+{{define "sms"}}Your login code is {{.Code}}{{end}}`,
+
+		TemplateLoginAlert: `{{define "subject"}}New login to your account{{end}}
+{{define "html"}}<p>Hi {{.Name}},</p><p>Your account was logged in to on {{.Time}} from {{.IPAddr}} ({{.UserAgent}}).</p><p>If this was not you, change your password now.</p>{{end}}
+{{define "text"}}Hi {{.Name}}, your account was logged in to on {{.Time}} from {{.IPAddr}} ({{.UserAgent}}). If this was not you, change your password now.{{end}}`,
+	},
+
+	LanguageSW: {
+		TemplateOTP: `{{define "subject"}}Msimbo wa uthibitisho{{end}}
+{{define "html"}}<p>Msimbo wako wa uthibitisho ni <b>{{.Code}}</b>.</p><p>Utaisha muda baada ya dakika {{.ExpireMins}}.</p>{{end}}
+{{define "text"}}Msimbo wako wa uthibitisho ni {{.Code}}. Utaisha muda baada ya dakika {{.ExpireMins}}.{{end}}
+{{define "sms"}}Msimbo wako wa uthibitisho ni {{.Code}}{{end}}`,
+
+		"otp_register": `{{define "subject"}}Thibitisha usajili wako{{end}}
+{{define "html"}}<p>Tumia msimbo <b>{{.Code}}</b> kukamilisha usajili wako.</p><p>Utaisha muda baada ya dakika {{.ExpireMins}}.</p>{{end}}
+{{define "text"}}Tumia msimbo {{.Code}} kukamilisha usajili wako. Utaisha muda baada ya dakika {{.ExpireMins}}.{{end}}
+{{define "sms"}}Msimbo wako wa usajili ni {{.Code}}{{end}}`,
+
+		"otp_reset": `{{define "subject"}}Badilisha nenosiri lako{{end}}
+{{define "html"}}<p>Tumia msimbo <b>{{.Code}}</b> kubadilisha nenosiri lako.</p><p>Utaisha muda baada ya dakika {{.ExpireMins}}. Kama hukuomba kubadilisha nenosiri, puuza barua pepe hii.</p>{{end}}
+{{define "text"}}Tumia msimbo {{.Code}} kubadilisha nenosiri lako. Utaisha muda baada ya dakika {{.ExpireMins}}. Kama hukuomba kubadilisha nenosiri, puuza barua pepe hii.{{end}}
+{{define "sms"}}Msimbo wako wa kubadilisha nenosiri ni {{.Code}}{{end}}`,
+
+		"otp_unlock": `{{define "subject"}}Fungua akaunti yako{{end}}
+{{define "html"}}<p>Akaunti yako imefungwa baada ya majaribio mengi ya kuingia. Tumia msimbo <b>{{.Code}}</b> kuifungua.</p><p>Utaisha muda baada ya dakika {{.ExpireMins}}.</p>{{end}}
+{{define "text"}}Akaunti yako imefungwa baada ya majaribio mengi ya kuingia. Tumia msimbo {{.Code}} kuifungua. Utaisha muda baada ya dakika {{.ExpireMins}}.{{end}}
+{{define "sms"}}Msimbo wako wa kufungua akaunti ni {{.Code}}{{end}}`,
+
+		"otp_login": `{{define "subject"}}Ingia kwenye akaunti yako{{end}}
+{{define "html"}}{{if .Link}}<p><a href="{{.Link}}">Ingia</a></p><p>Au tumia msimbo <b>{{.Code}}</b> kuingia.</p>{{else}}<p>Tumia msimbo <b>{{.Code}}</b> kuingia.</p>{{end}}<p>Utaisha muda baada ya dakika {{.ExpireMins}}. Kama hukujaribu kuingia, puuza barua pepe hii.</p>{{end}}
+{{define "text"}}{{if .Link}}Ingia: {{.Link}}
+
+Au tumia msimbo {{.Code}} kuingia.{{else}}Tumia msimbo {{.Code}} kuingia.{{end}} Utaisha muda baada ya dakika {{.ExpireMins}}. Kama hukujaribu kuingia, puuza barua pepe hii.{{end}}
+{{define "sms"}}Msimbo wako wa kuingia ni {{.Code}}{{end}}`,
+
+		TemplateLoginAlert: `{{define "subject"}}Kuingia kupya kwenye akaunti yako{{end}}
+{{define "html"}}<p>Habari {{.Name}},</p><p>Akaunti yako imeingiwa tarehe {{.Time}} kutoka {{.IPAddr}} ({{.UserAgent}}).</p><p>Kama si wewe, badilisha nenosiri lako sasa.</p>{{end}}
+{{define "text"}}Habari {{.Name}}, akaunti yako imeingiwa tarehe {{.Time}} kutoka {{.IPAddr}} ({{.UserAgent}}). Kama si wewe, badilisha nenosiri lako sasa.{{end}}`,
+	},
+
+	LanguageTR: {
+		TemplateOTP: `{{define "subject"}}Doğrulama Kodu{{end}}
+{{define "html"}}<p>Doğrulama kodunuz <b>{{.Code}}</b>.</p><p>Kodun süresi {{.ExpireMins}} dakika içinde dolar.</p>{{end}}
+{{define "text"}}Doğrulama kodunuz {{.Code}}. Kodun süresi {{.ExpireMins}} dakika içinde dolar.{{end}}
+{{define "sms"}}Doğrulama kodunuz {{.Code}}{{end}}`,
+
+		"otp_register": `{{define "subject"}}Kaydınızı onaylayın{{end}}
+{{define "html"}}<p>Kaydınızı tamamlamak için <b>{{.Code}}</b> kodunu kullanın.</p><p>Kodun süresi {{.ExpireMins}} dakika içinde dolar.</p>{{end}}
+{{define "text"}}Kaydınızı tamamlamak için {{.Code}} kodunu kullanın. Kodun süresi {{.ExpireMins}} dakika içinde dolar.{{end}}
+{{define "sms"}}Kayıt kodunuz {{.Code}}{{end}}`,
+
+		"otp_reset": `{{define "subject"}}Şifrenizi sıfırlayın{{end}}
+{{define "html"}}<p>Şifrenizi sıfırlamak için <b>{{.Code}}</b> kodunu kullanın.</p><p>Kodun süresi {{.ExpireMins}} dakika içinde dolar. Şifre sıfırlama isteğinde bulunmadıysanız bu e-postayı dikkate almayın.</p>{{end}}
+{{define "text"}}Şifrenizi sıfırlamak için {{.Code}} kodunu kullanın. Kodun süresi {{.ExpireMins}} dakika içinde dolar. Şifre sıfırlama isteğinde bulunmadıysanız bu e-postayı dikkate almayın.{{end}}
+{{define "sms"}}Şifre sıfırlama kodunuz {{.Code}}{{end}}`,
+
+		"otp_unlock": `{{define "subject"}}Hesabınızın kilidini açın{{end}}
+{{define "html"}}<p>Hesabınız çok fazla başarısız giriş nedeniyle kilitlendi. Kilidi açmak için <b>{{.Code}}</b> kodunu kullanın.</p><p>Kodun süresi {{.ExpireMins}} dakika içinde dolar.</p>{{end}}
+{{define "text"}}Hesabınız çok fazla başarısız giriş nedeniyle kilitlendi. Kilidi açmak için {{.Code}} kodunu kullanın. Kodun süresi {{.ExpireMins}} dakika içinde dolar.{{end}}
+{{define "sms"}}Hesap kilidi açma kodunuz {{.Code}}{{end}}`,
+
+		"otp_login": `{{define "subject"}}Hesabınıza giriş yapın{{end}}
+{{define "html"}}{{if .Link}}<p><a href="{{.Link}}">Giriş yap</a></p><p>Ya da giriş yapmak için <b>{{.Code}}</b> kodunu kullanın.</p>{{else}}<p>Giriş yapmak için <b>{{.Code}}</b> kodunu kullanın.</p>{{end}}<p>Kodun süresi {{.ExpireMins}} dakika içinde dolar. Giriş yapmayı denemediyseniz bu e-postayı dikkate almayın.</p>{{end}}
+{{define "text"}}{{if .Link}}Giriş yap: {{.Link}}
+
+Ya da giriş yapmak için {{.Code}} kodunu kullanın.{{else}}Giriş yapmak için {{.Code}} kodunu kullanın.{{end}} Kodun süresi {{.ExpireMins}} dakika içinde dolar. Giriş yapmayı denemediyseniz bu e-postayı dikkate almayın.{{end}}
+{{define "sms"}}Giriş kodunuz {{.Code}}{{end}}`,
+
+		TemplateLoginAlert: `{{define "subject"}}Hesabınıza yeni giriş{{end}}
+{{define "html"}}<p>Merhaba {{.Name}},</p><p>Hesabınıza {{.Time}} tarihinde {{.IPAddr}} ({{.UserAgent}}) adresinden giriş yapıldı.</p><p>Bu siz değilseniz şifrenizi hemen değiştirin.</p>{{end}}
+{{define "text"}}Merhaba {{.Name}}, hesabınıza {{.Time}} tarihinde {{.IPAddr}} ({{.UserAgent}}) adresinden giriş yapıldı. Bu siz değilseniz şifrenizi hemen değiştirin.{{end}}`,
+	},
+}
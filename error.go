@@ -47,6 +47,39 @@ const (
 	ErrorWrongValueFor    = 2017
 	ErrorUserNotFound     = 2018
 	ErrorWaitFor          = 2019
+
+	//API errors - two-factor authentication
+	ErrorTOTPNotEnabled     = 2020
+	ErrorTOTPAlreadyEnabled = 2021
+
+	//API errors - brute force protection
+	ErrorTooManyAttempts     = 2022
+	ErrorOTPAttemptsExceeded = 2023
+	ErrorAccountLocked       = 2024
+
+	//API errors - verification_id
+	ErrorVerificationExpired = 2025
+	ErrorVerificationUsed    = 2026
+
+	//API errors - webauthn
+	ErrorWebAuthnFailed           = 2027
+	ErrorWebAuthnCredentialExists = 2028
+	ErrorWebAuthnChallenge        = 2029
+
+	//API errors - oauth, see OAuthError for the error codes of the oauth responses
+	ErrorInvalidClient           = 2030
+	ErrorInvalidRedirectURI      = 2031
+	ErrorInvalidGrant            = 2032
+	ErrorUnsupportedGrantType    = 2033
+	ErrorUnsupportedResponseType = 2034
+	ErrorInvalidScope            = 2035
+	ErrorAccessDenied            = 2036
+	ErrorTOTPRequired            = 2037
+	ErrorUnauthorizedClient      = 2038
+	ErrorAuthorizationPending    = 2039
+	ErrorSlowDown                = 2040
+	ErrorExpiredToken            = 2041
+	ErrorInvalidUserCode         = 2042
 )
 
 var errorText = map[int]map[string]string{
@@ -77,6 +110,34 @@ var errorText = map[int]map[string]string{
 	ErrorWrongValueFor:      map[string]string{LanguageEN: "Wrong value for: ", LanguageSW: "Wrong value for: ", LanguageTR: "Yanlış değer: "},
 	ErrorUserNotFound:       map[string]string{LanguageEN: "User Not Found", LanguageSW: "User Not Found", LanguageTR: "Kullanıcı Bulunamadı"},
 	ErrorWaitFor:            map[string]string{LanguageEN: "Please wait for", LanguageSW: "Tafadhali subiri kwa", LanguageTR: "Lütfen bekleyin"},
+
+	ErrorTOTPNotEnabled:     map[string]string{LanguageEN: "Two-factor authentication is not enabled", LanguageSW: "Uthibitishaji wa hatua mbili haujawezeshwa", LanguageTR: "İki adımlı doğrulama etkin değil"},
+	ErrorTOTPAlreadyEnabled: map[string]string{LanguageEN: "Two-factor authentication is already enabled", LanguageSW: "Uthibitishaji wa hatua mbili tayari umewezeshwa", LanguageTR: "İki adımlı doğrulama zaten etkin"},
+
+	ErrorTooManyAttempts:     map[string]string{LanguageEN: "Too many attempts, please try again later", LanguageSW: "Majaribio mengi mno, tafadhali jaribu tena baadaye", LanguageTR: "Çok fazla deneme, lütfen daha sonra tekrar deneyin"},
+	ErrorOTPAttemptsExceeded: map[string]string{LanguageEN: "Too many wrong codes, please request a new OTP", LanguageSW: "Umekosea mara nyingi mno, tafadhali omba OTP mpya", LanguageTR: "Çok fazla yanlış kod, lütfen yeni bir kod isteyin"},
+	ErrorAccountLocked:       map[string]string{LanguageEN: "Account locked after too many failed logins", LanguageSW: "Akaunti imefungwa baada ya majaribio mengi ya kuingia", LanguageTR: "Çok fazla başarısız giriş nedeniyle hesap kilitlendi"},
+
+	ErrorVerificationExpired: map[string]string{LanguageEN: "Verification expired, please verify again", LanguageSW: "Uthibitisho umeisha muda wake, tafadhali thibitisha tena", LanguageTR: "Doğrulamanın süresi doldu, lütfen tekrar doğrulayın"},
+	ErrorVerificationUsed:    map[string]string{LanguageEN: "Verification already used, please verify again", LanguageSW: "Uthibitisho umeshatumika, tafadhali thibitisha tena", LanguageTR: "Doğrulama zaten kullanıldı, lütfen tekrar doğrulayın"},
+
+	ErrorWebAuthnFailed:           map[string]string{LanguageEN: "Passkey verification failed", LanguageSW: "Uthibitishaji wa passkey umeshindikana", LanguageTR: "Geçiş anahtarı doğrulanamadı"},
+	ErrorWebAuthnCredentialExists: map[string]string{LanguageEN: "Passkey already registered", LanguageSW: "Passkey tayari imesajiliwa", LanguageTR: "Geçiş anahtarı zaten kayıtlı"},
+	ErrorWebAuthnChallenge:        map[string]string{LanguageEN: "Invalid or expired challenge, please try again", LanguageSW: "Changamoto batili au imeisha muda wake, tafadhali jaribu tena", LanguageTR: "Geçersiz veya süresi dolmuş istek, lütfen tekrar deneyin"},
+
+	ErrorInvalidClient:           map[string]string{LanguageEN: "Invalid client", LanguageSW: "Programu batili", LanguageTR: "Geçersiz istemci"},
+	ErrorInvalidRedirectURI:      map[string]string{LanguageEN: "Invalid redirect_uri", LanguageSW: "redirect_uri batili", LanguageTR: "Geçersiz redirect_uri"},
+	ErrorInvalidGrant:            map[string]string{LanguageEN: "Invalid or expired authorization grant", LanguageSW: "Idhini batili au imeisha muda wake", LanguageTR: "Geçersiz veya süresi dolmuş yetki"},
+	ErrorUnsupportedGrantType:    map[string]string{LanguageEN: "Unsupported grant_type", LanguageSW: "grant_type haitumiki", LanguageTR: "Desteklenmeyen grant_type"},
+	ErrorUnsupportedResponseType: map[string]string{LanguageEN: "Unsupported response_type", LanguageSW: "response_type haitumiki", LanguageTR: "Desteklenmeyen response_type"},
+	ErrorInvalidScope:            map[string]string{LanguageEN: "Invalid scope", LanguageSW: "Wigo batili", LanguageTR: "Geçersiz kapsam"},
+	ErrorAccessDenied:            map[string]string{LanguageEN: "Access denied", LanguageSW: "Ruhusa imekataliwa", LanguageTR: "Erişim reddedildi"},
+	ErrorTOTPRequired:            map[string]string{LanguageEN: "Please enter the code from your authenticator app", LanguageSW: "Tafadhali ingiza namba kutoka kwenye programu yako ya uthibitishaji", LanguageTR: "Lütfen doğrulama uygulamanızdaki kodu girin"},
+	ErrorUnauthorizedClient:      map[string]string{LanguageEN: "The client is not allowed to use this grant type", LanguageSW: "Programu hairuhusiwi kutumia aina hii ya ruhusa", LanguageTR: "İstemcinin bu yetki türünü kullanmasına izin verilmiyor"},
+	ErrorAuthorizationPending:    map[string]string{LanguageEN: "Waiting for the user to approve the device", LanguageSW: "Inasubiri mtumiaji aruhusu kifaa", LanguageTR: "Kullanıcının cihazı onaylaması bekleniyor"},
+	ErrorSlowDown:                map[string]string{LanguageEN: "Polling too fast, please wait longer between requests", LanguageSW: "Maombi ni mengi mno, tafadhali subiri zaidi kati ya maombi", LanguageTR: "Çok sık sorgulama yapılıyor, lütfen istekler arasında daha uzun bekleyin"},
+	ErrorExpiredToken:            map[string]string{LanguageEN: "The device code has expired, please start again", LanguageSW: "Namba ya kifaa imeisha muda, tafadhali anza upya", LanguageTR: "Cihaz kodunun süresi doldu, lütfen yeniden başlayın"},
+	ErrorInvalidUserCode:         map[string]string{LanguageEN: "Invalid or expired code, please check the code shown on your device", LanguageSW: "Namba batili au imeisha muda, tafadhali hakiki namba iliyo kwenye kifaa chako", LanguageTR: "Geçersiz veya süresi dolmuş kod, lütfen cihazınızda görünen kodu kontrol edin"},
 }
 
 // ErrorText - returns a text for the API error code. It returns the empty
@@ -1,8 +1,10 @@
 package ngauth
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"gopkg.in/guregu/null.v3"
@@ -14,11 +16,17 @@ type PwdHashFunc = func(plainPassword string) string
 //PwdCheckFunc - function to check if hashed and plain passwords match
 type PwdCheckFunc = func(hashedPwd string, plainPwd string) bool
 
+//SendOTPFunc - function to send the otp code, eg AsyncSendOTP
+type SendOTPFunc = func(message OTPMessage)
+
 const otpForRegister = "REGISTER"
 const otpForReset = "RESET"
+const otpForUnlock = "UNLOCK"
+const otpForLogin = "LOGIN"
 
-// GenerateOTP - first step in registration, only email/phone is taken from user and otp code sent
-func GenerateOTP(db Database, lang string, params map[string]interface{}, sendOTPCallback func(email, phoneNo, verifCode string)) (map[string]interface{}, *Error) {
+// GenerateOTP - first step in registration, only email/phone is taken from user and otp code sent.
+// otp_for LOGIN sends a code for LoginOTP, emails also get a magic link (see Config.MagicLinkURL)
+func GenerateOTP(db Database, lang string, params map[string]interface{}, sendOTPCallback SendOTPFunc) (map[string]interface{}, *Error) {
 
 	email := GetStringOrEmpty(params["email"])
 	phoneNumber := GetStringOrEmpty(params["phone_number"])
@@ -37,7 +45,7 @@ func GenerateOTP(db Database, lang string, params map[string]interface{}, sendOT
 		return nil, NewError(lang, ErrorEmptyFields)
 	}
 
-	if otpFor != otpForRegister && otpFor != otpForReset {
+	if otpFor != otpForRegister && otpFor != otpForReset && otpFor != otpForUnlock && otpFor != otpForLogin {
 		return nil, NewErrorWithMessage(ErrorWrongValueFor, ErrorText(lang, ErrorWrongValueFor)+"otp_for")
 	}
 
@@ -69,8 +77,9 @@ func GenerateOTP(db Database, lang string, params map[string]interface{}, sendOT
 		}
 	}
 
-	//check for unregistered user -- when resetting password
-	if otpFor == otpForReset {
+	//check for unregistered user -- when resetting password, unlocking the account or logging in
+	var user *User
+	if otpFor == otpForReset || otpFor == otpForUnlock || otpFor == otpForLogin {
 
 		regdUser, err := db.GetUserBy(email, phoneNumber, lang)
 		if err != nil {
@@ -80,6 +89,13 @@ func GenerateOTP(db Database, lang string, params map[string]interface{}, sendOT
 		if regdUser == nil {
 			return nil, NewError(lang, ErrorUserNotFound)
 		}
+		user = regdUser
+	}
+
+	//locked after too many wrong codes, a new otp would reset the per otp limit
+	err := checkOTPLockout(db, lang, email, phoneNumber, 0)
+	if err != nil {
+		return nil, err
 	}
 
 	//ban users from resending too many times in a short time
@@ -112,14 +128,27 @@ func GenerateOTP(db Database, lang string, params map[string]interface{}, sendOT
 
 	expiresAt := ExpireAtTime(time.Duration(Config.OTPExpireTime) * time.Second)
 
-	_, err = db.CreateOTP(OTP{Code: verifCode, OTPFor: otpFor, Email: email, PhoneNumber: phoneNumber, ExpiresAt: null.TimeFrom(expiresAt), CreatedAt: null.TimeFrom(TimeNow())}, lang)
+	//only the hash is saved, the code is sent to the user
+	codeHash := HashOTPCode(email, phoneNumber, otpFor, verifCode)
+
+	otpID, err := db.CreateOTP(OTP{Code: codeHash, OTPFor: otpFor, Email: email, PhoneNumber: phoneNumber, ExpiresAt: null.TimeFrom(expiresAt), CreatedAt: null.TimeFrom(TimeNow())}, lang)
 	if err != nil {
 		return nil, err
 	}
 
-	//dispatch email sending
+	//magic link, logs in like the code and is usable once -- emails only, phone numbers get the code by sms
+	link := ""
+	if otpFor == otpForLogin && useEmail && !IsEmptyString(Config.MagicLinkURL) {
+		token, err := GenerateMagicLinkToken(user.ID, otpID)
+		if err != nil {
+			return nil, err
+		}
+		link = MagicLinkURL(token)
+	}
+
+	//dispatch email/sms sending
 	if sendOTPCallback != nil {
-		sendOTPCallback(email, phoneNumber, verifCode)
+		sendOTPCallback(OTPMessage{Lang: lang, OTPFor: otpFor, Email: email, PhoneNumber: phoneNumber, Code: verifCode, Link: link, ExpiresAt: expiresAt, ExpireMins: Config.OTPExpireTime / 60})
 	}
 
 	//Prepare the response
@@ -155,7 +184,7 @@ func VerifyOTP(db Database, lang string, params map[string]interface{}) (map[str
 		return nil, NewError(lang, ErrorEmptyFields)
 	}
 
-	if otpFor != otpForRegister && otpFor != otpForReset {
+	if otpFor != otpForRegister && otpFor != otpForReset && otpFor != otpForUnlock {
 		return nil, NewErrorWithMessage(ErrorWrongValueFor, ErrorText(lang, ErrorWrongValueFor)+"otp_for")
 	}
 
@@ -174,7 +203,41 @@ func VerifyOTP(db Database, lang string, params map[string]interface{}) (map[str
 		phoneNumber = num
 	}
 
-	otp, err := db.GetOTP(email, phoneNumber, otpFor, lang)
+	otp, err := checkOTPCode(db, lang, email, phoneNumber, otpFor, otpCode)
+	if err != nil {
+		return nil, err
+	}
+
+	verifID := GenerateUUID()
+
+	verificationExpiresAt := ExpireAtTime(time.Duration(Config.VerificationExpireTime) * time.Second)
+
+	//update db
+	err = db.UpdateOTPByID(otp.ID, Map{"verified_at": TimeNow(), "verification_id": verifID, "verification_expires_at": verificationExpiresAt}, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+	response["verification_id"] = verifID
+	response["verification_expires_at"] = verificationExpiresAt
+	return response, nil
+}
+
+// checkOTPCode - checks the code against the latest otp of the email/phoneNo, returns the otp if the code is valid
+// and not expired. Wrong codes are counted, the otp is invalidated after Config.OTPMaxAttempts
+func checkOTPCode(db Database, lang string, email string, phoneNo string, otpFor string, otpCode string) (*OTP, *Error) {
+
+	//locked after too many wrong codes
+	err := checkOTPLockout(db, lang, email, phoneNo, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	otp, err := db.GetOTP(email, phoneNo, otpFor, lang)
 	if err != nil {
 		return nil, err
 	}
@@ -184,36 +247,103 @@ func VerifyOTP(db Database, lang string, params map[string]interface{}) (map[str
 		return nil, NewError(lang, ErrorNotFound)
 	}
 
-	//invalid otp
-	if otp != nil && otp.Code != otpCode {
-		return nil, NewError(lang, ErrorInvalidOTPCode)
+	//the attempt is counted before the code is checked, concurrent requests cannot try more codes than allowed.
+	//invalidated, even the correct code is refused
+	failedAttempts, err := db.IncrementOTPFailedAttempts(otp.ID, Config.OTPMaxAttempts, lang)
+	if err != nil {
+		return nil, err
+	}
+	if failedAttempts == 0 {
+		return nil, NewError(lang, ErrorOTPAttemptsExceeded)
 	}
 
-	//valid otp
-	if otp != nil && otp.Code == otpCode && otp.ExpiresAt.Valid && otp.ExpiresAt.Time.After(TimeNow()) {
-
-		verifID := GenerateUUID()
+	//the same for the wrong codes of all otps of the email/phoneNo
+	err = checkOTPLockout(db, lang, email, phoneNo, 1)
+	if err != nil {
+		return nil, err
+	}
 
-		//update db
-		err = db.UpdateOTPByID(otp.ID, Map{"verified_at": TimeNow(), "verification_id": verifID}, lang)
-		if err != nil {
-			return nil, err
+	//invalid otp
+	if !IsValidOTPCode(otp, otpCode) {
+		if Config.OTPMaxAttempts > 0 && failedAttempts >= Config.OTPMaxAttempts {
+			return nil, NewError(lang, ErrorOTPAttemptsExceeded)
 		}
+		return nil, NewError(lang, ErrorInvalidOTPCode)
+	}
 
-		//Prepare the response
-		response := make(map[string]interface{})
-		response["code"] = http.StatusOK
-		response["success"] = true
-		response["verification_id"] = verifID
-		return response, nil
+	//the correct code is not a wrong one
+	err = db.DecrementOTPFailedAttempts(otp.ID, lang)
+	if err != nil {
+		return nil, err
 	}
 
 	//check if otp expired
-	if otp != nil && otp.ExpiresAt.Valid && otp.ExpiresAt.Time.Before(TimeNow()) {
+	if otp.ExpiresAt.Valid && otp.ExpiresAt.Time.Before(TimeNow()) {
 		return nil, NewError(lang, ErrorExpiredOTPCode)
 	}
 
-	return nil, NewError(lang, ErrorInvalidOTPCode)
+	if !otp.ExpiresAt.Valid {
+		return nil, NewError(lang, ErrorInvalidOTPCode)
+	}
+
+	return otp, nil
+}
+
+// checkOTPLockout - returns ErrorTooManyAttempts if the email/phoneNo entered too many wrong codes recently,
+// counted - attempts of this request that were counted already
+func checkOTPLockout(db Database, lang string, email string, phoneNo string, counted int64) *Error {
+
+	if Config.OTPLockoutAttempts <= 0 {
+		return nil
+	}
+
+	since := TimeNow().Add(-time.Duration(Config.OTPLockoutTime) * time.Second)
+	failedAttempts, err := db.GetOTPFailedAttempts(email, phoneNo, since, lang)
+	if err != nil {
+		return err
+	}
+
+	if failedAttempts-counted >= int64(Config.OTPLockoutAttempts) {
+		return NewError(lang, ErrorTooManyAttempts)
+	}
+
+	return nil
+}
+
+// useVerification - checks the verification_id from verify_otp belongs to the email/phoneNo and otp_for,
+// has not expired and marks it used. A verification_id is used up even if the caller fails after this
+func useVerification(db Database, lang string, verificationID string, email string, phoneNo string, otpFor string) *Error {
+
+	if IsEmptyTextContent(verificationID) {
+		return NewError(lang, ErrorGetVerifiedFirst)
+	}
+
+	otp, err := db.GetOTPByVerificationID(verificationID, lang)
+	if err != nil {
+		return err
+	}
+
+	//invalid otp verification
+	if otp == nil || otp.OTPFor != otpFor || !otp.VerifiedAt.Valid {
+		return NewError(lang, ErrorGetVerifiedFirst)
+	}
+
+	//verified for another email/phone number
+	if (IsEmptyString(phoneNo) && otp.Email != email) || (!IsEmptyString(phoneNo) && otp.PhoneNumber != phoneNo) {
+		return NewError(lang, ErrorGetVerifiedFirst)
+	}
+
+	if otp.VerificationUsedAt.Valid {
+		return NewError(lang, ErrorVerificationUsed)
+	}
+
+	//verified before verification ids expired are treated as expired
+	if !otp.VerificationExpiresAt.Valid || otp.VerificationExpiresAt.Time.Before(TimeNow()) {
+		return NewError(lang, ErrorVerificationExpired)
+	}
+
+	//concurrent requests with the same verification id, only one succeeds
+	return db.UseVerification(otp.ID, lang)
 }
 
 // Register - register user
@@ -279,24 +409,25 @@ func Register(db Database, lang string, params map[string]interface{}, pwdHashCa
 
 	}
 
+	//now lets register the user
+	hashedPassword := pwdHashCallback(password)
+	user := User{Name: name, Email: email, PhoneNumber: phoneNumber, Password: hashedPassword, CreatedAt: null.TimeFrom(TimeNow())}
+
 	//verify before registration
 	if Config.VerifyBeforeRegister {
 
-		otp, err := db.GetOTP(email, phoneNumber, otpForRegister, lang)
+		err = useVerification(db, lang, verificationID, email, phoneNumber, otpForRegister)
 		if err != nil {
 			return nil, err
 		}
 
-		//invalid otp verification
-		if otp == nil || otp.VerificationID != verificationID {
-			return nil, NewError(lang, ErrorGetVerifiedFirst)
+		if useEmail {
+			user.EmailVerifiedAt = null.TimeFrom(TimeNow())
+		} else {
+			user.PhoneNumberVerifiedAt = null.TimeFrom(TimeNow())
 		}
-
 	}
 
-	//now lets register the user
-	hashedPassword := pwdHashCallback(password)
-	user := User{Name: name, Email: email, PhoneNumber: phoneNumber, Password: hashedPassword, CreatedAt: null.TimeFrom(TimeNow())}
 	result, err := db.CreateUser(user, lang)
 	if err != nil {
 		return nil, err
@@ -312,19 +443,35 @@ func Register(db Database, lang string, params map[string]interface{}, pwdHashCa
 }
 
 // Login returns access_token if correct username and password are given.
+// Without a password, the code sent by GenerateOTP with otp_for LOGIN is accepted instead, see LoginOTP
 func Login(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) (map[string]interface{}, *Error) {
 
 	if pwdCheckCallback == nil {
 		return nil, NewError(lang, ErrorMissingFunctionParams)
 	}
 
+	//passwordless, e.g. phone users with an sms code
+	if IsEmptyString(GetStringOrEmpty(params["password"])) && !IsEmptyString(GetStringOrEmpty(params["code"])) {
+		return LoginOTP(db, lang, params)
+	}
+
+	user, err := authenticateUser(db, lang, params, pwdCheckCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	return completeLogin(db, lang, user, GetStringOrEmpty(params["ip_addr"]), GetStringOrEmpty(params["user_agent"]))
+}
+
+// authenticateUser - checks the email/phone_number and password of a login,
+// failed logins are counted towards the lockout
+func authenticateUser(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) (*User, *Error) {
+
 	email := GetStringOrEmpty(params["email"])
 	phoneNumber := GetStringOrEmpty(params["phone_number"])
 	countryCode := GetStringOrEmpty(params["country_code"])
 	password := GetStringOrEmpty(params["password"])
-
 	ipAddr := GetStringOrEmpty(params["ip_addr"])
-	userAgent := GetStringOrEmpty(params["user_agent"])
 
 	//flag to show whether to use email or phonenumber
 	useEmail := true
@@ -358,6 +505,18 @@ func Login(db Database, lang string, params map[string]interface{}, pwdCheckCall
 		phoneNumber = num
 	}
 
+	//too many failed logins from this ip address
+	if Config.LoginMaxFailuresPerIP > 0 && !IsEmptyString(ipAddr) {
+		since := TimeNow().Add(-time.Duration(Config.LoginFindTime) * time.Second)
+		failures, err := db.CountLoginFailures(ipAddr, since, lang)
+		if err != nil {
+			return nil, err
+		}
+		if failures >= int64(Config.LoginMaxFailuresPerIP) {
+			return nil, NewError(lang, ErrorTooManyAttempts)
+		}
+	}
+
 	user, err := db.GetUserBy(email, phoneNumber, lang)
 	if err != nil {
 		return nil, err
@@ -365,127 +524,1202 @@ func Login(db Database, lang string, params map[string]interface{}, pwdCheckCall
 
 	//no record found
 	if user == nil {
+		_, err = recordLoginFailure(db, lang, nil, ipAddr, email, phoneNumber)
+		if err != nil {
+			return nil, err
+		}
 		return nil, NewError(lang, ErrorNotFound)
 	}
 
+	//locked, unlocks automatically or via otp_for UNLOCK
+	if user.LockedUntil.Valid && user.LockedUntil.Time.After(TimeNow()) {
+		return nil, accountLockedError(lang, user.LockedUntil.Time)
+	}
+
 	//passwords do not match
 	if !pwdCheckCallback(user.Password, password) {
+		_, err = recordLoginFailure(db, lang, user, ipAddr, email, phoneNumber)
+		if err != nil {
+			return nil, err
+		}
 		if useEmail {
 			return nil, NewError(lang, ErrorIncorrectEmailOrPassword)
 		}
 		return nil, NewError(lang, ErrorIncorrectPhoneNumberOrPassword)
 	}
 
-	//access token
-	accessToken, err := GenerateAccessToken(user.ID)
-	if err != nil {
-		return nil, err
+	//successful login, reset the failed logins. With TOTP, wrong codes count too, reset after the code
+	if !user.TOTPEnabledAt.Valid {
+		err = resetLoginFailures(db, lang, user)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	//refresh token
-	refreshToken, err := GenerateRefreshToken(user.ID)
-	if err != nil {
-		return nil, err
-	}
+	return user, nil
+}
 
-	//save refresh token to db
-	_, err = db.CreateSession(Session{UserID: user.ID, RefreshToken: refreshToken, CreatedAt: null.TimeFrom(TimeNow()), IPAddr: ipAddr, UserAgent: userAgent}, lang)
-	if err != nil {
-		return nil, err
-	}
+// completeLogin - issues tokens to the authenticated user,
+// or an mfa_token if a second factor is required
+func completeLogin(db Database, lang string, user *User, ipAddr string, userAgent string) (map[string]interface{}, *Error) {
 
-	//Prepare the response
-	response := make(map[string]interface{})
-	response["code"] = http.StatusOK
-	response["success"] = true
-	response["id"] = user.ID
-	response["name"] = user.Name
-	response["photo_url"] = user.PhotoURL
-	response["access_token"] = accessToken
-	response["refresh_token"] = refreshToken
+	//second factor required, tokens are issued at /login/2fa
+	if user.TOTPEnabledAt.Valid {
 
-	return response, nil
-}
+		mfaToken, err := GenerateMFAToken(user.ID)
+		if err != nil {
+			return nil, err
+		}
 
-// ChangePassword - changes password of a user
-func ChangePassword(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc, pwdHashCallback PwdHashFunc) (map[string]interface{}, *Error) {
+		//Prepare the response
+		response := make(map[string]interface{})
+		response["code"] = http.StatusOK
+		response["success"] = true
+		response["mfa_required"] = true
+		response["mfa_token"] = mfaToken
 
-	if pwdCheckCallback == nil || pwdHashCallback == nil {
-		return nil, NewError(lang, ErrorMissingFunctionParams)
+		return response, nil
 	}
 
+	return createLoginSession(db, lang, user, ipAddr, userAgent)
+}
+
+// LoginOTP - passwordless login, exchanges the magic link token or the email/phone and code
+// sent by GenerateOTP with otp_for LOGIN for access/refresh tokens, same as Login
+func LoginOTP(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	token := GetStringOrEmpty(params["token"])
 	email := GetStringOrEmpty(params["email"])
 	phoneNumber := GetStringOrEmpty(params["phone_number"])
 	countryCode := GetStringOrEmpty(params["country_code"])
-	password := GetStringOrEmpty(params["password"])
-	newPassword := GetStringOrEmpty(params["new_password"])
-	confirmNewPassword := GetStringOrEmpty(params["confirm_new_password"])
+	otpCode := GetStringOrEmpty(params["code"])
 
-	//flag to show whether to use email or phonenumber
-	useEmail := true
-	if len(phoneNumber) > 0 {
-		useEmail = false
-		//email = ""
-	}
+	ipAddr := GetStringOrEmpty(params["ip_addr"])
+	userAgent := GetStringOrEmpty(params["user_agent"])
 
-	//check for empty fields
-	if useEmail && IsEmptyTextContent(email) || (!useEmail && IsEmptyTextContent(phoneNumber)) {
-		return nil, NewError(lang, ErrorEmptyFields)
-	}
-	// empty - password/confirm password
-	if IsEmptyString(password) || IsEmptyString(newPassword) || IsEmptyString(confirmNewPassword) {
-		return nil, NewError(lang, ErrorEmptyFields)
-	}
+	var user *User
+	var otp *OTP
 
-	//validate - email
-	if useEmail {
-		if !IsValidEmail(email) {
-			return nil, NewError(lang, ErrorInvalidEmail)
+	if !IsEmptyString(token) {
+
+		//magic link
+		claims, err := IsValidMagicLinkToken(token)
+		if err != nil {
+			return nil, err
+		}
+
+		user, err = db.GetUserByID(claims["id"], lang)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, NewError(lang, ErrorUserNotFound)
+		}
+
+		//locked after too many wrong codes, like the code
+		err = checkOTPLockout(db, lang, user.Email, "", 0)
+		if err != nil {
+			return nil, err
+		}
+
+		otp, err = db.GetOTP(user.Email, "", otpForLogin, lang)
+		if err != nil {
+			return nil, err
+		}
+
+		//only the link of the latest otp is valid
+		if otp == nil || !sameID(otp.ID, claims["otp_id"]) {
+			return nil, NewErrorWithMessage(ErrorInvalidToken, "Token invalid")
+		}
+
+		//invalidated by wrong codes, the link too
+		if Config.OTPMaxAttempts > 0 && otp.FailedAttempts >= Config.OTPMaxAttempts {
+			return nil, NewError(lang, ErrorOTPAttemptsExceeded)
+		}
+
+		if !otp.ExpiresAt.Valid || otp.ExpiresAt.Time.Before(TimeNow()) {
+			return nil, NewError(lang, ErrorExpiredOTPCode)
 		}
 
 	} else {
-		//validate - phone
-		num, err := IsValidPhoneNumber(phoneNumber, countryCode, lang)
+
+		//code, by email or sms
+		useEmail := true
+		if len(phoneNumber) > 0 {
+			useEmail = false
+			email = ""
+		}
+
+		if useEmail && IsEmptyTextContent(email) || (!useEmail && IsEmptyTextContent(phoneNumber)) || IsEmptyTextContent(otpCode) {
+			return nil, NewError(lang, ErrorEmptyFields)
+		}
+
+		//validate - email
+		if useEmail {
+			if !IsValidEmail(email) {
+				return nil, NewError(lang, ErrorInvalidEmail)
+			}
+
+		} else {
+			//validate - phone
+			num, err := IsValidPhoneNumber(phoneNumber, countryCode, lang)
+			if err != nil {
+				return nil, err
+			}
+			phoneNumber = num
+		}
+
+		var err *Error
+		otp, err = checkOTPCode(db, lang, email, phoneNumber, otpForLogin, otpCode)
 		if err != nil {
 			return nil, err
 		}
-		phoneNumber = num
+
+		user, err = db.GetUserBy(email, phoneNumber, lang)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, NewError(lang, ErrorUserNotFound)
+		}
 	}
 
-	//validate - new password
-	if newPassword != confirmNewPassword {
-		return nil, NewError(lang, ErrorPasswordsDoNotMatch)
+	//locked, unlocks automatically or via otp_for UNLOCK
+	if user.LockedUntil.Valid && user.LockedUntil.Time.After(TimeNow()) {
+		return nil, accountLockedError(lang, user.LockedUntil.Time)
 	}
 
-	user, err := db.GetUserBy(email, phoneNumber, lang)
+	//the code and the link are used up together, concurrent requests only one succeeds
+	err := db.UseOTP(otp.ID, lang)
 	if err != nil {
 		return nil, err
 	}
 
-	//no record found
-	if user == nil {
-		return nil, NewError(lang, ErrorNotFound)
+	//the code was received, the email/phone number is verified
+	if column := verifiedColumn(user, otp.PhoneNumber); !IsEmptyString(column) {
+		err = db.UpdateUserByID(user.ID, Map{column: TimeNow()}, lang)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	//user's password incorrect
-	if !pwdCheckCallback(user.Password, password) {
-		if useEmail {
-			return nil, NewError(lang, ErrorIncorrectEmailOrPassword)
+	return completeLogin(db, lang, user, ipAddr, userAgent)
+}
+
+// verifiedColumn - verified time column of the email, or of the phone number if phoneNo is given.
+// Empty if it is set already
+func verifiedColumn(user *User, phoneNo string) string {
+
+	if IsEmptyString(phoneNo) {
+		if user.EmailVerifiedAt.Valid {
+			return ""
 		}
-		return nil, NewError(lang, ErrorIncorrectPhoneNumberOrPassword)
+		return "email_verified_at"
 	}
 
-	//now let's change password
-	hashedPassword := pwdHashCallback(newPassword)
-	err = db.UpdateUserByID(user.ID, Map{"password": hashedPassword}, lang)
-	if err != nil {
-		return nil, err
+	if user.PhoneNumberVerifiedAt.Valid {
+		return ""
 	}
+	return "phone_number_verified_at"
+}
 
-	//Prepare the response
-	response := make(map[string]interface{})
-	response["code"] = http.StatusOK
-	response["success"] = true
+// recordLoginFailure - saves the failed login for the ip address and locks the account
+// after Config.LoginMaxFailures, the lockout doubles with every further failure
+func recordLoginFailure(db Database, lang string, user *User, ipAddr string, email string, phoneNo string) (null.Time, *Error) {
+
+	if Config.LoginMaxFailuresPerIP > 0 && !IsEmptyString(ipAddr) {
+
+		//older failures don't count anymore
+		err := db.DeleteLoginFailures(TimeNow().Add(-time.Duration(Config.LoginFindTime)*time.Second), lang)
+		if err != nil {
+			return null.Time{}, err
+		}
+
+		err = db.CreateLoginFailure(LoginFailure{IPAddr: ipAddr, Email: email, PhoneNumber: phoneNo, CreatedAt: null.TimeFrom(TimeNow())}, lang)
+		if err != nil {
+			return null.Time{}, err
+		}
+	}
+
+	if user == nil || Config.LoginMaxFailures <= 0 {
+		return null.Time{}, nil
+	}
+
+	failedLogins, err := db.IncrementFailedLogins(user.ID, lang)
+	if err != nil {
+		return null.Time{}, err
+	}
+
+	if failedLogins < Config.LoginMaxFailures {
+		return null.Time{}, nil
+	}
+
+	//exponential back-off, capped at LoginMaxLockoutTime
+	lockout := Config.LoginLockoutTime
+	for i := Config.LoginMaxFailures; i < failedLogins && (Config.LoginMaxLockoutTime <= 0 || lockout < Config.LoginMaxLockoutTime); i++ {
+		lockout *= 2
+	}
+	if Config.LoginMaxLockoutTime > 0 && lockout > Config.LoginMaxLockoutTime {
+		lockout = Config.LoginMaxLockoutTime
+	}
+
+	lockedUntil := TimeNow().Add(time.Duration(lockout) * time.Second)
+	LogInfof("Login: user %v locked until %s after %d failed logins", user.ID, lockedUntil.Format(time.RFC3339), failedLogins)
+
+	return null.TimeFrom(lockedUntil), db.UpdateUserByID(user.ID, Map{"locked_until": null.TimeFrom(lockedUntil)}, lang)
+}
+
+// resetLoginFailures - after a successful login
+func resetLoginFailures(db Database, lang string, user *User) *Error {
+
+	if user.FailedLogins == 0 && !user.LockedUntil.Valid {
+		return nil
+	}
+
+	return db.UpdateUserByID(user.ID, Map{"failed_logins": 0, "locked_until": null.Time{}}, lang)
+}
+
+// accountLockedError - ErrorAccountLocked with the time left
+func accountLockedError(lang string, lockedUntil time.Time) *Error {
+	waitFor := int64(lockedUntil.Sub(TimeNow())/time.Second) + 1
+	return NewErrorWithMessage(ErrorAccountLocked, fmt.Sprintf("%s. %s: %d seconds", ErrorText(lang, ErrorAccountLocked), ErrorText(lang, ErrorWaitFor), waitFor))
+}
+
+// UnlockAccount - unlocks an account locked after failed logins,
+// use generate_otp and verify_otp with otp_for UNLOCK prior to this
+func UnlockAccount(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	email := GetStringOrEmpty(params["email"])
+	phoneNumber := GetStringOrEmpty(params["phone_number"])
+	countryCode := GetStringOrEmpty(params["country_code"])
+	verificationID := GetStringOrEmpty(params["verification_id"])
+
+	//flag to show whether to use email or phonenumber
+	useEmail := true
+	if len(phoneNumber) > 0 {
+		useEmail = false
+		email = ""
+	}
+
+	//check for empty fields
+	if useEmail && IsEmptyTextContent(email) || (!useEmail && IsEmptyTextContent(phoneNumber)) || IsEmptyTextContent(verificationID) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	//validate - email
+	if useEmail {
+		if !IsValidEmail(email) {
+			return nil, NewError(lang, ErrorInvalidEmail)
+		}
+
+	} else {
+		//validate - phone
+		num, err := IsValidPhoneNumber(phoneNumber, countryCode, lang)
+		if err != nil {
+			return nil, err
+		}
+		phoneNumber = num
+	}
+
+	user, err := db.GetUserBy(email, phoneNumber, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorNotFound)
+	}
+
+	//check verification_id for the user
+	err = useVerification(db, lang, verificationID, email, phoneNumber, otpForUnlock)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.UpdateUserByID(user.ID, Map{"failed_logins": 0, "locked_until": null.Time{}}, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+	response["id"] = user.ID
+
+	return response, nil
+}
+
+// createLoginSession - issues access/refresh tokens for an authenticated user and saves the session
+func createLoginSession(db Database, lang string, user *User, ipAddr string, userAgent string) (map[string]interface{}, *Error) {
+
+	//access token
+	accessToken, err := GenerateAccessToken(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	//refresh token
+	refreshToken, err := GenerateRefreshToken(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	//save refresh token to db
+	_, err = db.CreateSession(Session{UserID: user.ID, RefreshToken: refreshToken, FamilyID: GenerateUUID(), CreatedAt: null.TimeFrom(TimeNow()), IPAddr: ipAddr, UserAgent: userAgent}, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	if Config.LoginAlertEmails && !IsEmptyString(user.Email) {
+		//the login succeeds even if the alert could not be queued
+		err = QueueLoginAlert(db, LoginAlert{Lang: lang, Email: user.Email, Name: user.Name, IPAddr: ipAddr, UserAgent: userAgent, Time: TimeNow().Format(time.RFC1123)})
+		if err != nil {
+			LogErrorf("Notifications: error queueing login alert: %s", err.Message)
+		}
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+	response["id"] = user.ID
+	response["name"] = user.Name
+	response["photo_url"] = user.PhotoURL
+	response["access_token"] = accessToken
+	response["refresh_token"] = refreshToken
+
+	return response, nil
+}
+
+// LoginTOTP - second step of Login when TOTP is enabled,
+// exchanges the mfa_token and a TOTP code (or a recovery_code) for access/refresh tokens
+func LoginTOTP(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) (map[string]interface{}, *Error) {
+
+	if pwdCheckCallback == nil {
+		return nil, NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	mfaToken := GetStringOrEmpty(params["mfa_token"])
+	code := GetStringOrEmpty(params["code"])
+	recoveryCode := GetStringOrEmpty(params["recovery_code"])
+
+	ipAddr := GetStringOrEmpty(params["ip_addr"])
+	userAgent := GetStringOrEmpty(params["user_agent"])
+
+	//check for empty fields
+	if IsEmptyTextContent(mfaToken) || (IsEmptyTextContent(code) && IsEmptyTextContent(recoveryCode)) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	// Validate mfa token
+	claims, err := IsValidMFAToken(mfaToken)
+	if err != nil {
+		return nil, err
+	}
+
+	//used up by a login or by too many wrong codes
+	jti := GetStringOrEmpty(claims["jti"])
+	used, err := db.IsTokenUsed(jti, lang)
+	if err != nil {
+		return nil, err
+	}
+	if used {
+		return nil, NewErrorWithMessage(ErrorInvalidToken, "Token used")
+	}
+
+	user, err := db.GetUserByID(claims["id"], lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	//disabled after the mfa token was issued
+	if !user.TOTPEnabledAt.Valid {
+		return nil, NewError(lang, ErrorTOTPNotEnabled)
+	}
+
+	err = verifySecondFactor(db, lang, user, code, recoveryCode, ipAddr, pwdCheckCallback)
+
+	//the mfa token is used up by the login, or once the wrong codes locked the account
+	if err == nil || err.Code == ErrorAccountLocked {
+		expiresAt := time.Unix(GetInt64OrZero(claims["exp"]), 0)
+		if useErr := db.UseToken(jti, expiresAt, lang); useErr != nil {
+			return nil, useErr
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return createLoginSession(db, lang, user, ipAddr, userAgent)
+}
+
+// verifySecondFactor - checks the TOTP code, or the recovery code if no TOTP code is given.
+// a TOTP code is accepted once and a matching recovery code is consumed. Wrong codes count as failed logins,
+// returns ErrorAccountLocked if the account is locked, or the wrong code locked it
+func verifySecondFactor(db Database, lang string, user *User, code string, recoveryCode string, ipAddr string, pwdCheckCallback PwdCheckFunc) *Error {
+
+	//locked, unlocks automatically or via otp_for UNLOCK
+	if user.LockedUntil.Valid && user.LockedUntil.Time.After(TimeNow()) {
+		return accountLockedError(lang, user.LockedUntil.Time)
+	}
+
+	err := checkSecondFactor(db, lang, user, code, recoveryCode, pwdCheckCallback)
+	if err != nil {
+		if err.Code != ErrorInvalidOTPCode {
+			return err
+		}
+
+		lockedUntil, lockErr := recordLoginFailure(db, lang, user, ipAddr, user.Email, user.PhoneNumber)
+		if lockErr != nil {
+			return lockErr
+		}
+		if lockedUntil.Valid {
+			return accountLockedError(lang, lockedUntil.Time)
+		}
+		return err
+	}
+
+	return resetLoginFailures(db, lang, user)
+}
+
+// checkSecondFactor - see verifySecondFactor, returns ErrorInvalidOTPCode for a wrong or reused code
+func checkSecondFactor(db Database, lang string, user *User, code string, recoveryCode string, pwdCheckCallback PwdCheckFunc) *Error {
+
+	if !IsEmptyTextContent(code) {
+		step, valid := ValidateTOTPStep(user.TOTPSecret, code, TimeNow(), Config.TOTPSkew)
+		if !valid {
+			return NewError(lang, ErrorInvalidOTPCode)
+		}
+
+		//the code, or a later one, was accepted already
+		return db.UpdateUserTOTPStep(user.ID, step, lang)
+	}
+
+	recoveryCode = NormalizeRecoveryCode(recoveryCode)
+	if IsEmptyString(recoveryCode) {
+		return NewError(lang, ErrorInvalidOTPCode)
+	}
+
+	codes, err := db.GetRecoveryCodes(user.ID, lang)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range codes {
+		if pwdCheckCallback(c.CodeHash, recoveryCode) {
+			return db.UseRecoveryCode(c.ID, lang)
+		}
+	}
+
+	return NewError(lang, ErrorInvalidOTPCode)
+}
+
+// generateRecoveryCodes - replaces the recovery codes of the user, only hashes are saved
+func generateRecoveryCodes(db Database, lang string, userID interface{}, pwdHashCallback PwdHashFunc) ([]string, *Error) {
+
+	count := Config.RecoveryCodesCount
+	if count <= 0 {
+		count = 10
+	}
+
+	codes := make([]string, count)
+	recoveryCodes := make([]RecoveryCode, count)
+	for i := range codes {
+		codes[i] = GenerateRecoveryCode()
+		recoveryCodes[i] = RecoveryCode{UserID: userID, CodeHash: pwdHashCallback(NormalizeRecoveryCode(codes[i])), CreatedAt: null.TimeFrom(TimeNow())}
+	}
+
+	err := db.ReplaceRecoveryCodes(userID, recoveryCodes, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// EnrollTOTP - generates a new TOTP secret for the logged in user,
+// TOTP is enabled after the first code is confirmed at ConfirmTOTP
+func EnrollTOTP(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	userID := params["loggedin_user_id"]
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorNotAuthorized)
+	}
+
+	user, err := db.GetUserByID(userID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	if user.TOTPEnabledAt.Valid {
+		return nil, NewError(lang, ErrorTOTPAlreadyEnabled)
+	}
+
+	secret, errSecret := GenerateTOTPSecret()
+	if errSecret != nil {
+		return nil, NewErrorWithMessage(ErrorInternalServerError, errSecret.Error())
+	}
+
+	err = db.UpdateUserTOTP(user.ID, secret, null.Time{}, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//account name shown in authenticator apps
+	accountName := user.Email
+	if IsEmptyString(accountName) {
+		accountName = user.PhoneNumber
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+	response["secret"] = secret
+	response["otpauth_uri"] = TOTPURI(secret, accountName, Config.TOTPIssuer)
+
+	return response, nil
+}
+
+// ConfirmTOTP - enables TOTP once the user enters a valid code from the enrolled secret,
+// returns the recovery codes, they are shown to the user only once
+func ConfirmTOTP(db Database, lang string, params map[string]interface{}, pwdHashCallback PwdHashFunc) (map[string]interface{}, *Error) {
+
+	if pwdHashCallback == nil {
+		return nil, NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	userID := params["loggedin_user_id"]
+	code := GetStringOrEmpty(params["code"])
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorNotAuthorized)
+	}
+
+	//check for empty fields
+	if IsEmptyTextContent(code) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	user, err := db.GetUserByID(userID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	if user.TOTPEnabledAt.Valid {
+		return nil, NewError(lang, ErrorTOTPAlreadyEnabled)
+	}
+
+	//not enrolled
+	if IsEmptyString(user.TOTPSecret) {
+		return nil, NewError(lang, ErrorTOTPNotEnabled)
+	}
+
+	step, valid := ValidateTOTPStep(user.TOTPSecret, code, TimeNow(), Config.TOTPSkew)
+	if !valid {
+		return nil, NewError(lang, ErrorInvalidOTPCode)
+	}
+
+	//the confirmation code cannot be used to login
+	err = db.UpdateUserTOTPStep(user.ID, step, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	recoveryCodes, err := generateRecoveryCodes(db, lang, user.ID, pwdHashCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.UpdateUserTOTP(user.ID, user.TOTPSecret, null.TimeFrom(TimeNow()), lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+	response["recovery_codes"] = recoveryCodes
+
+	return response, nil
+}
+
+// RegenerateRecoveryCodes - replaces the recovery codes of the logged in user,
+// previous codes stop working
+func RegenerateRecoveryCodes(db Database, lang string, params map[string]interface{}, pwdHashCallback PwdHashFunc) (map[string]interface{}, *Error) {
+
+	if pwdHashCallback == nil {
+		return nil, NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	userID := params["loggedin_user_id"]
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorNotAuthorized)
+	}
+
+	user, err := db.GetUserByID(userID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	if !user.TOTPEnabledAt.Valid {
+		return nil, NewError(lang, ErrorTOTPNotEnabled)
+	}
+
+	recoveryCodes, err := generateRecoveryCodes(db, lang, user.ID, pwdHashCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+	response["recovery_codes"] = recoveryCodes
+
+	return response, nil
+}
+
+// DisableTOTP - disables TOTP of the logged in user, a valid code or recovery_code is required
+func DisableTOTP(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) (map[string]interface{}, *Error) {
+
+	if pwdCheckCallback == nil {
+		return nil, NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	userID := params["loggedin_user_id"]
+	code := GetStringOrEmpty(params["code"])
+	recoveryCode := GetStringOrEmpty(params["recovery_code"])
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorNotAuthorized)
+	}
+
+	//check for empty fields
+	if IsEmptyTextContent(code) && IsEmptyTextContent(recoveryCode) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	user, err := db.GetUserByID(userID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	if !user.TOTPEnabledAt.Valid {
+		return nil, NewError(lang, ErrorTOTPNotEnabled)
+	}
+
+	err = verifySecondFactor(db, lang, user, code, recoveryCode, GetStringOrEmpty(params["ip_addr"]), pwdCheckCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.UpdateUserTOTP(user.ID, "", null.Time{}, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.ReplaceRecoveryCodes(user.ID, nil, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+
+	return response, nil
+}
+
+// WebAuthnRegisterOptions - starts the registration of a passkey for the logged in user,
+// public_key is passed to navigator.credentials.create() after decoding the base64url values
+func WebAuthnRegisterOptions(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	userID := params["loggedin_user_id"]
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorNotAuthorized)
+	}
+
+	user, err := db.GetUserByID(userID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	credentials, err := db.GetWebAuthnCredentials(user.ID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := createWebAuthnChallenge(db, lang, webAuthnTypeCreate, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	//account name shown by the browser
+	accountName := user.Email
+	if IsEmptyString(accountName) {
+		accountName = user.PhoneNumber
+	}
+	displayName := user.Name
+	if IsEmptyString(displayName) {
+		displayName = accountName
+	}
+
+	pubKeyCredParams := make([]Map, 0, len(webAuthnAlgs))
+	for _, alg := range webAuthnAlgs {
+		pubKeyCredParams = append(pubKeyCredParams, Map{"type": "public-key", "alg": alg})
+	}
+
+	//the same authenticator is not registered twice
+	excludeCredentials := make([]Map, 0, len(credentials))
+	for _, credential := range credentials {
+		excludeCredentials = append(excludeCredentials, Map{"type": "public-key", "id": credential.CredentialID})
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+	response["public_key"] = Map{
+		"challenge":          challenge,
+		"rp":                 Map{"id": Config.WebAuthnRPID, "name": Config.WebAuthnRPName},
+		"user":               Map{"id": webAuthnUserHandle(user.ID), "name": accountName, "displayName": displayName},
+		"pubKeyCredParams":   pubKeyCredParams,
+		"timeout":            Config.WebAuthnTimeout * 1000,
+		"attestation":        "direct",
+		"excludeCredentials": excludeCredentials,
+		"authenticatorSelection": Map{
+			"residentKey":      "preferred",
+			"userVerification": Config.WebAuthnUserVerification,
+		},
+	}
+
+	return response, nil
+}
+
+// WebAuthnRegister - verifies the attestation of the new passkey and saves it,
+// client_data_json and attestation_object are the base64url values of the credential response
+func WebAuthnRegister(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	userID := params["loggedin_user_id"]
+	name := GetStringOrEmpty(params["name"])
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorNotAuthorized)
+	}
+
+	values, err := decodeWebAuthnParams(lang, params, "client_data_json", "attestation_object")
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := db.GetUserByID(userID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	clientDataJSON := values["client_data_json"]
+
+	clientData, errClientData := parseWebAuthnClientData(clientDataJSON, webAuthnTypeCreate)
+	if errClientData != nil {
+		return nil, webAuthnError(lang, errClientData)
+	}
+
+	//challenge of this user's registration
+	challenge, err := useWebAuthnChallenge(db, lang, clientData.Challenge, webAuthnTypeCreate)
+	if err != nil {
+		return nil, err
+	}
+	if !sameID(challenge.UserID, user.ID) {
+		return nil, NewError(lang, ErrorWebAuthnChallenge)
+	}
+
+	attestation, errAttestation := verifyWebAuthnAttestation(values["attestation_object"], clientDataJSON)
+	if errAttestation != nil {
+		return nil, webAuthnError(lang, errAttestation)
+	}
+
+	authData := attestation.authData
+	credentialID := WebAuthnEncode(authData.credentialID)
+
+	existing, err := db.GetWebAuthnCredential(credentialID, lang)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, NewError(lang, ErrorWebAuthnCredentialExists)
+	}
+
+	credential := WebAuthnCredential{
+		UserID:          user.ID,
+		CredentialID:    credentialID,
+		PublicKey:       WebAuthnEncode(authData.publicKey),
+		SignCount:       int64(authData.signCount),
+		AAGUID:          formatAAGUID(authData.aaguid),
+		AttestationType: attestation.attestationType,
+		Name:            name,
+		CreatedAt:       null.TimeFrom(TimeNow()),
+	}
+
+	id, err := db.CreateWebAuthnCredential(credential, lang)
+	if err != nil {
+		return nil, err
+	}
+	credential.ID = id
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusCreated
+	response["success"] = true
+	response["credential"] = credential
+
+	return response, nil
+}
+
+// WebAuthnLoginOptions - starts a passkey login, public_key is passed to navigator.credentials.get().
+// With an email/phone only the passkeys of that user are allowed, without, the authenticator offers its discoverable passkeys
+func WebAuthnLoginOptions(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	email := GetStringOrEmpty(params["email"])
+	phoneNumber := GetStringOrEmpty(params["phone_number"])
+	countryCode := GetStringOrEmpty(params["country_code"])
+
+	var userID interface{}
+	allowCredentials := make([]Map, 0, 10)
+
+	if !IsEmptyTextContent(email) || !IsEmptyTextContent(phoneNumber) {
+
+		//validate - email
+		if IsEmptyTextContent(phoneNumber) {
+			if !IsValidEmail(email) {
+				return nil, NewError(lang, ErrorInvalidEmail)
+			}
+
+		} else {
+			//validate - phone
+			email = ""
+			num, err := IsValidPhoneNumber(phoneNumber, countryCode, lang)
+			if err != nil {
+				return nil, err
+			}
+			phoneNumber = num
+		}
+
+		user, err := db.GetUserBy(email, phoneNumber, lang)
+		if err != nil {
+			return nil, err
+		}
+
+		if user == nil {
+			return nil, NewError(lang, ErrorUserNotFound)
+		}
+
+		credentials, err := db.GetWebAuthnCredentials(user.ID, lang)
+		if err != nil {
+			return nil, err
+		}
+
+		//no passkeys registered
+		if len(credentials) == 0 {
+			return nil, NewError(lang, ErrorNotFound)
+		}
+
+		userID = user.ID
+		for _, credential := range credentials {
+			allowCredentials = append(allowCredentials, Map{"type": "public-key", "id": credential.CredentialID})
+		}
+	}
+
+	challenge, err := createWebAuthnChallenge(db, lang, webAuthnTypeGet, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+	response["public_key"] = Map{
+		"challenge":        challenge,
+		"rpId":             Config.WebAuthnRPID,
+		"timeout":          Config.WebAuthnTimeout * 1000,
+		"userVerification": Config.WebAuthnUserVerification,
+		"allowCredentials": allowCredentials,
+	}
+
+	return response, nil
+}
+
+// WebAuthnLogin - verifies the passkey assertion and issues access/refresh tokens, same as Login.
+// credential_id, client_data_json, authenticator_data, signature and user_handle are the base64url values of the credential.
+// Passkeys that verified the user (pin, biometrics) are a second factor themselves, otherwise TOTP is still required
+func WebAuthnLogin(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	credentialID := GetStringOrEmpty(params["credential_id"])
+	userHandle := GetStringOrEmpty(params["user_handle"])
+
+	ipAddr := GetStringOrEmpty(params["ip_addr"])
+	userAgent := GetStringOrEmpty(params["user_agent"])
+
+	values, err := decodeWebAuthnParams(lang, params, "credential_id", "client_data_json", "authenticator_data", "signature")
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataJSON := values["client_data_json"]
+
+	clientData, errClientData := parseWebAuthnClientData(clientDataJSON, webAuthnTypeGet)
+	if errClientData != nil {
+		return nil, webAuthnError(lang, errClientData)
+	}
+
+	challenge, err := useWebAuthnChallenge(db, lang, clientData.Challenge, webAuthnTypeGet)
+	if err != nil {
+		return nil, err
+	}
+
+	//normalised, clients may pad the base64url values
+	credential, err := db.GetWebAuthnCredential(WebAuthnEncode(values["credential_id"]), lang)
+	if err != nil {
+		return nil, err
+	}
+	if credential == nil {
+		return nil, webAuthnError(lang, fmt.Errorf("unknown credential %s", credentialID))
+	}
+
+	//the challenge was for another user's passkeys
+	if challenge.UserID != nil && !sameID(challenge.UserID, credential.UserID) {
+		return nil, webAuthnError(lang, errors.New("credential not allowed"))
+	}
+
+	//discoverable passkeys return the user.id given at registration
+	if !IsEmptyString(userHandle) && strings.TrimRight(userHandle, "=") != webAuthnUserHandle(credential.UserID) {
+		return nil, webAuthnError(lang, errors.New("user handle does not match the credential"))
+	}
+
+	authData, errAssertion := verifyWebAuthnAssertion(credential, values["authenticator_data"], clientDataJSON, values["signature"])
+	if errAssertion != nil {
+		return nil, webAuthnError(lang, errAssertion)
+	}
+
+	user, err := db.GetUserByID(credential.UserID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	//locked, unlocks automatically or via otp_for UNLOCK
+	if user.LockedUntil.Valid && user.LockedUntil.Time.After(TimeNow()) {
+		return nil, accountLockedError(lang, user.LockedUntil.Time)
+	}
+
+	err = db.UpdateWebAuthnCredentialByID(credential.ID, Map{"sign_count": int64(authData.signCount), "last_used_at": TimeNow()}, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	if authData.flags&webAuthnFlagUV != 0 {
+		return createLoginSession(db, lang, user, ipAddr, userAgent)
+	}
+
+	return completeLogin(db, lang, user, ipAddr, userAgent)
+}
+
+// createWebAuthnChallenge - saves a new challenge of the ceremony, userID is nil for discoverable logins
+func createWebAuthnChallenge(db Database, lang string, ceremony string, userID interface{}) (string, *Error) {
+
+	challenge, errChallenge := GenerateWebAuthnChallenge()
+	if errChallenge != nil {
+		return "", NewErrorWithMessage(ErrorInternalServerError, errChallenge.Error())
+	}
+
+	expiresAt := ExpireAtTime(time.Duration(Config.WebAuthnTimeout) * time.Second)
+
+	_, err := db.CreateWebAuthnChallenge(WebAuthnChallenge{Challenge: challenge, Ceremony: ceremony, UserID: userID, ExpiresAt: null.TimeFrom(expiresAt), CreatedAt: null.TimeFrom(TimeNow())}, lang)
+	if err != nil {
+		return "", err
+	}
+
+	return challenge, nil
+}
+
+// useWebAuthnChallenge - checks the challenge signed by the authenticator and marks it used,
+// a challenge is good for one attempt of its ceremony
+func useWebAuthnChallenge(db Database, lang string, value string, ceremony string) (*WebAuthnChallenge, *Error) {
+
+	challenge, err := db.GetWebAuthnChallenge(value, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	if challenge == nil || challenge.Ceremony != ceremony {
+		return nil, NewError(lang, ErrorWebAuthnChallenge)
+	}
+
+	if !challenge.ExpiresAt.Valid || challenge.ExpiresAt.Time.Before(TimeNow()) {
+		return nil, NewError(lang, ErrorWebAuthnChallenge)
+	}
+
+	//concurrent requests only one succeeds
+	err = db.UseWebAuthnChallenge(challenge.ID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	return challenge, nil
+}
+
+// decodeWebAuthnParams - decodes the required base64url params
+func decodeWebAuthnParams(lang string, params map[string]interface{}, names ...string) (map[string][]byte, *Error) {
+
+	values := make(map[string][]byte, len(names))
+	for _, name := range names {
+
+		value := GetStringOrEmpty(params[name])
+		if IsEmptyString(value) {
+			return nil, NewError(lang, ErrorEmptyFields)
+		}
+
+		decoded, err := WebAuthnDecode(value)
+		if err != nil || len(decoded) == 0 {
+			return nil, NewErrorWithMessage(ErrorWrongValueFor, ErrorText(lang, ErrorWrongValueFor)+name)
+		}
+		values[name] = decoded
+	}
+
+	return values, nil
+}
+
+// webAuthnError - failed verification, with the reason
+func webAuthnError(lang string, err error) *Error {
+	return NewErrorWithMessage(ErrorWebAuthnFailed, ErrorText(lang, ErrorWebAuthnFailed)+": "+err.Error())
+}
+
+// ChangePassword - changes password of a user
+func ChangePassword(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc, pwdHashCallback PwdHashFunc) (map[string]interface{}, *Error) {
+
+	if pwdCheckCallback == nil || pwdHashCallback == nil {
+		return nil, NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	email := GetStringOrEmpty(params["email"])
+	phoneNumber := GetStringOrEmpty(params["phone_number"])
+	countryCode := GetStringOrEmpty(params["country_code"])
+	password := GetStringOrEmpty(params["password"])
+	newPassword := GetStringOrEmpty(params["new_password"])
+	confirmNewPassword := GetStringOrEmpty(params["confirm_new_password"])
+
+	//flag to show whether to use email or phonenumber
+	useEmail := true
+	if len(phoneNumber) > 0 {
+		useEmail = false
+		//email = ""
+	}
+
+	//check for empty fields
+	if useEmail && IsEmptyTextContent(email) || (!useEmail && IsEmptyTextContent(phoneNumber)) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+	// empty - password/confirm password
+	if IsEmptyString(password) || IsEmptyString(newPassword) || IsEmptyString(confirmNewPassword) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	//validate - email
+	if useEmail {
+		if !IsValidEmail(email) {
+			return nil, NewError(lang, ErrorInvalidEmail)
+		}
+
+	} else {
+		//validate - phone
+		num, err := IsValidPhoneNumber(phoneNumber, countryCode, lang)
+		if err != nil {
+			return nil, err
+		}
+		phoneNumber = num
+	}
+
+	//validate - new password
+	if newPassword != confirmNewPassword {
+		return nil, NewError(lang, ErrorPasswordsDoNotMatch)
+	}
+
+	user, err := db.GetUserBy(email, phoneNumber, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorNotFound)
+	}
+
+	//user's password incorrect
+	if !pwdCheckCallback(user.Password, password) {
+		if useEmail {
+			return nil, NewError(lang, ErrorIncorrectEmailOrPassword)
+		}
+		return nil, NewError(lang, ErrorIncorrectPhoneNumberOrPassword)
+	}
+
+	//now let's change password
+	hashedPassword := pwdHashCallback(newPassword)
+	err = db.UpdateUserByID(user.ID, Map{"password": hashedPassword}, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
 	response["id"] = user.ID
 
 	return response, nil
@@ -552,19 +1786,18 @@ func ResetPassword(db Database, lang string, params map[string]interface{}, pwdH
 	}
 
 	//check verification_id for the user
-	otp, err := db.GetOTP(email, phoneNumber, otpForReset, lang)
+	err = useVerification(db, lang, verificationID, email, phoneNumber, otpForReset)
 	if err != nil {
 		return nil, err
 	}
 
-	//invalid otp verification
-	if otp == nil || otp.VerificationID != verificationID {
-		return nil, NewError(lang, ErrorGetVerifiedFirst)
-	}
-
 	//now let's reset password
 	hashedPassword := pwdHashCallback(password)
-	err = db.UpdateUserByID(user.ID, Map{"password": hashedPassword}, lang)
+	columns := Map{"password": hashedPassword}
+	if column := verifiedColumn(user, phoneNumber); !IsEmptyString(column) {
+		columns[column] = TimeNow()
+	}
+	err = db.UpdateUserByID(user.ID, columns, lang)
 	if err != nil {
 		return nil, err
 	}
@@ -582,9 +1815,51 @@ func ResetPassword(db Database, lang string, params map[string]interface{}, pwdH
 func Token(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
 
 	refreshToken := GetStringOrEmpty(params["refresh_token"])
+	ipAddr := GetStringOrEmpty(params["ip_addr"])
+	userAgent := GetStringOrEmpty(params["user_agent"])
+
+	session, err := getRefreshSession(db, lang, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	//sessions of oauth clients are refreshed by the client, see OAuthToken
+	if !IsEmptyString(session.ClientID) {
+		return nil, NewError(lang, ErrorInvalidToken)
+	}
+
+	//access token
+	accessToken, err := GenerateAccessToken(session.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+	response["access_token"] = accessToken
+
+	//replace the refresh token
+	if Config.JWTRefreshRotation {
+
+		newRefreshToken, err := rotateSession(db, lang, session, ipAddr, userAgent)
+		if err != nil {
+			return nil, err
+		}
+
+		response["refresh_token"] = newRefreshToken
+	}
+
+	return response, nil
+}
+
+// getRefreshSession - returns the session of a valid refresh token that was not revoked.
+// Reuse of a rotated refresh token revokes its session family
+func getRefreshSession(db Database, lang string, refreshToken string) (*Session, *Error) {
 
 	// Validate refresh token
-	_, err := IsValidToken(refreshToken)
+	_, err := IsValidRefreshToken(refreshToken)
 	if err != nil {
 		return nil, err
 	}
@@ -600,12 +1875,104 @@ func Token(db Database, lang string, params map[string]interface{}) (map[string]
 		return nil, err
 	}
 
+	//logged out
+	if session == nil || session.RevokedAt.Valid {
+		return nil, NewError(lang, ErrorInvalidToken)
+	}
+
+	//refresh token was rotated already, it has probably been stolen.
+	//revoke the whole family, the user has to login again
+	if session.RotatedAt.Valid {
+		LogInfof("Token: reuse of rotated refresh token, revoking session family %s", session.FamilyID)
+		err = db.RevokeSessionFamily(session.FamilyID, lang)
+		if err != nil {
+			return nil, err
+		}
+		return nil, NewError(lang, ErrorInvalidToken)
+	}
+
+	return session, nil
+}
+
+// rotateSession - replaces the session with a new one, returns its refresh token
+func rotateSession(db Database, lang string, session *Session, ipAddr string, userAgent string) (string, *Error) {
+
+	newRefreshToken, err := GenerateRefreshToken(session.UserID)
+	if err != nil {
+		return "", err
+	}
+
+	//sessions created before rotation was enabled have no family yet
+	familyID := session.FamilyID
+	if IsEmptyString(familyID) {
+		familyID = GenerateUUID()
+	}
+
+	if IsEmptyString(ipAddr) {
+		ipAddr = session.IPAddr
+	}
+	if IsEmptyString(userAgent) {
+		userAgent = session.UserAgent
+	}
+
+	newSession := Session{UserID: session.UserID, DeviceID: session.DeviceID, DeviceName: session.DeviceName, RefreshToken: newRefreshToken, FamilyID: familyID, ParentID: session.ID, CreatedAt: null.TimeFrom(TimeNow()), ClientID: session.ClientID, Scope: session.Scope, IPAddr: ipAddr, UserAgent: userAgent}
+	_, err = db.RotateSession(session.ID, newSession, lang)
+	if err != nil {
+		//rotated concurrently, the same refresh token was used twice
+		if err.Code == ErrorInvalidToken {
+			db.RevokeSessionFamily(familyID, lang)
+		}
+		return "", err
+	}
+
+	return newRefreshToken, nil
+}
+
+// Logout - revokes the session of the given refresh_token
+func Logout(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	refreshToken := GetStringOrEmpty(params["refresh_token"])
+
+	//check for empty fields
+	if IsEmptyTextContent(refreshToken) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	session, err := db.GetSession(refreshToken, lang)
+	if err != nil {
+		return nil, err
+	}
+
 	if session == nil {
 		return nil, NewError(lang, ErrorInvalidToken)
 	}
 
-	//access token
-	accessToken, err := GenerateAccessToken(session.UserID)
+	//already logged out
+	if !session.RevokedAt.Valid {
+		err = db.RevokeSession(refreshToken, lang)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusOK
+	response["success"] = true
+
+	return response, nil
+}
+
+// LogoutAll - revokes all sessions of the logged in user, ie. logout everywhere
+func LogoutAll(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	userID := params["loggedin_user_id"]
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorNotAuthorized)
+	}
+
+	err := db.RevokeUserSessions(userID, lang)
 	if err != nil {
 		return nil, err
 	}
@@ -614,7 +1981,6 @@ func Token(db Database, lang string, params map[string]interface{}) (map[string]
 	response := make(map[string]interface{})
 	response["code"] = http.StatusOK
 	response["success"] = true
-	response["access_token"] = accessToken
 
 	return response, nil
 }
@@ -0,0 +1,139 @@
+package ngauth
+
+// Token introspection, https://tools.ietf.org/html/rfc7662 and revocation, https://tools.ietf.org/html/rfc7009
+// for services that cannot validate the tokens locally or need to know if a session was revoked.
+// Access tokens are not stored, they stay valid until they expire, only refresh tokens are checked against the sessions
+
+// IntrospectToken - introspection endpoint, active and the claims of a valid access or refresh token,
+// only active false for any other token. Only confidential clients can introspect tokens.
+// The response is the RFC 7662 introspection response, errors are sent with OAuthErrorResponse
+func IntrospectToken(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) (map[string]interface{}, *Error) {
+
+	if pwdCheckCallback == nil {
+		return nil, NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	client, err := authenticateOAuthClient(db, lang, params, pwdCheckCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	//public clients are not trusted with the tokens of other clients
+	if IsEmptyString(client.ClientSecret) {
+		return nil, NewError(lang, ErrorUnauthorizedClient)
+	}
+
+	token := GetStringOrEmpty(params["token"])
+
+	//check for empty fields
+	if IsEmptyTextContent(token) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	inactive := map[string]interface{}{"active": false}
+
+	//the token_use claim tells the type, token_type_hint is not needed
+	claims, err := IsValidToken(token)
+	if err != nil {
+		return inactive, nil
+	}
+
+	response := make(map[string]interface{})
+	for key, value := range claims {
+		response[key] = value
+	}
+
+	switch GetStringOrEmpty(claims["token_use"]) {
+	case TokenUseAccess:
+	case TokenUseRefresh:
+		session, err := db.GetSession(token, lang)
+		if err != nil {
+			return nil, err
+		}
+
+		//logged out or rotated
+		if session == nil || session.RevokedAt.Valid || session.RotatedAt.Valid {
+			return inactive, nil
+		}
+
+		//refresh tokens have no client_id and scope claims
+		if !IsEmptyString(session.ClientID) {
+			response["client_id"] = session.ClientID
+		}
+		if !IsEmptyString(session.Scope) {
+			response["scope"] = session.Scope
+		}
+	default:
+		//id, mfa and magic link tokens are not oauth tokens
+		return inactive, nil
+	}
+
+	response["active"] = true
+
+	return response, nil
+}
+
+// RevokeToken - revocation endpoint, a refresh token revokes its session family, ie. the login.
+// An access token revokes the sessions of the user issued to the client, the access token itself stays valid until it expires.
+// Invalid tokens are ignored, tokens issued to another client return ErrorUnauthorizedClient
+func RevokeToken(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) *Error {
+
+	if pwdCheckCallback == nil {
+		return NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	client, err := authenticateOAuthClient(db, lang, params, pwdCheckCallback)
+	if err != nil {
+		return err
+	}
+
+	token := GetStringOrEmpty(params["token"])
+
+	//check for empty fields
+	if IsEmptyTextContent(token) {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	claims, err := IsValidToken(token)
+	if err != nil {
+		return nil
+	}
+
+	switch GetStringOrEmpty(claims["token_use"]) {
+	case TokenUseAccess:
+		if GetStringOrEmpty(claims["client_id"]) != client.ClientID {
+			return NewError(lang, ErrorUnauthorizedClient)
+		}
+
+		//client_credentials tokens have no sessions
+		userID := claims["id"]
+		if userID == nil {
+			return nil
+		}
+
+		return db.RevokeClientSessions(userID, client.ClientID, lang)
+	case TokenUseRefresh:
+		session, err := db.GetSession(token, lang)
+		if err != nil {
+			return err
+		}
+
+		//no record found
+		if session == nil {
+			return nil
+		}
+
+		if session.ClientID != client.ClientID {
+			return NewError(lang, ErrorUnauthorizedClient)
+		}
+
+		//sessions created before rotation have no family
+		if IsEmptyString(session.FamilyID) {
+			return db.RevokeSession(token, lang)
+		}
+
+		return db.RevokeSessionFamily(session.FamilyID, lang)
+	}
+
+	return nil
+}
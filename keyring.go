@@ -0,0 +1,233 @@
+package ngauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Keyring - one current signing key plus retired keys that still verify tokens until they age out.
+// It is safe for concurrent use, keys can be promoted while the server is running
+type Keyring struct {
+	mu      sync.RWMutex
+	current *SigningKey
+	retired []retiredKey
+
+	//legacy - key of the tokens without a kid, issued before the keyring
+	legacy *retiredKey
+
+	//Retention - how long retired keys are accepted, should be at least the refresh token lifetime
+	Retention time.Duration
+}
+
+// retiredKey - a key that no longer signs tokens
+type retiredKey struct {
+	key       *SigningKey
+	retiredAt time.Time
+}
+
+// keyringConfig - keyring configuration file (json), eg
+//
+//	{"current": "2020-02", "keys": [
+//	    {"kid": "2020-02", "alg": "ES256", "private_key_file": "keys/2020-02.pem"},
+//	    {"kid": "2020-01", "alg": "HS256", "secret": "...", "retired_at": "2020-02-01T00:00:00Z"}
+//	]}
+type keyringConfig struct {
+	Current string             `json:"current"`
+	Keys    []keyringConfigKey `json:"keys"`
+}
+
+type keyringConfigKey struct {
+	ID             string     `json:"kid"`
+	Alg            string     `json:"alg"`
+	PrivateKeyFile string     `json:"private_key_file"`
+	Secret         string     `json:"secret"`
+	RetiredAt      *time.Time `json:"retired_at"`
+}
+
+// NewKeyring - creates a keyring with the current signing key
+func NewKeyring(current *SigningKey, retention time.Duration) *Keyring {
+	return &Keyring{current: current, Retention: retention}
+}
+
+// LoadKeyring - creates a keyring from a keyring file
+func LoadKeyring(keyringFile string, retention time.Duration) (*Keyring, error) {
+
+	keyring := &Keyring{Retention: retention}
+	if err := keyring.Reload(keyringFile); err != nil {
+		return nil, err
+	}
+
+	return keyring, nil
+}
+
+// Current - the key new tokens are signed with
+func (k *Keyring) Current() *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	return k.current
+}
+
+// isExpired - retired keys are dropped after the retention period
+func (k *Keyring) isExpired(retired retiredKey) bool {
+	return TimeNow().After(retired.retiredAt.Add(k.Retention))
+}
+
+// Lookup - finds the current or a retired key by kid, returns nil if unknown or aged out
+func (k *Keyring) Lookup(kid string) *SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	if k.current != nil && k.current.ID == kid {
+		return k.current
+	}
+
+	for _, retired := range k.retired {
+		if retired.key.ID == kid && !k.isExpired(retired) {
+			return retired.key
+		}
+	}
+
+	//tokens without a kid, issued before kid headers were used
+	if IsEmptyString(kid) && k.legacy != nil && !k.isExpired(*k.legacy) {
+		return k.legacy.key
+	}
+
+	return nil
+}
+
+// SetLegacyKey - retires the key tokens were signed with before the keyring, ie. SIGN_KEY.
+// Those tokens have no kid, the key verifies them for the retention period after retiredAt
+func (k *Keyring) SetLegacyKey(key *SigningKey, retiredAt time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	k.legacy = &retiredKey{key: key, retiredAt: retiredAt}
+}
+
+// Keys - current and retired keys that still verify tokens
+func (k *Keyring) Keys() []*SigningKey {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := make([]*SigningKey, 0, len(k.retired)+1)
+	if k.current != nil {
+		keys = append(keys, k.current)
+	}
+
+	for _, retired := range k.retired {
+		if !k.isExpired(retired) {
+			keys = append(keys, retired.key)
+		}
+	}
+
+	if k.legacy != nil && !k.isExpired(*k.legacy) {
+		keys = append(keys, k.legacy.key)
+	}
+
+	return keys
+}
+
+// Promote - makes key the current signing key, the previous key is retired now
+// and keeps verifying tokens for the retention period
+func (k *Keyring) Promote(key *SigningKey) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	retired := make([]retiredKey, 0, len(k.retired)+1)
+	if k.current != nil && k.current.ID != key.ID {
+		retired = append(retired, retiredKey{key: k.current, retiredAt: TimeNow()})
+	}
+
+	//drop aged out keys and the promoted key
+	for _, r := range k.retired {
+		if r.key.ID != key.ID && !k.isExpired(r) {
+			retired = append(retired, r)
+		}
+	}
+
+	k.current = key
+	k.retired = retired
+}
+
+// Reload - re-reads the keyring file, to promote a new key without a restart
+// make it current in the file and reload. Keys without retired_at are retired when the file was
+// last modified, ie. when they stopped being current, so restarts don't extend their retention
+func (k *Keyring) Reload(keyringFile string) error {
+
+	data, err := ioutil.ReadFile(keyringFile)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(keyringFile)
+	if err != nil {
+		return err
+	}
+
+	var file keyringConfig
+	if err = json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+
+	if IsEmptyString(file.Current) {
+		return errors.New("Keyring: current kid is empty")
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	//when keys were retired before this reload
+	previouslyRetired := make(map[string]time.Time)
+	for _, r := range k.retired {
+		previouslyRetired[r.key.ID] = r.retiredAt
+	}
+
+	var current *SigningKey
+	retired := make([]retiredKey, 0, len(file.Keys))
+
+	for _, fileKey := range file.Keys {
+
+		var key *SigningKey
+		if !IsEmptyString(fileKey.Secret) {
+			key, err = NewHMACSigningKey(fileKey.Alg, fileKey.ID, []byte(fileKey.Secret))
+		} else {
+			key, err = LoadSigningKey(fileKey.Alg, fileKey.ID, fileKey.PrivateKeyFile)
+		}
+		if err != nil {
+			return fmt.Errorf("Keyring: key %s: %s", fileKey.ID, err.Error())
+		}
+
+		if key.ID == file.Current {
+			current = key
+			continue
+		}
+
+		retiredAt, ok := previouslyRetired[key.ID]
+		if fileKey.RetiredAt != nil {
+			retiredAt = *fileKey.RetiredAt
+		} else if !ok {
+			retiredAt = info.ModTime()
+		}
+
+		retired = append(retired, retiredKey{key: key, retiredAt: retiredAt})
+	}
+
+	if current == nil {
+		return fmt.Errorf("Keyring: current key %s not found", file.Current)
+	}
+
+	if k.current != nil && k.current.ID != current.ID {
+		LogInfof("Keyring: promoted key %s, retired key %s", current.ID, k.current.ID)
+	}
+
+	k.current = current
+	k.retired = retired
+
+	return nil
+}
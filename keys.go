@@ -0,0 +1,298 @@
+package ngauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// SigningKey - key used to sign and verify JWT tokens
+type SigningKey struct {
+	//ID - sent in the kid header of issued tokens
+	ID     string
+	Method jwt.SigningMethod
+
+	//signKey - []byte for HMAC, private key for asymmetric algorithms
+	signKey interface{}
+
+	//verifyKey - []byte for HMAC, public key for asymmetric algorithms
+	verifyKey interface{}
+}
+
+// NewHMACSigningKey - creates a HS256, HS384 or HS512 key from a shared secret
+func NewHMACSigningKey(alg string, kid string, secret []byte) (*SigningKey, error) {
+
+	method, ok := jwt.GetSigningMethod(alg).(*jwt.SigningMethodHMAC)
+	if !ok {
+		return nil, fmt.Errorf("Not an HMAC signing algorithm: %s", alg)
+	}
+
+	if len(secret) == 0 {
+		return nil, errors.New("Sign key is empty")
+	}
+
+	return &SigningKey{ID: kid, Method: method, signKey: secret, verifyKey: secret}, nil
+}
+
+// LoadSigningKey - loads the private key of an asymmetric algorithm from a PEM file
+func LoadSigningKey(alg string, kid string, privateKeyFile string) (*SigningKey, error) {
+
+	pemBytes, err := ioutil.ReadFile(privateKeyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSigningKeyPEM(alg, kid, pemBytes)
+}
+
+// ParseSigningKeyPEM - parses the private key of an asymmetric algorithm
+// RS* and PS* take RSA keys, ES* take EC keys on the matching curve and EdDSA takes Ed25519 keys.
+// if kid is empty, the JWK thumbprint (RFC 7638) of the public key is used
+func ParseSigningKeyPEM(alg string, kid string, pemBytes []byte) (*SigningKey, error) {
+
+	key := &SigningKey{ID: kid, Method: jwt.GetSigningMethod(alg)}
+
+	switch method := key.Method.(type) {
+
+	case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+		privateKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, err
+		}
+		key.signKey = privateKey
+		key.verifyKey = &privateKey.PublicKey
+
+	case *jwt.SigningMethodECDSA:
+		privateKey, err := parseECPrivateKeyFromPEM(pemBytes)
+		if err != nil {
+			return nil, err
+		}
+		if privateKey.Curve.Params().BitSize != method.CurveBits {
+			return nil, fmt.Errorf("EC key curve %s does not match %s", privateKey.Curve.Params().Name, alg)
+		}
+		key.signKey = privateKey
+		key.verifyKey = &privateKey.PublicKey
+
+	case *SigningMethodEdDSA:
+		block, _ := pem.Decode(pemBytes)
+		if block == nil {
+			return nil, jwt.ErrKeyMustBePEMEncoded
+		}
+		parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		privateKey, ok := parsedKey.(ed25519.PrivateKey)
+		if !ok {
+			return nil, errors.New("Key is not a valid Ed25519 private key")
+		}
+		key.signKey = privateKey
+		key.verifyKey = privateKey.Public()
+
+	default:
+		return nil, fmt.Errorf("Unsupported asymmetric signing algorithm: %s", alg)
+	}
+
+	if IsEmptyString(key.ID) {
+		key.ID = key.Thumbprint()
+	}
+
+	return key, nil
+}
+
+// parseECPrivateKeyFromPEM - parses SEC1 or PKCS8 EC keys, jwt-go v3 only parses SEC1
+func parseECPrivateKeyFromPEM(pemBytes []byte) (*ecdsa.PrivateKey, error) {
+
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, jwt.ErrKeyMustBePEMEncoded
+	}
+
+	if privateKey, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return privateKey, nil
+	}
+
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+
+	privateKey, ok := parsedKey.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, jwt.ErrNotECPrivateKey
+	}
+
+	return privateKey, nil
+}
+
+// IsSymmetric - HMAC keys are shared secrets, they are never published
+func (k *SigningKey) IsSymmetric() bool {
+	_, ok := k.Method.(*jwt.SigningMethodHMAC)
+	return ok
+}
+
+// publicJWK - required members of the public JWK, nil for HMAC keys
+func (k *SigningKey) publicJWK() map[string]interface{} {
+
+	switch publicKey := k.verifyKey.(type) {
+
+	case *rsa.PublicKey:
+		return map[string]interface{}{
+			"kty": "RSA",
+			"n":   base64.RawURLEncoding.EncodeToString(publicKey.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(publicKey.E)).Bytes()),
+		}
+
+	case *ecdsa.PublicKey:
+		//coordinates are padded to the curve size
+		size := (publicKey.Curve.Params().BitSize + 7) / 8
+		x := make([]byte, size)
+		y := make([]byte, size)
+		xBytes := publicKey.X.Bytes()
+		yBytes := publicKey.Y.Bytes()
+		copy(x[size-len(xBytes):], xBytes)
+		copy(y[size-len(yBytes):], yBytes)
+
+		return map[string]interface{}{
+			"kty": "EC",
+			"crv": publicKey.Curve.Params().Name,
+			"x":   base64.RawURLEncoding.EncodeToString(x),
+			"y":   base64.RawURLEncoding.EncodeToString(y),
+		}
+
+	case ed25519.PublicKey:
+		return map[string]interface{}{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(publicKey),
+		}
+	}
+
+	return nil
+}
+
+// JWK - public key in JSON Web Key format, nil for HMAC keys
+func (k *SigningKey) JWK() map[string]interface{} {
+
+	jwk := k.publicJWK()
+	if jwk == nil {
+		return nil
+	}
+
+	jwk["use"] = "sig"
+	jwk["alg"] = k.Method.Alg()
+	if !IsEmptyString(k.ID) {
+		jwk["kid"] = k.ID
+	}
+
+	return jwk
+}
+
+// Thumbprint - JWK thumbprint (RFC 7638) of the public key, empty for HMAC keys
+func (k *SigningKey) Thumbprint() string {
+
+	jwk := k.publicJWK()
+	if jwk == nil {
+		return ""
+	}
+
+	//required members only, in lexicographic order and without whitespace
+	var members string
+	switch jwk["kty"] {
+	case "RSA":
+		members = fmt.Sprintf(`{"e":"%s","kty":"RSA","n":"%s"}`, jwk["e"], jwk["n"])
+	case "EC":
+		members = fmt.Sprintf(`{"crv":"%s","kty":"EC","x":"%s","y":"%s"}`, jwk["crv"], jwk["x"], jwk["y"])
+	case "OKP":
+		members = fmt.Sprintf(`{"crv":"%s","kty":"OKP","x":"%s"}`, jwk["crv"], jwk["x"])
+	}
+
+	sum := sha256.Sum256([]byte(members))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// currentSigningKey - the key new tokens are signed with
+// falls back to HS256 with Config.SignKey when no keyring was loaded
+func currentSigningKey() (*SigningKey, error) {
+
+	if Config.JWTKeyring != nil {
+		if key := Config.JWTKeyring.Current(); key != nil {
+			return key, nil
+		}
+	}
+
+	alg := Config.JWTSigningAlg
+	if IsEmptyString(alg) {
+		alg = jwt.SigningMethodHS256.Alg()
+	}
+
+	if _, ok := jwt.GetSigningMethod(alg).(*jwt.SigningMethodHMAC); !ok {
+		return nil, fmt.Errorf("No private key loaded for %s", alg)
+	}
+
+	return NewHMACSigningKey(alg, Config.JWTKeyID, Config.SignKey)
+}
+
+// verificationKey - finds the key to verify a token with, using the kid header
+// retired keys in the keyring are accepted until they age out
+func verificationKey(token *jwt.Token) (*SigningKey, error) {
+
+	kid, _ := token.Header["kid"].(string)
+
+	var key *SigningKey
+	if Config.JWTKeyring != nil {
+		key = Config.JWTKeyring.Lookup(kid)
+	} else {
+		var err error
+		if key, err = currentSigningKey(); err != nil {
+			return nil, err
+		}
+		if !IsEmptyString(kid) && kid != key.ID {
+			key = nil
+		}
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("Unknown key id: %s", kid)
+	}
+
+	//the alg header must match the key, never let the token pick the algorithm
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+	}
+
+	return key, nil
+}
+
+// JWKS - JSON Web Key Set with the public keys used to sign tokens,
+// serve it at /.well-known/jwks.json so upstream services can verify tokens.
+// HMAC keys are secrets and never included
+func JWKS() map[string]interface{} {
+
+	keys := make([]map[string]interface{}, 0, 2)
+
+	var signingKeys []*SigningKey
+	if Config.JWTKeyring != nil {
+		signingKeys = Config.JWTKeyring.Keys()
+	} else if key, err := currentSigningKey(); err == nil {
+		signingKeys = []*SigningKey{key}
+	}
+
+	for _, key := range signingKeys {
+		if !key.IsSymmetric() {
+			keys = append(keys, key.JWK())
+		}
+	}
+
+	return map[string]interface{}{"keys": keys}
+}
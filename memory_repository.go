@@ -0,0 +1,1511 @@
+package ngauth
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/jinzhu/gorm"
+	"gopkg.in/guregu/null.v3"
+)
+
+// MemoryRepository keeps all records in memory, it is safe for concurrent use.
+// Useful for tests and local development, data is lost when the process exits
+type MemoryRepository struct {
+	mu sync.RWMutex
+
+	lastID     int64
+	users      []*User
+	otps       []*OTP
+	sessions   []*Session
+	pushTokens []*PushToken
+
+	recoveryCodes []*RecoveryCode
+	loginFailures []*LoginFailure
+	notifications []*Notification
+	usedTokens    []*UsedToken
+
+	webAuthnCredentials []*WebAuthnCredential
+	webAuthnChallenges  []*WebAuthnChallenge
+
+	oauthClients []*OAuthClient
+	oauthCodes   []*OAuthCode
+	deviceCodes  []*DeviceCode
+}
+
+// Init - initialize
+func (r *MemoryRepository) Init(config *Configuration) error {
+
+	LogInfo("DB: Initialization started")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lastID = 0
+	r.users = make([]*User, 0, 10)
+	r.otps = make([]*OTP, 0, 10)
+	r.sessions = make([]*Session, 0, 10)
+	r.pushTokens = make([]*PushToken, 0, 10)
+	r.recoveryCodes = make([]*RecoveryCode, 0, 10)
+	r.loginFailures = make([]*LoginFailure, 0, 10)
+	r.notifications = make([]*Notification, 0, 10)
+	r.usedTokens = make([]*UsedToken, 0, 10)
+	r.webAuthnCredentials = make([]*WebAuthnCredential, 0, 10)
+	r.webAuthnChallenges = make([]*WebAuthnChallenge, 0, 10)
+	r.oauthClients = make([]*OAuthClient, 0, 10)
+	r.oauthCodes = make([]*OAuthCode, 0, 10)
+	r.deviceCodes = make([]*DeviceCode, 0, 10)
+
+	LogInfo("DB: In-memory database ready!")
+
+	return nil
+}
+
+// Close - closes the db
+func (r *MemoryRepository) Close() error {
+	return nil
+}
+
+//############################# Utils #########################
+
+// nextID - returns the next auto increment id, caller must hold the lock
+func (r *MemoryRepository) nextID() int64 {
+	r.lastID++
+	return r.lastID
+}
+
+// sameID - compares record ids, ids from json/jwt claims are float64 while ours are int64
+func sameID(a interface{}, b interface{}) bool {
+	if a == nil || b == nil {
+		return false
+	}
+	return GetStringOrEmpty(a) == GetStringOrEmpty(b)
+}
+
+// updateColumns - copies columns to record, mimics gorm UpdateColumns
+// columns is either map[string]interface{} or a struct, for structs only non-zero fields are copied
+// record is a reference to struct, eg &user
+func updateColumns(record interface{}, columns interface{}) error {
+
+	dst := reflect.ValueOf(record).Elem()
+
+	switch cols := columns.(type) {
+	case Map:
+		return updateColumns(record, map[string]interface{}(cols))
+
+	case map[string]interface{}:
+		for column, val := range cols {
+			field, ok := fieldByColumn(dst, column)
+			if !ok {
+				return fmt.Errorf("unknown column: %s", column)
+			}
+			if err := setField(field, val); err != nil {
+				return fmt.Errorf("column %s: %s", column, err.Error())
+			}
+		}
+		return nil
+	}
+
+	src := reflect.Indirect(reflect.ValueOf(columns))
+	if src.Kind() != reflect.Struct {
+		return fmt.Errorf("unsupported columns type: %T", columns)
+	}
+
+	for i := 0; i < src.NumField(); i++ {
+		val := src.Field(i)
+		if isZeroValue(val) {
+			continue
+		}
+
+		field, ok := fieldByColumn(dst, gorm.ToColumnName(src.Type().Field(i).Name))
+		if !ok {
+			continue
+		}
+		if err := setField(field, val.Interface()); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// fieldByColumn - finds the struct field for a db column name
+func fieldByColumn(record reflect.Value, column string) (reflect.Value, bool) {
+	for i := 0; i < record.NumField(); i++ {
+		if gorm.ToColumnName(record.Type().Field(i).Name) == column {
+			return record.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// setField - sets a struct field the same way a db driver would scan a column
+func setField(field reflect.Value, val interface{}) error {
+
+	//scanners eg. null.Time, take driver values
+	if scanner, ok := field.Addr().Interface().(sql.Scanner); ok {
+		if valuer, ok := val.(driver.Valuer); ok {
+			var err error
+			if val, err = valuer.Value(); err != nil {
+				return err
+			}
+		}
+		return scanner.Scan(val)
+	}
+
+	if val == nil {
+		field.Set(reflect.Zero(field.Type()))
+		return nil
+	}
+
+	v := reflect.ValueOf(val)
+	if v.Type().AssignableTo(field.Type()) {
+		field.Set(v)
+		return nil
+	}
+	if v.Type().ConvertibleTo(field.Type()) {
+		field.Set(v.Convert(field.Type()))
+		return nil
+	}
+
+	return fmt.Errorf("cannot assign %T to %s", val, field.Type())
+}
+
+// isZeroValue - checks if a struct field has its zero value
+func isZeroValue(v reflect.Value) bool {
+	return reflect.DeepEqual(v.Interface(), reflect.Zero(v.Type()).Interface())
+}
+
+//############################# Users #########################
+
+// UpdateUserByID - updates user by using ID
+// columns map[string]interface{}
+func (r *MemoryRepository) UpdateUserByID(userID interface{}, columns interface{}, lang string) *Error {
+
+	if userID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, user := range r.users {
+		if sameID(user.ID, userID) {
+			if err := updateColumns(user, columns); err != nil {
+				return NewErrorWithMessage(ErrorDBError, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// CreateUser - creates a user
+func (r *MemoryRepository) CreateUser(user User, lang string) (interface{}, *Error) {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	user.ID = r.nextID()
+	r.users = append(r.users, &user)
+
+	return user.ID, nil
+}
+
+// GetUserByID - get a user by using ID
+func (r *MemoryRepository) GetUserByID(userID interface{}, lang string) (*User, *Error) {
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, user := range r.users {
+		if sameID(user.ID, userID) {
+			result := *user
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// IncrementFailedLogins - counts a failed login for the user, returns the new count
+func (r *MemoryRepository) IncrementFailedLogins(userID interface{}, lang string) (int, *Error) {
+
+	if userID == nil {
+		return 0, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, user := range r.users {
+		if sameID(user.ID, userID) {
+			user.FailedLogins++
+			return user.FailedLogins, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// UpdateUserTOTP - sets the TOTP secret of a user
+func (r *MemoryRepository) UpdateUserTOTP(userID interface{}, secret string, enabledAt null.Time, lang string) *Error {
+	return r.UpdateUserByID(userID, Map{"totp_secret": secret, "totp_enabled_at": enabledAt}, lang)
+}
+
+// UpdateUserTOTPStep - saves the time step of an accepted TOTP code
+func (r *MemoryRepository) UpdateUserTOTPStep(userID interface{}, step int64, lang string) *Error {
+
+	if userID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, user := range r.users {
+		if sameID(user.ID, userID) && user.TOTPLastStep < step {
+			user.TOTPLastStep = step
+			return nil
+		}
+	}
+
+	return NewError(lang, ErrorInvalidOTPCode)
+}
+
+// GetUserBy - get a user by using email/phonenumber
+func (r *MemoryRepository) GetUserBy(email string, phoneNo string, lang string) (*User, *Error) {
+
+	if IsEmptyString(email) && IsEmptyString(phoneNo) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	//flag to show whether to use email or phonenumber
+	useEmail := true
+	if !IsEmptyString(phoneNo) {
+		useEmail = false
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, user := range r.users {
+		if (useEmail && user.Email == email) || (!useEmail && user.PhoneNumber == phoneNo) {
+			result := *user
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+//############################ OTP #################################
+
+// CreateOTP - creates one time password
+func (r *MemoryRepository) CreateOTP(otp OTP, lang string) (interface{}, *Error) {
+
+	if len(otp.Code) == 0 {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	otp.ID = r.nextID()
+	r.otps = append(r.otps, &otp)
+
+	return otp.ID, nil
+}
+
+// findOTPs - otps for email/phoneNo ordered by created_at DESC, caller must hold the lock
+func (r *MemoryRepository) findOTPs(email string, phoneNo string, otpFor string) []OTP {
+
+	//flag to show whether to use email or phonenumber
+	useEmail := true
+	if !IsEmptyString(phoneNo) {
+		useEmail = false
+	}
+
+	results := make([]OTP, 0, 10)
+	for _, otp := range r.otps {
+		if otp.OTPFor != otpFor {
+			continue
+		}
+		if (useEmail && otp.Email == email) || (!useEmail && otp.PhoneNumber == phoneNo) {
+			results = append(results, *otp)
+		}
+	}
+
+	//newest first, records created at the same time are ordered by insertion
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].CreatedAt.Time.Equal(results[j].CreatedAt.Time) {
+			return GetInt64OrZero(results[i].ID) > GetInt64OrZero(results[j].ID)
+		}
+		return results[i].CreatedAt.Time.After(results[j].CreatedAt.Time)
+	})
+
+	return results
+}
+
+// GetOTP - get otp by using email/phoneNo
+func (r *MemoryRepository) GetOTP(email string, phoneNo string, otpFor string, lang string) (*OTP, *Error) {
+
+	if (IsEmptyString(email) && IsEmptyString(phoneNo)) || IsEmptyString(otpFor) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	results := r.findOTPs(email, phoneNo, otpFor)
+	if len(results) == 0 {
+		return nil, nil
+	}
+
+	return &results[0], nil
+}
+
+// GetOTPs - get otps by using email/phoneNo
+func (r *MemoryRepository) GetOTPs(email string, phoneNo string, otpFor string, offset int64, limit int64, lang string) ([]OTP, *Error) {
+
+	if (IsEmptyString(email) && IsEmptyString(phoneNo)) || IsEmptyString(otpFor) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	results := r.findOTPs(email, phoneNo, otpFor)
+
+	//limit and offset
+	if limit > 0 && offset >= 0 {
+		if offset > int64(len(results)) {
+			offset = int64(len(results))
+		}
+		end := offset + limit
+		if end > int64(len(results)) {
+			end = int64(len(results))
+		}
+		results = results[offset:end]
+	}
+
+	return results, nil
+}
+
+// UpdateOTPByID - updates otp by using ID
+// columns map[string]interface{}
+func (r *MemoryRepository) UpdateOTPByID(otpID interface{}, columns interface{}, lang string) *Error {
+
+	if otpID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, otp := range r.otps {
+		if sameID(otp.ID, otpID) {
+			if err := updateColumns(otp, columns); err != nil {
+				return NewErrorWithMessage(ErrorDBError, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// UseOTP - marks the otp verified, an otp can only be used once
+func (r *MemoryRepository) UseOTP(otpID interface{}, lang string) *Error {
+
+	if otpID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, otp := range r.otps {
+		if sameID(otp.ID, otpID) && !otp.VerifiedAt.Valid {
+			otp.VerifiedAt = null.TimeFrom(TimeNow())
+			return nil
+		}
+	}
+
+	return NewError(lang, ErrorAlreadyVerified)
+}
+
+// GetOTPByVerificationID - get otp by using the verification id
+func (r *MemoryRepository) GetOTPByVerificationID(verificationID string, lang string) (*OTP, *Error) {
+
+	if IsEmptyString(verificationID) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, otp := range r.otps {
+		if otp.VerificationID == verificationID {
+			result := *otp
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// UseVerification - marks the verification id used, it can only be used once
+func (r *MemoryRepository) UseVerification(otpID interface{}, lang string) *Error {
+
+	if otpID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, otp := range r.otps {
+		if sameID(otp.ID, otpID) && !otp.VerificationUsedAt.Valid {
+			otp.VerificationUsedAt = null.TimeFrom(TimeNow())
+			return nil
+		}
+	}
+
+	return NewError(lang, ErrorVerificationUsed)
+}
+
+// IncrementOTPFailedAttempts - counts an attempt at the code of the otp, unless it has maxAttempts already
+func (r *MemoryRepository) IncrementOTPFailedAttempts(otpID interface{}, maxAttempts int, lang string) (int, *Error) {
+
+	if otpID == nil {
+		return 0, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, otp := range r.otps {
+		if sameID(otp.ID, otpID) {
+			if maxAttempts > 0 && otp.FailedAttempts >= maxAttempts {
+				return 0, nil
+			}
+			otp.FailedAttempts++
+			otp.LastFailedAt = null.TimeFrom(TimeNow())
+			return otp.FailedAttempts, nil
+		}
+	}
+
+	return 0, nil
+}
+
+// DecrementOTPFailedAttempts - takes back the attempt of a correct code
+func (r *MemoryRepository) DecrementOTPFailedAttempts(otpID interface{}, lang string) *Error {
+
+	if otpID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, otp := range r.otps {
+		if sameID(otp.ID, otpID) && otp.FailedAttempts > 0 {
+			otp.FailedAttempts--
+		}
+	}
+
+	return nil
+}
+
+// GetOTPFailedAttempts - total wrong codes for the email/phoneNo since the given time
+func (r *MemoryRepository) GetOTPFailedAttempts(email string, phoneNo string, since time.Time, lang string) (int64, *Error) {
+
+	if IsEmptyString(email) && IsEmptyString(phoneNo) {
+		return 0, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var total int64
+	for _, otp := range r.otps {
+		if !otp.LastFailedAt.Valid || otp.LastFailedAt.Time.Before(since) {
+			continue
+		}
+		if (IsEmptyString(phoneNo) && otp.Email == email) || (!IsEmptyString(phoneNo) && otp.PhoneNumber == phoneNo) {
+			total += int64(otp.FailedAttempts)
+		}
+	}
+
+	return total, nil
+}
+
+//################## Session
+
+// CreateSession - creates a session
+func (r *MemoryRepository) CreateSession(session Session, lang string) (interface{}, *Error) {
+
+	if len(session.RefreshToken) == 0 {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	session.ID = r.nextID()
+	r.sessions = append(r.sessions, &session)
+
+	return session.ID, nil
+}
+
+// GetSession - get session by refresh token
+func (r *MemoryRepository) GetSession(refreshToken string, lang string) (*Session, *Error) {
+
+	if len(refreshToken) == 0 {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, session := range r.sessions {
+		if session.RefreshToken == refreshToken {
+			result := *session
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// RevokeSession - revokes session by refresh token
+func (r *MemoryRepository) RevokeSession(refreshToken string, lang string) *Error {
+
+	if len(refreshToken) == 0 {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, session := range r.sessions {
+		if session.RefreshToken == refreshToken && !session.RevokedAt.Valid {
+			session.RevokedAt = null.TimeFrom(TimeNow())
+		}
+	}
+
+	return nil
+}
+
+// RevokeUserSessions - revokes all sessions of a user
+func (r *MemoryRepository) RevokeUserSessions(userID interface{}, lang string) *Error {
+
+	if userID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, session := range r.sessions {
+		if sameID(session.UserID, userID) && !session.RevokedAt.Valid {
+			session.RevokedAt = null.TimeFrom(TimeNow())
+		}
+	}
+
+	return nil
+}
+
+// RevokeClientSessions - revokes the sessions of a user issued to the oauth client
+func (r *MemoryRepository) RevokeClientSessions(userID interface{}, clientID string, lang string) *Error {
+
+	if userID == nil || len(clientID) == 0 {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, session := range r.sessions {
+		if sameID(session.UserID, userID) && session.ClientID == clientID && !session.RevokedAt.Valid {
+			session.RevokedAt = null.TimeFrom(TimeNow())
+		}
+	}
+
+	return nil
+}
+
+// RotateSession - marks the session as rotated and creates the new session
+func (r *MemoryRepository) RotateSession(sessionID interface{}, newSession Session, lang string) (interface{}, *Error) {
+
+	if sessionID == nil || len(newSession.RefreshToken) == 0 || len(newSession.FamilyID) == 0 {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var session *Session
+	for _, s := range r.sessions {
+		if sameID(s.ID, sessionID) {
+			session = s
+			break
+		}
+	}
+
+	if session == nil || session.RotatedAt.Valid || session.RevokedAt.Valid {
+		return -1, NewError(lang, ErrorInvalidToken)
+	}
+
+	session.RotatedAt = null.TimeFrom(TimeNow())
+	session.FamilyID = newSession.FamilyID
+
+	newSession.ID = r.nextID()
+	r.sessions = append(r.sessions, &newSession)
+
+	return newSession.ID, nil
+}
+
+// RevokeSessionFamily - revokes all sessions of a token family
+func (r *MemoryRepository) RevokeSessionFamily(familyID string, lang string) *Error {
+
+	if len(familyID) == 0 {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, session := range r.sessions {
+		if session.FamilyID == familyID && !session.RevokedAt.Valid {
+			session.RevokedAt = null.TimeFrom(TimeNow())
+		}
+	}
+
+	return nil
+}
+
+//####################### Login Failures
+
+// CreateLoginFailure - saves a failed login attempt
+func (r *MemoryRepository) CreateLoginFailure(loginFailure LoginFailure, lang string) *Error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	loginFailure.ID = r.nextID()
+	r.loginFailures = append(r.loginFailures, &loginFailure)
+
+	return nil
+}
+
+// CountLoginFailures - failed logins from the ip address since the given time
+func (r *MemoryRepository) CountLoginFailures(ipAddr string, since time.Time, lang string) (int64, *Error) {
+
+	if IsEmptyString(ipAddr) {
+		return 0, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var count int64
+	for _, loginFailure := range r.loginFailures {
+		if loginFailure.IPAddr == ipAddr && !loginFailure.CreatedAt.Time.Before(since) {
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+// DeleteLoginFailures - deletes failed logins older than the given time
+func (r *MemoryRepository) DeleteLoginFailures(before time.Time, lang string) *Error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	loginFailures := r.loginFailures[:0]
+	for _, loginFailure := range r.loginFailures {
+		if !loginFailure.CreatedAt.Time.Before(before) {
+			loginFailures = append(loginFailures, loginFailure)
+		}
+	}
+	r.loginFailures = loginFailures
+
+	return nil
+}
+
+//####################### Used Tokens
+
+// UseToken - saves the jti of a single use token, returns ErrorInvalidToken if it was used already
+func (r *MemoryRepository) UseToken(jti string, expiresAt time.Time, lang string) *Error {
+
+	if IsEmptyString(jti) {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, usedToken := range r.usedTokens {
+		if usedToken.JTI == jti {
+			return NewErrorWithMessage(ErrorInvalidToken, "Token used")
+		}
+	}
+
+	//expired tokens are refused anyway
+	now := TimeNow()
+	usedTokens := r.usedTokens[:0]
+	for _, usedToken := range r.usedTokens {
+		if !usedToken.ExpiresAt.Time.Before(now) {
+			usedTokens = append(usedTokens, usedToken)
+		}
+	}
+
+	r.usedTokens = append(usedTokens, &UsedToken{ID: r.nextID(), JTI: jti, ExpiresAt: null.TimeFrom(expiresAt), CreatedAt: null.TimeFrom(now)})
+
+	return nil
+}
+
+// IsTokenUsed - true if the jti was saved with UseToken
+func (r *MemoryRepository) IsTokenUsed(jti string, lang string) (bool, *Error) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, usedToken := range r.usedTokens {
+		if usedToken.JTI == jti {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+//####################### Recovery Codes
+
+// ReplaceRecoveryCodes - deletes all recovery codes of the user and saves the new ones
+func (r *MemoryRepository) ReplaceRecoveryCodes(userID interface{}, codes []RecoveryCode, lang string) *Error {
+
+	if userID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recoveryCodes := make([]*RecoveryCode, 0, len(r.recoveryCodes)+len(codes))
+	for _, code := range r.recoveryCodes {
+		if !sameID(code.UserID, userID) {
+			recoveryCodes = append(recoveryCodes, code)
+		}
+	}
+
+	for _, code := range codes {
+		code := code
+		code.ID = r.nextID()
+		code.UserID = userID
+		recoveryCodes = append(recoveryCodes, &code)
+	}
+
+	r.recoveryCodes = recoveryCodes
+
+	return nil
+}
+
+// GetRecoveryCodes - get unused recovery codes of the user
+func (r *MemoryRepository) GetRecoveryCodes(userID interface{}, lang string) ([]RecoveryCode, *Error) {
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	results := make([]RecoveryCode, 0, 10)
+	for _, code := range r.recoveryCodes {
+		if sameID(code.UserID, userID) && !code.UsedAt.Valid {
+			results = append(results, *code)
+		}
+	}
+
+	return results, nil
+}
+
+// UseRecoveryCode - marks the recovery code used, a code can only be used once
+func (r *MemoryRepository) UseRecoveryCode(codeID interface{}, lang string) *Error {
+
+	if codeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, code := range r.recoveryCodes {
+		if sameID(code.ID, codeID) && !code.UsedAt.Valid {
+			code.UsedAt = null.TimeFrom(TimeNow())
+			return nil
+		}
+	}
+
+	return NewError(lang, ErrorInvalidOTPCode)
+}
+
+//####################### Notifications
+
+// CreateNotification - saves a notification to the outbox
+func (r *MemoryRepository) CreateNotification(notification Notification, lang string) (interface{}, *Error) {
+
+	if IsEmptyString(notification.Channel) || IsEmptyString(notification.Recipient) {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	notification.ID = r.nextID()
+	r.notifications = append(r.notifications, &notification)
+
+	return notification.ID, nil
+}
+
+// GetDueNotifications - notifications to deliver now, oldest first
+func (r *MemoryRepository) GetDueNotifications(now time.Time, limit int, lang string) ([]Notification, *Error) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	results := make([]Notification, 0, 10)
+	for _, notification := range r.notifications {
+		if (notification.Status == NotificationPending || notification.Status == NotificationSending) &&
+			notification.NextAttemptAt.Valid && !notification.NextAttemptAt.Time.After(now) {
+			results = append(results, *notification)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].NextAttemptAt.Time.Before(results[j].NextAttemptAt.Time)
+	})
+
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+
+	return results, nil
+}
+
+// ClaimNotification - marks the notification sending, only one worker can claim an attempt
+func (r *MemoryRepository) ClaimNotification(notificationID interface{}, attempts int, leaseUntil time.Time, lang string) (bool, *Error) {
+
+	if notificationID == nil {
+		return false, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, notification := range r.notifications {
+		if sameID(notification.ID, notificationID) && notification.Attempts == attempts &&
+			(notification.Status == NotificationPending || notification.Status == NotificationSending) {
+			notification.Status = NotificationSending
+			notification.Attempts = attempts + 1
+			notification.NextAttemptAt = null.TimeFrom(leaseUntil)
+			notification.UpdatedAt = null.TimeFrom(TimeNow())
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// ExpireNotifications - marks the undelivered notifications expired before now and clears their bodies
+func (r *MemoryRepository) ExpireNotifications(now time.Time, lang string) *Error {
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, notification := range r.notifications {
+		if (notification.Status == NotificationPending || notification.Status == NotificationSending) &&
+			notification.ExpiresAt.Valid && notification.ExpiresAt.Time.Before(now) {
+			notification.Status = NotificationExpired
+			notification.Body = ""
+			notification.TextBody = ""
+			notification.UpdatedAt = null.TimeFrom(TimeNow())
+		}
+	}
+
+	return nil
+}
+
+// UpdateNotificationByID - updates notification
+func (r *MemoryRepository) UpdateNotificationByID(notificationID interface{}, columns interface{}, lang string) *Error {
+
+	if notificationID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, notification := range r.notifications {
+		if sameID(notification.ID, notificationID) {
+			if err := updateColumns(notification, columns); err != nil {
+				return NewErrorWithMessage(ErrorDBError, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// GetNotifications - get notifications with the status, newest first
+func (r *MemoryRepository) GetNotifications(status string, offset int64, limit int64, lang string) ([]Notification, *Error) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	results := make([]Notification, 0, 10)
+	for i := len(r.notifications) - 1; i >= 0; i-- {
+		if IsEmptyString(status) || r.notifications[i].Status == status {
+			results = append(results, *r.notifications[i])
+		}
+	}
+
+	//limit and offset
+	if limit > 0 && offset >= 0 {
+		if offset > int64(len(results)) {
+			offset = int64(len(results))
+		}
+		end := offset + limit
+		if end > int64(len(results)) {
+			end = int64(len(results))
+		}
+		results = results[offset:end]
+	}
+
+	return results, nil
+}
+
+//####################### WebAuthn
+
+// CreateWebAuthnCredential - saves a passkey of the user, credential ids are unique
+func (r *MemoryRepository) CreateWebAuthnCredential(credential WebAuthnCredential, lang string) (interface{}, *Error) {
+
+	if credential.UserID == nil || IsEmptyString(credential.CredentialID) || IsEmptyString(credential.PublicKey) {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.webAuthnCredentials {
+		if existing.CredentialID == credential.CredentialID {
+			return -1, NewErrorWithMessage(ErrorDBError, "duplicate credential_id")
+		}
+	}
+
+	credential.ID = r.nextID()
+	r.webAuthnCredentials = append(r.webAuthnCredentials, &credential)
+
+	return credential.ID, nil
+}
+
+// GetWebAuthnCredential - get a credential by using the base64url credential id
+func (r *MemoryRepository) GetWebAuthnCredential(credentialID string, lang string) (*WebAuthnCredential, *Error) {
+
+	if IsEmptyString(credentialID) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, credential := range r.webAuthnCredentials {
+		if credential.CredentialID == credentialID {
+			result := *credential
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// GetWebAuthnCredentials - get all credentials of the user
+func (r *MemoryRepository) GetWebAuthnCredentials(userID interface{}, lang string) ([]WebAuthnCredential, *Error) {
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	results := make([]WebAuthnCredential, 0, 10)
+	for _, credential := range r.webAuthnCredentials {
+		if sameID(credential.UserID, userID) {
+			results = append(results, *credential)
+		}
+	}
+
+	return results, nil
+}
+
+// UpdateWebAuthnCredentialByID - updates credential
+func (r *MemoryRepository) UpdateWebAuthnCredentialByID(credentialID interface{}, columns interface{}, lang string) *Error {
+
+	if credentialID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, credential := range r.webAuthnCredentials {
+		if sameID(credential.ID, credentialID) {
+			if err := updateColumns(credential, columns); err != nil {
+				return NewErrorWithMessage(ErrorDBError, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// CreateWebAuthnChallenge - saves the challenge of a ceremony
+func (r *MemoryRepository) CreateWebAuthnChallenge(challenge WebAuthnChallenge, lang string) (interface{}, *Error) {
+
+	if IsEmptyString(challenge.Challenge) || IsEmptyString(challenge.Ceremony) {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	//expired challenges are refused anyway
+	now := TimeNow()
+	challenges := r.webAuthnChallenges[:0]
+	for _, c := range r.webAuthnChallenges {
+		if !c.ExpiresAt.Time.Before(now) {
+			challenges = append(challenges, c)
+		}
+	}
+
+	challenge.ID = r.nextID()
+	r.webAuthnChallenges = append(challenges, &challenge)
+
+	return challenge.ID, nil
+}
+
+// GetWebAuthnChallenge - get a challenge by its value
+func (r *MemoryRepository) GetWebAuthnChallenge(challenge string, lang string) (*WebAuthnChallenge, *Error) {
+
+	if IsEmptyString(challenge) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, c := range r.webAuthnChallenges {
+		if c.Challenge == challenge {
+			result := *c
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// UseWebAuthnChallenge - marks the challenge used, a challenge can only be used once
+func (r *MemoryRepository) UseWebAuthnChallenge(challengeID interface{}, lang string) *Error {
+
+	if challengeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, challenge := range r.webAuthnChallenges {
+		if sameID(challenge.ID, challengeID) && !challenge.UsedAt.Valid {
+			challenge.UsedAt = null.TimeFrom(TimeNow())
+			return nil
+		}
+	}
+
+	return NewError(lang, ErrorWebAuthnChallenge)
+}
+
+//####################### OAuth
+
+// CreateOAuthClient - registers a client, client ids are unique
+func (r *MemoryRepository) CreateOAuthClient(client OAuthClient, lang string) (interface{}, *Error) {
+
+	if IsEmptyString(client.ClientID) {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, existing := range r.oauthClients {
+		if existing.ClientID == client.ClientID {
+			return -1, NewErrorWithMessage(ErrorDBError, "duplicate client_id")
+		}
+	}
+
+	client.ID = r.nextID()
+	r.oauthClients = append(r.oauthClients, &client)
+
+	return client.ID, nil
+}
+
+// GetOAuthClient - get a client by using the client_id
+func (r *MemoryRepository) GetOAuthClient(clientID string, lang string) (*OAuthClient, *Error) {
+
+	if IsEmptyString(clientID) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, c := range r.oauthClients {
+		if c.ClientID == clientID {
+			result := *c
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// CreateOAuthCode - saves an authorization code
+func (r *MemoryRepository) CreateOAuthCode(code OAuthCode, lang string) (interface{}, *Error) {
+
+	if IsEmptyString(code.CodeHash) || IsEmptyString(code.ClientID) || code.UserID == nil {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	code.ID = r.nextID()
+	r.oauthCodes = append(r.oauthCodes, &code)
+
+	return code.ID, nil
+}
+
+// GetOAuthCode - get an authorization code by its hash
+func (r *MemoryRepository) GetOAuthCode(codeHash string, lang string) (*OAuthCode, *Error) {
+
+	if IsEmptyString(codeHash) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, c := range r.oauthCodes {
+		if c.CodeHash == codeHash {
+			result := *c
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// UseOAuthCode - marks the code used, a code can only be used once
+func (r *MemoryRepository) UseOAuthCode(codeID interface{}, lang string) *Error {
+
+	if codeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, code := range r.oauthCodes {
+		if sameID(code.ID, codeID) && !code.UsedAt.Valid {
+			code.UsedAt = null.TimeFrom(TimeNow())
+			return nil
+		}
+	}
+
+	return NewError(lang, ErrorInvalidGrant)
+}
+
+//####################### Device Authorization
+
+// CreateDeviceCode - saves a device authorization request
+func (r *MemoryRepository) CreateDeviceCode(deviceCode DeviceCode, lang string) (interface{}, *Error) {
+
+	if IsEmptyString(deviceCode.DeviceCodeHash) || IsEmptyString(deviceCode.UserCode) || IsEmptyString(deviceCode.ClientID) {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	//kept for a while after they expire, devices still polling get expired_token
+	purgeTime := deviceCodesPurgeTime()
+	deviceCodes := r.deviceCodes[:0]
+	for _, c := range r.deviceCodes {
+		if !c.ExpiresAt.Time.Before(purgeTime) {
+			deviceCodes = append(deviceCodes, c)
+		}
+	}
+
+	deviceCode.ID = r.nextID()
+	r.deviceCodes = append(deviceCodes, &deviceCode)
+
+	return deviceCode.ID, nil
+}
+
+// GetDeviceCode - get a device code by its hash
+func (r *MemoryRepository) GetDeviceCode(deviceCodeHash string, lang string) (*DeviceCode, *Error) {
+
+	if IsEmptyString(deviceCodeHash) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, c := range r.deviceCodes {
+		if c.DeviceCodeHash == deviceCodeHash {
+			result := *c
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// GetPendingDeviceCode - get the device code of a user code, waiting for the user
+func (r *MemoryRepository) GetPendingDeviceCode(userCode string, lang string) (*DeviceCode, *Error) {
+
+	if IsEmptyString(userCode) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	//newest first
+	for i := len(r.deviceCodes) - 1; i >= 0; i-- {
+		c := r.deviceCodes[i]
+		if c.UserCode == userCode && !c.ApprovedAt.Valid && !c.DeniedAt.Valid && c.ExpiresAt.Time.After(TimeNow()) {
+			result := *c
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// ApproveDeviceCode - the user allowed the device, a device code is approved or denied once
+func (r *MemoryRepository) ApproveDeviceCode(codeID interface{}, userID interface{}, lang string) *Error {
+
+	if codeID == nil || userID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.deviceCodes {
+		if sameID(c.ID, codeID) && !c.ApprovedAt.Valid && !c.DeniedAt.Valid {
+			c.UserID = userID
+			c.ApprovedAt = null.TimeFrom(TimeNow())
+			return nil
+		}
+	}
+
+	return NewError(lang, ErrorInvalidUserCode)
+}
+
+// DenyDeviceCode - the user denied the device
+func (r *MemoryRepository) DenyDeviceCode(codeID interface{}, lang string) *Error {
+
+	if codeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.deviceCodes {
+		if sameID(c.ID, codeID) && !c.ApprovedAt.Valid && !c.DeniedAt.Valid {
+			c.DeniedAt = null.TimeFrom(TimeNow())
+			return nil
+		}
+	}
+
+	return NewError(lang, ErrorInvalidUserCode)
+}
+
+// PollDeviceCode - saves the poll time and the interval of the next poll
+func (r *MemoryRepository) PollDeviceCode(codeID interface{}, pollInterval int, lang string) *Error {
+
+	if codeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.deviceCodes {
+		if sameID(c.ID, codeID) {
+			c.LastPolledAt = null.TimeFrom(TimeNow())
+			c.PollInterval = pollInterval
+		}
+	}
+
+	return nil
+}
+
+// UseDeviceCode - marks the approved device code used, tokens are issued once
+func (r *MemoryRepository) UseDeviceCode(codeID interface{}, lang string) *Error {
+
+	if codeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.deviceCodes {
+		if sameID(c.ID, codeID) && c.ApprovedAt.Valid && !c.UsedAt.Valid {
+			c.UsedAt = null.TimeFrom(TimeNow())
+			return nil
+		}
+	}
+
+	return NewError(lang, ErrorInvalidGrant)
+}
+
+//####################### Push Tokens
+
+// CreateOrUpdatePushToken - creates/updates push token
+func (r *MemoryRepository) CreateOrUpdatePushToken(pushToken PushToken, lang string) *Error {
+
+	if len(pushToken.DeviceID) == 0 || len(pushToken.PushToken) == 0 {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, token := range r.pushTokens {
+		if token.DeviceID == pushToken.DeviceID {
+			token.PushToken = pushToken.PushToken
+			token.DeviceOS = pushToken.DeviceOS
+			token.UpdatedAt = pushToken.UpdatedAt
+			if pushToken.UserID != nil {
+				token.UserID = pushToken.UserID
+			}
+			return nil
+		}
+	}
+
+	pushToken.ID = r.nextID()
+	r.pushTokens = append(r.pushTokens, &pushToken)
+
+	return nil
+}
+
+// GetPushToken - get push token by deviceID
+func (r *MemoryRepository) GetPushToken(deviceID string, lang string) (*PushToken, *Error) {
+
+	if len(deviceID) == 0 {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, token := range r.pushTokens {
+		if token.DeviceID == deviceID {
+			result := *token
+			return &result, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// findPushTokens - push tokens matching filter ordered by updated_at DESC, caller must hold the lock
+func (r *MemoryRepository) findPushTokens(filter func(token *PushToken) bool) []PushToken {
+
+	results := make([]PushToken, 0, 10)
+	for _, token := range r.pushTokens {
+		if filter(token) {
+			results = append(results, *token)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].UpdatedAt.Time.After(results[j].UpdatedAt.Time)
+	})
+
+	return results
+}
+
+// GetPushTokensForUserID - get push tokens for specific user - (multiple login with same account on different devices)
+func (r *MemoryRepository) GetPushTokensForUserID(userID interface{}, lang string) ([]PushToken, *Error) {
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.findPushTokens(func(token *PushToken) bool {
+		return sameID(token.UserID, userID)
+	}), nil
+}
+
+// GetPushTokens - get push tokens for user id list
+func (r *MemoryRepository) GetPushTokens(userIDs []interface{}, lang string) ([]PushToken, *Error) {
+
+	if userIDs == nil || len(userIDs) == 0 {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.findPushTokens(func(token *PushToken) bool {
+		for _, userID := range userIDs {
+			if sameID(token.UserID, userID) {
+				return true
+			}
+		}
+		return false
+	}), nil
+}
+
+// GetAllPushTokens - get all push tokens
+func (r *MemoryRepository) GetAllPushTokens(lang string) ([]PushToken, *Error) {
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.findPushTokens(func(token *PushToken) bool {
+		return true
+	}), nil
+}
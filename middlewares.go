@@ -9,6 +9,136 @@ import (
 type key string
 
 const contextKeyLang key = "lang"
+const contextKeyClaims key = "claims"
+
+// Claims - claims of a valid access token, see RequireAuth
+type Claims struct {
+	//UserID - id claim, as decoded from the token (float64 for numeric ids)
+	UserID    interface{}
+	Subject   string
+	Issuer    string
+	Audience  interface{}
+	ID        string
+	TokenUse  string
+	IssuedAt  int64
+	NotBefore int64
+	ExpiresAt int64
+
+	//ClientID - oauth client the token was issued to, UserID is nil for machine clients (client_credentials)
+	ClientID string
+
+	//Raw - all claims, including custom ones
+	Raw map[string]interface{}
+}
+
+// NewClaims - creates typed claims from the claims returned by IsValidToken
+func NewClaims(claims map[string]interface{}) *Claims {
+	return &Claims{
+		UserID:    claims["id"],
+		Subject:   GetStringOrEmpty(claims["sub"]),
+		Issuer:    GetStringOrEmpty(claims["iss"]),
+		Audience:  claims["aud"],
+		ID:        GetStringOrEmpty(claims["jti"]),
+		TokenUse:  GetStringOrEmpty(claims["token_use"]),
+		ClientID:  GetStringOrEmpty(claims["client_id"]),
+		IssuedAt:  GetInt64OrZero(claims["iat"]),
+		NotBefore: GetInt64OrZero(claims["nbf"]),
+		ExpiresAt: GetInt64OrZero(claims["exp"]),
+		Raw:       claims,
+	}
+}
+
+// RequireAuth - validates the access token in the Authorization header and sets its claims in context,
+// responds with 401 Unauthorized if the token is missing or invalid
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		// Validate access token
+		accessToken := GetTokenFromHeader(r)
+		claims, err := IsValidAccessToken(accessToken)
+		if err != nil {
+			if err.Code == ErrorInvalidToken {
+				HTTPErrorResponse(w, err.Message, http.StatusUnauthorized)
+			} else {
+				ErrorResponse(w, err.Message, err.Code)
+			}
+			return
+		}
+
+		//add claims to context
+		ctx := context.WithValue(r.Context(), contextKeyClaims, NewClaims(claims))
+
+		// authenticated, continue
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// OptionalAuth - sets the claims in context if a valid access token is present,
+// requests without a valid token continue anonymously
+func OptionalAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		accessToken := GetTokenFromHeader(r)
+		claims, err := IsValidAccessToken(accessToken)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		//add claims to context
+		ctx := context.WithValue(r.Context(), contextKeyClaims, NewClaims(claims))
+
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// RequireFirstParty - refuses access tokens issued to oauth clients with 403 Forbidden, for routes
+// managing the account (password, 2fa, passkeys, sessions). Use after RequireAuth
+func RequireFirstParty(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+		claims := ClaimsFromContext(r.Context())
+		if claims == nil || !IsEmptyString(claims.ClientID) {
+			HTTPErrorResponse(w, ErrorText(LangFromContext(r.Context()), ErrorNotAuthorized), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireScope - access tokens issued to oauth clients need the scope, responds with 403 Forbidden otherwise.
+// Tokens of the users themselves pass, with an empty scope oauth tokens are refused. Use after RequireAuth
+func RequireScope(scope string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+			claims := ClaimsFromContext(r.Context())
+			if claims == nil || (!IsEmptyString(claims.ClientID) && (IsEmptyString(scope) || !hasScope(GetStringOrEmpty(claims.Raw["scope"]), scope))) {
+				HTTPErrorResponse(w, ErrorText(LangFromContext(r.Context()), ErrorNotAuthorized), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ClaimsFromContext - get access token claims from context, nil if not authenticated
+func ClaimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(contextKeyClaims).(*Claims)
+	return claims
+}
+
+// UserIDFromContext - get the authenticated user id from context, nil if not authenticated
+func UserIDFromContext(ctx context.Context) interface{} {
+	claims := ClaimsFromContext(ctx)
+	if claims == nil {
+		return nil
+	}
+
+	return claims.UserID
+}
 
 //LanguageDetector - checks language from cookie,url query and sets it in context
 func LanguageDetector(next http.Handler) http.Handler {
@@ -80,6 +210,28 @@ func HTTPErrorResponse(w http.ResponseWriter, message string, code int) {
 	w.Write(jsonBytes)
 }
 
+// OAuthErrorResponse - writes an oauth error response (RFC 6749 section 5.2) of the oauth endpoints
+func OAuthErrorResponse(w http.ResponseWriter, err *Error) {
+
+	oauthErr, status := OAuthError(err)
+
+	response := make(map[string]interface{})
+	response["error"] = oauthErr
+	response["error_description"] = err.Message
+
+	jsonBytes, _ := json.Marshal(response)
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", `Basic realm="ngauth"`)
+	}
+	w.WriteHeader(status)
+	w.Write(jsonBytes)
+}
+
 func jsonErrorBytes(message string, code int) []byte {
 	response := make(map[string]interface{})
 	response["success"] = false
@@ -0,0 +1,124 @@
+package ngauth
+
+import (
+	"fmt"
+	"strings"
+)
+
+// migration - a versioned schema change
+// statements are run in order, table names are written as {{users}}, {{otp}} etc
+// and replaced with the configured table names
+type migration struct {
+	version    int64
+	name       string
+	statements []string
+}
+
+// migrationsTableName - keeps track of applied migrations
+const migrationsTableName = "schema_migrations"
+
+// dialectMigrations - migrations for each supported db driver, see migrations_*.go
+var dialectMigrations = map[string][]migration{
+	"mysql":    mysqlMigrations,
+	"postgres": postgresMigrations,
+	"mssql":    mssqlMigrations,
+	"sqlite3":  sqliteMigrations,
+}
+
+// migrationsTableSQL - creates the migrations table
+var migrationsTableSQL = map[string]string{
+	"mysql":    "CREATE TABLE IF NOT EXISTS " + migrationsTableName + " (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL DEFAULT '', applied_at DATETIME NULL)",
+	"postgres": "CREATE TABLE IF NOT EXISTS " + migrationsTableName + " (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL DEFAULT '', applied_at TIMESTAMP WITH TIME ZONE NULL)",
+	"mssql":    "IF OBJECT_ID(N'" + migrationsTableName + "', N'U') IS NULL CREATE TABLE " + migrationsTableName + " (version BIGINT NOT NULL PRIMARY KEY, name NVARCHAR(255) NOT NULL DEFAULT '', applied_at DATETIME2 NULL)",
+	"sqlite3":  "CREATE TABLE IF NOT EXISTS " + migrationsTableName + " (version INTEGER NOT NULL PRIMARY KEY, name TEXT NOT NULL DEFAULT '', applied_at DATETIME NULL)",
+}
+
+// tableNamesReplacer - replaces table name placeholders with the configured names
+func tableNamesReplacer(config *Configuration) *strings.Replacer {
+	return strings.NewReplacer(
+		"{{users}}", config.UsersTableName,
+		"{{otp}}", config.OTPTableName,
+		"{{sessions}}", config.SessionsTableName,
+		"{{push_tokens}}", "push_tokens",
+		"{{recovery_codes}}", "recovery_codes",
+		"{{login_failures}}", "login_failures",
+		"{{notifications}}", "notifications",
+		"{{webauthn_credentials}}", "webauthn_credentials",
+		"{{webauthn_challenges}}", "webauthn_challenges",
+		"{{oauth_clients}}", "oauth_clients",
+		"{{oauth_codes}}", "oauth_codes",
+		"{{device_codes}}", "device_codes",
+		"{{used_tokens}}", "used_tokens",
+	)
+}
+
+// Migrate - creates/updates the db schema, only migrations not applied yet are run
+func (r *SQLRepository) Migrate(config *Configuration) error {
+
+	LogInfo("DB: Migrations started")
+
+	migrations, ok := dialectMigrations[config.DBDriver]
+	if !ok {
+		LogErrorf("DB: no migrations for driver: %s \n", config.DBDriver)
+		return fmt.Errorf("No migrations for DB Driver: %s", config.DBDriver)
+	}
+
+	if len(config.UsersTableName) == 0 || len(config.OTPTableName) == 0 || len(config.SessionsTableName) == 0 {
+		LogError("DB: table names are empty")
+		return fmt.Errorf("DB table names are empty")
+	}
+
+	err := r.DB.Exec(migrationsTableSQL[config.DBDriver]).Error
+	if err != nil {
+		LogErrorf("DB: creating migrations table failed: %s \n", err.Error())
+		return err
+	}
+
+	var applied []int64
+	err = r.DB.Table(migrationsTableName).Pluck("version", &applied).Error
+	if err != nil {
+		LogErrorf("DB: reading migrations failed: %s \n", err.Error())
+		return err
+	}
+
+	isApplied := make(map[int64]bool)
+	for _, version := range applied {
+		isApplied[version] = true
+	}
+
+	replacer := tableNamesReplacer(config)
+
+	for _, m := range migrations {
+		if isApplied[m.version] {
+			continue
+		}
+
+		LogInfof("DB: applying migration %d_%s", m.version, m.name)
+
+		//ddl is not transactional in mysql, a failed migration has to be fixed manually
+		tx := r.DB.Begin()
+		for _, statement := range m.statements {
+			if err = tx.Exec(replacer.Replace(statement)).Error; err != nil {
+				tx.Rollback()
+				LogErrorf("DB: migration %d_%s failed: %s \n", m.version, m.name, err.Error())
+				return err
+			}
+		}
+
+		err = tx.Exec("INSERT INTO "+migrationsTableName+" (version, name, applied_at) VALUES (?, ?, ?)", m.version, m.name, TimeNow()).Error
+		if err != nil {
+			tx.Rollback()
+			LogErrorf("DB: migration %d_%s failed: %s \n", m.version, m.name, err.Error())
+			return err
+		}
+
+		if err = tx.Commit().Error; err != nil {
+			LogErrorf("DB: migration %d_%s failed: %s \n", m.version, m.name, err.Error())
+			return err
+		}
+	}
+
+	LogInfo("DB: Migrations completed")
+
+	return nil
+}
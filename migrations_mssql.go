@@ -0,0 +1,281 @@
+package ngauth
+
+// mssqlMigrations - schema for mssql
+var mssqlMigrations = []migration{
+	{
+		version: 1,
+		name:    "create_tables",
+		statements: []string{
+			`IF OBJECT_ID(N'{{users}}', N'U') IS NULL CREATE TABLE {{users}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				name NVARCHAR(255) NOT NULL DEFAULT '',
+				password NVARCHAR(255) NOT NULL DEFAULT '',
+				email NVARCHAR(255) NOT NULL DEFAULT '',
+				phone_number NVARCHAR(32) NOT NULL DEFAULT '',
+				photo_url NVARCHAR(1024) NOT NULL DEFAULT '',
+				created_at DATETIME2 NULL,
+				deleted_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{users}}_email') CREATE INDEX idx_{{users}}_email ON {{users}} (email)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{users}}_phone_number') CREATE INDEX idx_{{users}}_phone_number ON {{users}} (phone_number)`,
+
+			`IF OBJECT_ID(N'{{otp}}', N'U') IS NULL CREATE TABLE {{otp}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				phone_number NVARCHAR(32) NOT NULL DEFAULT '',
+				email NVARCHAR(255) NOT NULL DEFAULT '',
+				code NVARCHAR(255) NOT NULL DEFAULT '',
+				otp_for NVARCHAR(32) NOT NULL DEFAULT '',
+				verification_id NVARCHAR(64) NOT NULL DEFAULT '',
+				verified_at DATETIME2 NULL,
+				expires_at DATETIME2 NULL,
+				created_at DATETIME2 NULL,
+				deleted_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{otp}}_email') CREATE INDEX idx_{{otp}}_email ON {{otp}} (email, otp_for, created_at)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{otp}}_phone_number') CREATE INDEX idx_{{otp}}_phone_number ON {{otp}} (phone_number, otp_for, created_at)`,
+
+			`IF OBJECT_ID(N'{{sessions}}', N'U') IS NULL CREATE TABLE {{sessions}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				user_id BIGINT NULL,
+				device_id NVARCHAR(255) NOT NULL DEFAULT '',
+				device_name NVARCHAR(255) NOT NULL DEFAULT '',
+				refresh_token VARCHAR(1024) NOT NULL,
+				created_at DATETIME2 NULL,
+				ip_addr NVARCHAR(64) NOT NULL DEFAULT '',
+				user_agent NVARCHAR(MAX) NULL,
+				deleted_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{sessions}}_refresh_token') CREATE INDEX idx_{{sessions}}_refresh_token ON {{sessions}} (refresh_token)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{sessions}}_user_id') CREATE INDEX idx_{{sessions}}_user_id ON {{sessions}} (user_id)`,
+
+			`IF OBJECT_ID(N'{{push_tokens}}', N'U') IS NULL CREATE TABLE {{push_tokens}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				device_id NVARCHAR(255) NOT NULL,
+				device_os NVARCHAR(32) NOT NULL DEFAULT '',
+				push_token NVARCHAR(1024) NOT NULL DEFAULT '',
+				user_id BIGINT NULL,
+				created_at DATETIME2 NULL,
+				updated_at DATETIME2 NULL,
+				ip_addr NVARCHAR(64) NOT NULL DEFAULT '',
+				user_agent NVARCHAR(MAX) NULL,
+				deleted_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{push_tokens}}_device_id') CREATE INDEX idx_{{push_tokens}}_device_id ON {{push_tokens}} (device_id)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{push_tokens}}_user_id') CREATE INDEX idx_{{push_tokens}}_user_id ON {{push_tokens}} (user_id)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "sessions_revoked_at",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD revoked_at DATETIME2 NULL`,
+		},
+	},
+	{
+		version: 3,
+		name:    "sessions_token_family",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD family_id NVARCHAR(64) NOT NULL DEFAULT '', parent_id BIGINT NULL, rotated_at DATETIME2 NULL`,
+			`CREATE INDEX idx_{{sessions}}_family_id ON {{sessions}} (family_id)`,
+		},
+	},
+	{
+		version: 4,
+		name:    "users_totp",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD totp_secret NVARCHAR(64) NOT NULL DEFAULT '', totp_enabled_at DATETIME2 NULL`,
+		},
+	},
+	{
+		version: 5,
+		name:    "create_recovery_codes",
+		statements: []string{
+			`IF OBJECT_ID(N'{{recovery_codes}}', N'U') IS NULL CREATE TABLE {{recovery_codes}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				code_hash NVARCHAR(255) NOT NULL DEFAULT '',
+				used_at DATETIME2 NULL,
+				created_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{recovery_codes}}_user_id') CREATE INDEX idx_{{recovery_codes}}_user_id ON {{recovery_codes}} (user_id)`,
+		},
+	},
+	{
+		version: 6,
+		name:    "otp_failed_attempts",
+		statements: []string{
+			`ALTER TABLE {{otp}} ADD failed_attempts INT NOT NULL DEFAULT 0, last_failed_at DATETIME2 NULL`,
+		},
+	},
+	{
+		version: 7,
+		name:    "login_lockout",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD failed_logins INT NOT NULL DEFAULT 0, locked_until DATETIME2 NULL`,
+			`IF OBJECT_ID(N'{{login_failures}}', N'U') IS NULL CREATE TABLE {{login_failures}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				ip_addr NVARCHAR(64) NOT NULL DEFAULT '',
+				email NVARCHAR(255) NOT NULL DEFAULT '',
+				phone_number NVARCHAR(32) NOT NULL DEFAULT '',
+				created_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{login_failures}}_ip_addr') CREATE INDEX idx_{{login_failures}}_ip_addr ON {{login_failures}} (ip_addr, created_at)`,
+		},
+	},
+	{
+		version: 8,
+		name:    "otp_clear_plaintext_codes",
+		//codes are saved hashed now, pending plaintext codes have to be requested again
+		statements: []string{
+			`UPDATE {{otp}} SET code = '' WHERE code <> '' AND code NOT LIKE 'h1:%'`,
+		},
+	},
+	{
+		version: 9,
+		name:    "otp_verification_expiry",
+		statements: []string{
+			`ALTER TABLE {{otp}} ADD verification_expires_at DATETIME2 NULL, verification_used_at DATETIME2 NULL`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{otp}}_verification_id') CREATE INDEX idx_{{otp}}_verification_id ON {{otp}} (verification_id)`,
+		},
+	},
+	{
+		version: 10,
+		name:    "create_notifications",
+		statements: []string{
+			`IF OBJECT_ID(N'{{notifications}}', N'U') IS NULL CREATE TABLE {{notifications}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				channel NVARCHAR(16) NOT NULL DEFAULT '',
+				recipient NVARCHAR(255) NOT NULL DEFAULT '',
+				subject NVARCHAR(255) NOT NULL DEFAULT '',
+				body NVARCHAR(MAX) NOT NULL DEFAULT '',
+				text_body NVARCHAR(MAX) NOT NULL DEFAULT '',
+				status NVARCHAR(16) NOT NULL DEFAULT '',
+				attempts INT NOT NULL DEFAULT 0,
+				last_error NVARCHAR(1024) NOT NULL DEFAULT '',
+				next_attempt_at DATETIME2 NULL,
+				expires_at DATETIME2 NULL,
+				sent_at DATETIME2 NULL,
+				created_at DATETIME2 NULL,
+				updated_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{notifications}}_status') CREATE INDEX idx_{{notifications}}_status ON {{notifications}} (status, next_attempt_at)`,
+		},
+	},
+	{
+		version: 11,
+		name:    "create_webauthn",
+		statements: []string{
+			`IF OBJECT_ID(N'{{webauthn_credentials}}', N'U') IS NULL CREATE TABLE {{webauthn_credentials}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				credential_id NVARCHAR(512) NOT NULL,
+				public_key NVARCHAR(MAX) NOT NULL DEFAULT '',
+				sign_count BIGINT NOT NULL DEFAULT 0,
+				aaguid NVARCHAR(36) NOT NULL DEFAULT '',
+				attestation_type NVARCHAR(16) NOT NULL DEFAULT '',
+				name NVARCHAR(255) NOT NULL DEFAULT '',
+				created_at DATETIME2 NULL,
+				last_used_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{webauthn_credentials}}_credential_id') CREATE UNIQUE INDEX idx_{{webauthn_credentials}}_credential_id ON {{webauthn_credentials}} (credential_id)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{webauthn_credentials}}_user_id') CREATE INDEX idx_{{webauthn_credentials}}_user_id ON {{webauthn_credentials}} (user_id)`,
+			`IF OBJECT_ID(N'{{webauthn_challenges}}', N'U') IS NULL CREATE TABLE {{webauthn_challenges}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				challenge NVARCHAR(128) NOT NULL,
+				ceremony NVARCHAR(32) NOT NULL DEFAULT '',
+				user_id BIGINT NULL,
+				expires_at DATETIME2 NULL,
+				used_at DATETIME2 NULL,
+				created_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{webauthn_challenges}}_challenge') CREATE UNIQUE INDEX idx_{{webauthn_challenges}}_challenge ON {{webauthn_challenges}} (challenge)`,
+		},
+	},
+	{
+		version: 12,
+		name:    "create_oauth",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD client_id NVARCHAR(128) NOT NULL DEFAULT '', scope NVARCHAR(1024) NOT NULL DEFAULT ''`,
+			`IF OBJECT_ID(N'{{oauth_clients}}', N'U') IS NULL CREATE TABLE {{oauth_clients}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				client_id NVARCHAR(128) NOT NULL,
+				client_secret NVARCHAR(255) NOT NULL DEFAULT '',
+				name NVARCHAR(255) NOT NULL DEFAULT '',
+				redirect_uris NVARCHAR(MAX) NOT NULL DEFAULT '',
+				scopes NVARCHAR(1024) NOT NULL DEFAULT '',
+				created_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{oauth_clients}}_client_id') CREATE UNIQUE INDEX idx_{{oauth_clients}}_client_id ON {{oauth_clients}} (client_id)`,
+			`IF OBJECT_ID(N'{{oauth_codes}}', N'U') IS NULL CREATE TABLE {{oauth_codes}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				code_hash NVARCHAR(64) NOT NULL,
+				client_id NVARCHAR(128) NOT NULL DEFAULT '',
+				user_id BIGINT NOT NULL,
+				redirect_uri NVARCHAR(2048) NOT NULL DEFAULT '',
+				scope NVARCHAR(1024) NOT NULL DEFAULT '',
+				code_challenge NVARCHAR(128) NOT NULL DEFAULT '',
+				code_challenge_method NVARCHAR(16) NOT NULL DEFAULT '',
+				family_id NVARCHAR(64) NOT NULL DEFAULT '',
+				expires_at DATETIME2 NULL,
+				used_at DATETIME2 NULL,
+				created_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{oauth_codes}}_code_hash') CREATE UNIQUE INDEX idx_{{oauth_codes}}_code_hash ON {{oauth_codes}} (code_hash)`,
+		},
+	},
+	{
+		version: 13,
+		name:    "oidc",
+		//users registered before are not known to be verified
+		statements: []string{
+			`ALTER TABLE {{users}} ADD email_verified_at DATETIME2 NULL, phone_number_verified_at DATETIME2 NULL`,
+			`ALTER TABLE {{oauth_codes}} ADD nonce NVARCHAR(255) NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 14,
+		name:    "oauth_client_grant_types",
+		//clients registered before use the authorization code flow
+		statements: []string{
+			`ALTER TABLE {{oauth_clients}} ADD grant_types NVARCHAR(255) NOT NULL DEFAULT 'authorization_code refresh_token'`,
+		},
+	},
+	{
+		version: 15,
+		name:    "create_device_codes",
+		statements: []string{
+			`IF OBJECT_ID(N'{{device_codes}}', N'U') IS NULL CREATE TABLE {{device_codes}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				device_code_hash NVARCHAR(64) NOT NULL,
+				user_code NVARCHAR(16) NOT NULL,
+				client_id NVARCHAR(128) NOT NULL DEFAULT '',
+				scope NVARCHAR(1024) NOT NULL DEFAULT '',
+				user_id BIGINT NULL,
+				approved_at DATETIME2 NULL,
+				denied_at DATETIME2 NULL,
+				poll_interval INT NOT NULL DEFAULT 5,
+				last_polled_at DATETIME2 NULL,
+				expires_at DATETIME2 NULL,
+				used_at DATETIME2 NULL,
+				created_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{device_codes}}_device_code_hash') CREATE UNIQUE INDEX idx_{{device_codes}}_device_code_hash ON {{device_codes}} (device_code_hash)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{device_codes}}_user_code') CREATE INDEX idx_{{device_codes}}_user_code ON {{device_codes}} (user_code)`,
+		},
+	},
+	{
+		version: 16,
+		name:    "add_second_factor_replay_protection",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD totp_last_step BIGINT NOT NULL DEFAULT 0`,
+			`IF OBJECT_ID(N'{{used_tokens}}', N'U') IS NULL CREATE TABLE {{used_tokens}} (
+				id BIGINT IDENTITY(1,1) NOT NULL PRIMARY KEY,
+				jti NVARCHAR(64) NOT NULL,
+				expires_at DATETIME2 NULL,
+				created_at DATETIME2 NULL
+			)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{used_tokens}}_jti') CREATE UNIQUE INDEX idx_{{used_tokens}}_jti ON {{used_tokens}} (jti)`,
+			`IF NOT EXISTS (SELECT 1 FROM sys.indexes WHERE name = N'idx_{{used_tokens}}_expires_at') CREATE INDEX idx_{{used_tokens}}_expires_at ON {{used_tokens}} (expires_at)`,
+		},
+	},
+}
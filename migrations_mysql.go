@@ -0,0 +1,292 @@
+package ngauth
+
+// mysqlMigrations - schema for mysql
+var mysqlMigrations = []migration{
+	{
+		version: 1,
+		name:    "create_tables",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{users}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				name VARCHAR(255) NOT NULL DEFAULT '',
+				password VARCHAR(255) NOT NULL DEFAULT '',
+				email VARCHAR(255) NOT NULL DEFAULT '',
+				phone_number VARCHAR(32) NOT NULL DEFAULT '',
+				photo_url VARCHAR(1024) NOT NULL DEFAULT '',
+				created_at DATETIME NULL,
+				deleted_at DATETIME NULL,
+				PRIMARY KEY (id),
+				INDEX idx_{{users}}_email (email),
+				INDEX idx_{{users}}_phone_number (phone_number)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+
+			`CREATE TABLE IF NOT EXISTS {{otp}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				phone_number VARCHAR(32) NOT NULL DEFAULT '',
+				email VARCHAR(255) NOT NULL DEFAULT '',
+				code VARCHAR(255) NOT NULL DEFAULT '',
+				otp_for VARCHAR(32) NOT NULL DEFAULT '',
+				verification_id VARCHAR(64) NOT NULL DEFAULT '',
+				verified_at DATETIME NULL,
+				expires_at DATETIME NULL,
+				created_at DATETIME NULL,
+				deleted_at DATETIME NULL,
+				PRIMARY KEY (id),
+				INDEX idx_{{otp}}_email (email, otp_for, created_at),
+				INDEX idx_{{otp}}_phone_number (phone_number, otp_for, created_at)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+
+			`CREATE TABLE IF NOT EXISTS {{sessions}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				user_id BIGINT NULL,
+				device_id VARCHAR(255) NOT NULL DEFAULT '',
+				device_name VARCHAR(255) NOT NULL DEFAULT '',
+				refresh_token VARCHAR(2048) NOT NULL,
+				created_at DATETIME NULL,
+				ip_addr VARCHAR(64) NOT NULL DEFAULT '',
+				user_agent TEXT NULL,
+				deleted_at DATETIME NULL,
+				PRIMARY KEY (id),
+				INDEX idx_{{sessions}}_refresh_token (refresh_token(191)),
+				INDEX idx_{{sessions}}_user_id (user_id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+
+			`CREATE TABLE IF NOT EXISTS {{push_tokens}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				device_id VARCHAR(255) NOT NULL,
+				device_os VARCHAR(32) NOT NULL DEFAULT '',
+				push_token VARCHAR(1024) NOT NULL DEFAULT '',
+				user_id BIGINT NULL,
+				created_at DATETIME NULL,
+				updated_at DATETIME NULL,
+				ip_addr VARCHAR(64) NOT NULL DEFAULT '',
+				user_agent TEXT NULL,
+				deleted_at DATETIME NULL,
+				PRIMARY KEY (id),
+				INDEX idx_{{push_tokens}}_device_id (device_id),
+				INDEX idx_{{push_tokens}}_user_id (user_id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version: 2,
+		name:    "sessions_revoked_at",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD COLUMN revoked_at DATETIME NULL`,
+		},
+	},
+	{
+		version: 3,
+		name:    "sessions_token_family",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD COLUMN family_id VARCHAR(64) NOT NULL DEFAULT '', ADD COLUMN parent_id BIGINT NULL, ADD COLUMN rotated_at DATETIME NULL, ADD INDEX idx_{{sessions}}_family_id (family_id)`,
+		},
+	},
+	{
+		version: 4,
+		name:    "users_totp",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN totp_secret VARCHAR(64) NOT NULL DEFAULT '', ADD COLUMN totp_enabled_at DATETIME NULL`,
+		},
+	},
+	{
+		version: 5,
+		name:    "create_recovery_codes",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{recovery_codes}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				user_id BIGINT NOT NULL,
+				code_hash VARCHAR(255) NOT NULL DEFAULT '',
+				used_at DATETIME NULL,
+				created_at DATETIME NULL,
+				PRIMARY KEY (id),
+				INDEX idx_{{recovery_codes}}_user_id (user_id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version: 6,
+		name:    "otp_failed_attempts",
+		statements: []string{
+			`ALTER TABLE {{otp}} ADD COLUMN failed_attempts INT NOT NULL DEFAULT 0, ADD COLUMN last_failed_at DATETIME NULL`,
+		},
+	},
+	{
+		version: 7,
+		name:    "login_lockout",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN failed_logins INT NOT NULL DEFAULT 0, ADD COLUMN locked_until DATETIME NULL`,
+			`CREATE TABLE IF NOT EXISTS {{login_failures}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				ip_addr VARCHAR(64) NOT NULL DEFAULT '',
+				email VARCHAR(255) NOT NULL DEFAULT '',
+				phone_number VARCHAR(32) NOT NULL DEFAULT '',
+				created_at DATETIME NULL,
+				PRIMARY KEY (id),
+				INDEX idx_{{login_failures}}_ip_addr (ip_addr, created_at)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version: 8,
+		name:    "otp_clear_plaintext_codes",
+		//codes are saved hashed now, pending plaintext codes have to be requested again
+		statements: []string{
+			`UPDATE {{otp}} SET code = '' WHERE code <> '' AND code NOT LIKE 'h1:%'`,
+		},
+	},
+	{
+		version: 9,
+		name:    "otp_verification_expiry",
+		statements: []string{
+			`ALTER TABLE {{otp}} ADD COLUMN verification_expires_at DATETIME NULL, ADD COLUMN verification_used_at DATETIME NULL, ADD INDEX idx_{{otp}}_verification_id (verification_id)`,
+		},
+	},
+	{
+		version: 10,
+		name:    "create_notifications",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{notifications}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				channel VARCHAR(16) NOT NULL DEFAULT '',
+				recipient VARCHAR(255) NOT NULL DEFAULT '',
+				subject VARCHAR(255) NOT NULL DEFAULT '',
+				body TEXT NULL,
+				text_body TEXT NULL,
+				status VARCHAR(16) NOT NULL DEFAULT '',
+				attempts INT NOT NULL DEFAULT 0,
+				last_error VARCHAR(1024) NOT NULL DEFAULT '',
+				next_attempt_at DATETIME NULL,
+				expires_at DATETIME NULL,
+				sent_at DATETIME NULL,
+				created_at DATETIME NULL,
+				updated_at DATETIME NULL,
+				PRIMARY KEY (id),
+				INDEX idx_{{notifications}}_status (status, next_attempt_at)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version: 11,
+		name:    "create_webauthn",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{webauthn_credentials}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				user_id BIGINT NOT NULL,
+				credential_id VARCHAR(512) NOT NULL,
+				public_key TEXT NULL,
+				sign_count BIGINT NOT NULL DEFAULT 0,
+				aaguid VARCHAR(36) NOT NULL DEFAULT '',
+				attestation_type VARCHAR(16) NOT NULL DEFAULT '',
+				name VARCHAR(255) NOT NULL DEFAULT '',
+				created_at DATETIME NULL,
+				last_used_at DATETIME NULL,
+				PRIMARY KEY (id),
+				UNIQUE INDEX idx_{{webauthn_credentials}}_credential_id (credential_id),
+				INDEX idx_{{webauthn_credentials}}_user_id (user_id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS {{webauthn_challenges}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				challenge VARCHAR(128) NOT NULL,
+				ceremony VARCHAR(32) NOT NULL DEFAULT '',
+				user_id BIGINT NULL,
+				expires_at DATETIME NULL,
+				used_at DATETIME NULL,
+				created_at DATETIME NULL,
+				PRIMARY KEY (id),
+				UNIQUE INDEX idx_{{webauthn_challenges}}_challenge (challenge)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version: 12,
+		name:    "create_oauth",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD COLUMN client_id VARCHAR(128) NOT NULL DEFAULT '', ADD COLUMN scope VARCHAR(1024) NOT NULL DEFAULT ''`,
+			`CREATE TABLE IF NOT EXISTS {{oauth_clients}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				client_id VARCHAR(128) NOT NULL,
+				client_secret VARCHAR(255) NOT NULL DEFAULT '',
+				name VARCHAR(255) NOT NULL DEFAULT '',
+				redirect_uris TEXT NULL,
+				scopes VARCHAR(1024) NOT NULL DEFAULT '',
+				created_at DATETIME NULL,
+				PRIMARY KEY (id),
+				UNIQUE INDEX idx_{{oauth_clients}}_client_id (client_id)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+			`CREATE TABLE IF NOT EXISTS {{oauth_codes}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				code_hash VARCHAR(64) NOT NULL,
+				client_id VARCHAR(128) NOT NULL DEFAULT '',
+				user_id BIGINT NOT NULL,
+				redirect_uri VARCHAR(2048) NOT NULL DEFAULT '',
+				scope VARCHAR(1024) NOT NULL DEFAULT '',
+				code_challenge VARCHAR(128) NOT NULL DEFAULT '',
+				code_challenge_method VARCHAR(16) NOT NULL DEFAULT '',
+				family_id VARCHAR(64) NOT NULL DEFAULT '',
+				expires_at DATETIME NULL,
+				used_at DATETIME NULL,
+				created_at DATETIME NULL,
+				PRIMARY KEY (id),
+				UNIQUE INDEX idx_{{oauth_codes}}_code_hash (code_hash)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version: 13,
+		name:    "oidc",
+		//users registered before are not known to be verified
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN email_verified_at DATETIME NULL, ADD COLUMN phone_number_verified_at DATETIME NULL`,
+			`ALTER TABLE {{oauth_codes}} ADD COLUMN nonce VARCHAR(255) NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 14,
+		name:    "oauth_client_grant_types",
+		//clients registered before use the authorization code flow
+		statements: []string{
+			`ALTER TABLE {{oauth_clients}} ADD COLUMN grant_types VARCHAR(255) NOT NULL DEFAULT 'authorization_code refresh_token'`,
+		},
+	},
+	{
+		version: 15,
+		name:    "create_device_codes",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{device_codes}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				device_code_hash VARCHAR(64) NOT NULL,
+				user_code VARCHAR(16) NOT NULL,
+				client_id VARCHAR(128) NOT NULL DEFAULT '',
+				scope VARCHAR(1024) NOT NULL DEFAULT '',
+				user_id BIGINT NULL,
+				approved_at DATETIME NULL,
+				denied_at DATETIME NULL,
+				poll_interval INT NOT NULL DEFAULT 5,
+				last_polled_at DATETIME NULL,
+				expires_at DATETIME NULL,
+				used_at DATETIME NULL,
+				created_at DATETIME NULL,
+				PRIMARY KEY (id),
+				UNIQUE INDEX idx_{{device_codes}}_device_code_hash (device_code_hash),
+				INDEX idx_{{device_codes}}_user_code (user_code)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+	{
+		version: 16,
+		name:    "add_second_factor_replay_protection",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0`,
+			`CREATE TABLE IF NOT EXISTS {{used_tokens}} (
+				id BIGINT NOT NULL AUTO_INCREMENT,
+				jti VARCHAR(64) NOT NULL,
+				expires_at DATETIME NULL,
+				created_at DATETIME NULL,
+				PRIMARY KEY (id),
+				UNIQUE INDEX idx_{{used_tokens}}_jti (jti),
+				INDEX idx_{{used_tokens}}_expires_at (expires_at)
+			) ENGINE=InnoDB DEFAULT CHARSET=utf8mb4`,
+		},
+	},
+}
@@ -0,0 +1,289 @@
+package ngauth
+
+// postgresMigrations - schema for postgres
+var postgresMigrations = []migration{
+	{
+		version: 1,
+		name:    "create_tables",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{users}} (
+				id BIGSERIAL PRIMARY KEY,
+				name VARCHAR(255) NOT NULL DEFAULT '',
+				password VARCHAR(255) NOT NULL DEFAULT '',
+				email VARCHAR(255) NOT NULL DEFAULT '',
+				phone_number VARCHAR(32) NOT NULL DEFAULT '',
+				photo_url VARCHAR(1024) NOT NULL DEFAULT '',
+				created_at TIMESTAMP WITH TIME ZONE NULL,
+				deleted_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{users}}_email ON {{users}} (email)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{users}}_phone_number ON {{users}} (phone_number)`,
+
+			`CREATE TABLE IF NOT EXISTS {{otp}} (
+				id BIGSERIAL PRIMARY KEY,
+				phone_number VARCHAR(32) NOT NULL DEFAULT '',
+				email VARCHAR(255) NOT NULL DEFAULT '',
+				code VARCHAR(255) NOT NULL DEFAULT '',
+				otp_for VARCHAR(32) NOT NULL DEFAULT '',
+				verification_id VARCHAR(64) NOT NULL DEFAULT '',
+				verified_at TIMESTAMP WITH TIME ZONE NULL,
+				expires_at TIMESTAMP WITH TIME ZONE NULL,
+				created_at TIMESTAMP WITH TIME ZONE NULL,
+				deleted_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{otp}}_email ON {{otp}} (email, otp_for, created_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{otp}}_phone_number ON {{otp}} (phone_number, otp_for, created_at)`,
+
+			`CREATE TABLE IF NOT EXISTS {{sessions}} (
+				id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NULL,
+				device_id VARCHAR(255) NOT NULL DEFAULT '',
+				device_name VARCHAR(255) NOT NULL DEFAULT '',
+				refresh_token TEXT NOT NULL,
+				created_at TIMESTAMP WITH TIME ZONE NULL,
+				ip_addr VARCHAR(64) NOT NULL DEFAULT '',
+				user_agent TEXT NULL,
+				deleted_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{sessions}}_refresh_token ON {{sessions}} (refresh_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{sessions}}_user_id ON {{sessions}} (user_id)`,
+
+			`CREATE TABLE IF NOT EXISTS {{push_tokens}} (
+				id BIGSERIAL PRIMARY KEY,
+				device_id VARCHAR(255) NOT NULL,
+				device_os VARCHAR(32) NOT NULL DEFAULT '',
+				push_token VARCHAR(1024) NOT NULL DEFAULT '',
+				user_id BIGINT NULL,
+				created_at TIMESTAMP WITH TIME ZONE NULL,
+				updated_at TIMESTAMP WITH TIME ZONE NULL,
+				ip_addr VARCHAR(64) NOT NULL DEFAULT '',
+				user_agent TEXT NULL,
+				deleted_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{push_tokens}}_device_id ON {{push_tokens}} (device_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{push_tokens}}_user_id ON {{push_tokens}} (user_id)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "sessions_revoked_at",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP WITH TIME ZONE NULL`,
+		},
+	},
+	{
+		version: 3,
+		name:    "sessions_token_family",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD COLUMN IF NOT EXISTS family_id VARCHAR(64) NOT NULL DEFAULT ''`,
+			`ALTER TABLE {{sessions}} ADD COLUMN IF NOT EXISTS parent_id BIGINT NULL`,
+			`ALTER TABLE {{sessions}} ADD COLUMN IF NOT EXISTS rotated_at TIMESTAMP WITH TIME ZONE NULL`,
+			`CREATE INDEX IF NOT EXISTS idx_{{sessions}}_family_id ON {{sessions}} (family_id)`,
+		},
+	},
+	{
+		version: 4,
+		name:    "users_totp",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64) NOT NULL DEFAULT ''`,
+			`ALTER TABLE {{users}} ADD COLUMN IF NOT EXISTS totp_enabled_at TIMESTAMP WITH TIME ZONE NULL`,
+		},
+	},
+	{
+		version: 5,
+		name:    "create_recovery_codes",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{recovery_codes}} (
+				id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				code_hash VARCHAR(255) NOT NULL DEFAULT '',
+				used_at TIMESTAMP WITH TIME ZONE NULL,
+				created_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{recovery_codes}}_user_id ON {{recovery_codes}} (user_id)`,
+		},
+	},
+	{
+		version: 6,
+		name:    "otp_failed_attempts",
+		statements: []string{
+			`ALTER TABLE {{otp}} ADD COLUMN IF NOT EXISTS failed_attempts INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE {{otp}} ADD COLUMN IF NOT EXISTS last_failed_at TIMESTAMP WITH TIME ZONE NULL`,
+		},
+	},
+	{
+		version: 7,
+		name:    "login_lockout",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN IF NOT EXISTS failed_logins INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE {{users}} ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE NULL`,
+			`CREATE TABLE IF NOT EXISTS {{login_failures}} (
+				id BIGSERIAL PRIMARY KEY,
+				ip_addr VARCHAR(64) NOT NULL DEFAULT '',
+				email VARCHAR(255) NOT NULL DEFAULT '',
+				phone_number VARCHAR(32) NOT NULL DEFAULT '',
+				created_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{login_failures}}_ip_addr ON {{login_failures}} (ip_addr, created_at)`,
+		},
+	},
+	{
+		version: 8,
+		name:    "otp_clear_plaintext_codes",
+		//codes are saved hashed now, pending plaintext codes have to be requested again
+		statements: []string{
+			`UPDATE {{otp}} SET code = '' WHERE code <> '' AND code NOT LIKE 'h1:%'`,
+		},
+	},
+	{
+		version: 9,
+		name:    "otp_verification_expiry",
+		statements: []string{
+			`ALTER TABLE {{otp}} ADD COLUMN IF NOT EXISTS verification_expires_at TIMESTAMP WITH TIME ZONE NULL`,
+			`ALTER TABLE {{otp}} ADD COLUMN IF NOT EXISTS verification_used_at TIMESTAMP WITH TIME ZONE NULL`,
+			`CREATE INDEX IF NOT EXISTS idx_{{otp}}_verification_id ON {{otp}} (verification_id)`,
+		},
+	},
+	{
+		version: 10,
+		name:    "create_notifications",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{notifications}} (
+				id BIGSERIAL PRIMARY KEY,
+				channel VARCHAR(16) NOT NULL DEFAULT '',
+				recipient VARCHAR(255) NOT NULL DEFAULT '',
+				subject VARCHAR(255) NOT NULL DEFAULT '',
+				body TEXT NOT NULL DEFAULT '',
+				text_body TEXT NOT NULL DEFAULT '',
+				status VARCHAR(16) NOT NULL DEFAULT '',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				last_error VARCHAR(1024) NOT NULL DEFAULT '',
+				next_attempt_at TIMESTAMP WITH TIME ZONE NULL,
+				expires_at TIMESTAMP WITH TIME ZONE NULL,
+				sent_at TIMESTAMP WITH TIME ZONE NULL,
+				created_at TIMESTAMP WITH TIME ZONE NULL,
+				updated_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{notifications}}_status ON {{notifications}} (status, next_attempt_at)`,
+		},
+	},
+	{
+		version: 11,
+		name:    "create_webauthn",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{webauthn_credentials}} (
+				id BIGSERIAL PRIMARY KEY,
+				user_id BIGINT NOT NULL,
+				credential_id VARCHAR(512) NOT NULL,
+				public_key TEXT NOT NULL DEFAULT '',
+				sign_count BIGINT NOT NULL DEFAULT 0,
+				aaguid VARCHAR(36) NOT NULL DEFAULT '',
+				attestation_type VARCHAR(16) NOT NULL DEFAULT '',
+				name VARCHAR(255) NOT NULL DEFAULT '',
+				created_at TIMESTAMP WITH TIME ZONE NULL,
+				last_used_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{webauthn_credentials}}_credential_id ON {{webauthn_credentials}} (credential_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{webauthn_credentials}}_user_id ON {{webauthn_credentials}} (user_id)`,
+			`CREATE TABLE IF NOT EXISTS {{webauthn_challenges}} (
+				id BIGSERIAL PRIMARY KEY,
+				challenge VARCHAR(128) NOT NULL,
+				ceremony VARCHAR(32) NOT NULL DEFAULT '',
+				user_id BIGINT NULL,
+				expires_at TIMESTAMP WITH TIME ZONE NULL,
+				used_at TIMESTAMP WITH TIME ZONE NULL,
+				created_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{webauthn_challenges}}_challenge ON {{webauthn_challenges}} (challenge)`,
+		},
+	},
+	{
+		version: 12,
+		name:    "create_oauth",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD COLUMN IF NOT EXISTS client_id VARCHAR(128) NOT NULL DEFAULT ''`,
+			`ALTER TABLE {{sessions}} ADD COLUMN IF NOT EXISTS scope VARCHAR(1024) NOT NULL DEFAULT ''`,
+			`CREATE TABLE IF NOT EXISTS {{oauth_clients}} (
+				id BIGSERIAL PRIMARY KEY,
+				client_id VARCHAR(128) NOT NULL,
+				client_secret VARCHAR(255) NOT NULL DEFAULT '',
+				name VARCHAR(255) NOT NULL DEFAULT '',
+				redirect_uris TEXT NOT NULL DEFAULT '',
+				scopes VARCHAR(1024) NOT NULL DEFAULT '',
+				created_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{oauth_clients}}_client_id ON {{oauth_clients}} (client_id)`,
+			`CREATE TABLE IF NOT EXISTS {{oauth_codes}} (
+				id BIGSERIAL PRIMARY KEY,
+				code_hash VARCHAR(64) NOT NULL,
+				client_id VARCHAR(128) NOT NULL DEFAULT '',
+				user_id BIGINT NOT NULL,
+				redirect_uri VARCHAR(2048) NOT NULL DEFAULT '',
+				scope VARCHAR(1024) NOT NULL DEFAULT '',
+				code_challenge VARCHAR(128) NOT NULL DEFAULT '',
+				code_challenge_method VARCHAR(16) NOT NULL DEFAULT '',
+				family_id VARCHAR(64) NOT NULL DEFAULT '',
+				expires_at TIMESTAMP WITH TIME ZONE NULL,
+				used_at TIMESTAMP WITH TIME ZONE NULL,
+				created_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{oauth_codes}}_code_hash ON {{oauth_codes}} (code_hash)`,
+		},
+	},
+	{
+		version: 13,
+		name:    "oidc",
+		//users registered before are not known to be verified
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN IF NOT EXISTS email_verified_at TIMESTAMP WITH TIME ZONE NULL`,
+			`ALTER TABLE {{users}} ADD COLUMN IF NOT EXISTS phone_number_verified_at TIMESTAMP WITH TIME ZONE NULL`,
+			`ALTER TABLE {{oauth_codes}} ADD COLUMN IF NOT EXISTS nonce VARCHAR(255) NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 14,
+		name:    "oauth_client_grant_types",
+		//clients registered before use the authorization code flow
+		statements: []string{
+			`ALTER TABLE {{oauth_clients}} ADD COLUMN IF NOT EXISTS grant_types VARCHAR(255) NOT NULL DEFAULT 'authorization_code refresh_token'`,
+		},
+	},
+	{
+		version: 15,
+		name:    "create_device_codes",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{device_codes}} (
+				id BIGSERIAL PRIMARY KEY,
+				device_code_hash VARCHAR(64) NOT NULL,
+				user_code VARCHAR(16) NOT NULL,
+				client_id VARCHAR(128) NOT NULL DEFAULT '',
+				scope VARCHAR(1024) NOT NULL DEFAULT '',
+				user_id BIGINT NULL,
+				approved_at TIMESTAMP WITH TIME ZONE NULL,
+				denied_at TIMESTAMP WITH TIME ZONE NULL,
+				poll_interval INTEGER NOT NULL DEFAULT 5,
+				last_polled_at TIMESTAMP WITH TIME ZONE NULL,
+				expires_at TIMESTAMP WITH TIME ZONE NULL,
+				used_at TIMESTAMP WITH TIME ZONE NULL,
+				created_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{device_codes}}_device_code_hash ON {{device_codes}} (device_code_hash)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{device_codes}}_user_code ON {{device_codes}} (user_code)`,
+		},
+	},
+	{
+		version: 16,
+		name:    "add_second_factor_replay_protection",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN IF NOT EXISTS totp_last_step BIGINT NOT NULL DEFAULT 0`,
+			`CREATE TABLE IF NOT EXISTS {{used_tokens}} (
+				id BIGSERIAL PRIMARY KEY,
+				jti VARCHAR(64) NOT NULL,
+				expires_at TIMESTAMP WITH TIME ZONE NULL,
+				created_at TIMESTAMP WITH TIME ZONE NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{used_tokens}}_jti ON {{used_tokens}} (jti)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{used_tokens}}_expires_at ON {{used_tokens}} (expires_at)`,
+		},
+	},
+}
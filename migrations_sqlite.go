@@ -0,0 +1,289 @@
+package ngauth
+
+// sqliteMigrations - schema for sqlite3
+var sqliteMigrations = []migration{
+	{
+		version: 1,
+		name:    "create_tables",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{users}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL DEFAULT '',
+				password TEXT NOT NULL DEFAULT '',
+				email TEXT NOT NULL DEFAULT '',
+				phone_number TEXT NOT NULL DEFAULT '',
+				photo_url TEXT NOT NULL DEFAULT '',
+				created_at DATETIME NULL,
+				deleted_at DATETIME NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{users}}_email ON {{users}} (email)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{users}}_phone_number ON {{users}} (phone_number)`,
+
+			`CREATE TABLE IF NOT EXISTS {{otp}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				phone_number TEXT NOT NULL DEFAULT '',
+				email TEXT NOT NULL DEFAULT '',
+				code TEXT NOT NULL DEFAULT '',
+				otp_for TEXT NOT NULL DEFAULT '',
+				verification_id TEXT NOT NULL DEFAULT '',
+				verified_at DATETIME NULL,
+				expires_at DATETIME NULL,
+				created_at DATETIME NULL,
+				deleted_at DATETIME NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{otp}}_email ON {{otp}} (email, otp_for, created_at)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{otp}}_phone_number ON {{otp}} (phone_number, otp_for, created_at)`,
+
+			`CREATE TABLE IF NOT EXISTS {{sessions}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NULL,
+				device_id TEXT NOT NULL DEFAULT '',
+				device_name TEXT NOT NULL DEFAULT '',
+				refresh_token TEXT NOT NULL,
+				created_at DATETIME NULL,
+				ip_addr TEXT NOT NULL DEFAULT '',
+				user_agent TEXT NULL,
+				deleted_at DATETIME NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{sessions}}_refresh_token ON {{sessions}} (refresh_token)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{sessions}}_user_id ON {{sessions}} (user_id)`,
+
+			`CREATE TABLE IF NOT EXISTS {{push_tokens}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_id TEXT NOT NULL,
+				device_os TEXT NOT NULL DEFAULT '',
+				push_token TEXT NOT NULL DEFAULT '',
+				user_id INTEGER NULL,
+				created_at DATETIME NULL,
+				updated_at DATETIME NULL,
+				ip_addr TEXT NOT NULL DEFAULT '',
+				user_agent TEXT NULL,
+				deleted_at DATETIME NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{push_tokens}}_device_id ON {{push_tokens}} (device_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{push_tokens}}_user_id ON {{push_tokens}} (user_id)`,
+		},
+	},
+	{
+		version: 2,
+		name:    "sessions_revoked_at",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD COLUMN revoked_at DATETIME NULL`,
+		},
+	},
+	{
+		version: 3,
+		name:    "sessions_token_family",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD COLUMN family_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE {{sessions}} ADD COLUMN parent_id INTEGER NULL`,
+			`ALTER TABLE {{sessions}} ADD COLUMN rotated_at DATETIME NULL`,
+			`CREATE INDEX IF NOT EXISTS idx_{{sessions}}_family_id ON {{sessions}} (family_id)`,
+		},
+	},
+	{
+		version: 4,
+		name:    "users_totp",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN totp_secret TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE {{users}} ADD COLUMN totp_enabled_at DATETIME NULL`,
+		},
+	},
+	{
+		version: 5,
+		name:    "create_recovery_codes",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{recovery_codes}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				code_hash TEXT NOT NULL DEFAULT '',
+				used_at DATETIME NULL,
+				created_at DATETIME NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{recovery_codes}}_user_id ON {{recovery_codes}} (user_id)`,
+		},
+	},
+	{
+		version: 6,
+		name:    "otp_failed_attempts",
+		statements: []string{
+			`ALTER TABLE {{otp}} ADD COLUMN failed_attempts INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE {{otp}} ADD COLUMN last_failed_at DATETIME NULL`,
+		},
+	},
+	{
+		version: 7,
+		name:    "login_lockout",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN failed_logins INTEGER NOT NULL DEFAULT 0`,
+			`ALTER TABLE {{users}} ADD COLUMN locked_until DATETIME NULL`,
+			`CREATE TABLE IF NOT EXISTS {{login_failures}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				ip_addr TEXT NOT NULL DEFAULT '',
+				email TEXT NOT NULL DEFAULT '',
+				phone_number TEXT NOT NULL DEFAULT '',
+				created_at DATETIME NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{login_failures}}_ip_addr ON {{login_failures}} (ip_addr, created_at)`,
+		},
+	},
+	{
+		version: 8,
+		name:    "otp_clear_plaintext_codes",
+		//codes are saved hashed now, pending plaintext codes have to be requested again
+		statements: []string{
+			`UPDATE {{otp}} SET code = '' WHERE code <> '' AND code NOT LIKE 'h1:%'`,
+		},
+	},
+	{
+		version: 9,
+		name:    "otp_verification_expiry",
+		statements: []string{
+			`ALTER TABLE {{otp}} ADD COLUMN verification_expires_at DATETIME NULL`,
+			`ALTER TABLE {{otp}} ADD COLUMN verification_used_at DATETIME NULL`,
+			`CREATE INDEX IF NOT EXISTS idx_{{otp}}_verification_id ON {{otp}} (verification_id)`,
+		},
+	},
+	{
+		version: 10,
+		name:    "create_notifications",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{notifications}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				channel TEXT NOT NULL DEFAULT '',
+				recipient TEXT NOT NULL DEFAULT '',
+				subject TEXT NOT NULL DEFAULT '',
+				body TEXT NOT NULL DEFAULT '',
+				text_body TEXT NOT NULL DEFAULT '',
+				status TEXT NOT NULL DEFAULT '',
+				attempts INTEGER NOT NULL DEFAULT 0,
+				last_error TEXT NOT NULL DEFAULT '',
+				next_attempt_at DATETIME NULL,
+				expires_at DATETIME NULL,
+				sent_at DATETIME NULL,
+				created_at DATETIME NULL,
+				updated_at DATETIME NULL
+			)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{notifications}}_status ON {{notifications}} (status, next_attempt_at)`,
+		},
+	},
+	{
+		version: 11,
+		name:    "create_webauthn",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{webauthn_credentials}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				credential_id TEXT NOT NULL,
+				public_key TEXT NOT NULL DEFAULT '',
+				sign_count INTEGER NOT NULL DEFAULT 0,
+				aaguid TEXT NOT NULL DEFAULT '',
+				attestation_type TEXT NOT NULL DEFAULT '',
+				name TEXT NOT NULL DEFAULT '',
+				created_at DATETIME NULL,
+				last_used_at DATETIME NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{webauthn_credentials}}_credential_id ON {{webauthn_credentials}} (credential_id)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{webauthn_credentials}}_user_id ON {{webauthn_credentials}} (user_id)`,
+			`CREATE TABLE IF NOT EXISTS {{webauthn_challenges}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				challenge TEXT NOT NULL,
+				ceremony TEXT NOT NULL DEFAULT '',
+				user_id INTEGER NULL,
+				expires_at DATETIME NULL,
+				used_at DATETIME NULL,
+				created_at DATETIME NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{webauthn_challenges}}_challenge ON {{webauthn_challenges}} (challenge)`,
+		},
+	},
+	{
+		version: 12,
+		name:    "create_oauth",
+		statements: []string{
+			`ALTER TABLE {{sessions}} ADD COLUMN client_id TEXT NOT NULL DEFAULT ''`,
+			`ALTER TABLE {{sessions}} ADD COLUMN scope TEXT NOT NULL DEFAULT ''`,
+			`CREATE TABLE IF NOT EXISTS {{oauth_clients}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				client_id TEXT NOT NULL,
+				client_secret TEXT NOT NULL DEFAULT '',
+				name TEXT NOT NULL DEFAULT '',
+				redirect_uris TEXT NOT NULL DEFAULT '',
+				scopes TEXT NOT NULL DEFAULT '',
+				created_at DATETIME NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{oauth_clients}}_client_id ON {{oauth_clients}} (client_id)`,
+			`CREATE TABLE IF NOT EXISTS {{oauth_codes}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				code_hash TEXT NOT NULL,
+				client_id TEXT NOT NULL DEFAULT '',
+				user_id INTEGER NOT NULL,
+				redirect_uri TEXT NOT NULL DEFAULT '',
+				scope TEXT NOT NULL DEFAULT '',
+				code_challenge TEXT NOT NULL DEFAULT '',
+				code_challenge_method TEXT NOT NULL DEFAULT '',
+				family_id TEXT NOT NULL DEFAULT '',
+				expires_at DATETIME NULL,
+				used_at DATETIME NULL,
+				created_at DATETIME NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{oauth_codes}}_code_hash ON {{oauth_codes}} (code_hash)`,
+		},
+	},
+	{
+		version: 13,
+		name:    "oidc",
+		//users registered before are not known to be verified
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN email_verified_at DATETIME NULL`,
+			`ALTER TABLE {{users}} ADD COLUMN phone_number_verified_at DATETIME NULL`,
+			`ALTER TABLE {{oauth_codes}} ADD COLUMN nonce TEXT NOT NULL DEFAULT ''`,
+		},
+	},
+	{
+		version: 14,
+		name:    "oauth_client_grant_types",
+		//clients registered before use the authorization code flow
+		statements: []string{
+			`ALTER TABLE {{oauth_clients}} ADD COLUMN grant_types TEXT NOT NULL DEFAULT 'authorization_code refresh_token'`,
+		},
+	},
+	{
+		version: 15,
+		name:    "create_device_codes",
+		statements: []string{
+			`CREATE TABLE IF NOT EXISTS {{device_codes}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				device_code_hash TEXT NOT NULL,
+				user_code TEXT NOT NULL,
+				client_id TEXT NOT NULL DEFAULT '',
+				scope TEXT NOT NULL DEFAULT '',
+				user_id INTEGER NULL,
+				approved_at DATETIME NULL,
+				denied_at DATETIME NULL,
+				poll_interval INTEGER NOT NULL DEFAULT 5,
+				last_polled_at DATETIME NULL,
+				expires_at DATETIME NULL,
+				used_at DATETIME NULL,
+				created_at DATETIME NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{device_codes}}_device_code_hash ON {{device_codes}} (device_code_hash)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{device_codes}}_user_code ON {{device_codes}} (user_code)`,
+		},
+	},
+	{
+		version: 16,
+		name:    "add_second_factor_replay_protection",
+		statements: []string{
+			`ALTER TABLE {{users}} ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0`,
+			`CREATE TABLE IF NOT EXISTS {{used_tokens}} (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				jti TEXT NOT NULL,
+				expires_at DATETIME NULL,
+				created_at DATETIME NULL
+			)`,
+			`CREATE UNIQUE INDEX IF NOT EXISTS idx_{{used_tokens}}_jti ON {{used_tokens}} (jti)`,
+			`CREATE INDEX IF NOT EXISTS idx_{{used_tokens}}_expires_at ON {{used_tokens}} (expires_at)`,
+		},
+	},
+}
@@ -13,6 +13,20 @@ type User struct {
 	PhoneNumber string      `json:"phone_number"`
 	PhotoURL    string      `json:"photo_url"`
 	CreatedAt   null.Time   `json:"created_at"`
+
+	//TOTP two-factor authentication, enabled once the secret is confirmed
+	TOTPSecret    string    `json:"-"`
+	TOTPEnabledAt null.Time `json:"totp_enabled_at"`
+	//time step of the last accepted TOTP code, codes of this or an earlier step are refused
+	TOTPLastStep int64 `json:"-"`
+
+	//failed logins since the last successful login, the account is locked until LockedUntil
+	FailedLogins int       `json:"-"`
+	LockedUntil  null.Time `json:"-"`
+
+	//set when an otp sent to the email/phone number was verified, eg at registration
+	EmailVerifiedAt       null.Time `json:"email_verified_at"`
+	PhoneNumberVerifiedAt null.Time `json:"phone_number_verified_at"`
 }
 
 //OTP - one time password
@@ -28,6 +42,14 @@ type OTP struct {
 	VerifiedAt     null.Time `json:"verified_at"`
 	ExpiresAt      null.Time `json:"expires_at"`
 	CreatedAt      null.Time `json:"created_at"`
+
+	//verification_id can be used once, before it expires
+	VerificationExpiresAt null.Time `json:"verification_expires_at"`
+	VerificationUsedAt    null.Time `json:"verification_used_at"`
+
+	//wrong codes entered, the otp is invalidated after Config.OTPMaxAttempts
+	FailedAttempts int       `json:"failed_attempts"`
+	LastFailedAt   null.Time `json:"last_failed_at"`
 }
 
 //Session - one time password
@@ -38,11 +60,201 @@ type Session struct {
 	DeviceName   string      `json:"device_name"`
 	RefreshToken string      `json:"refresh_token"`
 	CreatedAt    null.Time   `json:"created_at"`
+	RevokedAt    null.Time   `json:"revoked_at"`
+
+	//refresh token rotation, all sessions rotated from the same login share a family
+	FamilyID  string      `json:"family_id"`
+	ParentID  interface{} `json:"parent_id"`
+	RotatedAt null.Time   `json:"rotated_at"`
+
+	//sessions of oauth clients, empty for the /login api
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
 
 	IPAddr    string `json:"ip_addr"`
 	UserAgent string `json:"user_agent"`
 }
 
+//RecoveryCode - single use code, alternative second factor when the TOTP device is lost
+type RecoveryCode struct {
+	ID        interface{} `json:"id" bson:"_id,omitempty"`
+	UserID    interface{} `json:"user_id"`
+	CodeHash  string      `json:"-"`
+	UsedAt    null.Time   `json:"used_at"`
+	CreatedAt null.Time   `json:"created_at"`
+}
+
+//LoginFailure - failed login attempt, used to throttle logins per ip address
+type LoginFailure struct {
+	ID          interface{} `json:"id" bson:"_id,omitempty"`
+	IPAddr      string      `json:"ip_addr"`
+	Email       string      `json:"email"`
+	PhoneNumber string      `json:"phone_number"`
+	CreatedAt   null.Time   `json:"created_at"`
+}
+
+//UsedToken - id (jti) of a single use token that was used, eg the mfa token. Kept until the token expires
+type UsedToken struct {
+	ID        interface{} `json:"id" bson:"_id,omitempty"`
+	JTI       string      `json:"jti"`
+	ExpiresAt null.Time   `json:"expires_at"`
+	CreatedAt null.Time   `json:"created_at"`
+}
+
+// Notification channels
+const (
+	NotificationEmail = "email"
+	NotificationSMS   = "sms"
+	NotificationPush  = "push"
+)
+
+// Notification statuses
+const (
+	NotificationPending = "pending"
+	NotificationSending = "sending"
+	NotificationSent    = "sent"
+	NotificationFailed  = "failed"
+	NotificationExpired = "expired"
+)
+
+//Notification - email/sms/push message in the delivery outbox, see NotificationDispatcher
+type Notification struct {
+	ID interface{} `json:"id" bson:"_id,omitempty"`
+
+	//Channel - email, sms or push
+	Channel string `json:"channel"`
+
+	//Recipient - email address, phone number or push token
+	Recipient string `json:"recipient"`
+	Subject   string `json:"subject"`
+
+	//Body - html for emails, the message for sms/push. TextBody - plain text alternative of emails.
+	//bodies can contain otp codes, they are saved encrypted and cleared once the notification is done
+	Body     string `json:"-"`
+	TextBody string `json:"-"`
+
+	Status        string    `json:"status"`
+	Attempts      int       `json:"attempts"`
+	LastError     string    `json:"last_error"`
+	NextAttemptAt null.Time `json:"next_attempt_at"`
+
+	//ExpiresAt - not delivered after this, eg when the otp code expired
+	ExpiresAt null.Time `json:"expires_at"`
+	SentAt    null.Time `json:"sent_at"`
+	CreatedAt null.Time `json:"created_at"`
+	UpdatedAt null.Time `json:"updated_at"`
+}
+
+//WebAuthnCredential - passkey/security key of a user, see webauthn.go
+type WebAuthnCredential struct {
+	ID     interface{} `json:"id" bson:"_id,omitempty"`
+	UserID interface{} `json:"user_id"`
+
+	//CredentialID - base64url id chosen by the authenticator. PublicKey - base64url COSE key
+	CredentialID string `json:"credential_id"`
+	PublicKey    string `json:"-"`
+
+	//SignCount - signature counter of the authenticator, it increases with every login
+	SignCount int64 `json:"sign_count"`
+
+	//AAGUID - model of the authenticator. AttestationType - none, self or basic
+	AAGUID          string `json:"aaguid" gorm:"column:aaguid"`
+	AttestationType string `json:"attestation_type"`
+
+	Name       string    `json:"name"`
+	CreatedAt  null.Time `json:"created_at"`
+	LastUsedAt null.Time `json:"last_used_at"`
+}
+
+//WebAuthnChallenge - challenge of a registration or login ceremony, it can be used once
+type WebAuthnChallenge struct {
+	ID        interface{} `json:"id" bson:"_id,omitempty"`
+	Challenge string      `json:"challenge"`
+
+	//Ceremony - webauthn.create or webauthn.get
+	Ceremony string `json:"ceremony"`
+
+	//UserID - the registering user, or the user logging in. nil for discoverable credentials
+	UserID interface{} `json:"user_id"`
+
+	ExpiresAt null.Time `json:"expires_at"`
+	UsedAt    null.Time `json:"used_at"`
+	CreatedAt null.Time `json:"created_at"`
+}
+
+//OAuthClient - application allowed to use the oauth endpoints, see oauth.go
+type OAuthClient struct {
+	ID       interface{} `json:"id" bson:"_id,omitempty"`
+	ClientID string      `json:"client_id"`
+
+	//ClientSecret - sha256 hash of the secret, empty for public clients (SPAs, mobile apps)
+	ClientSecret string `json:"-"`
+
+	Name string `json:"name"`
+
+	//RedirectURIs - space separated, redirect_uri must match one of them exactly
+	RedirectURIs string `json:"redirect_uris" gorm:"column:redirect_uris"`
+
+	//Scopes - space separated scopes the client can request, empty for any
+	Scopes string `json:"scopes"`
+
+	//GrantTypes - space separated grant types the client can use at the token endpoint,
+	//client_credentials clients are machine clients acting on their own behalf
+	GrantTypes string `json:"grant_types"`
+
+	CreatedAt null.Time `json:"created_at"`
+}
+
+//OAuthCode - authorization code, saved hashed. It can be used once
+type OAuthCode struct {
+	ID       interface{} `json:"id" bson:"_id,omitempty"`
+	CodeHash string      `json:"-"`
+	ClientID string      `json:"client_id"`
+	UserID   interface{} `json:"user_id"`
+
+	RedirectURI string `json:"redirect_uri"`
+	Scope       string `json:"scope"`
+
+	//PKCE, the method is always S256
+	CodeChallenge       string `json:"-"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+
+	//Nonce - OpenID Connect nonce, returned in the id token
+	Nonce string `json:"-"`
+
+	//FamilyID - of the sessions issued for the code, they are revoked if the code is used twice
+	FamilyID string `json:"family_id"`
+
+	ExpiresAt null.Time `json:"expires_at"`
+	UsedAt    null.Time `json:"used_at"`
+	CreatedAt null.Time `json:"created_at"`
+}
+
+//DeviceCode - device authorization request (RFC 8628), the device polls the token endpoint
+//until the user approves it on another device with the user code
+type DeviceCode struct {
+	ID             interface{} `json:"id" bson:"_id,omitempty"`
+	DeviceCodeHash string      `json:"-"`
+
+	//UserCode - entered at the verification page, stored without the dash
+	UserCode string `json:"user_code"`
+	ClientID string `json:"client_id"`
+	Scope    string `json:"scope"`
+
+	//UserID - set when the user approves the device
+	UserID     interface{} `json:"user_id"`
+	ApprovedAt null.Time   `json:"approved_at"`
+	DeniedAt   null.Time   `json:"denied_at"`
+
+	//PollInterval - seconds the device has to wait between polls, increased by 5 after each slow_down
+	PollInterval int       `json:"poll_interval"`
+	LastPolledAt null.Time `json:"last_polled_at"`
+
+	ExpiresAt null.Time `json:"expires_at"`
+	UsedAt    null.Time `json:"used_at"`
+	CreatedAt null.Time `json:"created_at"`
+}
+
 //PushToken - push notification tokens
 type PushToken struct {
 	ID        interface{} `json:"id" bson:"_id,omitempty"`
@@ -0,0 +1,533 @@
+package ngauth
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// Notifier - delivers notifications of one channel
+type Notifier interface {
+	Notify(notification Notification) error
+}
+
+// notificationWake - wakes running dispatchers when a notification is queued
+var notificationWake = make(chan struct{}, 1)
+
+//######## NOTIFIERS
+
+// EmailNotifier - sends email notifications with SMTP, see SendEmail
+type EmailNotifier struct{}
+
+// Notify - sends the email
+func (n *EmailNotifier) Notify(notification Notification) error {
+	return sendEmail(notification.Recipient, notification.Subject, notification.Body, notification.TextBody)
+}
+
+// SMSNotifier - sends sms notifications with the SMSSender
+type SMSNotifier struct {
+	Sender SMSSender
+}
+
+// Notify - sends the sms
+func (n *SMSNotifier) Notify(notification Notification) error {
+	return n.Sender.SendSMS(notification.Recipient, notification.Body)
+}
+
+// FCMNotifier - sends push notifications with the Firebase Cloud Messaging HTTP API,
+// the recipient is the push token of the device
+type FCMNotifier struct {
+	ServerKey string
+
+	//BaseURL - defaults to https://fcm.googleapis.com
+	BaseURL string
+	Client  *http.Client
+}
+
+// fcmResponse - send response
+type fcmResponse struct {
+	Success int `json:"success"`
+	Failure int `json:"failure"`
+	Results []struct {
+		Error string `json:"error"`
+	} `json:"results"`
+}
+
+// Notify - sends the push notification
+func (n *FCMNotifier) Notify(notification Notification) error {
+
+	baseURL := n.BaseURL
+	if IsEmptyString(baseURL) {
+		baseURL = "https://fcm.googleapis.com"
+	}
+
+	payload, err := json.Marshal(Map{
+		"to":           notification.Recipient,
+		"notification": Map{"title": notification.Subject, "body": notification.Body},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(baseURL, "/")+"/fcm/send", bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "key="+n.ServerKey)
+
+	client := n.Client
+	if client == nil {
+		client = smsHTTPClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("FCM: returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	var response fcmResponse
+	if err = json.Unmarshal(body, &response); err != nil {
+		return err
+	}
+
+	//200 is returned even when the message was not sent
+	if response.Failure > 0 {
+		reason := "unknown error"
+		if len(response.Results) > 0 && !IsEmptyString(response.Results[0].Error) {
+			reason = response.Results[0].Error
+		}
+		return fmt.Errorf("FCM: message not sent: %s", reason)
+	}
+
+	return nil
+}
+
+//######## BODY ENCRYPTION
+
+// notificationBodyPrefix - marks bodies encrypted with AES-256-GCM
+const notificationBodyPrefix = "e1:"
+
+// notificationKey - key of the body encryption, derived from Config.OTPHashKey or SignKey
+func notificationKey() []byte {
+	return deriveKey("notification body")
+}
+
+func notificationCipher() (cipher.AEAD, error) {
+
+	block, err := aes.NewCipher(notificationKey())
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// sealNotificationBody - encrypts the body before it is saved, empty bodies stay empty
+func sealNotificationBody(body string) (string, error) {
+
+	if len(body) == 0 {
+		return "", nil
+	}
+
+	gcm, err := notificationCipher()
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(body), nil)
+
+	return notificationBodyPrefix + base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// openNotificationBody - decrypts a saved body, bodies queued before they were encrypted are returned as they are
+func openNotificationBody(body string) (string, error) {
+
+	if !strings.HasPrefix(body, notificationBodyPrefix) {
+		return body, nil
+	}
+
+	sealed, err := base64.RawStdEncoding.DecodeString(strings.TrimPrefix(body, notificationBodyPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	gcm, err := notificationCipher()
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("notification body too short")
+	}
+
+	plain, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+
+	return string(plain), nil
+}
+
+//######## QUEUE
+
+// QueueNotification - saves the notification to the outbox, a running NotificationDispatcher delivers it.
+// The bodies are saved encrypted, they can contain otp codes and magic links
+func QueueNotification(db Database, lang string, notification Notification) *Error {
+
+	now := TimeNow()
+
+	//expired bodies are cleared even when no dispatcher is running
+	err := db.ExpireNotifications(now, lang)
+	if err != nil {
+		return err
+	}
+
+	var sealErr error
+	if notification.Body, sealErr = sealNotificationBody(notification.Body); sealErr != nil {
+		return NewErrorWithMessage(ErrorInternalServerError, sealErr.Error())
+	}
+	if notification.TextBody, sealErr = sealNotificationBody(notification.TextBody); sealErr != nil {
+		return NewErrorWithMessage(ErrorInternalServerError, sealErr.Error())
+	}
+
+	notification.Status = NotificationPending
+	notification.Attempts = 0
+	notification.NextAttemptAt = null.TimeFrom(now)
+	notification.CreatedAt = null.TimeFrom(now)
+	notification.UpdatedAt = null.TimeFrom(now)
+
+	_, err = db.CreateNotification(notification, lang)
+	if err != nil {
+		return err
+	}
+
+	//non blocking, a pending wake up is enough
+	select {
+	case notificationWake <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// QueueOTP - renders the otp message and queues it, by sms to phone numbers and by email otherwise.
+// It is not delivered after the code expired
+func QueueOTP(db Database, message OTPMessage) *Error {
+
+	rendered, err := RenderOTPMessage(message)
+	if err != nil {
+		return NewErrorWithMessage(ErrorInternalServerError, err.Error())
+	}
+
+	notification := Notification{Channel: NotificationEmail, Recipient: message.Email, Subject: rendered.Subject, Body: rendered.HTML, TextBody: rendered.Text}
+	if !IsEmptyString(message.PhoneNumber) {
+		notification = Notification{Channel: NotificationSMS, Recipient: message.PhoneNumber, Body: rendered.SMS}
+	}
+	if !message.ExpiresAt.IsZero() {
+		notification.ExpiresAt = null.TimeFrom(message.ExpiresAt)
+	}
+
+	return QueueNotification(db, message.Lang, notification)
+}
+
+// QueueLoginAlert - renders the login alert email and queues it
+func QueueLoginAlert(db Database, alert LoginAlert) *Error {
+
+	rendered, err := emailTemplates().Render(alert.Lang, TemplateLoginAlert, alert)
+	if err != nil {
+		return NewErrorWithMessage(ErrorInternalServerError, err.Error())
+	}
+
+	return QueueNotification(db, alert.Lang, Notification{Channel: NotificationEmail, Recipient: alert.Email, Subject: rendered.Subject, Body: rendered.HTML, TextBody: rendered.Text})
+}
+
+// QueuePush - queues a push notification to every device of the user
+func QueuePush(db Database, lang string, userID interface{}, title string, body string) *Error {
+
+	tokens, err := db.GetPushTokensForUserID(userID, lang)
+	if err != nil {
+		return err
+	}
+
+	for _, token := range tokens {
+		err = QueueNotification(db, lang, Notification{Channel: NotificationPush, Recipient: token.PushToken, Subject: title, Body: body})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//######## DISPATCHER
+
+// NotificationDispatcher - delivers queued notifications with a pool of workers.
+// Failed deliveries are retried with exponential backoff and marked failed after MaxAttempts,
+// several dispatchers (processes) can share the outbox, every attempt is claimed by one of them
+type NotificationDispatcher struct {
+	DB        Database
+	Notifiers map[string]Notifier
+
+	//Workers - notifications delivered concurrently
+	Workers int
+
+	//BatchSize - notifications claimed per poll
+	BatchSize int
+
+	//PollInterval - how often the outbox is checked, queued notifications wake the dispatcher
+	PollInterval time.Duration
+
+	MaxAttempts int
+
+	//RetryTime - wait after the first failure, doubles with every further failure up to MaxRetryTime
+	RetryTime    time.Duration
+	MaxRetryTime time.Duration
+
+	//LeaseTime - a claimed notification is retried after this if the process died while sending it
+	LeaseTime time.Duration
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewNotificationDispatcher - creates a dispatcher with notifiers for the configured channels,
+// email is always available, sms when an SMSSender is configured and push with an FCM server key
+func NewNotificationDispatcher(db Database, config *Configuration) *NotificationDispatcher {
+
+	notifiers := map[string]Notifier{NotificationEmail: &EmailNotifier{}}
+	if config.SMSSender != nil {
+		notifiers[NotificationSMS] = &SMSNotifier{Sender: config.SMSSender}
+	}
+	if !IsEmptyString(config.FCMServerKey) {
+		notifiers[NotificationPush] = &FCMNotifier{ServerKey: config.FCMServerKey}
+	}
+
+	return &NotificationDispatcher{
+		DB:           db,
+		Notifiers:    notifiers,
+		Workers:      config.NotificationWorkers,
+		BatchSize:    100,
+		PollInterval: time.Duration(config.NotificationPollInterval) * time.Second,
+		MaxAttempts:  config.NotificationMaxAttempts,
+		RetryTime:    time.Duration(config.NotificationRetryTime) * time.Second,
+		MaxRetryTime: time.Duration(config.NotificationMaxRetryTime) * time.Second,
+		LeaseTime:    5 * time.Minute,
+	}
+}
+
+// Start - delivers notifications in the background until Stop
+func (d *NotificationDispatcher) Start() {
+
+	d.stop = make(chan struct{})
+	d.done = make(chan struct{})
+
+	pollInterval := d.PollInterval
+	if pollInterval <= 0 {
+		pollInterval = 5 * time.Second
+	}
+
+	go func() {
+		defer close(d.done)
+
+		ticker := time.NewTicker(pollInterval)
+		defer ticker.Stop()
+
+		for {
+			d.RunOnce()
+
+			select {
+			case <-d.stop:
+				return
+			case <-ticker.C:
+			case <-notificationWake:
+			}
+		}
+	}()
+
+	LogInfof("Notifications: dispatcher started with %d workers", d.workers())
+}
+
+// Stop - stops polling and waits for deliveries in progress
+func (d *NotificationDispatcher) Stop() {
+	if d.stop == nil {
+		return
+	}
+
+	close(d.stop)
+	<-d.done
+	d.stop = nil
+}
+
+// workers - at least one
+func (d *NotificationDispatcher) workers() int {
+	if d.Workers <= 0 {
+		return 1
+	}
+	return d.Workers
+}
+
+// RunOnce - delivers the due notifications, returns how many were attempted
+func (d *NotificationDispatcher) RunOnce() int {
+
+	if err := d.DB.ExpireNotifications(TimeNow(), LanguageEN); err != nil {
+		LogErrorf("Notifications: error expiring notifications: %s", err.Message)
+	}
+
+	due, err := d.DB.GetDueNotifications(TimeNow(), d.BatchSize, LanguageEN)
+	if err != nil {
+		LogErrorf("Notifications: error getting due notifications: %s", err.Message)
+		return 0
+	}
+
+	if len(due) == 0 {
+		return 0
+	}
+
+	var attempted int32
+	var wg sync.WaitGroup
+	jobs := make(chan Notification)
+
+	for i := 0; i < d.workers(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for notification := range jobs {
+				if d.deliver(notification) {
+					atomic.AddInt32(&attempted, 1)
+				}
+			}
+		}()
+	}
+
+	for _, notification := range due {
+		jobs <- notification
+	}
+	close(jobs)
+	wg.Wait()
+
+	return int(attempted)
+}
+
+// retryDelay - exponential backoff after the nth failed attempt
+func (d *NotificationDispatcher) retryDelay(attempts int) time.Duration {
+
+	delay := d.RetryTime
+	for i := 1; i < attempts; i++ {
+		if d.MaxRetryTime > 0 && delay >= d.MaxRetryTime {
+			break
+		}
+		delay *= 2
+	}
+
+	if d.MaxRetryTime > 0 && delay > d.MaxRetryTime {
+		delay = d.MaxRetryTime
+	}
+
+	return delay
+}
+
+// deliver - claims and sends the notification, returns false if another worker claimed it
+func (d *NotificationDispatcher) deliver(notification Notification) bool {
+
+	lang := LanguageEN
+
+	claimed, err := d.DB.ClaimNotification(notification.ID, notification.Attempts, TimeNow().Add(d.LeaseTime), lang)
+	if err != nil {
+		LogErrorf("Notifications: error claiming notification %v: %s", notification.ID, err.Message)
+		return false
+	}
+	if !claimed {
+		return false
+	}
+	notification.Attempts++
+
+	//bodies are cleared once done, they can contain otp codes
+	done := Map{"body": "", "text_body": "", "updated_at": TimeNow()}
+
+	if notification.ExpiresAt.Valid && notification.ExpiresAt.Time.Before(TimeNow()) {
+		done["status"] = NotificationExpired
+		d.update(notification, done)
+		return true
+	}
+
+	var sendErr error
+	notifier, ok := d.Notifiers[notification.Channel]
+	if !ok {
+		sendErr = fmt.Errorf("no notifier for channel %s", notification.Channel)
+	} else if sendErr = d.openBodies(&notification); sendErr == nil {
+		sendErr = notifier.Notify(notification)
+	}
+
+	if sendErr == nil {
+		done["status"] = NotificationSent
+		done["sent_at"] = TimeNow()
+		done["last_error"] = ""
+		d.update(notification, done)
+		return true
+	}
+
+	if notification.Attempts >= d.MaxAttempts {
+		LogErrorf("Notifications: %s to %s failed after %d attempts: %s", notification.Channel, notification.Recipient, notification.Attempts, sendErr)
+		done["status"] = NotificationFailed
+		done["last_error"] = sendErr.Error()
+		d.update(notification, done)
+		return true
+	}
+
+	d.update(notification, Map{
+		"status":          NotificationPending,
+		"last_error":      sendErr.Error(),
+		"next_attempt_at": TimeNow().Add(d.retryDelay(notification.Attempts)),
+		"updated_at":      TimeNow(),
+	})
+
+	return true
+}
+
+// openBodies - decrypts the bodies of the notification
+func (d *NotificationDispatcher) openBodies(notification *Notification) error {
+
+	var err error
+	if notification.Body, err = openNotificationBody(notification.Body); err != nil {
+		return err
+	}
+	notification.TextBody, err = openNotificationBody(notification.TextBody)
+
+	return err
+}
+
+// update - saves the delivery result
+func (d *NotificationDispatcher) update(notification Notification, columns Map) {
+	if err := d.DB.UpdateNotificationByID(notification.ID, columns, LanguageEN); err != nil {
+		LogErrorf("Notifications: error updating notification %v: %s", notification.ID, err.Message)
+	}
+}
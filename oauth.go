@@ -0,0 +1,833 @@
+package ngauth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	htmltemplate "html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"gopkg.in/guregu/null.v3"
+)
+
+// OAuth 2.0 authorization server, https://tools.ietf.org/html/rfc6749
+// only the authorization code grant with PKCE (RFC 7636, S256) is available to users, codes are exchanged at
+// the token endpoint and the tokens are refreshed there with the refresh_token grant.
+// Clients are registered with RegisterOAuthClient, public clients (SPAs, mobile apps) have no secret.
+// Machine clients (upstream services) get access tokens of their own with the client_credentials grant,
+// devices without a keyboard (TVs, POS terminals) use the device authorization grant, see device.go
+
+// grant types of the token endpoint
+const (
+	GrantTypeAuthorizationCode = "authorization_code"
+	GrantTypeRefreshToken      = "refresh_token"
+	GrantTypeClientCredentials = "client_credentials"
+	GrantTypeDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+)
+
+// grantTypes - grant types a client can be registered with
+var grantTypes = []string{GrantTypeAuthorizationCode, GrantTypeRefreshToken, GrantTypeClientCredentials, GrantTypeDeviceCode}
+
+// defaultGrantTypes - grant types of clients registered without grant_types
+const defaultGrantTypes = GrantTypeAuthorizationCode + " " + GrantTypeRefreshToken
+
+// pkceMethodS256 - the only code_challenge_method accepted, plain is not allowed
+const pkceMethodS256 = "S256"
+
+// pkceVerifierPattern - code_verifier and code_challenge, 43-128 unreserved characters
+var pkceVerifierPattern = regexp.MustCompile(`^[A-Za-z0-9\-._~]{43,128}$`)
+
+// oauthErrors - oauth error codes (RFC 6749 sections 4.1.2.1 and 5.2, RFC 8628 section 3.5) and http status of the API errors
+var oauthErrors = map[int]struct {
+	code   string
+	status int
+}{
+	ErrorInvalidClient:           {"invalid_client", http.StatusUnauthorized},
+	ErrorInvalidGrant:            {"invalid_grant", http.StatusBadRequest},
+	ErrorInvalidToken:            {"invalid_grant", http.StatusBadRequest},
+	ErrorAccountLocked:           {"invalid_grant", http.StatusBadRequest},
+	ErrorUserNotFound:            {"invalid_grant", http.StatusBadRequest},
+	ErrorUnsupportedGrantType:    {"unsupported_grant_type", http.StatusBadRequest},
+	ErrorUnsupportedResponseType: {"unsupported_response_type", http.StatusBadRequest},
+	ErrorInvalidScope:            {"invalid_scope", http.StatusBadRequest},
+	ErrorAccessDenied:            {"access_denied", http.StatusBadRequest},
+	ErrorUnauthorizedClient:      {"unauthorized_client", http.StatusBadRequest},
+	ErrorAuthorizationPending:    {"authorization_pending", http.StatusBadRequest},
+	ErrorSlowDown:                {"slow_down", http.StatusBadRequest},
+	ErrorExpiredToken:            {"expired_token", http.StatusBadRequest},
+	ErrorNotAuthorized:           {"unauthorized_client", http.StatusBadRequest},
+	ErrorInternalServerError:     {"server_error", http.StatusInternalServerError},
+	ErrorDBError:                 {"server_error", http.StatusInternalServerError},
+}
+
+// OAuthError - oauth error code and http status for the API error, invalid_request for the validation errors
+func OAuthError(err *Error) (string, int) {
+	if oauthErr, ok := oauthErrors[err.Code]; ok {
+		return oauthErr.code, oauthErr.status
+	}
+	return "invalid_request", http.StatusBadRequest
+}
+
+// generateOAuthToken - random base64url value of authorization codes and client secrets
+func generateOAuthToken() string {
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// hashOAuthCode - codes are saved as sha256 hashes, they are random so no salt is needed
+func hashOAuthCode(code string) string {
+	hash := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(hash[:])
+}
+
+// clientSecretPrefix - marks client secrets saved as sha256 hashes, secrets without it are
+// PwdHashFunc hashes of clients registered by older versions
+const clientSecretPrefix = "s1:"
+
+// hashClientSecret - client secrets are random like the codes, sha256 is enough and fast to check
+func hashClientSecret(secret string) string {
+	return clientSecretPrefix + hashOAuthCode(secret)
+}
+
+// isValidClientSecret - compares the hash of the secret with the client secret in constant time
+func isValidClientSecret(client *OAuthClient, secret string, pwdCheckCallback PwdCheckFunc) bool {
+
+	if strings.HasPrefix(client.ClientSecret, clientSecretPrefix) {
+		return subtle.ConstantTimeCompare([]byte(client.ClientSecret), []byte(hashClientSecret(secret))) == 1
+	}
+
+	//registered by an older version
+	return pwdCheckCallback != nil && pwdCheckCallback(client.ClientSecret, secret)
+}
+
+// pkceChallenge - S256 code_challenge of the code_verifier
+func pkceChallenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// scopesAllowed - every requested scope is in allowed, an empty allowed list allows any scope
+func scopesAllowed(requested string, allowed string) bool {
+
+	allowedScopes := strings.Fields(allowed)
+	if len(allowedScopes) == 0 {
+		return true
+	}
+
+	for _, scope := range strings.Fields(requested) {
+		if !ArrayContains(scope, allowedScopes) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// IsValidRedirectURI - redirect uris of clients are absolute without a fragment, http is only allowed
+// for loopback addresses (native apps) and private-use schemes like com.example.app:/callback are allowed
+func IsValidRedirectURI(redirectURI string) bool {
+
+	u, err := url.Parse(redirectURI)
+	if err != nil || !u.IsAbs() || !IsEmptyString(u.Fragment) || strings.Contains(redirectURI, "#") {
+		return false
+	}
+
+	switch strings.ToLower(u.Scheme) {
+	case "https":
+		return !IsEmptyString(u.Hostname())
+	case "http":
+		host := u.Hostname()
+		if host == "localhost" {
+			return true
+		}
+		ip := net.ParseIP(host)
+		return ip != nil && ip.IsLoopback()
+	case "javascript", "data", "vbscript", "file":
+		return false
+	}
+
+	return true
+}
+
+//######## CLIENTS
+
+// stringList - array or space separated string param
+func stringList(param interface{}) []string {
+
+	var list []string
+	if values, ok := param.([]interface{}); ok {
+		for _, value := range values {
+			list = append(list, GetStringOrEmpty(value))
+		}
+	} else if values, ok := param.([]string); ok {
+		list = values
+	} else {
+		list = strings.Fields(GetStringOrEmpty(param))
+	}
+
+	return list
+}
+
+// RegisterOAuthClient - registers a client with the name, redirect_uris, grant_types (arrays or space separated) and
+// the allowed scopes. The client_secret of confidential clients is only returned here, public clients have none.
+// grant_types defaults to authorization_code and refresh_token, only authorization_code clients need redirect_uris
+// and client_credentials clients can not be public
+func RegisterOAuthClient(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	name := GetStringOrEmpty(params["name"])
+	scopes := strings.Join(strings.Fields(GetStringOrEmpty(params["scopes"])), " ")
+	public := GetBoolOrFalse(params["public"])
+	redirectURIs := stringList(params["redirect_uris"])
+
+	clientGrantTypes := stringList(params["grant_types"])
+	if len(clientGrantTypes) == 0 {
+		clientGrantTypes = strings.Fields(defaultGrantTypes)
+	}
+
+	for _, grantType := range clientGrantTypes {
+		if !ArrayContains(grantType, grantTypes) {
+			return nil, NewError(lang, ErrorUnsupportedGrantType)
+		}
+	}
+
+	//the authorization code flow redirects back to the client
+	authorizationCode := ArrayContains(GrantTypeAuthorizationCode, clientGrantTypes)
+
+	//check for empty fields
+	if IsEmptyTextContent(name) || (authorizationCode && len(redirectURIs) == 0) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	//machine clients authenticate with their secret
+	if public && ArrayContains(GrantTypeClientCredentials, clientGrantTypes) {
+		return nil, NewError(lang, ErrorUnauthorizedClient)
+	}
+
+	for _, uri := range redirectURIs {
+		if !IsValidRedirectURI(uri) {
+			return nil, NewError(lang, ErrorInvalidRedirectURI)
+		}
+	}
+
+	client := OAuthClient{ClientID: GenerateUUID(), Name: name, RedirectURIs: strings.Join(redirectURIs, " "), Scopes: scopes,
+		GrantTypes: strings.Join(clientGrantTypes, " "), CreatedAt: null.TimeFrom(TimeNow())}
+
+	secret := ""
+	if !public {
+		secret = generateOAuthToken()
+		client.ClientSecret = hashClientSecret(secret)
+	}
+
+	result, err := db.CreateOAuthClient(client, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["code"] = http.StatusCreated
+	response["success"] = true
+	response["id"] = result
+	response["client_id"] = client.ClientID
+	response["client_secret"] = secret
+	response["name"] = client.Name
+	response["redirect_uris"] = redirectURIs
+	response["scopes"] = client.Scopes
+	response["grant_types"] = clientGrantTypes
+
+	return response, nil
+}
+
+// authenticateOAuthClient - client_id and client_secret of a token request,
+// public clients send the client_id only. pwdCheckCallback checks the secrets of clients registered by older versions
+func authenticateOAuthClient(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) (*OAuthClient, *Error) {
+
+	clientID := GetStringOrEmpty(params["client_id"])
+	clientSecret := GetStringOrEmpty(params["client_secret"])
+
+	if IsEmptyTextContent(clientID) {
+		return nil, NewError(lang, ErrorInvalidClient)
+	}
+
+	client, err := db.GetOAuthClient(clientID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if client == nil {
+		return nil, NewError(lang, ErrorInvalidClient)
+	}
+
+	//public client
+	if IsEmptyString(client.ClientSecret) {
+		if !IsEmptyString(clientSecret) {
+			return nil, NewError(lang, ErrorInvalidClient)
+		}
+		return client, nil
+	}
+
+	if IsEmptyString(clientSecret) || !isValidClientSecret(client, clientSecret, pwdCheckCallback) {
+		return nil, NewError(lang, ErrorInvalidClient)
+	}
+
+	return client, nil
+}
+
+//######## AUTHORIZATION ENDPOINT
+
+// AuthorizeRequest - parameters of an authorization request
+type AuthorizeRequest struct {
+	Client *OAuthClient
+
+	ResponseType        string
+	RedirectURI         string
+	Scope               string
+	State               string
+	CodeChallenge       string
+	CodeChallengeMethod string
+
+	//Nonce - OpenID Connect, copied to the id token
+	Nonce string
+}
+
+// ParseAuthorizeRequest - reads the request and checks the client_id and redirect_uri.
+// These errors have to be shown to the user, the other parameters are checked by Validate
+// and their errors are sent to the client with ErrorURL
+func ParseAuthorizeRequest(db Database, lang string, params map[string]interface{}) (*AuthorizeRequest, *Error) {
+
+	clientID := GetStringOrEmpty(params["client_id"])
+	redirectURI := GetStringOrEmpty(params["redirect_uri"])
+
+	if IsEmptyTextContent(clientID) {
+		return nil, NewError(lang, ErrorInvalidClient)
+	}
+
+	client, err := db.GetOAuthClient(clientID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if client == nil {
+		return nil, NewError(lang, ErrorInvalidClient)
+	}
+
+	//machine clients
+	if !ArrayContains(GrantTypeAuthorizationCode, strings.Fields(client.GrantTypes)) {
+		return nil, NewError(lang, ErrorUnauthorizedClient)
+	}
+
+	//exact match only
+	if IsEmptyString(redirectURI) || !ArrayContains(redirectURI, strings.Fields(client.RedirectURIs)) {
+		return nil, NewError(lang, ErrorInvalidRedirectURI)
+	}
+
+	return &AuthorizeRequest{
+		Client:              client,
+		ResponseType:        GetStringOrEmpty(params["response_type"]),
+		RedirectURI:         redirectURI,
+		Scope:               strings.Join(strings.Fields(GetStringOrEmpty(params["scope"])), " "),
+		State:               GetStringOrEmpty(params["state"]),
+		CodeChallenge:       GetStringOrEmpty(params["code_challenge"]),
+		CodeChallengeMethod: GetStringOrEmpty(params["code_challenge_method"]),
+		Nonce:               GetStringOrEmpty(params["nonce"]),
+	}, nil
+}
+
+// Validate - checks the response_type, the PKCE code_challenge and the scope
+func (r *AuthorizeRequest) Validate(lang string) *Error {
+
+	if r.ResponseType != "code" {
+		return NewError(lang, ErrorUnsupportedResponseType)
+	}
+
+	if !pkceVerifierPattern.MatchString(r.CodeChallenge) {
+		return NewErrorWithMessage(ErrorWrongValueFor, ErrorText(lang, ErrorWrongValueFor)+"code_challenge")
+	}
+
+	if r.CodeChallengeMethod != pkceMethodS256 {
+		return NewErrorWithMessage(ErrorWrongValueFor, ErrorText(lang, ErrorWrongValueFor)+"code_challenge_method")
+	}
+
+	//OpenID Connect scopes are allowed for every client
+	if !scopesAllowed(withoutOIDCScopes(r.Scope), r.Client.Scopes) || !oidcScopesAllowed(r.Scope) {
+		return NewError(lang, ErrorInvalidScope)
+	}
+
+	return nil
+}
+
+// Params - parameters of the request, posted back by the login page
+func (r *AuthorizeRequest) Params() map[string]string {
+	return map[string]string{
+		"client_id":             r.Client.ClientID,
+		"response_type":         r.ResponseType,
+		"redirect_uri":          r.RedirectURI,
+		"scope":                 r.Scope,
+		"state":                 r.State,
+		"code_challenge":        r.CodeChallenge,
+		"code_challenge_method": r.CodeChallengeMethod,
+		"nonce":                 r.Nonce,
+	}
+}
+
+// redirectURL - redirect_uri with the response parameters and the state added to its query
+func (r *AuthorizeRequest) redirectURL(values url.Values) string {
+
+	if !IsEmptyString(r.State) {
+		values.Set("state", r.State)
+	}
+
+	u, err := url.Parse(r.RedirectURI)
+	if err != nil {
+		return r.RedirectURI
+	}
+
+	query := u.Query()
+	for k, v := range values {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// ErrorURL - redirect_uri with the oauth error of err
+func (r *AuthorizeRequest) ErrorURL(err *Error) string {
+	code, _ := OAuthError(err)
+	return r.redirectURL(url.Values{"error": {code}, "error_description": {err.Message}})
+}
+
+// Authorize - logs the user in with the credentials posted by the login page (see Login) and issues
+// an authorization code, returns the redirect_uri with the code. username is the email or
+// a phone number in international format, unless country_code is given.
+// When two-factor authentication is enabled, ErrorTOTPRequired is returned until code or recovery_code is posted
+func Authorize(db Database, lang string, request *AuthorizeRequest, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) (string, *Error) {
+
+	if request == nil || pwdCheckCallback == nil {
+		return "", NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	err := request.Validate(lang)
+	if err != nil {
+		return "", err
+	}
+
+	user, err := loginPageUser(db, lang, params, pwdCheckCallback)
+	if err != nil {
+		return "", err
+	}
+
+	code := generateOAuthToken()
+	oauthCode := OAuthCode{
+		CodeHash:            hashOAuthCode(code),
+		ClientID:            request.Client.ClientID,
+		UserID:              user.ID,
+		RedirectURI:         request.RedirectURI,
+		Scope:               request.Scope,
+		CodeChallenge:       request.CodeChallenge,
+		CodeChallengeMethod: request.CodeChallengeMethod,
+		Nonce:               request.Nonce,
+		FamilyID:            GenerateUUID(),
+		ExpiresAt:           null.TimeFrom(TimeNow().Add(time.Duration(Config.OAuthCodeExpireMins) * time.Minute)),
+		CreatedAt:           null.TimeFrom(TimeNow()),
+	}
+
+	_, err = db.CreateOAuthCode(oauthCode, lang)
+	if err != nil {
+		return "", err
+	}
+
+	return request.redirectURL(url.Values{"code": {code}}), nil
+}
+
+// loginPageUser - authenticates the username (email or phone number) and password posted by a login page,
+// ErrorTOTPRequired is returned until the code or recovery_code of users with two-factor authentication is posted
+func loginPageUser(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) (*User, *Error) {
+
+	username := strings.TrimSpace(GetStringOrEmpty(params["username"]))
+	countryCode := GetStringOrEmpty(params["country_code"])
+
+	loginParams := Map{"password": params["password"], "ip_addr": params["ip_addr"]}
+	if strings.Contains(username, "@") {
+		loginParams["email"] = username
+	} else {
+		//international format, the region is taken from the number
+		if IsEmptyString(countryCode) {
+			if !strings.HasPrefix(username, "+") {
+				return nil, NewError(lang, ErrorInvalidPhoneNumber)
+			}
+			countryCode = "ZZ"
+		}
+		loginParams["phone_number"] = username
+		loginParams["country_code"] = countryCode
+	}
+
+	user, err := authenticateUser(db, lang, loginParams, pwdCheckCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	//second factor
+	if user.TOTPEnabledAt.Valid {
+		code := GetStringOrEmpty(params["code"])
+		recoveryCode := GetStringOrEmpty(params["recovery_code"])
+
+		if IsEmptyTextContent(code) && IsEmptyTextContent(recoveryCode) {
+			return nil, NewError(lang, ErrorTOTPRequired)
+		}
+
+		err = verifySecondFactor(db, lang, user, code, recoveryCode, GetStringOrEmpty(params["ip_addr"]), pwdCheckCallback)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return user, nil
+}
+
+//######## TOKEN ENDPOINT
+
+// OAuthToken - token endpoint, authenticates the client and issues tokens for the grant_type.
+// The response is the RFC 6749 token response, errors are sent with OAuthErrorResponse
+func OAuthToken(db Database, lang string, params map[string]interface{}, pwdCheckCallback PwdCheckFunc) (map[string]interface{}, *Error) {
+
+	if pwdCheckCallback == nil {
+		return nil, NewError(lang, ErrorMissingFunctionParams)
+	}
+
+	grantType := GetStringOrEmpty(params["grant_type"])
+
+	//check for empty fields
+	if IsEmptyTextContent(grantType) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	if !ArrayContains(grantType, grantTypes) {
+		return nil, NewError(lang, ErrorUnsupportedGrantType)
+	}
+
+	client, err := authenticateOAuthClient(db, lang, params, pwdCheckCallback)
+	if err != nil {
+		return nil, err
+	}
+
+	//not registered for the grant type
+	if !ArrayContains(grantType, strings.Fields(client.GrantTypes)) {
+		return nil, NewError(lang, ErrorUnauthorizedClient)
+	}
+
+	switch grantType {
+	case GrantTypeAuthorizationCode:
+		return oauthAuthorizationCodeGrant(db, lang, client, params)
+	case GrantTypeRefreshToken:
+		return oauthRefreshTokenGrant(db, lang, client, params)
+	case GrantTypeDeviceCode:
+		return oauthDeviceCodeGrant(db, lang, client, params)
+	}
+
+	return oauthClientCredentialsGrant(db, lang, client, params)
+}
+
+// oauthAuthorizationCodeGrant - exchanges an authorization code, with the code_verifier of its code_challenge
+func oauthAuthorizationCodeGrant(db Database, lang string, client *OAuthClient, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	code := GetStringOrEmpty(params["code"])
+	redirectURI := GetStringOrEmpty(params["redirect_uri"])
+	codeVerifier := GetStringOrEmpty(params["code_verifier"])
+
+	//check for empty fields
+	if IsEmptyTextContent(code) || IsEmptyTextContent(redirectURI) || IsEmptyTextContent(codeVerifier) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	oauthCode, err := db.GetOAuthCode(hashOAuthCode(code), lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//issued to another client
+	if oauthCode == nil || oauthCode.ClientID != client.ClientID {
+		return nil, NewError(lang, ErrorInvalidGrant)
+	}
+
+	//used twice, the code has probably been stolen. Revoke the tokens issued with it
+	if oauthCode.UsedAt.Valid {
+		LogInfof("OAuth: reuse of authorization code, revoking session family %s", oauthCode.FamilyID)
+		err = db.RevokeSessionFamily(oauthCode.FamilyID, lang)
+		if err != nil {
+			return nil, err
+		}
+		return nil, NewError(lang, ErrorInvalidGrant)
+	}
+
+	if !oauthCode.ExpiresAt.Valid || oauthCode.ExpiresAt.Time.Before(TimeNow()) {
+		return nil, NewError(lang, ErrorInvalidGrant)
+	}
+
+	if oauthCode.RedirectURI != redirectURI {
+		return nil, NewError(lang, ErrorInvalidGrant)
+	}
+
+	//PKCE
+	if !pkceVerifierPattern.MatchString(codeVerifier) || subtle.ConstantTimeCompare([]byte(pkceChallenge(codeVerifier)), []byte(oauthCode.CodeChallenge)) != 1 {
+		return nil, NewError(lang, ErrorInvalidGrant)
+	}
+
+	err = db.UseOAuthCode(oauthCode.ID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := db.GetUserByID(oauthCode.UserID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	//locked after the code was issued
+	if user.LockedUntil.Valid && user.LockedUntil.Time.After(TimeNow()) {
+		return nil, accountLockedError(lang, user.LockedUntil.Time)
+	}
+
+	//refresh token
+	refreshToken, err := GenerateRefreshToken(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	//save refresh token to db, in the family of the code
+	session := Session{UserID: user.ID, RefreshToken: refreshToken, FamilyID: oauthCode.FamilyID, CreatedAt: null.TimeFrom(TimeNow()), ClientID: client.ClientID, Scope: oauthCode.Scope,
+		IPAddr: GetStringOrEmpty(params["ip_addr"]), UserAgent: GetStringOrEmpty(params["user_agent"])}
+	_, err = db.CreateSession(session, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//the user logged in when the code was issued
+	return oauthTokenResponse(&session, user, oauthCode.Nonce, oauthCode.CreatedAt.Time.Unix())
+}
+
+// oauthRefreshTokenGrant - new access token for a session of the client, the scope can be narrowed.
+// Refresh tokens of public clients are always rotated
+func oauthRefreshTokenGrant(db Database, lang string, client *OAuthClient, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	refreshToken := GetStringOrEmpty(params["refresh_token"])
+	scope := strings.Join(strings.Fields(GetStringOrEmpty(params["scope"])), " ")
+
+	session, err := getRefreshSession(db, lang, refreshToken)
+	if err != nil {
+		return nil, err
+	}
+
+	//issued to another client or by /login
+	if session.ClientID != client.ClientID {
+		return nil, NewError(lang, ErrorInvalidGrant)
+	}
+
+	if IsEmptyString(scope) {
+		scope = session.Scope
+	} else if IsEmptyString(session.Scope) || !scopesAllowed(scope, session.Scope) {
+		return nil, NewError(lang, ErrorInvalidScope)
+	}
+
+	refreshed := *session
+	refreshed.Scope = scope
+
+	if Config.JWTRefreshRotation || IsEmptyString(client.ClientSecret) {
+
+		refreshed.RefreshToken, err = rotateSession(db, lang, session, GetStringOrEmpty(params["ip_addr"]), GetStringOrEmpty(params["user_agent"]))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	user, err := db.GetUserByID(session.UserID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	response, err := oauthTokenResponse(&refreshed, user, "", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	//the refresh token did not change
+	if refreshed.RefreshToken == session.RefreshToken {
+		delete(response, "refresh_token")
+	}
+
+	return response, nil
+}
+
+// oauthClientCredentialsGrant - access token of a machine client, its sub is the client_id and it has no id claim,
+// so it is not accepted where a user is required. The scope defaults to the client scopes, there is no refresh token
+func oauthClientCredentialsGrant(db Database, lang string, client *OAuthClient, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	scope := strings.Join(strings.Fields(GetStringOrEmpty(params["scope"])), " ")
+
+	if IsEmptyString(scope) {
+		scope = client.Scopes
+	} else if !scopesAllowed(scope, client.Scopes) {
+		return nil, NewError(lang, ErrorInvalidScope)
+	}
+
+	claims := map[string]interface{}{"token_use": TokenUseAccess, "sub": client.ClientID, "client_id": client.ClientID}
+	if !IsEmptyString(scope) {
+		claims["scope"] = scope
+	}
+
+	accessToken, err := GenerateToken(nil, Config.JWTAccessExpireMins, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["access_token"] = accessToken
+	response["token_type"] = "Bearer"
+	response["expires_in"] = Config.JWTAccessExpireMins * 60
+	if !IsEmptyString(scope) {
+		response["scope"] = scope
+	}
+
+	return response, nil
+}
+
+// oauthTokenResponse - access token of the session, with the client_id and scope claims.
+// An id token of the user is added for the openid scope
+func oauthTokenResponse(session *Session, user *User, nonce string, authTime int64) (map[string]interface{}, *Error) {
+
+	claims := map[string]interface{}{"token_use": TokenUseAccess, "client_id": session.ClientID}
+	if !IsEmptyString(session.Scope) {
+		claims["scope"] = session.Scope
+	}
+
+	accessToken, err := GenerateToken(session.UserID, Config.JWTAccessExpireMins, claims)
+	if err != nil {
+		return nil, err
+	}
+
+	//Prepare the response
+	response := make(map[string]interface{})
+	response["access_token"] = accessToken
+	response["token_type"] = "Bearer"
+	response["expires_in"] = Config.JWTAccessExpireMins * 60
+	response["refresh_token"] = session.RefreshToken
+	if !IsEmptyString(session.Scope) {
+		response["scope"] = session.Scope
+	}
+
+	if hasScope(session.Scope, ScopeOpenID) {
+		idToken, err := GenerateIDToken(user, session.ClientID, session.Scope, nonce, authTime)
+		if err != nil {
+			return nil, err
+		}
+		response["id_token"] = idToken
+	}
+
+	return response, nil
+}
+
+//######## LOGIN PAGE
+
+// AuthorizePage - data of the login/consent page of the authorization endpoint and of the device verification page,
+// Params are the AuthorizeRequest/DeviceRequest params. Without Params, only the Error is shown
+type AuthorizePage struct {
+	Lang         string
+	ClientName   string
+	Scopes       []string
+	Params       map[string]string
+	Username     string
+	TOTPRequired bool
+	Error        string
+
+	//UserCodeRequired - asks for the user code of a device first
+	UserCodeRequired bool
+
+	//Result - approved or denied, shown after the user decided on a device
+	Result string
+}
+
+// authorizePageText - labels of the login page
+var authorizePageText = map[string]map[string]string{
+	LanguageEN: {"title": "Sign in", "wants_access": "wants to access your account", "scopes": "Requested permissions", "username": "Email or phone number", "password": "Password", "code": "Authentication code", "allow": "Sign in and allow", "deny": "Deny",
+		"user_code": "Code shown on your device", "continue": "Continue", "approved": "Your device is signed in, you can return to it now", "denied": "The device was denied access"},
+	LanguageSW: {"title": "Ingia", "wants_access": "inaomba kutumia akaunti yako", "scopes": "Ruhusa zinazoombwa", "username": "Barua pepe au namba ya simu", "password": "Neno la siri", "code": "Namba ya uthibitisho", "allow": "Ingia na ruhusu", "deny": "Kataa",
+		"user_code": "Namba inayoonekana kwenye kifaa chako", "continue": "Endelea", "approved": "Kifaa chako kimeingia, unaweza kurudi kwenye kifaa sasa", "denied": "Kifaa kimenyimwa ruhusa"},
+	LanguageTR: {"title": "Giriş yap", "wants_access": "hesabınıza erişmek istiyor", "scopes": "İstenen izinler", "username": "E-posta veya telefon numarası", "password": "Şifre", "code": "Doğrulama kodu", "allow": "Giriş yap ve izin ver", "deny": "Reddet",
+		"user_code": "Cihazınızda görünen kod", "continue": "Devam", "approved": "Cihazınızda oturum açıldı, şimdi cihaza geri dönebilirsiniz", "denied": "Cihazın erişimi reddedildi"},
+}
+
+// authorizePageTemplate - the form posts to the current url, ie POST /oauth/authorize or POST /device
+var authorizePageTemplate = htmltemplate.Must(htmltemplate.New("authorize").Parse(`<!DOCTYPE html>
+<html lang="{{.Lang}}">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Text.title}}</title>
+<style>body{font-family:sans-serif;max-width:360px;margin:40px auto;padding:0 16px}label,input,button{display:block;width:100%;box-sizing:border-box;margin-top:8px}.error{color:#b00020}</style>
+</head>
+<body>
+<h1>{{.Text.title}}</h1>
+{{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+{{if .Result}}<p>{{index .Text .Result}}</p>{{end}}
+{{if .UserCodeRequired}}
+<form method="get">
+<label>{{.Text.user_code}}<input name="user_code" autocomplete="off" autocapitalize="characters" required autofocus></label>
+<button type="submit">{{.Text.continue}}</button>
+</form>
+{{end}}
+{{if .Params}}
+<p><b>{{.ClientName}}</b> {{.Text.wants_access}}</p>
+{{if .Scopes}}<p>{{.Text.scopes}}:</p><ul>{{range .Scopes}}<li>{{.}}</li>{{end}}</ul>{{end}}
+<form method="post">
+{{range $name, $value := .Params}}<input type="hidden" name="{{$name}}" value="{{$value}}">
+{{end}}<label>{{.Text.username}}<input name="username" value="{{.Username}}" autocomplete="username" required></label>
+<label>{{.Text.password}}<input type="password" name="password" autocomplete="current-password" required></label>
+{{if .TOTPRequired}}<label>{{.Text.code}}<input name="code" autocomplete="one-time-code" inputmode="numeric" autofocus></label>
+{{end}}<button type="submit" name="action" value="allow">{{.Text.allow}}</button>
+<button type="submit" name="action" value="deny" formnovalidate>{{.Text.deny}}</button>
+</form>
+{{end}}
+</body>
+</html>
+`))
+
+// RenderAuthorizePage - writes the login/consent page in the page language, english if not supported
+func RenderAuthorizePage(w io.Writer, page AuthorizePage) error {
+
+	text, ok := authorizePageText[page.Lang]
+	if !ok {
+		page.Lang = LanguageEN
+		text = authorizePageText[LanguageEN]
+	}
+
+	return authorizePageTemplate.Execute(w, struct {
+		AuthorizePage
+		Text map[string]string
+	}{page, text})
+}
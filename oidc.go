@@ -0,0 +1,174 @@
+package ngauth
+
+import (
+	"net/url"
+	"strings"
+)
+
+// OpenID Connect provider, https://openid.net/specs/openid-connect-core-1_0.html
+// on top of the oauth authorization code flow: the openid scope adds an id token to the token response
+// and allows the access token at the userinfo endpoint. Config.JWTIssuer has to be the public url of ngauth,
+// id tokens are only issued with an asymmetric signing key so clients can verify them with the JWKS
+
+// OpenID Connect scopes, they can always be requested
+const (
+	ScopeOpenID  = "openid"
+	ScopeProfile = "profile"
+	ScopeEmail   = "email"
+	ScopePhone   = "phone"
+)
+
+// oidcScopes - standard scopes, not restricted by OAuthClient.Scopes
+var oidcScopes = []string{ScopeOpenID, ScopeProfile, ScopeEmail, ScopePhone}
+
+// hasScope - scope is one of the space separated scopes
+func hasScope(scopes string, scope string) bool {
+	return ArrayContains(scope, strings.Fields(scopes))
+}
+
+// oidcAvailable - id tokens are signed with an asymmetric key, clients verify them with the JWKS.
+// With an HMAC key they could only be verified with the secret that signs the access tokens
+func oidcAvailable() bool {
+
+	key, err := currentSigningKey()
+	return err == nil && !key.IsSymmetric()
+}
+
+// oidcScopesAllowed - the openid scope is only allowed when id tokens can be issued
+func oidcScopesAllowed(scopes string) bool {
+	return !hasScope(scopes, ScopeOpenID) || oidcAvailable()
+}
+
+// withoutOIDCScopes - the scopes that are not OpenID Connect scopes
+func withoutOIDCScopes(scopes string) string {
+
+	var others []string
+	for _, scope := range strings.Fields(scopes) {
+		if !ArrayContains(scope, oidcScopes) {
+			others = append(others, scope)
+		}
+	}
+
+	return strings.Join(others, " ")
+}
+
+// userClaims - standard claims of the user allowed by the scope, empty values are left out
+func userClaims(user *User, scope string) map[string]interface{} {
+
+	claims := make(map[string]interface{})
+
+	if hasScope(scope, ScopeProfile) {
+		if !IsEmptyString(user.Name) {
+			claims["name"] = user.Name
+		}
+		if !IsEmptyString(user.PhotoURL) {
+			claims["picture"] = user.PhotoURL
+		}
+	}
+
+	if hasScope(scope, ScopeEmail) && !IsEmptyString(user.Email) {
+		claims["email"] = user.Email
+		claims["email_verified"] = user.EmailVerifiedAt.Valid
+	}
+
+	if hasScope(scope, ScopePhone) && !IsEmptyString(user.PhoneNumber) {
+		claims["phone_number"] = user.PhoneNumber
+		claims["phone_number_verified"] = user.PhoneNumberVerifiedAt.Valid
+	}
+
+	return claims
+}
+
+// GenerateIDToken - id token of the user for the client, with the user claims of the scope.
+// nonce and authTime (unix time of the login) are left out when empty. Refused with an HMAC signing key
+func GenerateIDToken(user *User, clientID string, scope string, nonce string, authTime int64) (string, *Error) {
+
+	if !oidcAvailable() {
+		return "", NewErrorWithMessage(ErrorInternalServerError, "id tokens need an asymmetric signing key")
+	}
+
+	claims := userClaims(user, scope)
+	claims["token_use"] = TokenUseID
+	claims["aud"] = clientID
+	claims["azp"] = clientID
+
+	if !IsEmptyString(nonce) {
+		claims["nonce"] = nonce
+	}
+	if authTime > 0 {
+		claims["auth_time"] = authTime
+	}
+
+	return GenerateToken(user.ID, Config.JWTAccessExpireMins, claims)
+}
+
+// UserInfo - claims of the logged in user, the access token needs the openid scope
+func UserInfo(db Database, lang string, params map[string]interface{}) (map[string]interface{}, *Error) {
+
+	loggedInUserID := params["loggedin_user_id"]
+	scope := GetStringOrEmpty(params["scope"])
+
+	if loggedInUserID == nil {
+		return nil, NewError(lang, ErrorNotAuthorized)
+	}
+
+	//access tokens of /login have no scope
+	if !hasScope(scope, ScopeOpenID) {
+		return nil, NewError(lang, ErrorNotAuthorized)
+	}
+
+	user, err := db.GetUserByID(loggedInUserID, lang)
+	if err != nil {
+		return nil, err
+	}
+
+	//no record found
+	if user == nil {
+		return nil, NewError(lang, ErrorUserNotFound)
+	}
+
+	response := userClaims(user, scope)
+	response["sub"] = GetStringOrEmpty(user.ID)
+
+	return response, nil
+}
+
+// OpenIDConfiguration - provider metadata served at /.well-known/openid-configuration,
+// the endpoints are relative to Config.JWTIssuer. ErrorNotFound if the issuer is not an url
+// or the tokens are signed with an HMAC key, see oidcAvailable
+func OpenIDConfiguration(lang string) (map[string]interface{}, *Error) {
+
+	issuer := Config.JWTIssuer
+	if u, err := url.Parse(issuer); err != nil || !u.IsAbs() || IsEmptyString(u.Host) {
+		return nil, NewError(lang, ErrorNotFound)
+	}
+	baseURL := strings.TrimRight(issuer, "/")
+
+	key, keyErr := currentSigningKey()
+	if keyErr != nil {
+		return nil, NewErrorWithMessage(ErrorInternalServerError, keyErr.Error())
+	}
+	if key.IsSymmetric() {
+		return nil, NewError(lang, ErrorNotFound)
+	}
+
+	response := make(map[string]interface{})
+	response["issuer"] = issuer
+	response["authorization_endpoint"] = baseURL + "/oauth/authorize"
+	response["token_endpoint"] = baseURL + "/oauth/token"
+	response["device_authorization_endpoint"] = baseURL + "/device/code"
+	response["userinfo_endpoint"] = baseURL + "/userinfo"
+	response["introspection_endpoint"] = baseURL + "/introspect"
+	response["revocation_endpoint"] = baseURL + "/revoke"
+	response["jwks_uri"] = baseURL + "/.well-known/jwks.json"
+	response["response_types_supported"] = []string{"code"}
+	response["grant_types_supported"] = grantTypes
+	response["subject_types_supported"] = []string{"public"}
+	response["id_token_signing_alg_values_supported"] = []string{key.Method.Alg()}
+	response["scopes_supported"] = oidcScopes
+	response["claims_supported"] = []string{"sub", "iss", "aud", "exp", "iat", "auth_time", "nonce", "name", "picture", "email", "email_verified", "phone_number", "phone_number_verified"}
+	response["code_challenge_methods_supported"] = []string{pkceMethodS256}
+	response["token_endpoint_auth_methods_supported"] = []string{"client_secret_basic", "client_secret_post", "none"}
+
+	return response, nil
+}
@@ -0,0 +1,317 @@
+package ngauth
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SMS providers, set with SMS_PROVIDER
+const (
+	SMSProviderLog            = "log"
+	SMSProviderFile           = "file"
+	SMSProviderTwilio         = "twilio"
+	SMSProviderAfricasTalking = "africastalking"
+	SMSProviderVonage         = "vonage"
+)
+
+// SMSSender - sends text messages, phone number otp codes are sent with it
+type SMSSender interface {
+	SendSMS(toPhoneNo string, message string) error
+}
+
+// smsHTTPClient - used by the gateways when no Client is set
+var smsHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// NewSMSSender - creates the sender of the configured SMSProvider, nil without a provider.
+// log prints the messages, otp codes included, it has to be set explicitly
+func NewSMSSender(config *Configuration) (SMSSender, error) {
+
+	switch strings.ToLower(config.SMSProvider) {
+
+	case "":
+		return nil, nil
+
+	case SMSProviderLog:
+		return &LogSMSSender{}, nil
+
+	case SMSProviderFile:
+		if IsEmptyString(config.SMSFilePath) {
+			return nil, errors.New("SMS: SMS_FILE_PATH is empty")
+		}
+		return &FileSMSSender{Path: config.SMSFilePath}, nil
+
+	case SMSProviderTwilio:
+		if IsEmptyString(config.TwilioAccountSID) || IsEmptyString(config.TwilioAuthToken) {
+			return nil, errors.New("SMS: TWILIO_ACCOUNT_SID or TWILIO_AUTH_TOKEN is empty")
+		}
+		return &TwilioSMSSender{AccountSID: config.TwilioAccountSID, AuthToken: config.TwilioAuthToken, From: config.SMSFrom, BaseURL: config.SMSBaseURL}, nil
+
+	case SMSProviderAfricasTalking:
+		if IsEmptyString(config.AfricasTalkingUsername) || IsEmptyString(config.AfricasTalkingAPIKey) {
+			return nil, errors.New("SMS: AFRICASTALKING_USERNAME or AFRICASTALKING_API_KEY is empty")
+		}
+		return &AfricasTalkingSMSSender{Username: config.AfricasTalkingUsername, APIKey: config.AfricasTalkingAPIKey, From: config.SMSFrom, BaseURL: config.SMSBaseURL}, nil
+
+	case SMSProviderVonage:
+		if IsEmptyString(config.VonageAPIKey) || IsEmptyString(config.VonageAPISecret) {
+			return nil, errors.New("SMS: VONAGE_API_KEY or VONAGE_API_SECRET is empty")
+		}
+		return &VonageSMSSender{APIKey: config.VonageAPIKey, APISecret: config.VonageAPISecret, From: config.SMSFrom, BaseURL: config.SMSBaseURL}, nil
+	}
+
+	return nil, fmt.Errorf("SMS: unknown provider %s", config.SMSProvider)
+}
+
+// postForm - posts the form to a gateway, returns the response body
+// non 2xx responses are returned as errors with the body
+func postForm(client *http.Client, endpoint string, form url.Values, setHeaders func(req *http.Request)) ([]byte, error) {
+
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if setHeaders != nil {
+		setHeaders(req)
+	}
+
+	if client == nil {
+		client = smsHTTPClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return body, fmt.Errorf("SMS: gateway returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+//######## TWILIO
+
+// TwilioSMSSender - sends messages with the Twilio Messages API
+type TwilioSMSSender struct {
+	AccountSID string
+	AuthToken  string
+
+	//From - twilio phone number or messaging service sid (MG...)
+	From string
+
+	//BaseURL - defaults to https://api.twilio.com
+	BaseURL string
+	Client  *http.Client
+}
+
+// SendSMS - sends the message
+func (s *TwilioSMSSender) SendSMS(toPhoneNo string, message string) error {
+
+	baseURL := s.BaseURL
+	if IsEmptyString(baseURL) {
+		baseURL = "https://api.twilio.com"
+	}
+	endpoint := strings.TrimRight(baseURL, "/") + "/2010-04-01/Accounts/" + url.PathEscape(s.AccountSID) + "/Messages.json"
+
+	form := url.Values{}
+	form.Set("To", toPhoneNo)
+	form.Set("Body", message)
+	if strings.HasPrefix(s.From, "MG") {
+		form.Set("MessagingServiceSid", s.From)
+	} else {
+		form.Set("From", s.From)
+	}
+
+	_, err := postForm(s.Client, endpoint, form, func(req *http.Request) {
+		req.SetBasicAuth(s.AccountSID, s.AuthToken)
+	})
+
+	return err
+}
+
+//######## AFRICA'S TALKING
+
+// AfricasTalkingSMSSender - sends messages with the Africa's Talking SMS API
+type AfricasTalkingSMSSender struct {
+	//Username - use sandbox with the sandbox BaseURL
+	Username string
+	APIKey   string
+
+	//From - sender id or short code, empty for the default sender
+	From string
+
+	//BaseURL - defaults to https://api.africastalking.com,
+	//https://api.sandbox.africastalking.com for the sandbox
+	BaseURL string
+	Client  *http.Client
+}
+
+// africasTalkingResponse - send message response
+type africasTalkingResponse struct {
+	SMSMessageData struct {
+		Message    string `json:"Message"`
+		Recipients []struct {
+			Number     string `json:"number"`
+			Status     string `json:"status"`
+			StatusCode int    `json:"statusCode"`
+		} `json:"Recipients"`
+	} `json:"SMSMessageData"`
+}
+
+// SendSMS - sends the message
+func (s *AfricasTalkingSMSSender) SendSMS(toPhoneNo string, message string) error {
+
+	baseURL := s.BaseURL
+	if IsEmptyString(baseURL) {
+		baseURL = "https://api.africastalking.com"
+	}
+	endpoint := strings.TrimRight(baseURL, "/") + "/version1/messaging"
+
+	form := url.Values{}
+	form.Set("username", s.Username)
+	form.Set("to", toPhoneNo)
+	form.Set("message", message)
+	if !IsEmptyString(s.From) {
+		form.Set("from", s.From)
+	}
+
+	body, err := postForm(s.Client, endpoint, form, func(req *http.Request) {
+		req.Header.Set("apiKey", s.APIKey)
+	})
+	if err != nil {
+		return err
+	}
+
+	var response africasTalkingResponse
+	if err = json.Unmarshal(body, &response); err != nil {
+		return err
+	}
+
+	//a 201 is returned even when the message was not sent, the recipient has the status
+	if len(response.SMSMessageData.Recipients) == 0 {
+		return fmt.Errorf("SMS: message not sent: %s", response.SMSMessageData.Message)
+	}
+	for _, recipient := range response.SMSMessageData.Recipients {
+		//100 processed, 101 sent, 102 queued
+		if recipient.StatusCode < 100 || recipient.StatusCode > 102 {
+			return fmt.Errorf("SMS: message to %s not sent: %s", recipient.Number, recipient.Status)
+		}
+	}
+
+	return nil
+}
+
+//######## VONAGE
+
+// VonageSMSSender - sends messages with the Vonage (Nexmo) SMS API
+type VonageSMSSender struct {
+	APIKey    string
+	APISecret string
+
+	//From - sender id or virtual number
+	From string
+
+	//BaseURL - defaults to https://rest.nexmo.com
+	BaseURL string
+	Client  *http.Client
+}
+
+// vonageResponse - send message response
+type vonageResponse struct {
+	Messages []struct {
+		To        string `json:"to"`
+		Status    string `json:"status"`
+		ErrorText string `json:"error-text"`
+	} `json:"messages"`
+}
+
+// SendSMS - sends the message
+func (s *VonageSMSSender) SendSMS(toPhoneNo string, message string) error {
+
+	baseURL := s.BaseURL
+	if IsEmptyString(baseURL) {
+		baseURL = "https://rest.nexmo.com"
+	}
+	endpoint := strings.TrimRight(baseURL, "/") + "/sms/json"
+
+	form := url.Values{}
+	form.Set("api_key", s.APIKey)
+	form.Set("api_secret", s.APISecret)
+	form.Set("from", s.From)
+	//numbers are sent without the leading +
+	form.Set("to", strings.TrimPrefix(toPhoneNo, "+"))
+	form.Set("text", message)
+	form.Set("type", "unicode")
+
+	body, err := postForm(s.Client, endpoint, form, nil)
+	if err != nil {
+		return err
+	}
+
+	var response vonageResponse
+	if err = json.Unmarshal(body, &response); err != nil {
+		return err
+	}
+
+	//200 is returned even when the message was not sent, status 0 is success
+	if len(response.Messages) == 0 {
+		return errors.New("SMS: message not sent")
+	}
+	for _, msg := range response.Messages {
+		if msg.Status != "0" {
+			return fmt.Errorf("SMS: message to %s not sent: %s", msg.To, msg.ErrorText)
+		}
+	}
+
+	return nil
+}
+
+//######## DEVELOPMENT
+
+// LogSMSSender - logs messages instead of sending them, for development
+type LogSMSSender struct{}
+
+// SendSMS - logs the message
+func (s *LogSMSSender) SendSMS(toPhoneNo string, message string) error {
+	LogInfof("SMS: to %s: %s", toPhoneNo, message)
+	return nil
+}
+
+// FileSMSSender - appends messages to a file instead of sending them, for development and tests
+type FileSMSSender struct {
+	Path string
+	mu   sync.Mutex
+}
+
+// SendSMS - appends the message to the file, one line per message
+func (s *FileSMSSender) SendSMS(toPhoneNo string, message string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	line := fmt.Sprintf("%s\t%s\t%s\n", TimeNow().Format(time.RFC3339), toPhoneNo, strings.Replace(message, "\n", " ", -1))
+	_, err = file.WriteString(line)
+	return err
+}
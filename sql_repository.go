@@ -2,8 +2,10 @@ package ngauth
 
 import (
 	"errors"
+	"time"
 
 	"github.com/jinzhu/gorm"
+	"gopkg.in/guregu/null.v3"
 )
 
 // SQLRepository queries the database and returns results to the controller
@@ -50,10 +52,19 @@ func (r *SQLRepository) Init(config *Configuration) error {
 	if config.DBPoolMaxOpenConns > 0 {
 		r.DB.DB().SetMaxOpenConns(config.DBPoolMaxOpenConns)
 		LogInfof("DB: DBPoolMaxOpenConns: %d", config.DBPoolMaxOpenConns)
+	} else if config.DBDriver == "sqlite3" {
+		//sqlite allows a single writer, avoid "database is locked" errors
+		r.DB.DB().SetMaxOpenConns(1)
 	}
 
 	LogInfo("DB: Connection Successful!")
 
+	if config.DBAutoMigrate {
+		if err = r.Migrate(config); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -132,6 +143,73 @@ func (r *SQLRepository) CreateUser(user User, lang string) (interface{}, *Error)
 	return user.ID, err
 }
 
+// GetUserByID - get a user by using ID
+func (r *SQLRepository) GetUserByID(userID interface{}, lang string) (*User, *Error) {
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	var user User
+	err := r.DB.Table(Config.UsersTableName).Select("*").Where("id=? AND deleted_at IS NULL", userID).First(&user)
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return &user, nil
+}
+
+// IncrementFailedLogins - counts a failed login for the user, returns the new count
+func (r *SQLRepository) IncrementFailedLogins(userID interface{}, lang string) (int, *Error) {
+
+	if userID == nil {
+		return 0, NewError(lang, ErrorEmptyFields)
+	}
+
+	//incremented in the db, concurrent failures are all counted
+	err := r.DB.Table(Config.UsersTableName).Where("id=?", userID).UpdateColumn("failed_logins", gorm.Expr("failed_logins + 1")).Error
+	if err != nil {
+		return 0, NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	var failedLogins int
+	err = r.DB.Table(Config.UsersTableName).Select("failed_logins").Where("id=?", userID).Row().Scan(&failedLogins)
+	if err != nil {
+		return 0, NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	return failedLogins, nil
+}
+
+// UpdateUserTOTP - sets the TOTP secret of a user
+func (r *SQLRepository) UpdateUserTOTP(userID interface{}, secret string, enabledAt null.Time, lang string) *Error {
+	return r.UpdateUserByID(userID, Map{"totp_secret": secret, "totp_enabled_at": enabledAt}, lang)
+}
+
+// UpdateUserTOTPStep - saves the time step of an accepted TOTP code
+func (r *SQLRepository) UpdateUserTOTPStep(userID interface{}, step int64, lang string) *Error {
+
+	if userID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	//a concurrent use of the same code updates no rows
+	result := r.DB.Table(Config.UsersTableName).Where("id=?", userID).Where("totp_last_step < ?", step).UpdateColumn("totp_last_step", step)
+	if result.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if result.RowsAffected == 0 {
+		return NewError(lang, ErrorInvalidOTPCode)
+	}
+
+	return nil
+}
+
 // GetUserBy - get a user by using email/phonenumber
 func (r *SQLRepository) GetUserBy(email string, phoneNo string, lang string) (*User, *Error) {
 
@@ -268,6 +346,138 @@ func (r *SQLRepository) UpdateOTPByID(otpID interface{}, columns interface{}, la
 	return r.UpdateRecordByID(Config.OTPTableName, otpID, columns, lang)
 }
 
+// UseOTP - marks the otp verified, an otp can only be used once
+func (r *SQLRepository) UseOTP(otpID interface{}, lang string) *Error {
+
+	if otpID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	//a concurrent use of the same otp updates no rows
+	result := r.DB.Table(Config.OTPTableName).Where("id=?", otpID).Where("verified_at IS NULL").UpdateColumns(Map{"verified_at": TimeNow()})
+	if result.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if result.RowsAffected == 0 {
+		return NewError(lang, ErrorAlreadyVerified)
+	}
+
+	return nil
+}
+
+// GetOTPByVerificationID - get otp by using the verification id
+func (r *SQLRepository) GetOTPByVerificationID(verificationID string, lang string) (*OTP, *Error) {
+
+	if IsEmptyString(verificationID) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	var otp OTP
+	err := r.DB.Table(Config.OTPTableName).Select("*").Where("verification_id=?", verificationID).First(&otp)
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return &otp, nil
+}
+
+// UseVerification - marks the verification id used, it can only be used once
+func (r *SQLRepository) UseVerification(otpID interface{}, lang string) *Error {
+
+	if otpID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	//a concurrent use of the same verification id updates no rows
+	result := r.DB.Table(Config.OTPTableName).Where("id=?", otpID).Where("verification_used_at IS NULL").UpdateColumns(Map{"verification_used_at": TimeNow()})
+	if result.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if result.RowsAffected == 0 {
+		return NewError(lang, ErrorVerificationUsed)
+	}
+
+	return nil
+}
+
+// IncrementOTPFailedAttempts - counts an attempt at the code of the otp, unless it has maxAttempts already
+func (r *SQLRepository) IncrementOTPFailedAttempts(otpID interface{}, maxAttempts int, lang string) (int, *Error) {
+
+	if otpID == nil {
+		return 0, NewError(lang, ErrorEmptyFields)
+	}
+
+	//checked and incremented in one statement, concurrent attempts cannot pass maxAttempts
+	query := r.DB.Table(Config.OTPTableName).Where("id=?", otpID)
+	if maxAttempts > 0 {
+		query = query.Where("failed_attempts < ?", maxAttempts)
+	}
+
+	result := query.UpdateColumns(Map{"failed_attempts": gorm.Expr("failed_attempts + 1"), "last_failed_at": TimeNow()})
+	if result.Error != nil {
+		return 0, NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if result.RowsAffected == 0 {
+		return 0, nil
+	}
+
+	var failedAttempts int
+	err := r.DB.Table(Config.OTPTableName).Select("failed_attempts").Where("id=?", otpID).Row().Scan(&failedAttempts)
+	if err != nil {
+		return 0, NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	return failedAttempts, nil
+}
+
+// DecrementOTPFailedAttempts - takes back the attempt of a correct code
+func (r *SQLRepository) DecrementOTPFailedAttempts(otpID interface{}, lang string) *Error {
+
+	if otpID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.DB.Table(Config.OTPTableName).Where("id=?", otpID).Where("failed_attempts > 0").UpdateColumn("failed_attempts", gorm.Expr("failed_attempts - 1")).Error
+	if err != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	return nil
+}
+
+// GetOTPFailedAttempts - total wrong codes for the email/phoneNo since the given time
+func (r *SQLRepository) GetOTPFailedAttempts(email string, phoneNo string, since time.Time, lang string) (int64, *Error) {
+
+	if IsEmptyString(email) && IsEmptyString(phoneNo) {
+		return 0, NewError(lang, ErrorEmptyFields)
+	}
+
+	query := r.DB.Table(Config.OTPTableName).Select("COALESCE(SUM(failed_attempts), 0)").Where("last_failed_at >= ?", since)
+
+	//email
+	if IsEmptyString(phoneNo) {
+		query = query.Where("email=?", email)
+	} else {
+		//phone number
+		query = query.Where("phone_number=?", phoneNo)
+	}
+
+	var total int64
+	err := query.Row().Scan(&total)
+	if err != nil {
+		return 0, NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	return total, nil
+}
+
 //################## Session
 
 // CreateSession - creates a session
@@ -300,6 +510,693 @@ func (r *SQLRepository) GetSession(refreshToken string, lang string) (*Session,
 	return &session, nil
 }
 
+// RevokeSession - revokes session by refresh token
+func (r *SQLRepository) RevokeSession(refreshToken string, lang string) *Error {
+
+	if len(refreshToken) == 0 {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.DB.Table(Config.SessionsTableName).Where("refresh_token=?", refreshToken).Where("revoked_at IS NULL").UpdateColumns(Map{"revoked_at": TimeNow()})
+	if err.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+
+	return nil
+}
+
+// RevokeUserSessions - revokes all sessions of a user
+func (r *SQLRepository) RevokeUserSessions(userID interface{}, lang string) *Error {
+
+	if userID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.DB.Table(Config.SessionsTableName).Where("user_id=?", userID).Where("revoked_at IS NULL").UpdateColumns(Map{"revoked_at": TimeNow()})
+	if err.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+
+	return nil
+}
+
+// RevokeClientSessions - revokes the sessions of a user issued to the oauth client
+func (r *SQLRepository) RevokeClientSessions(userID interface{}, clientID string, lang string) *Error {
+
+	if userID == nil || len(clientID) == 0 {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.DB.Table(Config.SessionsTableName).Where("user_id=?", userID).Where("client_id=?", clientID).Where("revoked_at IS NULL").UpdateColumns(Map{"revoked_at": TimeNow()})
+	if err.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+
+	return nil
+}
+
+// RotateSession - marks the session as rotated and creates the new session in a transaction
+func (r *SQLRepository) RotateSession(sessionID interface{}, newSession Session, lang string) (interface{}, *Error) {
+
+	if sessionID == nil || len(newSession.RefreshToken) == 0 || len(newSession.FamilyID) == 0 {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	tx := r.DB.Begin()
+	if tx.Error != nil {
+		return -1, NewErrorWithMessage(ErrorDBError, tx.Error.Error())
+	}
+
+	//only one rotation per session, a concurrent rotation updates no rows
+	result := tx.Table(Config.SessionsTableName).Where("id=?", sessionID).Where("rotated_at IS NULL").Where("revoked_at IS NULL").UpdateColumns(Map{"rotated_at": TimeNow(), "family_id": newSession.FamilyID})
+	if result.Error != nil {
+		tx.Rollback()
+		return -1, NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if result.RowsAffected == 0 {
+		tx.Rollback()
+		return -1, NewError(lang, ErrorInvalidToken)
+	}
+
+	result = tx.Table(Config.SessionsTableName).Create(&newSession)
+	if result.Error != nil {
+		tx.Rollback()
+		return -1, NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return -1, NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	return newSession.ID, nil
+}
+
+// RevokeSessionFamily - revokes all sessions of a token family
+func (r *SQLRepository) RevokeSessionFamily(familyID string, lang string) *Error {
+
+	if len(familyID) == 0 {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.DB.Table(Config.SessionsTableName).Where("family_id=?", familyID).Where("revoked_at IS NULL").UpdateColumns(Map{"revoked_at": TimeNow()})
+	if err.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+
+	return nil
+}
+
+//####################### Login Failures
+
+// CreateLoginFailure - saves a failed login attempt
+func (r *SQLRepository) CreateLoginFailure(loginFailure LoginFailure, lang string) *Error {
+	return r.CreateRecord("login_failures", &loginFailure, lang)
+}
+
+// CountLoginFailures - failed logins from the ip address since the given time
+func (r *SQLRepository) CountLoginFailures(ipAddr string, since time.Time, lang string) (int64, *Error) {
+
+	if IsEmptyString(ipAddr) {
+		return 0, NewError(lang, ErrorEmptyFields)
+	}
+
+	var count int64
+	err := r.DB.Table("login_failures").Where("ip_addr=?", ipAddr).Where("created_at >= ?", since).Count(&count).Error
+	if err != nil {
+		return 0, NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	return count, nil
+}
+
+// DeleteLoginFailures - deletes failed logins older than the given time
+func (r *SQLRepository) DeleteLoginFailures(before time.Time, lang string) *Error {
+
+	err := r.DB.Table("login_failures").Where("created_at < ?", before).Delete(LoginFailure{}).Error
+	if err != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	return nil
+}
+
+//####################### Used Tokens
+
+// UseToken - saves the jti of a single use token, returns ErrorInvalidToken if it was used already
+func (r *SQLRepository) UseToken(jti string, expiresAt time.Time, lang string) *Error {
+
+	if IsEmptyString(jti) {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	//expired tokens are refused anyway
+	err := r.DB.Table("used_tokens").Where("expires_at < ?", TimeNow()).Delete(UsedToken{}).Error
+	if err != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	//the unique index refuses a concurrent use of the same jti
+	usedToken := UsedToken{JTI: jti, ExpiresAt: null.TimeFrom(expiresAt), CreatedAt: null.TimeFrom(TimeNow())}
+	if createErr := r.CreateRecord("used_tokens", &usedToken, lang); createErr != nil {
+		used, err := r.IsTokenUsed(jti, lang)
+		if err != nil {
+			return err
+		}
+		if used {
+			return NewErrorWithMessage(ErrorInvalidToken, "Token used")
+		}
+		return createErr
+	}
+
+	return nil
+}
+
+// IsTokenUsed - true if the jti was saved with UseToken
+func (r *SQLRepository) IsTokenUsed(jti string, lang string) (bool, *Error) {
+
+	var count int64
+	err := r.DB.Table("used_tokens").Where("jti=?", jti).Count(&count).Error
+	if err != nil {
+		return false, NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	return count > 0, nil
+}
+
+//####################### Recovery Codes
+
+// ReplaceRecoveryCodes - deletes all recovery codes of the user and saves the new ones
+func (r *SQLRepository) ReplaceRecoveryCodes(userID interface{}, codes []RecoveryCode, lang string) *Error {
+
+	if userID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	tx := r.DB.Begin()
+	if tx.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, tx.Error.Error())
+	}
+
+	result := tx.Table("recovery_codes").Where("user_id=?", userID).Delete(RecoveryCode{})
+	if result.Error != nil {
+		tx.Rollback()
+		return NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	for _, code := range codes {
+		code.UserID = userID
+		result = tx.Table("recovery_codes").Create(&code)
+		if result.Error != nil {
+			tx.Rollback()
+			return NewErrorWithMessage(ErrorDBError, result.Error.Error())
+		}
+	}
+
+	if err := tx.Commit().Error; err != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	return nil
+}
+
+// GetRecoveryCodes - get unused recovery codes of the user
+func (r *SQLRepository) GetRecoveryCodes(userID interface{}, lang string) ([]RecoveryCode, *Error) {
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	query := r.DB.Table("recovery_codes").Select("*").Where("user_id=?", userID).Where("used_at IS NULL")
+
+	// select
+	results := make([]RecoveryCode, 0, 10)
+	err := query.Order("id").Find(&results)
+
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return results, nil
+}
+
+// UseRecoveryCode - marks the recovery code used, a code can only be used once
+func (r *SQLRepository) UseRecoveryCode(codeID interface{}, lang string) *Error {
+
+	if codeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	//a concurrent use of the same code updates no rows
+	result := r.DB.Table("recovery_codes").Where("id=?", codeID).Where("used_at IS NULL").UpdateColumns(Map{"used_at": TimeNow()})
+	if result.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if result.RowsAffected == 0 {
+		return NewError(lang, ErrorInvalidOTPCode)
+	}
+
+	return nil
+}
+
+//####################### Notifications
+
+// CreateNotification - saves a notification to the outbox
+func (r *SQLRepository) CreateNotification(notification Notification, lang string) (interface{}, *Error) {
+
+	if IsEmptyString(notification.Channel) || IsEmptyString(notification.Recipient) {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.CreateRecord("notifications", &notification, lang)
+	return notification.ID, err
+}
+
+// GetDueNotifications - notifications to deliver now, oldest first
+func (r *SQLRepository) GetDueNotifications(now time.Time, limit int, lang string) ([]Notification, *Error) {
+
+	query := r.DB.Table("notifications").Select("*").Where("status IN (?)", []string{NotificationPending, NotificationSending}).Where("next_attempt_at <= ?", now)
+
+	// select
+	results := make([]Notification, 0, 10)
+	err := query.Order("next_attempt_at").Limit(limit).Find(&results)
+
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return results, nil
+}
+
+// ClaimNotification - marks the notification sending, only one worker can claim an attempt
+func (r *SQLRepository) ClaimNotification(notificationID interface{}, attempts int, leaseUntil time.Time, lang string) (bool, *Error) {
+
+	if notificationID == nil {
+		return false, NewError(lang, ErrorEmptyFields)
+	}
+
+	//attempts changes with every claim, a concurrent claim of the same attempt updates no rows
+	result := r.DB.Table("notifications").Where("id=?", notificationID).Where("attempts=?", attempts).Where("status IN (?)", []string{NotificationPending, NotificationSending}).
+		UpdateColumns(Map{"status": NotificationSending, "attempts": attempts + 1, "next_attempt_at": leaseUntil, "updated_at": TimeNow()})
+	if result.Error != nil {
+		return false, NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	return result.RowsAffected == 1, nil
+}
+
+// ExpireNotifications - marks the undelivered notifications expired before now and clears their bodies
+func (r *SQLRepository) ExpireNotifications(now time.Time, lang string) *Error {
+
+	err := r.DB.Table("notifications").Where("status IN (?)", []string{NotificationPending, NotificationSending}).Where("expires_at < ?", now).
+		UpdateColumns(Map{"status": NotificationExpired, "body": "", "text_body": "", "updated_at": TimeNow()})
+	if err.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+
+	return nil
+}
+
+// UpdateNotificationByID - updates notification
+func (r *SQLRepository) UpdateNotificationByID(notificationID interface{}, columns interface{}, lang string) *Error {
+
+	if notificationID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.DB.Table("notifications").Where("id=?", notificationID).UpdateColumns(columns)
+	if err.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+
+	return nil
+}
+
+// GetNotifications - get notifications with the status, newest first
+func (r *SQLRepository) GetNotifications(status string, offset int64, limit int64, lang string) ([]Notification, *Error) {
+
+	query := r.DB.Table("notifications").Select("*")
+	if !IsEmptyString(status) {
+		query = query.Where("status=?", status)
+	}
+
+	// select
+	results := make([]Notification, 0, 10)
+	err := query.Order("id DESC").Offset(offset).Limit(limit).Find(&results)
+
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return results, nil
+}
+
+//####################### WebAuthn
+
+// CreateWebAuthnCredential - saves a passkey of the user
+func (r *SQLRepository) CreateWebAuthnCredential(credential WebAuthnCredential, lang string) (interface{}, *Error) {
+
+	if credential.UserID == nil || IsEmptyString(credential.CredentialID) || IsEmptyString(credential.PublicKey) {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.CreateRecord("webauthn_credentials", &credential, lang)
+	return credential.ID, err
+}
+
+// GetWebAuthnCredential - get a credential by using the base64url credential id
+func (r *SQLRepository) GetWebAuthnCredential(credentialID string, lang string) (*WebAuthnCredential, *Error) {
+
+	if IsEmptyString(credentialID) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	var credential WebAuthnCredential
+	err := r.DB.Table("webauthn_credentials").Select("*").Where("credential_id=?", credentialID).First(&credential)
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return &credential, nil
+}
+
+// GetWebAuthnCredentials - get all credentials of the user
+func (r *SQLRepository) GetWebAuthnCredentials(userID interface{}, lang string) ([]WebAuthnCredential, *Error) {
+
+	if userID == nil {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	query := r.DB.Table("webauthn_credentials").Select("*").Where("user_id=?", userID)
+
+	// select
+	results := make([]WebAuthnCredential, 0, 10)
+	err := query.Order("id").Find(&results)
+
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return results, nil
+}
+
+// UpdateWebAuthnCredentialByID - updates credential
+func (r *SQLRepository) UpdateWebAuthnCredentialByID(credentialID interface{}, columns interface{}, lang string) *Error {
+	return r.UpdateRecordByID("webauthn_credentials", credentialID, columns, lang)
+}
+
+// CreateWebAuthnChallenge - saves the challenge of a ceremony
+func (r *SQLRepository) CreateWebAuthnChallenge(challenge WebAuthnChallenge, lang string) (interface{}, *Error) {
+
+	if IsEmptyString(challenge.Challenge) || IsEmptyString(challenge.Ceremony) {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	//expired challenges are refused anyway
+	dbErr := r.DB.Table("webauthn_challenges").Where("expires_at < ?", TimeNow()).Delete(WebAuthnChallenge{}).Error
+	if dbErr != nil {
+		return -1, NewErrorWithMessage(ErrorDBError, dbErr.Error())
+	}
+
+	err := r.CreateRecord("webauthn_challenges", &challenge, lang)
+	return challenge.ID, err
+}
+
+// GetWebAuthnChallenge - get a challenge by its value
+func (r *SQLRepository) GetWebAuthnChallenge(challenge string, lang string) (*WebAuthnChallenge, *Error) {
+
+	if IsEmptyString(challenge) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	var result WebAuthnChallenge
+	err := r.DB.Table("webauthn_challenges").Select("*").Where("challenge=?", challenge).First(&result)
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return &result, nil
+}
+
+// UseWebAuthnChallenge - marks the challenge used, a challenge can only be used once
+func (r *SQLRepository) UseWebAuthnChallenge(challengeID interface{}, lang string) *Error {
+
+	if challengeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	//a concurrent use of the same challenge updates no rows
+	result := r.DB.Table("webauthn_challenges").Where("id=?", challengeID).Where("used_at IS NULL").UpdateColumns(Map{"used_at": TimeNow()})
+	if result.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if result.RowsAffected == 0 {
+		return NewError(lang, ErrorWebAuthnChallenge)
+	}
+
+	return nil
+}
+
+//####################### OAuth
+
+// CreateOAuthClient - registers a client
+func (r *SQLRepository) CreateOAuthClient(client OAuthClient, lang string) (interface{}, *Error) {
+
+	if IsEmptyString(client.ClientID) {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.CreateRecord("oauth_clients", &client, lang)
+	return client.ID, err
+}
+
+// GetOAuthClient - get a client by using the client_id
+func (r *SQLRepository) GetOAuthClient(clientID string, lang string) (*OAuthClient, *Error) {
+
+	if IsEmptyString(clientID) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	var client OAuthClient
+	err := r.DB.Table("oauth_clients").Select("*").Where("client_id=?", clientID).First(&client)
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return &client, nil
+}
+
+// CreateOAuthCode - saves an authorization code
+func (r *SQLRepository) CreateOAuthCode(code OAuthCode, lang string) (interface{}, *Error) {
+
+	if IsEmptyString(code.CodeHash) || IsEmptyString(code.ClientID) || code.UserID == nil {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.CreateRecord("oauth_codes", &code, lang)
+	return code.ID, err
+}
+
+// GetOAuthCode - get an authorization code by its hash
+func (r *SQLRepository) GetOAuthCode(codeHash string, lang string) (*OAuthCode, *Error) {
+
+	if IsEmptyString(codeHash) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	var code OAuthCode
+	err := r.DB.Table("oauth_codes").Select("*").Where("code_hash=?", codeHash).First(&code)
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return &code, nil
+}
+
+// UseOAuthCode - marks the code used, a code can only be used once
+func (r *SQLRepository) UseOAuthCode(codeID interface{}, lang string) *Error {
+
+	if codeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	//a concurrent use of the same code updates no rows
+	result := r.DB.Table("oauth_codes").Where("id=?", codeID).Where("used_at IS NULL").UpdateColumns(Map{"used_at": TimeNow()})
+	if result.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if result.RowsAffected == 0 {
+		return NewError(lang, ErrorInvalidGrant)
+	}
+
+	return nil
+}
+
+//####################### Device Authorization
+
+// CreateDeviceCode - saves a device authorization request
+func (r *SQLRepository) CreateDeviceCode(deviceCode DeviceCode, lang string) (interface{}, *Error) {
+
+	if IsEmptyString(deviceCode.DeviceCodeHash) || IsEmptyString(deviceCode.UserCode) || IsEmptyString(deviceCode.ClientID) {
+		return -1, NewError(lang, ErrorEmptyFields)
+	}
+
+	//kept for a while after they expire, devices still polling get expired_token
+	dbErr := r.DB.Table("device_codes").Where("expires_at < ?", deviceCodesPurgeTime()).Delete(DeviceCode{}).Error
+	if dbErr != nil {
+		return -1, NewErrorWithMessage(ErrorDBError, dbErr.Error())
+	}
+
+	err := r.CreateRecord("device_codes", &deviceCode, lang)
+	return deviceCode.ID, err
+}
+
+// GetDeviceCode - get a device code by its hash
+func (r *SQLRepository) GetDeviceCode(deviceCodeHash string, lang string) (*DeviceCode, *Error) {
+
+	if IsEmptyString(deviceCodeHash) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	var deviceCode DeviceCode
+	err := r.DB.Table("device_codes").Select("*").Where("device_code_hash=?", deviceCodeHash).First(&deviceCode)
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return &deviceCode, nil
+}
+
+// GetPendingDeviceCode - get the device code of a user code, waiting for the user
+func (r *SQLRepository) GetPendingDeviceCode(userCode string, lang string) (*DeviceCode, *Error) {
+
+	if IsEmptyString(userCode) {
+		return nil, NewError(lang, ErrorEmptyFields)
+	}
+
+	var deviceCode DeviceCode
+	err := r.DB.Table("device_codes").Select("*").Where("user_code=?", userCode).Where("approved_at IS NULL AND denied_at IS NULL").Where("expires_at > ?", TimeNow()).Order("id desc").First(&deviceCode)
+	//no rows error
+	if err.RecordNotFound() {
+		return nil, nil
+	}
+	//any other error
+	if err.Error != nil {
+		return nil, NewErrorWithMessage(ErrorDBError, err.Error.Error())
+	}
+	return &deviceCode, nil
+}
+
+// ApproveDeviceCode - the user allowed the device, a device code is approved or denied once
+func (r *SQLRepository) ApproveDeviceCode(codeID interface{}, userID interface{}, lang string) *Error {
+
+	if codeID == nil || userID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	return r.decideDeviceCode(codeID, Map{"user_id": userID, "approved_at": TimeNow()}, lang)
+}
+
+// DenyDeviceCode - the user denied the device
+func (r *SQLRepository) DenyDeviceCode(codeID interface{}, lang string) *Error {
+
+	if codeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	return r.decideDeviceCode(codeID, Map{"denied_at": TimeNow()}, lang)
+}
+
+// decideDeviceCode - updates a device code that was neither approved nor denied
+func (r *SQLRepository) decideDeviceCode(codeID interface{}, columns Map, lang string) *Error {
+
+	//a concurrent decision on the same code updates no rows
+	result := r.DB.Table("device_codes").Where("id=?", codeID).Where("approved_at IS NULL AND denied_at IS NULL").UpdateColumns(columns)
+	if result.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if result.RowsAffected == 0 {
+		return NewError(lang, ErrorInvalidUserCode)
+	}
+
+	return nil
+}
+
+// PollDeviceCode - saves the poll time and the interval of the next poll
+func (r *SQLRepository) PollDeviceCode(codeID interface{}, pollInterval int, lang string) *Error {
+
+	if codeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	err := r.DB.Table("device_codes").Where("id=?", codeID).UpdateColumns(Map{"last_polled_at": TimeNow(), "poll_interval": pollInterval}).Error
+	if err != nil {
+		return NewErrorWithMessage(ErrorDBError, err.Error())
+	}
+
+	return nil
+}
+
+// UseDeviceCode - marks the approved device code used, tokens are issued once
+func (r *SQLRepository) UseDeviceCode(codeID interface{}, lang string) *Error {
+
+	if codeID == nil {
+		return NewError(lang, ErrorEmptyFields)
+	}
+
+	//a concurrent poll of the same code updates no rows
+	result := r.DB.Table("device_codes").Where("id=?", codeID).Where("approved_at IS NOT NULL AND used_at IS NULL").UpdateColumns(Map{"used_at": TimeNow()})
+	if result.Error != nil {
+		return NewErrorWithMessage(ErrorDBError, result.Error.Error())
+	}
+
+	if result.RowsAffected == 0 {
+		return NewError(lang, ErrorInvalidGrant)
+	}
+
+	return nil
+}
+
 //####################### Push Tokens
 
 // CreateOrUpdatePushToken - creates/updates push token
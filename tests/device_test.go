@@ -0,0 +1,181 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hmkwizu/ngauth"
+	"gopkg.in/guregu/null.v3"
+)
+
+// registerDeviceClient - public client of a TV app
+func registerDeviceClient(t *testing.T, db ngauth.Database) string {
+
+	response, err := ngauth.RegisterOAuthClient(db, "en", map[string]interface{}{"name": "TV App", "grant_types": []string{ngauth.GrantTypeDeviceCode, "refresh_token"}, "public": true})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	return response["client_id"].(string)
+}
+
+// pollDevice - polls the token endpoint with the device code
+func pollDevice(db ngauth.Database, clientID string, deviceCode interface{}) (map[string]interface{}, *ngauth.Error) {
+	return ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": ngauth.GrantTypeDeviceCode, "client_id": clientID, "device_code": deviceCode}, hashCheck)
+}
+
+func TestDeviceAuthorization(t *testing.T) {
+
+	config := setTestConfig()
+	useES256Key(t, config)
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+	clientID := registerDeviceClient(t, db)
+
+	response, err := ngauth.DeviceAuthorization(db, "en", map[string]interface{}{"client_id": clientID, "scope": "openid profile"}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	userCode := response["user_code"].(string)
+	if len(userCode) != 9 || userCode[4] != '-' || response["interval"] != 5 || response["expires_in"] != int64(600) {
+		t.Fatal("device authorization", response)
+	}
+	if response["verification_uri"] != "https://auth.example.com/device" || response["verification_uri_complete"] != "https://auth.example.com/device?user_code="+userCode {
+		t.Fatal("verification uri", response)
+	}
+	deviceCode := response["device_code"]
+
+	_, err = pollDevice(db, clientID, deviceCode)
+	if err == nil || err.Code != ngauth.ErrorAuthorizationPending {
+		t.Fatal("expected ErrorAuthorizationPending")
+	}
+
+	//polled again within the interval
+	_, err = pollDevice(db, clientID, deviceCode)
+	if err == nil || err.Code != ngauth.ErrorSlowDown {
+		t.Fatal("expected ErrorSlowDown")
+	}
+	if oauthErr, _ := ngauth.OAuthError(err); oauthErr != "slow_down" {
+		t.Fatal("oauth error", oauthErr)
+	}
+
+	//user codes are case insensitive, the dash is optional
+	request, err := ngauth.ParseDeviceRequest(db, "en", map[string]interface{}{"user_code": strings.ToLower(strings.Replace(userCode, "-", "", 1))})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if request.Client.Name != "TV App" || request.Params()["user_code"] != userCode {
+		t.Fatal("device request", request.Params())
+	}
+
+	err = ngauth.AuthorizeDevice(db, "en", request, map[string]interface{}{"username": "a@example.com", "password": "wrong"}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorIncorrectEmailOrPassword {
+		t.Fatal("expected ErrorIncorrectEmailOrPassword")
+	}
+
+	err = ngauth.AuthorizeDevice(db, "en", request, map[string]interface{}{"username": "a@example.com", "password": "1234"}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//approved once
+	if _, err = ngauth.ParseDeviceRequest(db, "en", map[string]interface{}{"user_code": userCode}); err == nil || err.Code != ngauth.ErrorInvalidUserCode {
+		t.Fatal("expected ErrorInvalidUserCode for an approved user code")
+	}
+
+	response, err = pollDevice(db, clientID, deviceCode)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["access_token"] == nil || response["refresh_token"] == nil || response["id_token"] == nil {
+		t.Fatal("token response", response)
+	}
+
+	session, _ := db.GetSession(response["refresh_token"].(string), "en")
+	if session == nil || session.ClientID != clientID || session.Scope != "openid profile" || ngauth.GetStringOrEmpty(session.UserID) != ngauth.GetStringOrEmpty(userID) {
+		t.Fatalf("session %+v", session)
+	}
+
+	//tokens are issued once
+	if _, err = pollDevice(db, clientID, deviceCode); err == nil || err.Code != ngauth.ErrorInvalidGrant {
+		t.Fatal("expected ErrorInvalidGrant for a used device code")
+	}
+
+	//clients without the grant type
+	appID, _ := registerOAuthClient(t, db, true, "")
+	if _, err = ngauth.DeviceAuthorization(db, "en", map[string]interface{}{"client_id": appID}, hashCheck); err == nil || err.Code != ngauth.ErrorUnauthorizedClient {
+		t.Fatal("expected ErrorUnauthorizedClient")
+	}
+}
+
+func TestDeviceAuthorizationDenied(t *testing.T) {
+
+	config := setTestConfig()
+	db := newTestDB(t)
+
+	clientID := registerDeviceClient(t, db)
+
+	response, _ := ngauth.DeviceAuthorization(db, "en", map[string]interface{}{"client_id": clientID}, hashCheck)
+
+	request, err := ngauth.ParseDeviceRequest(db, "en", map[string]interface{}{"user_code": response["user_code"]})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if err = ngauth.DenyDevice(db, "en", request); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	_, err = pollDevice(db, clientID, response["device_code"])
+	if err == nil || err.Code != ngauth.ErrorAccessDenied {
+		t.Fatal("expected ErrorAccessDenied")
+	}
+
+	//another client can not poll the device code
+	otherID := registerDeviceClient(t, db)
+	if _, err = pollDevice(db, otherID, response["device_code"]); err == nil || err.Code != ngauth.ErrorInvalidGrant {
+		t.Fatal("expected ErrorInvalidGrant for another client")
+	}
+
+	//expired before the user approved
+	config.DeviceCodeExpireMins = 0
+	response, _ = ngauth.DeviceAuthorization(db, "en", map[string]interface{}{"client_id": clientID}, hashCheck)
+
+	if _, err = ngauth.ParseDeviceRequest(db, "en", map[string]interface{}{"user_code": response["user_code"]}); err == nil || err.Code != ngauth.ErrorInvalidUserCode {
+		t.Fatal("expected ErrorInvalidUserCode for an expired user code")
+	}
+	if _, err = pollDevice(db, clientID, response["device_code"]); err == nil || err.Code != ngauth.ErrorExpiredToken {
+		t.Fatal("expected ErrorExpiredToken")
+	}
+}
+
+func TestDeviceCodesPurged(t *testing.T) {
+
+	config := setTestConfig()
+	config.DeviceCodeExpireMins = 10
+	db := newTestDB(t)
+
+	create := func(hash string, expiresAt time.Time) {
+		deviceCode := ngauth.DeviceCode{DeviceCodeHash: hash, UserCode: strings.ToUpper(hash), ClientID: "client", ExpiresAt: null.TimeFrom(expiresAt)}
+		if _, err := db.CreateDeviceCode(deviceCode, "en"); err != nil {
+			t.Fatal(err.Message)
+		}
+	}
+
+	create("old", time.Now().Add(-time.Hour))
+	create("expired", time.Now().Add(-time.Minute))
+	create("current", time.Now().Add(time.Minute))
+
+	//devices polling a recently expired code still find it
+	if deviceCode, err := db.GetDeviceCode("old", "en"); err != nil || deviceCode != nil {
+		t.Fatal("old device code not deleted")
+	}
+	if deviceCode, err := db.GetDeviceCode("expired", "en"); err != nil || deviceCode == nil {
+		t.Fatal("expired device code deleted")
+	}
+	if deviceCode, err := db.GetDeviceCode("current", "en"); err != nil || deviceCode == nil {
+		t.Fatal("current device code deleted")
+	}
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hmkwizu/ngauth"
+)
+
+func TestRenderOTPMessage(t *testing.T) {
+
+	setTestConfig()
+
+	tests := []struct {
+		lang    string
+		otpFor  string
+		subject string
+	}{
+		{"en", "REGISTER", "Confirm your registration"},
+		{"en", "RESET", "Reset your password"},
+		{"sw", "RESET", "Badilisha nenosiri lako"},
+		{"tr", "UNLOCK", "Hesabınızın kilidini açın"},
+		//no template for the purpose
+		{"sw", "OTHER", "Msimbo wa uthibitisho"},
+		//unsupported language
+		{"fr", "REGISTER", "Confirm your registration"},
+	}
+
+	for _, test := range tests {
+		rendered, err := ngauth.RenderOTPMessage(ngauth.OTPMessage{Lang: test.lang, OTPFor: test.otpFor, Code: "123456", ExpireMins: 5})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rendered.Subject != test.subject {
+			t.Fatalf("%s %s: subject %q", test.lang, test.otpFor, rendered.Subject)
+		}
+		if !strings.Contains(rendered.HTML, "<b>123456</b>") || !strings.Contains(rendered.Text, "123456") || !strings.Contains(rendered.SMS, "123456") {
+			t.Fatalf("%s %s: code missing %+v", test.lang, test.otpFor, rendered)
+		}
+		if strings.Contains(rendered.Text, "<") {
+			t.Fatalf("%s %s: html in text body %q", test.lang, test.otpFor, rendered.Text)
+		}
+	}
+}
+
+func TestEmailTemplatesDir(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ngauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err = os.Mkdir(filepath.Join(dir, "sw"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "sw", "login_alert.tmpl")
+	source := `{{define "subject"}}Umeingia {{.Name}}{{end}}{{define "html"}}<p>{{.Name}}</p>{{end}}{{define "text"}}{{.Name}}{{end}}`
+	if err = ioutil.WriteFile(file, []byte(source), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	templates := ngauth.NewEmailTemplates(dir)
+	alert := ngauth.LoginAlert{Name: "<Juma>", IPAddr: "127.0.0.1"}
+
+	rendered, err := templates.Render("sw", ngauth.TemplateLoginAlert, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//html is escaped, subject and text are not
+	if rendered.Subject != "Umeingia <Juma>" || rendered.HTML != "<p>&lt;Juma&gt;</p>" || rendered.Text != "<Juma>" || rendered.SMS != rendered.Text {
+		t.Fatalf("rendered %+v", rendered)
+	}
+
+	//other languages use the built-in templates
+	rendered, err = templates.Render("en", ngauth.TemplateLoginAlert, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered.Subject != "New login to your account" || !strings.Contains(rendered.Text, "127.0.0.1") {
+		t.Fatalf("rendered %+v", rendered)
+	}
+
+	//edits are read after Reload
+	source = strings.Replace(source, "Umeingia", "Karibu", 1)
+	if err = ioutil.WriteFile(file, []byte(source), 0600); err != nil {
+		t.Fatal(err)
+	}
+	templates.Reload()
+
+	rendered, err = templates.Render("sw", ngauth.TemplateLoginAlert, alert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rendered.Subject != "Karibu <Juma>" {
+		t.Fatalf("subject after reload %q", rendered.Subject)
+	}
+
+	if _, err = templates.Render("sw", "missing", alert); err == nil {
+		t.Fatal("missing template rendered")
+	}
+}
+
+func TestGenerateOTPMessage(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	var message ngauth.OTPMessage
+	_, err := ngauth.GenerateOTP(db, "sw", map[string]interface{}{"email": "a@example.com", "otp_for": "REGISTER"}, func(m ngauth.OTPMessage) {
+		message = m
+	})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	if message.Lang != "sw" || message.OTPFor != "REGISTER" || message.Email != "a@example.com" || len(message.Code) == 0 || message.ExpireMins != 5 {
+		t.Fatalf("message %+v", message)
+	}
+}
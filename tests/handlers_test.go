@@ -0,0 +1,1064 @@
+package tests
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/hmkwizu/ngauth"
+	"gopkg.in/guregu/null.v3"
+)
+
+func setTestConfig() *ngauth.Configuration {
+	config := &ngauth.Configuration{
+		SignKey:                []byte("g4k591b582367a97acd7d1e5dc260729"),
+		JWTAccessExpireMins:    15,
+		JWTRefreshExpireMins:   1440,
+		OTPExpireTime:          300,
+		OTPBanTime:             300,
+		OTPFindTime:            300,
+		OTPMaxRetry:            3,
+		VerificationExpireTime: 600,
+		OTPMaxAttempts:         5,
+		OTPLockoutAttempts:     10,
+		OTPLockoutTime:         900,
+		LoginMaxFailures:       5,
+		LoginLockoutTime:       300,
+		LoginMaxLockoutTime:    86400,
+		TOTPIssuer:             "ngauth",
+		TOTPSkew:               1,
+		MFATokenExpireMins:     5,
+		VerifyBeforeRegister:   true,
+
+		WebAuthnRPID:             "example.com",
+		WebAuthnRPName:           "ngauth",
+		WebAuthnTimeout:          300,
+		WebAuthnUserVerification: "preferred",
+
+		OAuthCodeExpireMins: 2,
+
+		DeviceVerificationURL: "https://auth.example.com/device",
+		DeviceCodeExpireMins:  10,
+		DeviceCodeInterval:    5,
+	}
+	ngauth.SetConfig(config)
+	return config
+}
+
+func hashMake(plainPassword string) string {
+	return ngauth.BcryptHashMake(plainPassword)
+}
+
+func hashCheck(hashedPassword string, plainPassword string) bool {
+	return ngauth.BcryptHashCheck(hashedPassword, plainPassword)
+}
+
+// generateAndVerifyOTP - runs generate_otp and verify_otp, returns the verification_id
+func generateAndVerifyOTP(t *testing.T, db ngauth.Database, email string, otpFor string) string {
+
+	var code string
+	_, err := ngauth.GenerateOTP(db, "en", map[string]interface{}{"email": email, "otp_for": otpFor}, func(message ngauth.OTPMessage) {
+		code = message.Code
+	})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	response, err := ngauth.VerifyOTP(db, "en", map[string]interface{}{"email": email, "otp_for": otpFor, "code": code})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	return response["verification_id"].(string)
+}
+
+// registerUser - registers a user with email and password
+func registerUser(t *testing.T, db ngauth.Database, email string, password string) interface{} {
+
+	verificationID := generateAndVerifyOTP(t, db, email, "REGISTER")
+
+	response, err := ngauth.Register(db, "en", map[string]interface{}{"name": "Test", "email": email, "password": password, "confirm_password": password, "verification_id": verificationID}, hashMake)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	return response["id"]
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	//register without verification
+	_, err := ngauth.Register(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234", "confirm_password": "1234"}, hashMake)
+	if err == nil || err.Code != ngauth.ErrorGetVerifiedFirst {
+		t.Fatal("expected ErrorGetVerifiedFirst")
+	}
+
+	registerUser(t, db, "a@example.com", "1234")
+
+	//already registered
+	_, err = ngauth.GenerateOTP(db, "en", map[string]interface{}{"email": "a@example.com", "otp_for": "REGISTER"}, nil)
+	if err == nil || err.Code != ngauth.ErrorUsernameExists {
+		t.Fatal("expected ErrorUsernameExists")
+	}
+
+	//wrong password
+	_, err = ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "12345"}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorIncorrectEmailOrPassword {
+		t.Fatal("expected ErrorIncorrectEmailOrPassword")
+	}
+
+	response, err := ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234"}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//new access token
+	response, err = ngauth.Token(db, "en", map[string]interface{}{"refresh_token": response["refresh_token"]})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	if _, err = ngauth.IsValidToken(response["access_token"].(string)); err != nil {
+		t.Fatal(err.Message)
+	}
+}
+
+func TestGenerateOTPBan(t *testing.T) {
+
+	config := setTestConfig()
+	db := newTestDB(t)
+
+	params := map[string]interface{}{"email": "b@example.com", "otp_for": "REGISTER"}
+	for i := 0; i < config.OTPMaxRetry; i++ {
+		if _, err := ngauth.GenerateOTP(db, "en", params, nil); err != nil {
+			t.Fatal(err.Message)
+		}
+	}
+
+	//too many otps in a short time
+	if _, err := ngauth.GenerateOTP(db, "en", params, nil); err == nil {
+		t.Fail()
+	}
+}
+
+func TestVerifyOTPAttempts(t *testing.T) {
+
+	config := setTestConfig()
+	config.OTPMaxAttempts = 3
+	config.OTPLockoutAttempts = 5
+	db := newTestDB(t)
+
+	var code string
+	params := map[string]interface{}{"email": "b@example.com", "otp_for": "REGISTER"}
+	_, err := ngauth.GenerateOTP(db, "en", params, func(message ngauth.OTPMessage) {
+		code = message.Code
+	})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	wrongCode := "000000"
+	if code == wrongCode {
+		wrongCode = "111111"
+	}
+
+	//only the hash is saved
+	otp, _ := db.GetOTP("b@example.com", "", "REGISTER", "en")
+	if otp.Code == code || !ngauth.IsValidOTPCode(otp, code) {
+		t.Fatal("otp code not hashed")
+	}
+
+	verify := func(otpCode string) *ngauth.Error {
+		_, err := ngauth.VerifyOTP(db, "en", map[string]interface{}{"email": "b@example.com", "otp_for": "REGISTER", "code": otpCode})
+		return err
+	}
+
+	for i := 1; i < config.OTPMaxAttempts; i++ {
+		if err = verify(wrongCode); err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+			t.Fatal("expected ErrorInvalidOTPCode")
+		}
+	}
+	if err = verify(wrongCode); err == nil || err.Code != ngauth.ErrorOTPAttemptsExceeded {
+		t.Fatal("expected ErrorOTPAttemptsExceeded")
+	}
+
+	//invalidated, the correct code is refused too
+	if err = verify(code); err == nil || err.Code != ngauth.ErrorOTPAttemptsExceeded {
+		t.Fatal("expected ErrorOTPAttemptsExceeded for the correct code")
+	}
+
+	//a new otp, until the identifier is locked
+	_, err = ngauth.GenerateOTP(db, "en", params, func(message ngauth.OTPMessage) {
+		code = message.Code
+	})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	for i := config.OTPMaxAttempts; i < config.OTPLockoutAttempts; i++ {
+		verify(wrongCode)
+	}
+
+	if err = verify(code); err == nil || err.Code != ngauth.ErrorTooManyAttempts {
+		t.Fatal("expected ErrorTooManyAttempts")
+	}
+	if _, err = ngauth.GenerateOTP(db, "en", params, nil); err == nil || err.Code != ngauth.ErrorTooManyAttempts {
+		t.Fatal("expected ErrorTooManyAttempts on generate_otp")
+	}
+
+	//lockout window passed
+	config.OTPLockoutTime = -1
+	if err = verify(code); err != nil {
+		t.Fatal(err.Message)
+	}
+}
+
+func TestVerifyOTPConcurrentAttempts(t *testing.T) {
+
+	config := setTestConfig()
+	config.OTPMaxAttempts = 3
+	config.OTPLockoutAttempts = 0
+	db := newTestDB(t)
+
+	var code string
+	_, err := ngauth.GenerateOTP(db, "en", map[string]interface{}{"email": "b@example.com", "otp_for": "REGISTER"}, func(message ngauth.OTPMessage) {
+		code = message.Code
+	})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	wrongCode := "000000"
+	if code == wrongCode {
+		wrongCode = "111111"
+	}
+
+	//wrong codes at the same time, only OTPMaxAttempts of them are checked
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	checked := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ngauth.VerifyOTP(db, "en", map[string]interface{}{"email": "b@example.com", "otp_for": "REGISTER", "code": wrongCode})
+			if err != nil && err.Code == ngauth.ErrorInvalidOTPCode {
+				mu.Lock()
+				checked++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if checked >= config.OTPMaxAttempts {
+		t.Fatalf("%d wrong codes checked", checked)
+	}
+	_, err = ngauth.VerifyOTP(db, "en", map[string]interface{}{"email": "b@example.com", "otp_for": "REGISTER", "code": code})
+	if err == nil || err.Code != ngauth.ErrorOTPAttemptsExceeded {
+		t.Fatal("expected ErrorOTPAttemptsExceeded for the correct code")
+	}
+}
+
+func TestResetPassword(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	registerUser(t, db, "c@example.com", "1234")
+	verificationID := generateAndVerifyOTP(t, db, "c@example.com", "RESET")
+
+	_, err := ngauth.ResetPassword(db, "en", map[string]interface{}{"email": "c@example.com", "password": "abcd", "confirm_password": "abcd", "verification_id": verificationID}, hashMake)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	if _, err = ngauth.Login(db, "en", map[string]interface{}{"email": "c@example.com", "password": "abcd"}, hashCheck); err != nil {
+		t.Fatal(err.Message)
+	}
+}
+
+func TestVerificationSingleUse(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	registerUser(t, db, "c@example.com", "1234")
+	registerUser(t, db, "d@example.com", "1234")
+	verificationID := generateAndVerifyOTP(t, db, "c@example.com", "RESET")
+
+	reset := func(email string, verificationID string) *ngauth.Error {
+		_, err := ngauth.ResetPassword(db, "en", map[string]interface{}{"email": email, "password": "abcd", "confirm_password": "abcd", "verification_id": verificationID}, hashMake)
+		return err
+	}
+
+	//bound to the email it was verified for
+	if err := reset("d@example.com", verificationID); err == nil || err.Code != ngauth.ErrorGetVerifiedFirst {
+		t.Fatal("verification_id of another email was accepted")
+	}
+
+	if err := reset("c@example.com", verificationID); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//replay
+	if err := reset("c@example.com", verificationID); err == nil || err.Code != ngauth.ErrorVerificationUsed {
+		t.Fatal("verification_id was used twice")
+	}
+
+	//bound to otp_for
+	unlockID := generateAndVerifyOTP(t, db, "c@example.com", "UNLOCK")
+	if err := reset("c@example.com", unlockID); err == nil || err.Code != ngauth.ErrorGetVerifiedFirst {
+		t.Fatal("UNLOCK verification_id was accepted by reset password")
+	}
+}
+
+func TestVerificationExpired(t *testing.T) {
+
+	config := setTestConfig()
+	db := newTestDB(t)
+
+	registerUser(t, db, "c@example.com", "1234")
+
+	config.VerificationExpireTime = -1
+	ngauth.SetConfig(config)
+	verificationID := generateAndVerifyOTP(t, db, "c@example.com", "RESET")
+
+	_, err := ngauth.ResetPassword(db, "en", map[string]interface{}{"email": "c@example.com", "password": "abcd", "confirm_password": "abcd", "verification_id": verificationID}, hashMake)
+	if err == nil || err.Code != ngauth.ErrorVerificationExpired {
+		t.Fatal("expired verification_id was accepted")
+	}
+}
+
+func TestLogout(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "d@example.com", "1234")
+
+	login := func() string {
+		response, err := ngauth.Login(db, "en", map[string]interface{}{"email": "d@example.com", "password": "1234"}, hashCheck)
+		if err != nil {
+			t.Fatal(err.Message)
+		}
+		return response["refresh_token"].(string)
+	}
+
+	refreshToken := login()
+	if _, err := ngauth.Logout(db, "en", map[string]interface{}{"refresh_token": refreshToken}); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//revoked refresh token
+	_, err := ngauth.Token(db, "en", map[string]interface{}{"refresh_token": refreshToken})
+	if err == nil || err.Code != ngauth.ErrorInvalidToken {
+		t.Fatal("expected ErrorInvalidToken")
+	}
+
+	//logout everywhere
+	refreshToken = login()
+	if _, err = ngauth.LogoutAll(db, "en", map[string]interface{}{"loggedin_user_id": userID}); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	if _, err = ngauth.Token(db, "en", map[string]interface{}{"refresh_token": refreshToken}); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+
+	config := setTestConfig()
+	config.JWTRefreshRotation = true
+	db := newTestDB(t)
+
+	registerUser(t, db, "e@example.com", "1234")
+
+	response, err := ngauth.Login(db, "en", map[string]interface{}{"email": "e@example.com", "password": "1234"}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	first := response["refresh_token"]
+
+	response, err = ngauth.Token(db, "en", map[string]interface{}{"refresh_token": first})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	second := response["refresh_token"]
+	if second == nil || second == first {
+		t.Fatal("expected a new refresh token")
+	}
+
+	//reuse of the rotated token revokes the family
+	_, err = ngauth.Token(db, "en", map[string]interface{}{"refresh_token": first})
+	if err == nil || err.Code != ngauth.ErrorInvalidToken {
+		t.Fatal("expected ErrorInvalidToken")
+	}
+
+	if _, err = ngauth.Token(db, "en", map[string]interface{}{"refresh_token": second}); err == nil {
+		t.Fatal("expected the whole family to be revoked")
+	}
+}
+
+func TestTokenTypes(t *testing.T) {
+
+	config := setTestConfig()
+	config.JWTIssuer = "ngauth"
+	config.JWTAudience = "api"
+
+	accessToken, _ := ngauth.GenerateAccessToken(int64(1))
+	refreshToken, _ := ngauth.GenerateRefreshToken(int64(1))
+
+	claims, err := ngauth.IsValidAccessToken(accessToken)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if claims["sub"] != "1" || claims["iss"] != "ngauth" || claims["aud"] != "api" || claims["jti"] == nil || claims["nbf"] == nil {
+		t.Fatalf("unexpected claims %v", claims)
+	}
+
+	//refresh token is not a bearer token and vice versa
+	if _, err = ngauth.IsValidAccessToken(refreshToken); err == nil || err.Code != ngauth.ErrorInvalidToken {
+		t.Fatal("refresh token accepted as access token")
+	}
+	if _, err = ngauth.IsValidRefreshToken(accessToken); err == nil {
+		t.Fatal("access token accepted as refresh token")
+	}
+	if _, err = ngauth.Token(newTestDB(t), "en", map[string]interface{}{"refresh_token": accessToken}); err == nil {
+		t.Fatal("access token accepted by Token")
+	}
+
+	//other issuer/audience
+	config.JWTAudience = "other"
+	if _, err = ngauth.IsValidAccessToken(accessToken); err == nil {
+		t.Fatal("wrong audience accepted")
+	}
+	config.JWTAudience = "api"
+	config.JWTIssuer = "other"
+	if _, err = ngauth.IsValidAccessToken(accessToken); err == nil {
+		t.Fatal("wrong issuer accepted")
+	}
+}
+
+func TestLegacyTokens(t *testing.T) {
+
+	config := setTestConfig()
+	config.JWTIssuer = "ngauth"
+	config.JWTAudience = "api"
+	db := newTestDB(t)
+
+	//tokens of older versions, only the lifetime tells access and refresh tokens apart
+	claims := jwt.MapClaims{"id": 1, "iat": time.Now().Unix(), "exp": time.Now().Add(15 * time.Minute).Unix()}
+	accessToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(config.SignKey)
+	claims["exp"] = time.Now().Add(24 * time.Hour).Unix()
+	refreshToken, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(config.SignKey)
+
+	if _, err := ngauth.IsValidAccessToken(accessToken); err == nil {
+		t.Fatal("legacy token accepted")
+	}
+
+	config.JWTAcceptLegacyTokens = true
+	if _, err := ngauth.IsValidAccessToken(accessToken); err != nil {
+		t.Fatal(err.Message)
+	}
+	if _, err := ngauth.IsValidRefreshToken(accessToken); err == nil {
+		t.Fatal("legacy access token accepted as refresh token")
+	}
+	if _, err := ngauth.IsValidAccessToken(refreshToken); err == nil {
+		t.Fatal("legacy refresh token accepted as access token")
+	}
+	if _, err := ngauth.IsValidMFAToken(accessToken); err == nil {
+		t.Fatal("legacy token accepted as mfa token")
+	}
+
+	_, err := db.CreateSession(ngauth.Session{UserID: 1, RefreshToken: refreshToken, CreatedAt: null.TimeFrom(time.Now())}, "en")
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	response, err := ngauth.Token(db, "en", map[string]interface{}{"refresh_token": refreshToken})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if newClaims, _ := ngauth.IsValidAccessToken(response["access_token"].(string)); newClaims["token_use"] != ngauth.TokenUseAccess || newClaims["iss"] != "ngauth" {
+		t.Fatal("new access token", newClaims)
+	}
+
+	//a different issuer is still rejected
+	otherIssuer, _ := ngauth.GenerateAccessToken(1)
+	config.JWTIssuer = "other"
+	if _, err = ngauth.IsValidAccessToken(otherIssuer); err == nil {
+		t.Fatal("wrong issuer accepted")
+	}
+}
+
+func TestTOTPLogin(t *testing.T) {
+
+	config := setTestConfig()
+	config.TOTPSkew = 2
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+	params := map[string]interface{}{"loggedin_user_id": userID}
+
+	//confirm before enroll
+	_, err := ngauth.ConfirmTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID, "code": "123456"}, hashMake)
+	if err == nil || err.Code != ngauth.ErrorTOTPNotEnabled {
+		t.Fatal("expected ErrorTOTPNotEnabled")
+	}
+
+	response, err := ngauth.EnrollTOTP(db, "en", params)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	secret := response["secret"].(string)
+
+	//not enabled until confirmed
+	response, err = ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234"}, hashCheck)
+	if err != nil || response["access_token"] == nil {
+		t.Fatal("expected tokens before TOTP is confirmed")
+	}
+
+	_, err = ngauth.ConfirmTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID, "code": "000000"}, hashMake)
+	if err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+		t.Fatal("expected ErrorInvalidOTPCode")
+	}
+
+	//codes are accepted once, each step uses the code of the next one
+	now := time.Now()
+	confirmCode, _ := ngauth.TOTPCode(secret, now.Add(-30*time.Second))
+	code, _ := ngauth.TOTPCode(secret, now)
+	disableCode, _ := ngauth.TOTPCode(secret, now.Add(30*time.Second))
+
+	response, err = ngauth.ConfirmTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID, "code": confirmCode}, hashMake)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if len(response["recovery_codes"].([]string)) != 10 {
+		t.Fatal("expected 10 recovery codes")
+	}
+
+	//login returns an mfa challenge instead of tokens
+	response, err = ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234"}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["mfa_required"] != true || response["access_token"] != nil {
+		t.Fatalf("expected mfa challenge, got %v", response)
+	}
+	mfaToken := response["mfa_token"]
+
+	//mfa token is not an access token
+	if _, err = ngauth.IsValidAccessToken(mfaToken.(string)); err == nil {
+		t.Fatal("mfa token accepted as access token")
+	}
+
+	_, err = ngauth.LoginTOTP(db, "en", map[string]interface{}{"mfa_token": mfaToken, "code": "000000"}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+		t.Fatal("expected ErrorInvalidOTPCode")
+	}
+
+	//the confirmation code was used
+	_, err = ngauth.LoginTOTP(db, "en", map[string]interface{}{"mfa_token": mfaToken, "code": confirmCode}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+		t.Fatal("expected ErrorInvalidOTPCode for a used code")
+	}
+
+	response, err = ngauth.LoginTOTP(db, "en", map[string]interface{}{"mfa_token": mfaToken, "code": code}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["access_token"] == nil || response["refresh_token"] == nil {
+		t.Fatal("expected tokens after second factor")
+	}
+
+	//the mfa token and the code are used up
+	_, err = ngauth.LoginTOTP(db, "en", map[string]interface{}{"mfa_token": mfaToken, "code": disableCode}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidToken {
+		t.Fatal("expected ErrorInvalidToken for a used mfa token")
+	}
+	response, _ = ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234"}, hashCheck)
+	_, err = ngauth.LoginTOTP(db, "en", map[string]interface{}{"mfa_token": response["mfa_token"], "code": code}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+		t.Fatal("expected ErrorInvalidOTPCode for a used code")
+	}
+
+	//disable
+	_, err = ngauth.DisableTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID, "code": disableCode}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	response, err = ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234"}, hashCheck)
+	if err != nil || response["access_token"] == nil {
+		t.Fatal("expected tokens after TOTP is disabled")
+	}
+}
+
+func TestTOTPLockout(t *testing.T) {
+
+	config := setTestConfig()
+	config.LoginMaxFailures = 3
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+	response, _ := ngauth.EnrollTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID})
+	secret := response["secret"].(string)
+	confirmCode, _ := ngauth.TOTPCode(secret, time.Now().Add(-30*time.Second))
+	if _, err := ngauth.ConfirmTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID, "code": confirmCode}, hashMake); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	mfaToken := func() interface{} {
+		response, err := ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234"}, hashCheck)
+		if err != nil {
+			t.Fatal(err.Message)
+		}
+		return response["mfa_token"]
+	}
+
+	token := mfaToken()
+	for i := 0; i < config.LoginMaxFailures-1; i++ {
+		_, err := ngauth.LoginTOTP(db, "en", map[string]interface{}{"mfa_token": token, "code": "000000"}, hashCheck)
+		if err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+			t.Fatal("expected ErrorInvalidOTPCode")
+		}
+	}
+
+	//the password does not reset the wrong codes
+	token = mfaToken()
+	_, err := ngauth.LoginTOTP(db, "en", map[string]interface{}{"mfa_token": token, "code": "000000"}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorAccountLocked {
+		t.Fatal("expected ErrorAccountLocked")
+	}
+
+	//the mfa token is used up, the account locked
+	code, _ := ngauth.TOTPCode(secret, time.Now())
+	_, err = ngauth.LoginTOTP(db, "en", map[string]interface{}{"mfa_token": token, "code": code}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidToken {
+		t.Fatal("expected ErrorInvalidToken")
+	}
+	_, err = ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234"}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorAccountLocked {
+		t.Fatal("expected ErrorAccountLocked")
+	}
+}
+
+func TestRecoveryCodes(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+
+	//only for TOTP users
+	_, err := ngauth.RegenerateRecoveryCodes(db, "en", map[string]interface{}{"loggedin_user_id": userID}, hashMake)
+	if err == nil || err.Code != ngauth.ErrorTOTPNotEnabled {
+		t.Fatal("expected ErrorTOTPNotEnabled")
+	}
+
+	response, _ := ngauth.EnrollTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID})
+	code, _ := ngauth.TOTPCode(response["secret"].(string), time.Now())
+	response, err = ngauth.ConfirmTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID, "code": code}, hashMake)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	oldCodes := response["recovery_codes"].([]string)
+
+	response, err = ngauth.RegenerateRecoveryCodes(db, "en", map[string]interface{}{"loggedin_user_id": userID}, hashMake)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	codes := response["recovery_codes"].([]string)
+
+	login := func(recoveryCode string) *ngauth.Error {
+		response, err := ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234"}, hashCheck)
+		if err != nil {
+			t.Fatal(err.Message)
+		}
+		_, err = ngauth.LoginTOTP(db, "en", map[string]interface{}{"mfa_token": response["mfa_token"], "recovery_code": recoveryCode}, hashCheck)
+		return err
+	}
+
+	//regenerated, old codes stop working
+	if err = login(oldCodes[0]); err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+		t.Fatal("old recovery code accepted")
+	}
+
+	//case and dashes are ignored
+	if err = login(" " + strings.ToUpper(strings.Replace(codes[0], "-", "", 1))); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//single use
+	if err = login(codes[0]); err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+		t.Fatal("recovery code used twice")
+	}
+
+	//lost device, disable with a recovery code
+	_, err = ngauth.DisableTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID, "recovery_code": codes[1]}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	left, _ := db.GetRecoveryCodes(userID, "en")
+	if len(left) != 0 {
+		t.Fatal("recovery codes not deleted when TOTP is disabled")
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+
+	config := setTestConfig()
+	config.LoginMaxFailures = 3
+	config.LoginMaxFailuresPerIP = 5
+	config.LoginFindTime = 900
+	db := newTestDB(t)
+
+	registerUser(t, db, "a@example.com", "1234")
+
+	login := func(email string, password string, ipAddr string) *ngauth.Error {
+		_, err := ngauth.Login(db, "en", map[string]interface{}{"email": email, "password": password, "ip_addr": ipAddr}, hashCheck)
+		return err
+	}
+
+	for i := 0; i < config.LoginMaxFailures; i++ {
+		if err := login("a@example.com", "wrong", "10.0.0.1"); err == nil || err.Code != ngauth.ErrorIncorrectEmailOrPassword {
+			t.Fatal("expected ErrorIncorrectEmailOrPassword")
+		}
+	}
+
+	//locked, even with the correct password
+	if err := login("a@example.com", "1234", "10.0.0.2"); err == nil || err.Code != ngauth.ErrorAccountLocked {
+		t.Fatal("expected ErrorAccountLocked")
+	}
+
+	//unlock via otp
+	verificationID := generateAndVerifyOTP(t, db, "a@example.com", "UNLOCK")
+	if _, err := ngauth.UnlockAccount(db, "en", map[string]interface{}{"email": "a@example.com", "verification_id": "wrong"}); err == nil || err.Code != ngauth.ErrorGetVerifiedFirst {
+		t.Fatal("expected ErrorGetVerifiedFirst")
+	}
+	if _, err := ngauth.UnlockAccount(db, "en", map[string]interface{}{"email": "a@example.com", "verification_id": verificationID}); err != nil {
+		t.Fatal(err.Message)
+	}
+	if err := login("a@example.com", "1234", "10.0.0.2"); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//per ip address, unknown users count too
+	for i := 0; i < 2; i++ {
+		login("unknown@example.com", "wrong", "10.0.0.1")
+	}
+	if err := login("a@example.com", "1234", "10.0.0.1"); err == nil || err.Code != ngauth.ErrorTooManyAttempts {
+		t.Fatal("expected ErrorTooManyAttempts")
+	}
+	if err := login("a@example.com", "1234", "10.0.0.3"); err != nil {
+		t.Fatal(err.Message)
+	}
+}
+
+func TestLoginThrottleClientIP(t *testing.T) {
+
+	config := setTestConfig()
+	config.LoginMaxFailuresPerIP = 3
+	config.LoginFindTime = 900
+	db := newTestDB(t)
+
+	registerUser(t, db, "a@example.com", "1234")
+
+	//failures from an hour ago are deleted with the next failure
+	db.CreateLoginFailure(ngauth.LoginFailure{IPAddr: "203.0.113.7", CreatedAt: null.TimeFrom(time.Now().Add(-time.Hour))}, "en")
+
+	//same ip address, a new connection every time
+	login := func(password string, port int) *ngauth.Error {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = fmt.Sprintf("203.0.113.7:%d", port)
+		_, err := ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": password, "ip_addr": ngauth.ClientIP(r)}, hashCheck)
+		return err
+	}
+
+	for port := 50001; port <= 50003; port++ {
+		if err := login("wrong", port); err == nil || err.Code != ngauth.ErrorIncorrectEmailOrPassword {
+			t.Fatal("expected ErrorIncorrectEmailOrPassword")
+		}
+	}
+	if err := login("1234", 50004); err == nil || err.Code != ngauth.ErrorTooManyAttempts {
+		t.Fatal("expected ErrorTooManyAttempts")
+	}
+
+	if count, _ := db.CountLoginFailures("203.0.113.7", time.Time{}, "en"); count != 3 {
+		t.Fatal("old failures not deleted", count)
+	}
+}
+
+func TestLoginLockoutBackoff(t *testing.T) {
+
+	config := setTestConfig()
+	config.LoginMaxFailures = 2
+	config.LoginLockoutTime = 100
+	config.LoginMaxLockoutTime = 300
+	db := newTestDB(t)
+
+	registerUser(t, db, "a@example.com", "1234")
+
+	lockedFor := func() int64 {
+		user, _ := db.GetUserBy("a@example.com", "", "en")
+		return int64(time.Until(user.LockedUntil.Time).Seconds() + 0.5)
+	}
+
+	//failures while locked are refused before the password is checked,
+	//expire the lock to simulate the next attempts after the lockout
+	expected := []int64{100, 200, 300, 300}
+	ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "wrong"}, hashCheck)
+	for _, seconds := range expected {
+		ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "wrong"}, hashCheck)
+		if lockedFor() != seconds {
+			t.Fatalf("expected lockout of %d seconds, got %d", seconds, lockedFor())
+		}
+		user, _ := db.GetUserBy("a@example.com", "", "en")
+		db.UpdateUserByID(user.ID, ngauth.Map{"locked_until": time.Now().Add(-time.Second)}, "en")
+	}
+
+	//a successful login resets the failures
+	if _, err := ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234"}, hashCheck); err != nil {
+		t.Fatal(err.Message)
+	}
+	user, _ := db.GetUserBy("a@example.com", "", "en")
+	if user.FailedLogins != 0 || user.LockedUntil.Valid {
+		t.Fatal("failed logins not reset")
+	}
+}
+
+// requestLoginOTP - runs generate_otp with otp_for LOGIN, returns the message sent
+func requestLoginOTP(t *testing.T, db ngauth.Database, email string) ngauth.OTPMessage {
+
+	var message ngauth.OTPMessage
+	_, err := ngauth.GenerateOTP(db, "en", map[string]interface{}{"email": email, "otp_for": "LOGIN"}, func(m ngauth.OTPMessage) {
+		message = m
+	})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	return message
+}
+
+func TestMagicLinkLogin(t *testing.T) {
+
+	config := setTestConfig()
+	config.MagicLinkURL = "https://app.example.com/login?source=email"
+	db := newTestDB(t)
+
+	registerUser(t, db, "a@example.com", "1234")
+
+	message := requestLoginOTP(t, db, "a@example.com")
+	prefix := "https://app.example.com/login?source=email&token="
+	if !strings.HasPrefix(message.Link, prefix) {
+		t.Fatal("link", message.Link)
+	}
+	token := strings.TrimPrefix(message.Link, prefix)
+
+	//the link is not an access token
+	if _, err := ngauth.IsValidAccessToken(token); err == nil {
+		t.Fatal("magic link token accepted as access token")
+	}
+
+	//a newer link replaces it
+	newer := requestLoginOTP(t, db, "a@example.com")
+	if _, err := ngauth.LoginOTP(db, "en", map[string]interface{}{"token": token}); err == nil || err.Code != ngauth.ErrorInvalidToken {
+		t.Fatal("older link accepted")
+	}
+	token = strings.TrimPrefix(newer.Link, prefix)
+
+	response, err := ngauth.LoginOTP(db, "en", map[string]interface{}{"token": token, "ip_addr": "127.0.0.1", "user_agent": "test"})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	refreshToken, _ := response["refresh_token"].(string)
+	if response["access_token"] == nil || len(refreshToken) == 0 {
+		t.Fatal("tokens not returned", response)
+	}
+
+	session, err := db.GetSession(refreshToken, "en")
+	if err != nil || session == nil || session.IPAddr != "127.0.0.1" || session.UserAgent != "test" {
+		t.Fatal("session not created", session)
+	}
+
+	//the link and the code are single use
+	if _, err = ngauth.LoginOTP(db, "en", map[string]interface{}{"token": token}); err == nil || err.Code != ngauth.ErrorAlreadyVerified {
+		t.Fatal("link used twice")
+	}
+	if _, err = ngauth.LoginOTP(db, "en", map[string]interface{}{"email": "a@example.com", "code": newer.Code}); err == nil || err.Code != ngauth.ErrorAlreadyVerified {
+		t.Fatal("code used after the link")
+	}
+}
+
+func TestMagicLinkLockout(t *testing.T) {
+
+	config := setTestConfig()
+	config.MagicLinkURL = "https://app.example.com/login"
+	config.OTPMaxAttempts = 2
+	config.OTPLockoutAttempts = 3
+	db := newTestDB(t)
+
+	registerUser(t, db, "a@example.com", "1234")
+
+	link := func(message ngauth.OTPMessage) map[string]interface{} {
+		return map[string]interface{}{"token": strings.TrimPrefix(message.Link, "https://app.example.com/login?token=")}
+	}
+	wrongCode := func() {
+		ngauth.LoginOTP(db, "en", map[string]interface{}{"email": "a@example.com", "code": "000000"})
+	}
+
+	//the otp is invalidated by wrong codes
+	message := requestLoginOTP(t, db, "a@example.com")
+	wrongCode()
+	wrongCode()
+	if _, err := ngauth.LoginOTP(db, "en", link(message)); err == nil || err.Code != ngauth.ErrorOTPAttemptsExceeded {
+		t.Fatal("expected ErrorOTPAttemptsExceeded")
+	}
+
+	//the identifier is locked, a new link is refused too
+	message = requestLoginOTP(t, db, "a@example.com")
+	wrongCode()
+	if _, err := ngauth.LoginOTP(db, "en", link(message)); err == nil || err.Code != ngauth.ErrorTooManyAttempts {
+		t.Fatal("expected ErrorTooManyAttempts")
+	}
+
+	config.OTPLockoutAttempts = 0
+	if _, err := ngauth.LoginOTP(db, "en", link(message)); err != nil {
+		t.Fatal(err.Message)
+	}
+}
+
+func TestLoginOTPCode(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+
+	//unknown users and other otp_for values
+	if _, err := ngauth.GenerateOTP(db, "en", map[string]interface{}{"email": "b@example.com", "otp_for": "LOGIN"}, nil); err == nil || err.Code != ngauth.ErrorUserNotFound {
+		t.Fatal("login otp sent to unknown user")
+	}
+
+	message := requestLoginOTP(t, db, "a@example.com")
+	if message.Link != "" {
+		t.Fatal("link sent without MagicLinkURL")
+	}
+
+	if _, err := ngauth.VerifyOTP(db, "en", map[string]interface{}{"email": "a@example.com", "otp_for": "LOGIN", "code": message.Code}); err == nil || err.Code != ngauth.ErrorWrongValueFor {
+		t.Fatal("LOGIN otp exchanged for a verification_id")
+	}
+
+	if _, err := ngauth.LoginOTP(db, "en", map[string]interface{}{"email": "a@example.com", "code": "000000"}); err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+		t.Fatal("wrong code accepted")
+	}
+
+	response, err := ngauth.LoginOTP(db, "en", map[string]interface{}{"email": "a@example.com", "code": message.Code})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["access_token"] == nil || response["refresh_token"] == nil {
+		t.Fatal("tokens not returned", response)
+	}
+
+	//second factor still required
+	enroll, _ := ngauth.EnrollTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID})
+	code, _ := ngauth.TOTPCode(enroll["secret"].(string), time.Now())
+	if _, err = ngauth.ConfirmTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID, "code": code}, hashMake); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	message = requestLoginOTP(t, db, "a@example.com")
+	response, err = ngauth.LoginOTP(db, "en", map[string]interface{}{"email": "a@example.com", "code": message.Code})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["mfa_required"] != true || response["access_token"] != nil {
+		t.Fatal("second factor skipped", response)
+	}
+}
+
+func TestPhoneLoginOTP(t *testing.T) {
+
+	config := setTestConfig()
+	config.MagicLinkURL = "https://app.example.com/login"
+	db := newTestDB(t)
+
+	//register by phone, the number is normalised to E.164
+	var code string
+	_, err := ngauth.GenerateOTP(db, "en", map[string]interface{}{"phone_number": "0712 345 678", "country_code": "TZ", "otp_for": "REGISTER"}, func(message ngauth.OTPMessage) {
+		code = message.Code
+	})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	response, err := ngauth.VerifyOTP(db, "en", map[string]interface{}{"phone_number": "+255712345678", "country_code": "TZ", "otp_for": "REGISTER", "code": code})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	_, err = ngauth.Register(db, "en", map[string]interface{}{"phone_number": "0712345678", "country_code": "TZ", "password": "1234", "confirm_password": "1234", "verification_id": response["verification_id"]}, hashMake)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	if _, err = ngauth.GenerateOTP(db, "en", map[string]interface{}{"phone_number": "0712345679", "country_code": "TZ", "otp_for": "LOGIN"}, nil); err == nil || err.Code != ngauth.ErrorUserNotFound {
+		t.Fatal("login otp sent to unknown phone number")
+	}
+
+	var message ngauth.OTPMessage
+	_, err = ngauth.GenerateOTP(db, "sw", map[string]interface{}{"phone_number": "0712345678", "country_code": "TZ", "otp_for": "LOGIN"}, func(m ngauth.OTPMessage) {
+		message = m
+	})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if message.PhoneNumber != "+255712345678" || message.Email != "" || len(message.Code) == 0 {
+		t.Fatalf("message %+v", message)
+	}
+	//links are emailed only
+	if message.Link != "" {
+		t.Fatal("magic link sent by sms", message.Link)
+	}
+
+	rendered, renderErr := ngauth.RenderOTPMessage(message)
+	if renderErr != nil || !strings.Contains(rendered.SMS, message.Code) {
+		t.Fatal("sms", rendered.SMS, renderErr)
+	}
+
+	//Login without a password takes the code
+	_, err = ngauth.Login(db, "en", map[string]interface{}{"phone_number": "0712345678", "country_code": "TZ", "code": "000000"}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+		t.Fatal("wrong code accepted")
+	}
+
+	response, err = ngauth.Login(db, "en", map[string]interface{}{"phone_number": "0712345678", "country_code": "TZ", "code": message.Code}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["access_token"] == nil || response["refresh_token"] == nil {
+		t.Fatal("tokens not returned", response)
+	}
+
+	//single use
+	if _, err = ngauth.LoginOTP(db, "en", map[string]interface{}{"phone_number": "+255712345678", "country_code": "TZ", "code": message.Code}); err == nil {
+		t.Fatal("code used twice")
+	}
+
+	//rate limited like the other otps
+	for i := 0; i < 2; i++ {
+		if _, err = ngauth.GenerateOTP(db, "en", map[string]interface{}{"phone_number": "0712345678", "country_code": "TZ", "otp_for": "LOGIN"}, nil); err != nil {
+			t.Fatal(err.Message)
+		}
+	}
+	if _, err = ngauth.GenerateOTP(db, "en", map[string]interface{}{"phone_number": "0712345678", "country_code": "TZ", "otp_for": "LOGIN"}, nil); err == nil || err.Code != ngauth.ErrorBadRequest {
+		t.Fatal("login otp not rate limited")
+	}
+}
@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/hmkwizu/ngauth"
+)
+
+// oauthTokens - tokens of the authorization code flow for a confidential client
+func oauthTokens(t *testing.T, db ngauth.Database, clientID string, secret string) map[string]interface{} {
+
+	code := authorizeCode(t, db, clientID, "read", map[string]interface{}{"username": "a@example.com", "password": "1234"})
+	response, err := ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "authorization_code", "client_id": clientID, "client_secret": secret, "code": code, "redirect_uri": testRedirectURI, "code_verifier": testVerifier}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	return response
+}
+
+func TestIntrospectToken(t *testing.T) {
+
+	config := setTestConfig()
+	config.JWTRefreshRotation = true
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+	clientID, secret := registerOAuthClient(t, db, false, "read")
+	publicClientID, _ := registerOAuthClient(t, db, true, "read")
+	tokens := oauthTokens(t, db, clientID, secret)
+
+	introspect := func(token interface{}) map[string]interface{} {
+		response, err := ngauth.IntrospectToken(db, "en", map[string]interface{}{"client_id": clientID, "client_secret": secret, "token": token}, hashCheck)
+		if err != nil {
+			t.Fatal(err.Message)
+		}
+		return response
+	}
+
+	response := introspect(tokens["access_token"])
+	if response["active"] != true || response["client_id"] != clientID || response["scope"] != "read" || response["sub"] != ngauth.GetStringOrEmpty(userID) || response["token_use"] != ngauth.TokenUseAccess {
+		t.Fatal("access token", response)
+	}
+
+	//client_id and scope of the session
+	response = introspect(tokens["refresh_token"])
+	if response["active"] != true || response["client_id"] != clientID || response["scope"] != "read" || response["token_use"] != ngauth.TokenUseRefresh {
+		t.Fatal("refresh token", response)
+	}
+
+	response = introspect("not-a-token")
+	if response["active"] != false || len(response) != 1 {
+		t.Fatal("invalid token", response)
+	}
+
+	//rotated refresh tokens are not active
+	_, err := ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "refresh_token", "client_id": clientID, "client_secret": secret, "refresh_token": tokens["refresh_token"]}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response = introspect(tokens["refresh_token"]); response["active"] != false {
+		t.Fatal("rotated refresh token", response)
+	}
+
+	_, err = ngauth.IntrospectToken(db, "en", map[string]interface{}{"client_id": publicClientID, "token": tokens["access_token"]}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorUnauthorizedClient {
+		t.Fatal("expected ErrorUnauthorizedClient for a public client")
+	}
+
+	_, err = ngauth.IntrospectToken(db, "en", map[string]interface{}{"client_id": clientID, "client_secret": "wrong", "token": tokens["access_token"]}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidClient {
+		t.Fatal("expected ErrorInvalidClient for a wrong secret")
+	}
+}
+
+func TestRevokeToken(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	registerUser(t, db, "a@example.com", "1234")
+	clientID, secret := registerOAuthClient(t, db, false, "read")
+	otherClientID, otherSecret := registerOAuthClient(t, db, false, "read")
+	tokens := oauthTokens(t, db, clientID, secret)
+
+	revokeParams := map[string]interface{}{"client_id": otherClientID, "client_secret": otherSecret, "token": tokens["refresh_token"]}
+	if err := ngauth.RevokeToken(db, "en", revokeParams, hashCheck); err == nil || err.Code != ngauth.ErrorUnauthorizedClient {
+		t.Fatal("expected ErrorUnauthorizedClient for the token of another client")
+	}
+
+	revokeParams = map[string]interface{}{"client_id": clientID, "client_secret": secret, "token": tokens["refresh_token"]}
+	if err := ngauth.RevokeToken(db, "en", revokeParams, hashCheck); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	_, err := ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "refresh_token", "client_id": clientID, "client_secret": secret, "refresh_token": tokens["refresh_token"]}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidToken {
+		t.Fatal("expected ErrorInvalidToken for a revoked refresh token")
+	}
+
+	//revoked twice and invalid tokens are ignored
+	if err = ngauth.RevokeToken(db, "en", revokeParams, hashCheck); err != nil {
+		t.Fatal(err.Message)
+	}
+	revokeParams["token"] = "not-a-token"
+	if err = ngauth.RevokeToken(db, "en", revokeParams, hashCheck); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//access tokens revoke the sessions of the client
+	tokens = oauthTokens(t, db, clientID, secret)
+	revokeParams["token"] = tokens["access_token"]
+	if err = ngauth.RevokeToken(db, "en", revokeParams, hashCheck); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	response, err := ngauth.IntrospectToken(db, "en", map[string]interface{}{"client_id": clientID, "client_secret": secret, "token": tokens["refresh_token"]}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["active"] != false {
+		t.Fatal("refresh token of a revoked access token", response)
+	}
+}
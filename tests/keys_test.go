@@ -0,0 +1,201 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/hmkwizu/ngauth"
+)
+
+func pemPrivateKey(t *testing.T, privateKey interface{}) []byte {
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+func TestAsymmetricSigning(t *testing.T) {
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	keys := map[string]interface{}{"RS256": rsaKey, "PS256": rsaKey, "ES256": ecKey, "EdDSA": edKey}
+
+	for alg, privateKey := range keys {
+
+		config := setTestConfig()
+		key, err := ngauth.ParseSigningKeyPEM(alg, "", pemPrivateKey(t, privateKey))
+		if err != nil {
+			t.Fatalf("%s: %s", alg, err)
+		}
+		config.JWTSigningAlg = alg
+		config.JWTKeyring = ngauth.NewKeyring(key, time.Hour)
+
+		token, apiErr := ngauth.GenerateAccessToken(1)
+		if apiErr != nil {
+			t.Fatalf("%s: %s", alg, apiErr.Message)
+		}
+
+		if _, apiErr = ngauth.IsValidToken(token); apiErr != nil {
+			t.Fatalf("%s: %s", alg, apiErr.Message)
+		}
+
+		//public key is published with the kid
+		jwks := ngauth.JWKS()["keys"].([]map[string]interface{})
+		if len(jwks) != 1 || jwks[0]["kid"] != key.ID || jwks[0]["alg"] != alg {
+			t.Fatalf("%s: unexpected jwks %v", alg, jwks)
+		}
+
+		//HS256 token signed with the shared secret must be rejected
+		keyring := config.JWTKeyring
+		config.JWTKeyring = nil
+		config.JWTSigningAlg = "HS256"
+		hmacToken, _ := ngauth.GenerateAccessToken(1)
+		config.JWTKeyring = keyring
+		config.JWTSigningAlg = alg
+		if _, apiErr = ngauth.IsValidToken(hmacToken); apiErr == nil {
+			t.Fatalf("%s: accepted HS256 token", alg)
+		}
+	}
+
+	//curve does not match the algorithm
+	if _, err := ngauth.ParseSigningKeyPEM("ES384", "", pemPrivateKey(t, ecKey)); err == nil {
+		t.Fail()
+	}
+
+	//secrets are never published
+	setTestConfig()
+	if len(ngauth.JWKS()["keys"].([]map[string]interface{})) != 0 {
+		t.Fail()
+	}
+}
+
+func TestKeyringRotation(t *testing.T) {
+
+	config := setTestConfig()
+
+	oldKey, _ := ngauth.NewHMACSigningKey("HS256", "old", []byte("g4k591b582367a97acd7d1e5dc260729"))
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ngauth.ParseSigningKeyPEM("ES256", "new", pemPrivateKey(t, ecKey))
+
+	keyring := ngauth.NewKeyring(oldKey, time.Hour)
+	config.JWTKeyring = keyring
+
+	oldToken, _ := ngauth.GenerateAccessToken(1)
+
+	keyring.Promote(newKey)
+
+	//retired key still verifies
+	if _, err := ngauth.IsValidToken(oldToken); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	newToken, _ := ngauth.GenerateAccessToken(1)
+	if _, err := ngauth.IsValidToken(newToken); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//aged out
+	keyring.Retention = 0
+	if _, err := ngauth.IsValidToken(oldToken); err == nil {
+		t.Fatal("expected retired key to age out")
+	}
+	if _, err := ngauth.IsValidToken(newToken); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//reload from a keyring file
+	dir, _ := ioutil.TempDir("", "keyring")
+	defer os.RemoveAll(dir)
+
+	pemFile := filepath.Join(dir, "new.pem")
+	ioutil.WriteFile(pemFile, pemPrivateKey(t, ecKey), 0600)
+
+	keyringFile := filepath.Join(dir, "keyring.json")
+	ioutil.WriteFile(keyringFile, []byte(`{"current": "old", "keys": [
+		{"kid": "old", "alg": "HS256", "secret": "g4k591b582367a97acd7d1e5dc260729"},
+		{"kid": "new", "alg": "ES256", "private_key_file": "`+pemFile+`"}]}`), 0600)
+
+	keyring, err := ngauth.LoadKeyring(keyringFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.JWTKeyring = keyring
+	if keyring.Current().ID != "old" || len(keyring.Keys()) != 2 {
+		t.Fatal("unexpected keyring")
+	}
+
+	ioutil.WriteFile(keyringFile, []byte(`{"current": "new", "keys": [
+		{"kid": "old", "alg": "HS256", "secret": "g4k591b582367a97acd7d1e5dc260729"},
+		{"kid": "new", "alg": "ES256", "private_key_file": "`+pemFile+`"}]}`), 0600)
+
+	if err = keyring.Reload(keyringFile); err != nil {
+		t.Fatal(err)
+	}
+	if keyring.Current().ID != "new" {
+		t.Fatal("expected new key to be promoted")
+	}
+	if _, err := ngauth.IsValidToken(oldToken); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//retired when the file was modified, loading it again does not restart the retention
+	modified := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(keyringFile, modified, modified)
+
+	keyring, err = ngauth.LoadKeyring(keyringFile, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyring.Lookup("old") != nil || len(keyring.Keys()) != 1 {
+		t.Fatal("expected old key to age out")
+	}
+}
+
+func TestKeyringLegacyKey(t *testing.T) {
+
+	config := setTestConfig()
+
+	//signed with SIGN_KEY before the keyring, no kid header
+	legacyToken, _ := ngauth.GenerateAccessToken(1)
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	newKey, _ := ngauth.ParseSigningKeyPEM("ES256", "new", pemPrivateKey(t, ecKey))
+	keyring := ngauth.NewKeyring(newKey, time.Hour)
+	config.JWTKeyring = keyring
+
+	if _, err := ngauth.IsValidToken(legacyToken); err == nil {
+		t.Fatal("token without kid accepted without a legacy key")
+	}
+
+	legacyKey, _ := ngauth.NewHMACSigningKey("HS256", "", config.SignKey)
+	keyring.SetLegacyKey(legacyKey, time.Now())
+	if _, err := ngauth.IsValidToken(legacyToken); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//new tokens have the kid of the current key
+	newToken, _ := ngauth.GenerateAccessToken(1)
+	if token, _ := jwt.Parse(newToken, nil); token == nil || token.Header["kid"] != "new" {
+		t.Fatal("expected kid of the current key")
+	}
+
+	//aged out
+	keyring.SetLegacyKey(legacyKey, time.Now().Add(-2*time.Hour))
+	if _, err := ngauth.IsValidToken(legacyToken); err == nil {
+		t.Fatal("expected legacy key to age out")
+	}
+}
@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hmkwizu/ngauth"
+	"gopkg.in/guregu/null.v3"
+)
+
+// newTestDB - database of the handler tests, TestSQLRepository runs them against sqlite
+var newTestDB = func(t *testing.T) ngauth.Database {
+	return newMemoryDB(t)
+}
+
+func newMemoryDB(t *testing.T) *ngauth.MemoryRepository {
+	db := &ngauth.MemoryRepository{}
+	if err := db.Init(nil); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func TestMemoryGetOTP(t *testing.T) {
+
+	db := newMemoryDB(t)
+	now := time.Now()
+
+	//created out of order, the newest must be returned
+	codes := []string{"111111", "333333", "222222"}
+	times := []time.Time{now.Add(-3 * time.Minute), now.Add(-1 * time.Minute), now.Add(-2 * time.Minute)}
+	for i := range codes {
+		_, err := db.CreateOTP(ngauth.OTP{Code: codes[i], OTPFor: "REGISTER", Email: "a@example.com", CreatedAt: null.TimeFrom(times[i])}, "en")
+		if err != nil {
+			t.Fatal(err.Message)
+		}
+	}
+
+	otp, err := db.GetOTP("a@example.com", "", "REGISTER", "en")
+	if err != nil || otp == nil || otp.Code != "333333" {
+		t.Fatalf("expected newest otp, got %v", otp)
+	}
+
+	//other purpose
+	otp, err = db.GetOTP("a@example.com", "", "RESET", "en")
+	if err != nil || otp != nil {
+		t.Fail()
+	}
+
+	//offset and limit
+	otps, err := db.GetOTPs("a@example.com", "", "REGISTER", 1, 1, "en")
+	if err != nil || len(otps) != 1 || otps[0].Code != "222222" {
+		t.Fatalf("unexpected otps %v", otps)
+	}
+
+	otps, err = db.GetOTPs("a@example.com", "", "REGISTER", 0, 0, "en")
+	if err != nil || len(otps) != 3 {
+		t.Fail()
+	}
+
+	//update
+	otp, _ = db.GetOTP("a@example.com", "", "REGISTER", "en")
+	err = db.UpdateOTPByID(otp.ID, ngauth.Map{"verified_at": now, "verification_id": "abc"}, "en")
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	otp, _ = db.GetOTP("a@example.com", "", "REGISTER", "en")
+	if otp.VerificationID != "abc" || !otp.VerifiedAt.Valid {
+		t.Fail()
+	}
+}
+
+func TestMemoryPushTokens(t *testing.T) {
+
+	db := newMemoryDB(t)
+
+	err := db.CreateOrUpdatePushToken(ngauth.PushToken{DeviceID: "d1", PushToken: "t1", UserID: int64(1)}, "en")
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//same device, new token and user
+	err = db.CreateOrUpdatePushToken(ngauth.PushToken{DeviceID: "d1", PushToken: "t2", UserID: int64(2)}, "en")
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	token, _ := db.GetPushToken("d1", "en")
+	if token == nil || token.PushToken != "t2" {
+		t.Fail()
+	}
+
+	//user ids from jwt claims are float64
+	tokens, _ := db.GetPushTokensForUserID(float64(2), "en")
+	if len(tokens) != 1 {
+		t.Fail()
+	}
+
+	tokens, _ = db.GetAllPushTokens("en")
+	if len(tokens) != 1 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,137 @@
+package tests
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hmkwizu/ngauth"
+)
+
+func TestRequireAuth(t *testing.T) {
+
+	setTestConfig()
+
+	var called bool
+	var userID interface{}
+	handler := ngauth.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		userID = ngauth.UserIDFromContext(r.Context())
+	}))
+
+	accessToken, _ := ngauth.GenerateAccessToken(int64(7))
+	refreshToken, _ := ngauth.GenerateRefreshToken(int64(7))
+
+	//malformed tokens are bad requests, api error code in the json body
+	tests := []struct {
+		header string
+		status int
+		called bool
+	}{
+		{"", http.StatusUnauthorized, false},
+		{"Bearer invalid", http.StatusOK, false},
+		{"Bearer " + refreshToken, http.StatusUnauthorized, false},
+		{"Bearer " + accessToken, http.StatusOK, true},
+	}
+
+	for _, test := range tests {
+		called = false
+		userID = nil
+
+		r := httptest.NewRequest("POST", "/", nil)
+		if test.header != "" {
+			r.Header.Set("Authorization", test.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Fatalf("%q: expected status %d, got %d", test.header, test.status, w.Code)
+		}
+		if called != test.called {
+			t.Fatalf("%q: expected next handler called %v", test.header, test.called)
+		}
+		if test.called && ngauth.GetStringOrEmpty(userID) != "7" {
+			t.Fatalf("expected user id 7 in context, got %v", userID)
+		}
+	}
+}
+
+func TestOptionalAuth(t *testing.T) {
+
+	setTestConfig()
+
+	var claims *ngauth.Claims
+	handler := ngauth.OptionalAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims = ngauth.ClaimsFromContext(r.Context())
+	}))
+
+	//anonymous
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/", nil))
+	if w.Code != http.StatusOK || claims != nil {
+		t.Fatal("anonymous request should continue without claims")
+	}
+
+	//authenticated
+	accessToken, _ := ngauth.GenerateAccessToken(int64(7))
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+accessToken)
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if claims == nil || claims.Subject != "7" || claims.TokenUse != ngauth.TokenUseAccess || claims.ExpiresAt == 0 {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+}
+
+func TestRequireAuthMachineClient(t *testing.T) {
+
+	setTestConfig()
+
+	var claims *ngauth.Claims
+	handler := ngauth.RequireAuth(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims = ngauth.ClaimsFromContext(r.Context())
+	}))
+
+	//client_credentials access token
+	accessToken, _ := ngauth.GenerateToken(nil, 15, map[string]interface{}{"token_use": ngauth.TokenUseAccess, "sub": "billing", "client_id": "billing"})
+
+	r := httptest.NewRequest("POST", "/", nil)
+	r.Header.Set("Authorization", "Bearer "+accessToken)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+
+	if w.Code != http.StatusOK || claims == nil || claims.UserID != nil || claims.Subject != "billing" || claims.ClientID != "billing" {
+		t.Fatalf("unexpected claims %+v", claims)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+
+	setTestConfig()
+
+	status := func(scope string, claims map[string]interface{}) int {
+		handler := ngauth.RequireAuth(ngauth.RequireScope(scope)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+		claims["token_use"] = ngauth.TokenUseAccess
+		accessToken, _ := ngauth.GenerateToken(nil, 15, claims)
+
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header.Set("Authorization", "Bearer "+accessToken)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := status("api", map[string]interface{}{"sub": "7", "id": 7}); code != http.StatusOK {
+		t.Fatalf("user token: status %d", code)
+	}
+	if code := status("api", map[string]interface{}{"sub": "billing", "client_id": "billing", "scope": "read api"}); code != http.StatusOK {
+		t.Fatalf("client token with the scope: status %d", code)
+	}
+	if code := status("api", map[string]interface{}{"sub": "billing", "client_id": "billing", "scope": "read"}); code != http.StatusForbidden {
+		t.Fatalf("client token without the scope: status %d", code)
+	}
+	if code := status("", map[string]interface{}{"sub": "billing", "client_id": "billing", "scope": "read"}); code != http.StatusForbidden {
+		t.Fatalf("client token without a scope configured: status %d", code)
+	}
+}
@@ -0,0 +1,220 @@
+package tests
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hmkwizu/ngauth"
+)
+
+// fakeNotifier - fails the first failures notifications, records the sent ones
+type fakeNotifier struct {
+	mu       sync.Mutex
+	failures int
+	sent     []ngauth.Notification
+}
+
+func (n *fakeNotifier) Notify(notification ngauth.Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.failures > 0 {
+		n.failures--
+		return errors.New("gateway down")
+	}
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+func (n *fakeNotifier) count() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return len(n.sent)
+}
+
+func newTestDispatcher(db ngauth.Database, notifier ngauth.Notifier) *ngauth.NotificationDispatcher {
+	return &ngauth.NotificationDispatcher{
+		DB:           db,
+		Notifiers:    map[string]ngauth.Notifier{ngauth.NotificationEmail: notifier, ngauth.NotificationSMS: notifier},
+		Workers:      2,
+		BatchSize:    10,
+		PollInterval: 10 * time.Millisecond,
+		MaxAttempts:  3,
+		LeaseTime:    time.Minute,
+	}
+}
+
+func getNotification(t *testing.T, db ngauth.Database) ngauth.Notification {
+	notifications, err := db.GetNotifications("", 0, 1, "en")
+	if err != nil || len(notifications) != 1 {
+		t.Fatal("notification not found", err)
+	}
+	return notifications[0]
+}
+
+func TestNotificationRetry(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	notifier := &fakeNotifier{failures: 2}
+	dispatcher := newTestDispatcher(db, notifier)
+
+	if err := ngauth.QueueNotification(db, "en", ngauth.Notification{Channel: ngauth.NotificationEmail, Recipient: "a@example.com", Subject: "Hi", Body: "<p>Hi</p>", TextBody: "Hi"}); err != nil {
+		t.Fatal(err.Message)
+	}
+	if notification := getNotification(t, db); notification.Body == "<p>Hi</p>" || notification.TextBody == "Hi" {
+		t.Fatal("body saved in plaintext")
+	}
+
+	//failed attempts are retried
+	for i := 1; i <= 2; i++ {
+		if attempted := dispatcher.RunOnce(); attempted != 1 {
+			t.Fatal("attempted", attempted)
+		}
+		notification := getNotification(t, db)
+		if notification.Status != ngauth.NotificationPending || notification.Attempts != i || notification.LastError != "gateway down" {
+			t.Fatalf("after failure %d: %+v", i, notification)
+		}
+	}
+
+	dispatcher.RunOnce()
+	notification := getNotification(t, db)
+	if notification.Status != ngauth.NotificationSent || !notification.SentAt.Valid || notification.Attempts != 3 || notification.LastError != "" {
+		t.Fatalf("not sent: %+v", notification)
+	}
+	if notification.Body != "" {
+		t.Fatal("body not cleared after delivery")
+	}
+	if notifier.count() != 1 || notifier.sent[0].Body != "<p>Hi</p>" || notifier.sent[0].TextBody != "Hi" {
+		t.Fatal("notifier", notifier.sent)
+	}
+
+	//nothing left to deliver
+	if attempted := dispatcher.RunOnce(); attempted != 0 {
+		t.Fatal("sent notification attempted again")
+	}
+}
+
+func TestNotificationBackoffAndFailure(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	notifier := &fakeNotifier{failures: 10}
+	dispatcher := newTestDispatcher(db, notifier)
+	dispatcher.RetryTime = time.Hour
+
+	ngauth.QueueNotification(db, "en", ngauth.Notification{Channel: ngauth.NotificationSMS, Recipient: "+255700000000", Body: "code"})
+
+	dispatcher.RunOnce()
+	notification := getNotification(t, db)
+	if !notification.NextAttemptAt.Time.After(time.Now().Add(59 * time.Minute)) {
+		t.Fatal("retry not delayed", notification.NextAttemptAt.Time)
+	}
+
+	//not due yet
+	if attempted := dispatcher.RunOnce(); attempted != 0 {
+		t.Fatal("retried before the backoff")
+	}
+
+	dispatcher.RetryTime = 0
+	db.UpdateNotificationByID(notification.ID, map[string]interface{}{"next_attempt_at": time.Now()}, "en")
+	dispatcher.RunOnce()
+	dispatcher.RunOnce()
+
+	notification = getNotification(t, db)
+	if notification.Status != ngauth.NotificationFailed || notification.Attempts != 3 || notification.LastError != "gateway down" {
+		t.Fatalf("not failed after max attempts: %+v", notification)
+	}
+
+	failed, _ := db.GetNotifications(ngauth.NotificationFailed, 0, 10, "en")
+	if len(failed) != 1 {
+		t.Fatal("failed notifications", len(failed))
+	}
+}
+
+func TestQueueOTPExpired(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	notifier := &fakeNotifier{}
+	dispatcher := newTestDispatcher(db, notifier)
+
+	err := ngauth.QueueOTP(db, ngauth.OTPMessage{Lang: "en", OTPFor: "REGISTER", PhoneNumber: "+255700000000", Code: "123456", ExpiresAt: time.Now().Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	notification := getNotification(t, db)
+	if notification.Channel != ngauth.NotificationSMS || notification.Recipient != "+255700000000" {
+		t.Fatalf("otp of phone number not queued as sms: %+v", notification)
+	}
+
+	//the code is not saved in plaintext
+	if notification.Body == "" || strings.Contains(notification.Body, "123456") {
+		t.Fatal("otp body not encrypted", notification.Body)
+	}
+
+	//expired without a dispatcher, when the next notification is queued
+	ngauth.QueueNotification(db, "en", ngauth.Notification{Channel: ngauth.NotificationEmail, Recipient: "a@example.com", Body: "hi"})
+	expired, _ := db.GetNotifications(ngauth.NotificationExpired, 0, 10, "en")
+	if len(expired) != 1 || expired[0].Body != "" {
+		t.Fatalf("expired otp not cleared: %+v", expired)
+	}
+
+	dispatcher.RunOnce()
+	if notifier.count() != 1 || notifier.sent[0].Recipient != "a@example.com" {
+		t.Fatal("expired otp sent", notifier.sent)
+	}
+}
+
+func TestNotificationDispatcherStart(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	notifier := &fakeNotifier{}
+	dispatcher := newTestDispatcher(db, notifier)
+	dispatcher.Start()
+	defer dispatcher.Stop()
+
+	for i := 0; i < 5; i++ {
+		ngauth.QueueNotification(db, "en", ngauth.Notification{Channel: ngauth.NotificationEmail, Recipient: "a@example.com", Body: "hi"})
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for notifier.count() < 5 {
+		if time.Now().After(deadline) {
+			t.Fatal("notifications not delivered", notifier.count())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFCMNotifier(t *testing.T) {
+
+	gateway := newSMSGateway(t, http.StatusOK, `{"success": 1, "failure": 0, "results": [{"message_id": "1"}]}`)
+	defer gateway.Close()
+
+	notifier := &ngauth.FCMNotifier{ServerKey: "key", BaseURL: gateway.URL}
+	if err := notifier.Notify(ngauth.Notification{Recipient: "token", Subject: "Hi", Body: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+	if gateway.request.URL.Path != "/fcm/send" || gateway.request.Header.Get("Authorization") != "key=key" {
+		t.Fatal("request", gateway.request.URL.Path, gateway.request.Header)
+	}
+
+	failedGateway := newSMSGateway(t, http.StatusOK, `{"success": 0, "failure": 1, "results": [{"error": "NotRegistered"}]}`)
+	defer failedGateway.Close()
+
+	notifier.BaseURL = failedGateway.URL
+	if err := notifier.Notify(ngauth.Notification{Recipient: "token", Body: "hello"}); err == nil {
+		t.Fatal("failure not returned")
+	}
+}
@@ -0,0 +1,422 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hmkwizu/ngauth"
+)
+
+const testRedirectURI = "https://app.example.com/callback"
+
+// testVerifier - PKCE code_verifier
+var testVerifier = strings.Repeat("v", 43)
+
+func s256(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// registerOAuthClient - returns the client_id and client_secret, empty for public clients
+func registerOAuthClient(t *testing.T, db ngauth.Database, public bool, scopes string) (string, string) {
+
+	response, err := ngauth.RegisterOAuthClient(db, "en", map[string]interface{}{"name": "Test App", "redirect_uris": []interface{}{testRedirectURI}, "scopes": scopes, "public": public})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	return response["client_id"].(string), response["client_secret"].(string)
+}
+
+func authorizeParams(clientID string, scope string) map[string]interface{} {
+	return map[string]interface{}{
+		"client_id":             clientID,
+		"response_type":         "code",
+		"redirect_uri":          testRedirectURI,
+		"scope":                 scope,
+		"state":                 "xyz",
+		"code_challenge":        s256(testVerifier),
+		"code_challenge_method": "S256",
+	}
+}
+
+// authorizeCode - logs in at the authorization endpoint, returns the code
+func authorizeCode(t *testing.T, db ngauth.Database, clientID string, scope string, login map[string]interface{}) string {
+
+	request, err := ngauth.ParseAuthorizeRequest(db, "en", authorizeParams(clientID, scope))
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	redirectURL, err := ngauth.Authorize(db, "en", request, login, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	u, _ := url.Parse(redirectURL)
+	if !strings.HasPrefix(redirectURL, testRedirectURI+"?") || u.Query().Get("state") != "xyz" || u.Query().Get("code") == "" {
+		t.Fatal("redirect", redirectURL)
+	}
+
+	return u.Query().Get("code")
+}
+
+func TestOAuthAuthorizationCode(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+	clientID, secret := registerOAuthClient(t, db, true, "read write")
+	if secret != "" {
+		t.Fatal("public client with a secret")
+	}
+
+	request, err := ngauth.ParseAuthorizeRequest(db, "en", authorizeParams(clientID, "read"))
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	_, err = ngauth.Authorize(db, "en", request, map[string]interface{}{"username": "a@example.com", "password": "wrong"}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorIncorrectEmailOrPassword {
+		t.Fatal("expected ErrorIncorrectEmailOrPassword")
+	}
+
+	code := authorizeCode(t, db, clientID, "read", map[string]interface{}{"username": "a@example.com", "password": "1234"})
+
+	tokenParams := map[string]interface{}{"grant_type": "authorization_code", "client_id": clientID, "code": code, "redirect_uri": testRedirectURI, "code_verifier": strings.Repeat("w", 43)}
+	_, err = ngauth.OAuthToken(db, "en", tokenParams, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidGrant {
+		t.Fatal("expected ErrorInvalidGrant for a wrong code_verifier")
+	}
+
+	tokenParams["code_verifier"] = testVerifier
+	response, err := ngauth.OAuthToken(db, "en", tokenParams, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["token_type"] != "Bearer" || response["scope"] != "read" || response["expires_in"] != 15*60 {
+		t.Fatal("token response", response)
+	}
+
+	claims, err := ngauth.IsValidAccessToken(response["access_token"].(string))
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if claims["client_id"] != clientID || claims["scope"] != "read" || claims["sub"] != ngauth.GetStringOrEmpty(userID) {
+		t.Fatal("claims", claims)
+	}
+
+	//the code can be used once, reuse revokes the tokens issued with it
+	_, err = ngauth.OAuthToken(db, "en", tokenParams, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidGrant {
+		t.Fatal("expected ErrorInvalidGrant for a used code")
+	}
+
+	_, err = ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "refresh_token", "client_id": clientID, "refresh_token": response["refresh_token"]}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidToken {
+		t.Fatal("expected the session to be revoked")
+	}
+}
+
+func TestOAuthAuthorizeRequest(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	clientID, _ := registerOAuthClient(t, db, true, "read")
+
+	params := authorizeParams("unknown", "read")
+	if _, err := ngauth.ParseAuthorizeRequest(db, "en", params); err == nil || err.Code != ngauth.ErrorInvalidClient {
+		t.Fatal("expected ErrorInvalidClient")
+	}
+
+	params = authorizeParams(clientID, "read")
+	params["redirect_uri"] = testRedirectURI + "/other"
+	if _, err := ngauth.ParseAuthorizeRequest(db, "en", params); err == nil || err.Code != ngauth.ErrorInvalidRedirectURI {
+		t.Fatal("expected ErrorInvalidRedirectURI")
+	}
+
+	invalid := map[string]string{
+		"response_type":         "token",
+		"code_challenge":        "short",
+		"code_challenge_method": "plain",
+		"scope":                 "read admin",
+	}
+	for name, value := range invalid {
+		params = authorizeParams(clientID, "read")
+		params[name] = value
+
+		request, err := ngauth.ParseAuthorizeRequest(db, "en", params)
+		if err != nil {
+			t.Fatal(err.Message)
+		}
+		if err = request.Validate("en"); err == nil {
+			t.Fatal("expected an error for", name, value)
+		}
+
+		//sent to the client
+		u, _ := url.Parse(request.ErrorURL(err))
+		if u.Query().Get("error") == "" || u.Query().Get("state") != "xyz" {
+			t.Fatal("error url", u)
+		}
+		if name == "scope" && u.Query().Get("error") != "invalid_scope" {
+			t.Fatal("expected invalid_scope", u)
+		}
+	}
+
+	validURIs := []string{testRedirectURI, "http://localhost:8080/cb", "http://127.0.0.1/cb", "com.example.app:/callback"}
+	for _, uri := range validURIs {
+		if !ngauth.IsValidRedirectURI(uri) {
+			t.Fatal("expected valid redirect uri", uri)
+		}
+	}
+
+	invalidURIs := []string{"http://app.example.com/cb", "https://app.example.com/cb#x", "/callback", "javascript:alert(1)"}
+	for _, uri := range invalidURIs {
+		if ngauth.IsValidRedirectURI(uri) {
+			t.Fatal("expected invalid redirect uri", uri)
+		}
+	}
+
+	_, err := ngauth.RegisterOAuthClient(db, "en", map[string]interface{}{"name": "App", "redirect_uris": "http://app.example.com/cb"})
+	if err == nil || err.Code != ngauth.ErrorInvalidRedirectURI {
+		t.Fatal("expected ErrorInvalidRedirectURI")
+	}
+}
+
+func TestOAuthRefreshToken(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	registerUser(t, db, "b@example.com", "1234")
+	clientID, secret := registerOAuthClient(t, db, false, "")
+	otherClientID, otherSecret := registerOAuthClient(t, db, false, "")
+
+	code := authorizeCode(t, db, clientID, "read write", map[string]interface{}{"username": "b@example.com", "password": "1234"})
+
+	tokenParams := map[string]interface{}{"grant_type": "authorization_code", "client_id": clientID, "client_secret": "wrong", "code": code, "redirect_uri": testRedirectURI, "code_verifier": testVerifier}
+	_, err := ngauth.OAuthToken(db, "en", tokenParams, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidClient {
+		t.Fatal("expected ErrorInvalidClient")
+	}
+	if oauthErr, status := ngauth.OAuthError(err); oauthErr != "invalid_client" || status != http.StatusUnauthorized {
+		t.Fatal("oauth error", oauthErr, status)
+	}
+
+	tokenParams["client_secret"] = secret
+	response, err := ngauth.OAuthToken(db, "en", tokenParams, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	refreshToken := response["refresh_token"]
+
+	//bound to the client
+	_, err = ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "refresh_token", "client_id": otherClientID, "client_secret": otherSecret, "refresh_token": refreshToken}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidGrant {
+		t.Fatal("expected ErrorInvalidGrant for another client")
+	}
+	if _, err = ngauth.Token(db, "en", map[string]interface{}{"refresh_token": refreshToken}); err == nil || err.Code != ngauth.ErrorInvalidToken {
+		t.Fatal("expected ErrorInvalidToken at /token")
+	}
+
+	refreshParams := map[string]interface{}{"grant_type": "refresh_token", "client_id": clientID, "client_secret": secret, "refresh_token": refreshToken, "scope": "read admin"}
+	_, err = ngauth.OAuthToken(db, "en", refreshParams, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidScope {
+		t.Fatal("expected ErrorInvalidScope")
+	}
+
+	//narrowed scope, not rotated for confidential clients
+	refreshParams["scope"] = "read"
+	response, err = ngauth.OAuthToken(db, "en", refreshParams, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["scope"] != "read" || response["refresh_token"] != nil {
+		t.Fatal("refresh response", response)
+	}
+
+	_, err = ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "password", "client_id": clientID, "client_secret": secret}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorUnsupportedGrantType {
+		t.Fatal("expected ErrorUnsupportedGrantType")
+	}
+
+	//public clients always get a new refresh token
+	publicClientID, _ := registerOAuthClient(t, db, true, "")
+	code = authorizeCode(t, db, publicClientID, "", map[string]interface{}{"username": "b@example.com", "password": "1234"})
+	response, err = ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "authorization_code", "client_id": publicClientID, "code": code, "redirect_uri": testRedirectURI, "code_verifier": testVerifier}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	refreshed, err := ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "refresh_token", "client_id": publicClientID, "refresh_token": response["refresh_token"]}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if refreshed["refresh_token"] == nil || refreshed["refresh_token"] == response["refresh_token"] {
+		t.Fatal("expected a new refresh token")
+	}
+}
+
+func TestOAuthAuthorizeTOTP(t *testing.T) {
+
+	config := setTestConfig()
+	config.TOTPSkew = 2
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "c@example.com", "1234")
+	clientID, _ := registerOAuthClient(t, db, true, "")
+
+	response, err := ngauth.EnrollTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	secret := response["secret"].(string)
+
+	//codes are accepted once, confirm with the code of the previous step
+	now := time.Now()
+	confirmCode, _ := ngauth.TOTPCode(secret, now.Add(-30*time.Second))
+	code, _ := ngauth.TOTPCode(secret, now)
+	if _, err = ngauth.ConfirmTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID, "code": confirmCode}, hashMake); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	request, err := ngauth.ParseAuthorizeRequest(db, "en", authorizeParams(clientID, ""))
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	login := map[string]interface{}{"username": "c@example.com", "password": "1234"}
+	_, err = ngauth.Authorize(db, "en", request, login, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorTOTPRequired {
+		t.Fatal("expected ErrorTOTPRequired")
+	}
+
+	//the page asks for the code
+	var page bytes.Buffer
+	if err := ngauth.RenderAuthorizePage(&page, ngauth.AuthorizePage{Lang: "sw", ClientName: "Test App", Params: request.Params(), TOTPRequired: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(page.String(), `name="code"`) || !strings.Contains(page.String(), `value="`+s256(testVerifier)+`"`) || !strings.Contains(page.String(), "Ingia") {
+		t.Fatal("page", page.String())
+	}
+
+	login["code"] = code
+	authorizeCode(t, db, clientID, "", login)
+
+	//the code was used
+	_, err = ngauth.Authorize(db, "en", request, login, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorInvalidOTPCode {
+		t.Fatal("expected ErrorInvalidOTPCode for a used code")
+	}
+}
+
+func TestOAuthClientCredentials(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	//machine clients need no redirect_uris
+	response, err := ngauth.RegisterOAuthClient(db, "en", map[string]interface{}{"name": "Billing", "grant_types": "client_credentials", "scopes": "invoices:read invoices:write"})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	clientID, secret := response["client_id"].(string), response["client_secret"].(string)
+
+	_, err = ngauth.RegisterOAuthClient(db, "en", map[string]interface{}{"name": "Billing", "grant_types": "client_credentials", "public": true})
+	if err == nil || err.Code != ngauth.ErrorUnauthorizedClient {
+		t.Fatal("expected ErrorUnauthorizedClient for a public machine client")
+	}
+
+	tokenParams := map[string]interface{}{"grant_type": "client_credentials", "client_id": clientID, "client_secret": "wrong"}
+	if _, err = ngauth.OAuthToken(db, "en", tokenParams, hashCheck); err == nil || err.Code != ngauth.ErrorInvalidClient {
+		t.Fatal("expected ErrorInvalidClient for a wrong secret")
+	}
+
+	//secrets are saved as sha256 hashes
+	client, _ := db.GetOAuthClient(clientID, "en")
+	if client == nil || !strings.HasPrefix(client.ClientSecret, "s1:") || strings.Contains(client.ClientSecret, secret) {
+		t.Fatalf("client %+v", client)
+	}
+
+	tokenParams["client_secret"] = secret
+	response, err = ngauth.OAuthToken(db, "en", tokenParams, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["scope"] != "invoices:read invoices:write" || response["refresh_token"] != nil {
+		t.Fatal("token response", response)
+	}
+
+	claims, err := ngauth.IsValidAccessToken(response["access_token"].(string))
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if claims["sub"] != clientID || claims["client_id"] != clientID || claims["id"] != nil {
+		t.Fatal("claims", claims)
+	}
+
+	//no user behind the token
+	if _, err = ngauth.LogoutAll(db, "en", map[string]interface{}{"loggedin_user_id": ngauth.NewClaims(claims).UserID}); err == nil || err.Code != ngauth.ErrorNotAuthorized {
+		t.Fatal("expected ErrorNotAuthorized for a machine client")
+	}
+
+	//narrowed scope
+	tokenParams["scope"] = "invoices:read"
+	response, _ = ngauth.OAuthToken(db, "en", tokenParams, hashCheck)
+	if response["scope"] != "invoices:read" {
+		t.Fatal("scope", response)
+	}
+
+	tokenParams["scope"] = "users:read"
+	if _, err = ngauth.OAuthToken(db, "en", tokenParams, hashCheck); err == nil || err.Code != ngauth.ErrorInvalidScope {
+		t.Fatal("expected ErrorInvalidScope")
+	}
+
+	//grant types the clients are not registered for
+	if _, err = ngauth.ParseAuthorizeRequest(db, "en", authorizeParams(clientID, "")); err == nil || err.Code != ngauth.ErrorUnauthorizedClient {
+		t.Fatal("expected ErrorUnauthorizedClient at the authorization endpoint")
+	}
+
+	appID, appSecret := registerOAuthClient(t, db, false, "")
+	_, err = ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "client_credentials", "client_id": appID, "client_secret": appSecret}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorUnauthorizedClient {
+		t.Fatal("expected ErrorUnauthorizedClient")
+	}
+	if oauthErr, status := ngauth.OAuthError(err); oauthErr != "unauthorized_client" || status != http.StatusBadRequest {
+		t.Fatal("oauth error", oauthErr, status)
+	}
+
+	_, err = ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "password", "client_id": appID, "client_secret": appSecret}, hashCheck)
+	if err == nil || err.Code != ngauth.ErrorUnsupportedGrantType {
+		t.Fatal("expected ErrorUnsupportedGrantType")
+	}
+}
+
+func TestOAuthLegacyClientSecret(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	//clients of older versions have PwdHashFunc hashes of their secrets
+	client := ngauth.OAuthClient{ClientID: "legacy", ClientSecret: hashMake("legacy-secret"), Name: "Legacy", GrantTypes: "client_credentials"}
+	if _, err := db.CreateOAuthClient(client, "en"); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	tokenParams := map[string]interface{}{"grant_type": "client_credentials", "client_id": "legacy", "client_secret": "legacy-secret"}
+	if _, err := ngauth.OAuthToken(db, "en", tokenParams, hashCheck); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	tokenParams["client_secret"] = "wrong"
+	if _, err := ngauth.OAuthToken(db, "en", tokenParams, hashCheck); err == nil || err.Code != ngauth.ErrorInvalidClient {
+		t.Fatal("expected ErrorInvalidClient for a wrong secret")
+	}
+}
@@ -0,0 +1,159 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/hmkwizu/ngauth"
+)
+
+// useES256Key - signs the tokens with an ES256 key, id tokens are not issued with HMAC keys
+func useES256Key(t *testing.T, config *ngauth.Configuration) {
+
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	key, err := ngauth.ParseSigningKeyPEM("ES256", "", pemPrivateKey(t, ecKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.JWTSigningAlg = "ES256"
+	config.JWTKeyring = ngauth.NewKeyring(key, time.Hour)
+}
+
+func TestOpenIDConnectIDToken(t *testing.T) {
+
+	config := setTestConfig()
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+	clientID, _ := registerOAuthClient(t, db, true, "read")
+
+	//OpenID Connect scopes are not restricted by the client scopes
+	params := authorizeParams(clientID, "openid email profile")
+	params["nonce"] = "n-0S6_WzA2Mj"
+
+	request, err := ngauth.ParseAuthorizeRequest(db, "en", params)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//id tokens signed with the HMAC key could not be verified by the client
+	if err = request.Validate("en"); err == nil || err.Code != ngauth.ErrorInvalidScope {
+		t.Fatal("expected ErrorInvalidScope for openid with an HMAC key")
+	}
+
+	useES256Key(t, config)
+	if err = request.Validate("en"); err != nil {
+		t.Fatal(err.Message)
+	}
+	if request.Params()["nonce"] != "n-0S6_WzA2Mj" {
+		t.Fatal("nonce not posted back", request.Params())
+	}
+
+	redirectURL, err := ngauth.Authorize(db, "en", request, map[string]interface{}{"username": "a@example.com", "password": "1234"}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	u, _ := url.Parse(redirectURL)
+	code := u.Query().Get("code")
+
+	response, err := ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "authorization_code", "client_id": clientID, "code": code, "redirect_uri": testRedirectURI, "code_verifier": testVerifier}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	idToken, ok := response["id_token"].(string)
+	if !ok {
+		t.Fatal("id_token not returned", response)
+	}
+
+	claims, err := ngauth.IsValidToken(idToken)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if claims["token_use"] != ngauth.TokenUseID || claims["aud"] != clientID || claims["nonce"] != "n-0S6_WzA2Mj" || claims["sub"] != ngauth.GetStringOrEmpty(userID) || claims["auth_time"] == nil {
+		t.Fatal("claims", claims)
+	}
+	if claims["email"] != "a@example.com" || claims["email_verified"] != true || claims["name"] != "Test" {
+		t.Fatal("user claims", claims)
+	}
+	//phone scope not requested
+	if _, ok = claims["phone_number"]; ok {
+		t.Fatal("phone_number without the phone scope", claims)
+	}
+
+	//id tokens are not access tokens
+	if _, err = ngauth.IsValidAccessToken(idToken); err == nil {
+		t.Fatal("id token accepted as an access token")
+	}
+
+	//refreshed id tokens have no nonce
+	response, err = ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "refresh_token", "client_id": clientID, "refresh_token": response["refresh_token"]}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	claims, _ = ngauth.IsValidToken(response["id_token"].(string))
+	if claims["aud"] != clientID || claims["nonce"] != nil {
+		t.Fatal("refreshed claims", claims)
+	}
+
+	//without the openid scope
+	code = authorizeCode(t, db, clientID, "read", map[string]interface{}{"username": "a@example.com", "password": "1234"})
+	response, _ = ngauth.OAuthToken(db, "en", map[string]interface{}{"grant_type": "authorization_code", "client_id": clientID, "code": code, "redirect_uri": testRedirectURI, "code_verifier": testVerifier}, hashCheck)
+	if response["id_token"] != nil {
+		t.Fatal("id_token without the openid scope", response)
+	}
+}
+
+func TestOpenIDConnectUserInfo(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+
+	response, err := ngauth.UserInfo(db, "en", map[string]interface{}{"loggedin_user_id": userID, "scope": "openid email"})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["sub"] != ngauth.GetStringOrEmpty(userID) || response["email"] != "a@example.com" || response["email_verified"] != true || response["name"] != nil {
+		t.Fatal("userinfo", response)
+	}
+
+	//access tokens of /login
+	_, err = ngauth.UserInfo(db, "en", map[string]interface{}{"loggedin_user_id": userID})
+	if err == nil || err.Code != ngauth.ErrorNotAuthorized {
+		t.Fatal("expected ErrorNotAuthorized without the openid scope")
+	}
+}
+
+func TestOpenIDConfiguration(t *testing.T) {
+
+	config := setTestConfig()
+
+	//the issuer has to be an url
+	if _, err := ngauth.OpenIDConfiguration("en"); err == nil || err.Code != ngauth.ErrorNotFound {
+		t.Fatal("expected ErrorNotFound without an issuer url")
+	}
+
+	//nor with an HMAC key
+	config.JWTIssuer = "https://auth.example.com"
+	if _, err := ngauth.OpenIDConfiguration("en"); err == nil || err.Code != ngauth.ErrorNotFound {
+		t.Fatal("expected ErrorNotFound with an HMAC key")
+	}
+
+	useES256Key(t, config)
+	response, err := ngauth.OpenIDConfiguration("en")
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["issuer"] != "https://auth.example.com" || response["token_endpoint"] != "https://auth.example.com/oauth/token" || response["jwks_uri"] != "https://auth.example.com/.well-known/jwks.json" {
+		t.Fatal("metadata", response)
+	}
+	if algs := response["id_token_signing_alg_values_supported"].([]string); len(algs) != 1 || algs[0] != "ES256" {
+		t.Fatal("signing algs", algs)
+	}
+}
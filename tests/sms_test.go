@@ -0,0 +1,167 @@
+package tests
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hmkwizu/ngauth"
+)
+
+// smsGateway - httptest stand-in for a gateway, records the last request
+type smsGateway struct {
+	*httptest.Server
+	request *http.Request
+}
+
+func newSMSGateway(t *testing.T, status int, body string) *smsGateway {
+	gateway := &smsGateway{}
+	gateway.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Error(err)
+		}
+		gateway.request = r
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(body))
+	}))
+	return gateway
+}
+
+func TestTwilioSMSSender(t *testing.T) {
+
+	gateway := newSMSGateway(t, http.StatusCreated, `{"sid": "SM1", "status": "queued"}`)
+	defer gateway.Close()
+
+	sender := &ngauth.TwilioSMSSender{AccountSID: "AC1", AuthToken: "token", From: "+15005550006", BaseURL: gateway.URL}
+	if err := sender.SendSMS("+255700000000", "code 123456"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gateway.request
+	if r.URL.Path != "/2010-04-01/Accounts/AC1/Messages.json" {
+		t.Fatal("path", r.URL.Path)
+	}
+	if user, pass, ok := r.BasicAuth(); !ok || user != "AC1" || pass != "token" {
+		t.Fatal("basic auth", user, pass)
+	}
+	if r.PostForm.Get("To") != "+255700000000" || r.PostForm.Get("From") != "+15005550006" || r.PostForm.Get("Body") != "code 123456" {
+		t.Fatal("form", r.PostForm)
+	}
+
+	errorGateway := newSMSGateway(t, http.StatusBadRequest, `{"code": 21211, "message": "Invalid 'To' Phone Number"}`)
+	defer errorGateway.Close()
+
+	sender.BaseURL = errorGateway.URL
+	if err := sender.SendSMS("+1", "code"); err == nil || !strings.Contains(err.Error(), "Invalid 'To' Phone Number") {
+		t.Fatal("gateway error not returned", err)
+	}
+}
+
+func TestAfricasTalkingSMSSender(t *testing.T) {
+
+	gateway := newSMSGateway(t, http.StatusCreated, `{"SMSMessageData": {"Message": "Sent to 1/1", "Recipients": [{"number": "+255700000000", "status": "Success", "statusCode": 101}]}}`)
+	defer gateway.Close()
+
+	sender := &ngauth.AfricasTalkingSMSSender{Username: "sandbox", APIKey: "key", BaseURL: gateway.URL}
+	if err := sender.SendSMS("+255700000000", "code 123456"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gateway.request
+	if r.URL.Path != "/version1/messaging" || r.Header.Get("apiKey") != "key" {
+		t.Fatal("request", r.URL.Path, r.Header)
+	}
+	if r.PostForm.Get("username") != "sandbox" || r.PostForm.Get("to") != "+255700000000" || r.PostForm.Get("message") != "code 123456" {
+		t.Fatal("form", r.PostForm)
+	}
+
+	//201 with a failed recipient
+	failedGateway := newSMSGateway(t, http.StatusCreated, `{"SMSMessageData": {"Message": "Sent to 0/1", "Recipients": [{"number": "+255700000000", "status": "InsufficientBalance", "statusCode": 405}]}}`)
+	defer failedGateway.Close()
+
+	sender.BaseURL = failedGateway.URL
+	if err := sender.SendSMS("+255700000000", "code"); err == nil || !strings.Contains(err.Error(), "InsufficientBalance") {
+		t.Fatal("recipient error not returned", err)
+	}
+}
+
+func TestVonageSMSSender(t *testing.T) {
+
+	gateway := newSMSGateway(t, http.StatusOK, `{"message-count": "1", "messages": [{"to": "255700000000", "status": "0"}]}`)
+	defer gateway.Close()
+
+	sender := &ngauth.VonageSMSSender{APIKey: "key", APISecret: "secret", From: "ngauth", BaseURL: gateway.URL}
+	if err := sender.SendSMS("+255700000000", "code 123456"); err != nil {
+		t.Fatal(err)
+	}
+
+	r := gateway.request
+	if r.URL.Path != "/sms/json" {
+		t.Fatal("path", r.URL.Path)
+	}
+	if r.PostForm.Get("api_key") != "key" || r.PostForm.Get("api_secret") != "secret" || r.PostForm.Get("to") != "255700000000" || r.PostForm.Get("text") != "code 123456" {
+		t.Fatal("form", r.PostForm)
+	}
+
+	//200 with a failed message
+	failedGateway := newSMSGateway(t, http.StatusOK, `{"message-count": "1", "messages": [{"to": "255700000000", "status": "4", "error-text": "Bad Credentials"}]}`)
+	defer failedGateway.Close()
+
+	sender.BaseURL = failedGateway.URL
+	if err := sender.SendSMS("+255700000000", "code"); err == nil || !strings.Contains(err.Error(), "Bad Credentials") {
+		t.Fatal("message error not returned", err)
+	}
+}
+
+func TestFileSMSSender(t *testing.T) {
+
+	dir, err := ioutil.TempDir("", "ngauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := setTestConfig()
+	config.SMSProvider = ngauth.SMSProviderFile
+	config.SMSFilePath = filepath.Join(dir, "sms.log")
+
+	sender, err := ngauth.NewSMSSender(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SMSSender = sender
+
+	if err = ngauth.SendSMS("+255700000000", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err = ngauth.SendSMS("+255700000001", "second"); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(config.SMSFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 || !strings.HasSuffix(lines[0], "+255700000000\tfirst") || !strings.HasSuffix(lines[1], "+255700000001\tsecond") {
+		t.Fatal("file content", string(data))
+	}
+
+	//no provider, no sender
+	config.SMSProvider = ""
+	if sender, err = ngauth.NewSMSSender(config); sender != nil || err != nil {
+		t.Fatal("sender created without a provider")
+	}
+
+	//missing credentials
+	config.SMSProvider = ngauth.SMSProviderTwilio
+	if _, err = ngauth.NewSMSSender(config); err == nil {
+		t.Fatal("twilio sender created without credentials")
+	}
+}
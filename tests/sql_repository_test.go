@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/hmkwizu/ngauth"
+)
+
+// newSQLiteDB - sqlite database at path with all migrations applied, uses the current ngauth.Config
+func newSQLiteDB(t *testing.T, path string) *ngauth.SQLRepository {
+
+	config := ngauth.Config
+	config.DBDriver = "sqlite3"
+	config.DBConnectionString = path
+	config.DBAutoMigrate = true
+	config.UsersTableName = "users"
+	config.OTPTableName = "otp"
+	config.SessionsTableName = "sessions"
+
+	db := &ngauth.SQLRepository{}
+	if err := db.Init(config); err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ngauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// appliedMigrations - number of applied migrations and the latest version
+func appliedMigrations(t *testing.T, db *ngauth.SQLRepository) (int, int) {
+
+	var count, version int
+	row := db.DB.DB().QueryRow("SELECT COUNT(*), COALESCE(MAX(version), 0) FROM schema_migrations")
+	if err := row.Scan(&count, &version); err != nil {
+		t.Fatal(err)
+	}
+
+	return count, version
+}
+
+func TestSQLiteMigrations(t *testing.T) {
+
+	config := setTestConfig()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	db := newSQLiteDB(t, filepath.Join(dir, "ngauth.db"))
+	defer db.Close()
+
+	count, version := appliedMigrations(t, db)
+	if count == 0 || count != version {
+		t.Fatalf("applied %d migrations, latest version %d", count, version)
+	}
+
+	//nothing left to apply
+	if err := db.Migrate(config); err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := appliedMigrations(t, db); again != count {
+		t.Fatalf("applied %d migrations, then %d", count, again)
+	}
+}
+
+// TestSQLRepository - runs the handler tests against SQLRepository and the sqlite migrations
+func TestSQLRepository(t *testing.T) {
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	var dbs []*ngauth.SQLRepository
+	newTestDB = func(t *testing.T) ngauth.Database {
+		db := newSQLiteDB(t, filepath.Join(dir, fmt.Sprintf("ngauth%d.db", len(dbs))))
+		dbs = append(dbs, db)
+		return db
+	}
+	defer func() {
+		newTestDB = func(t *testing.T) ngauth.Database {
+			return newMemoryDB(t)
+		}
+		for _, db := range dbs {
+			db.Close()
+		}
+	}()
+
+	tests := []func(*testing.T){
+		TestRegisterAndLogin, TestGenerateOTPBan, TestResetPassword, TestLogout, TestRefreshTokenRotation,
+		TestTokenTypes, TestTOTPLogin, TestTOTPLockout, TestRecoveryCodes, TestVerifyOTPAttempts, TestVerifyOTPConcurrentAttempts, TestLoginLockout,
+		TestLoginLockoutBackoff, TestVerificationSingleUse, TestVerificationExpired, TestGenerateOTPMessage,
+		TestNotificationRetry, TestNotificationBackoffAndFailure, TestQueueOTPExpired,
+		TestNotificationDispatcherStart, TestMagicLinkLogin, TestLoginOTPCode, TestPhoneLoginOTP,
+		TestWebAuthnRegisterAndLogin, TestWebAuthnPackedAttestation, TestWebAuthnUserVerification,
+		TestOAuthAuthorizationCode, TestOAuthAuthorizeRequest, TestOAuthRefreshToken, TestOAuthAuthorizeTOTP,
+		TestOpenIDConnectIDToken, TestOpenIDConnectUserInfo, TestOAuthClientCredentials, TestDeviceAuthorization,
+		TestDeviceAuthorizationDenied, TestDeviceCodesPurged, TestWebAuthnChallengesPurged, TestIntrospectToken, TestRevokeToken, TestLegacyTokens,
+		TestLoginThrottleClientIP, TestMagicLinkLockout, TestWebAuthnRegisterOAuthToken, TestOAuthLegacyClientSecret,
+	}
+
+	for _, test := range tests {
+		name := runtime.FuncForPC(reflect.ValueOf(test).Pointer()).Name()
+		t.Run(name[strings.LastIndex(name, ".")+1:], test)
+	}
+}
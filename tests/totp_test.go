@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hmkwizu/ngauth"
+)
+
+func TestTOTPCode(t *testing.T) {
+
+	//RFC 6238 test vectors (SHA1), last 6 digits
+	secret := "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ" //12345678901234567890
+
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, test := range tests {
+		code, err := ngauth.TOTPCode(secret, time.Unix(test.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != test.code {
+			t.Fatalf("%d: expected %s, got %s", test.unix, test.code, code)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+
+	//clock drift
+	if !ngauth.ValidateTOTP(secret, "005924", now.Add(30*time.Second), 1) {
+		t.Fatal("code of previous step rejected")
+	}
+	if ngauth.ValidateTOTP(secret, "005924", now.Add(90*time.Second), 1) {
+		t.Fatal("code outside skew accepted")
+	}
+	if ngauth.ValidateTOTP(secret, "", now, 1) {
+		t.Fatal("empty code accepted")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+
+	secret, err := ngauth.GenerateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(secret) != 32 {
+		t.Fatalf("unexpected secret length %d", len(secret))
+	}
+
+	uri := ngauth.TOTPURI(secret, "a@example.com", "ngauth")
+	if !strings.HasPrefix(uri, "otpauth://totp/ngauth:a@example.com?") || !strings.Contains(uri, "secret="+secret) || !strings.Contains(uri, "issuer=ngauth") {
+		t.Fatalf("unexpected uri %s", uri)
+	}
+}
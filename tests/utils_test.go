@@ -1,6 +1,11 @@
 package tests
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
 	"github.com/hmkwizu/ngauth"
@@ -79,3 +84,102 @@ func TestBcrypt(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestGenerateRecoveryCode(t *testing.T) {
+
+	seen := make(map[string]bool)
+	for i := 0; i < 100; i++ {
+		code := ngauth.GenerateRecoveryCode()
+		if len(code) != 11 || code[5] != '-' || strings.ContainsAny(code, "01ilo") {
+			t.Fatalf("unexpected recovery code %s", code)
+		}
+		if seen[code] {
+			t.Fatalf("duplicate recovery code %s", code)
+		}
+		seen[code] = true
+	}
+
+	if ngauth.NormalizeRecoveryCode(" AB2CD-EF3GH ") != "ab2cdef3gh" {
+		t.Fatal("recovery code not normalized")
+	}
+}
+
+func TestIsValidOTPCode(t *testing.T) {
+
+	config := setTestConfig()
+
+	hash := ngauth.HashOTPCode("a@example.com", "", "RESET", "123456")
+	if !strings.HasPrefix(hash, "h1:") || strings.Contains(hash, "123456") {
+		t.Fatalf("unexpected hash %s", hash)
+	}
+
+	otp := &ngauth.OTP{Email: "a@example.com", OTPFor: "RESET", Code: hash}
+	if !ngauth.IsValidOTPCode(otp, "123456") || ngauth.IsValidOTPCode(otp, "123457") {
+		t.Fatal("hashed code not checked")
+	}
+
+	//the hash is bound to the email and otp_for
+	if ngauth.IsValidOTPCode(&ngauth.OTP{Email: "b@example.com", OTPFor: "RESET", Code: hash}, "123456") {
+		t.Fatal("hash accepted for another email")
+	}
+	if ngauth.IsValidOTPCode(&ngauth.OTP{Email: "a@example.com", OTPFor: "REGISTER", Code: hash}, "123456") {
+		t.Fatal("hash accepted for another otp_for")
+	}
+
+	//plaintext rows are never accepted
+	plaintext := &ngauth.OTP{Email: "a@example.com", OTPFor: "RESET", Code: "654321"}
+	if ngauth.IsValidOTPCode(plaintext, "654321") || ngauth.IsValidOTPCode(plaintext, "") {
+		t.Fatal("plaintext code accepted")
+	}
+	if ngauth.IsValidOTPCode(&ngauth.OTP{}, "") {
+		t.Fatal("empty code accepted")
+	}
+
+	//SIGN_KEY is not the hmac key
+	mac := hmac.New(sha256.New, config.SignKey)
+	mac.Write([]byte("RESET\x00a@example.com\x00\x00123456"))
+	if hash == "h1:"+hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatal("code hashed with SIGN_KEY")
+	}
+
+	config.OTPHashKey = []byte("otp hash key")
+	if ngauth.IsValidOTPCode(otp, "123456") {
+		t.Fatal("hash accepted with another OTP_HASH_KEY")
+	}
+}
+
+func TestClientIP(t *testing.T) {
+
+	config := setTestConfig()
+
+	request := func(remoteAddr string, forwardedFor string) string {
+		r := httptest.NewRequest("POST", "/login", nil)
+		r.RemoteAddr = remoteAddr
+		if forwardedFor != "" {
+			r.Header.Set("X-Forwarded-For", forwardedFor)
+		}
+		return ngauth.ClientIP(r)
+	}
+
+	//every connection has its own port
+	if request("203.0.113.7:50001", "") != "203.0.113.7" || request("203.0.113.7:50002", "") != "203.0.113.7" {
+		t.Fatal("port not removed")
+	}
+	if ip := request("[2001:db8::1]:50001", ""); ip != "2001:db8::1" {
+		t.Fatal("ipv6", ip)
+	}
+
+	//not from a trusted proxy
+	if ip := request("203.0.113.7:50001", "198.51.100.1"); ip != "203.0.113.7" {
+		t.Fatal("X-Forwarded-For of an untrusted client", ip)
+	}
+
+	//addresses before the trusted proxies can be forged
+	config.TrustedProxies = []string{"10.0.0.0/8", "192.0.2.1"}
+	if ip := request("10.0.0.5:50001", "1.1.1.1, 198.51.100.1, 192.0.2.1"); ip != "198.51.100.1" {
+		t.Fatal("X-Forwarded-For of a trusted proxy", ip)
+	}
+	if ip := request("10.0.0.5:50001", ""); ip != "10.0.0.5" {
+		t.Fatal("trusted proxy without X-Forwarded-For", ip)
+	}
+}
@@ -0,0 +1,534 @@
+package tests
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hmkwizu/ngauth"
+	"gopkg.in/guregu/null.v3"
+)
+
+//######## CBOR encoder, enough for attestation objects and COSE keys
+
+// cborMap - map with ordered keys
+type cborMap []cborPair
+
+type cborPair struct {
+	key   interface{}
+	value interface{}
+}
+
+func cborHead(major byte, n uint64) []byte {
+	switch {
+	case n < 24:
+		return []byte{major<<5 | byte(n)}
+	case n <= 0xff:
+		return []byte{major<<5 | 24, byte(n)}
+	case n <= 0xffff:
+		head := []byte{major<<5 | 25, 0, 0}
+		binary.BigEndian.PutUint16(head[1:], uint16(n))
+		return head
+	}
+	head := []byte{major<<5 | 26, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(head[1:], uint32(n))
+	return head
+}
+
+func cborEncode(value interface{}) []byte {
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case []interface{}:
+		data := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			data = append(data, cborEncode(item)...)
+		}
+		return data
+	case cborMap:
+		data := cborHead(5, uint64(len(v)))
+		for _, pair := range v {
+			data = append(data, cborEncode(pair.key)...)
+			data = append(data, cborEncode(pair.value)...)
+		}
+		return data
+	}
+	panic("cbor: unsupported type")
+}
+
+//######## software authenticator
+
+// softAuthenticator - ES256 authenticator in memory, what a security key/platform authenticator does
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	aaguid       []byte
+	signCount    uint32
+	origin       string
+	userVerified bool
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	credentialID := make([]byte, 32)
+	rand.Read(credentialID)
+
+	aaguid := make([]byte, 16)
+	rand.Read(aaguid)
+
+	return &softAuthenticator{key: key, credentialID: credentialID, aaguid: aaguid, origin: "https://example.com", userVerified: true}
+}
+
+func (a *softAuthenticator) coseKey() []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	a.key.X.FillBytes(x)
+	a.key.Y.FillBytes(y)
+	return cborEncode(cborMap{{1, 2}, {3, -7}, {-1, 1}, {-2, x}, {-3, y}})
+}
+
+func (a *softAuthenticator) authData(attested bool) []byte {
+
+	rpIDHash := sha256.Sum256([]byte("example.com"))
+
+	flags := byte(0x01)
+	if a.userVerified {
+		flags |= 0x04
+	}
+	if attested {
+		flags |= 0x40
+	}
+
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.signCount)
+
+	if attested {
+		data = append(data, a.aaguid...)
+		data = append(data, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+		data = append(data, a.credentialID...)
+		data = append(data, a.coseKey()...)
+	}
+
+	return data
+}
+
+func (a *softAuthenticator) clientData(clientDataType string, challenge string) []byte {
+	data, _ := json.Marshal(map[string]interface{}{"type": clientDataType, "challenge": challenge, "origin": a.origin})
+	return data
+}
+
+// sign - ES256 signature of authData and the client data hash
+func sign(key *ecdsa.PrivateKey, authData []byte, clientDataJSON []byte) []byte {
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	sig, _ := asn1.Marshal(struct{ R, S *big.Int }{r, s})
+	return sig
+}
+
+// create - navigator.credentials.create(), format none or packed.
+// packed is self attestation without an attestation key, basic attestation with attestationKey and its certificate
+func (a *softAuthenticator) create(challenge string, format string, attestationKey *ecdsa.PrivateKey, cert []byte) map[string]interface{} {
+
+	clientDataJSON := a.clientData("webauthn.create", challenge)
+	authData := a.authData(true)
+
+	attStmt := cborMap{}
+	if format == "packed" {
+		key := a.key
+		if attestationKey != nil {
+			key = attestationKey
+		}
+		attStmt = cborMap{{"alg", -7}, {"sig", sign(key, authData, clientDataJSON)}}
+		if cert != nil {
+			attStmt = append(attStmt, cborPair{"x5c", []interface{}{cert}})
+		}
+	}
+
+	attestationObject := cborEncode(cborMap{{"fmt", format}, {"attStmt", attStmt}, {"authData", authData}})
+
+	return map[string]interface{}{
+		"client_data_json":   ngauth.WebAuthnEncode(clientDataJSON),
+		"attestation_object": ngauth.WebAuthnEncode(attestationObject),
+	}
+}
+
+// get - navigator.credentials.get()
+func (a *softAuthenticator) get(challenge string) map[string]interface{} {
+
+	a.signCount++
+
+	clientDataJSON := a.clientData("webauthn.get", challenge)
+	authData := a.authData(false)
+
+	return map[string]interface{}{
+		"credential_id":      ngauth.WebAuthnEncode(a.credentialID),
+		"client_data_json":   ngauth.WebAuthnEncode(clientDataJSON),
+		"authenticator_data": ngauth.WebAuthnEncode(authData),
+		"signature":          ngauth.WebAuthnEncode(sign(a.key, authData, clientDataJSON)),
+	}
+}
+
+// attestationCertificate - self signed packed attestation certificate
+func attestationCertificate(t *testing.T, key *ecdsa.PrivateKey, ou string, aaguid []byte) []byte {
+
+	extension, _ := asn1.Marshal(aaguid)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{Country: []string{"TZ"}, Organization: []string{"ngauth"}, OrganizationalUnit: []string{ou}, CommonName: "ngauth test authenticator"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		ExtraExtensions:       []pkix.Extension{{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}, Value: extension}},
+	}
+
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func challengeOf(t *testing.T, response map[string]interface{}) string {
+	publicKey, ok := response["public_key"].(ngauth.Map)
+	if !ok {
+		t.Fatal("public_key missing", response)
+	}
+	return publicKey["challenge"].(string)
+}
+
+// registerPasskey - runs the registration ceremony of the authenticator
+func registerPasskey(t *testing.T, db ngauth.Database, userID interface{}, authenticator *softAuthenticator, format string, attestationKey *ecdsa.PrivateKey, cert []byte) (map[string]interface{}, *ngauth.Error) {
+
+	options, err := ngauth.WebAuthnRegisterOptions(db, "en", map[string]interface{}{"loggedin_user_id": userID})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	params := authenticator.create(challengeOf(t, options), format, attestationKey, cert)
+	params["loggedin_user_id"] = userID
+	params["name"] = "Laptop"
+
+	return ngauth.WebAuthnRegister(db, "en", params)
+}
+
+// loginPasskey - runs the login ceremony of the authenticator, for the email or a discoverable passkey
+func loginPasskey(t *testing.T, db ngauth.Database, authenticator *softAuthenticator, email string) (map[string]interface{}, *ngauth.Error) {
+
+	options, err := ngauth.WebAuthnLoginOptions(db, "en", map[string]interface{}{"email": email})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+
+	return ngauth.WebAuthnLogin(db, "en", authenticator.get(challengeOf(t, options)))
+}
+
+func TestWebAuthnRegisterAndLogin(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+	authenticator := newSoftAuthenticator(t)
+
+	options, err := ngauth.WebAuthnRegisterOptions(db, "en", map[string]interface{}{"loggedin_user_id": userID})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	//user handle, the base64url user id
+	userHandle := ngauth.WebAuthnEncode([]byte(ngauth.GetStringOrEmpty(userID)))
+
+	publicKey := options["public_key"].(ngauth.Map)
+	if publicKey["rp"].(ngauth.Map)["id"] != "example.com" || publicKey["user"].(ngauth.Map)["id"] != userHandle {
+		t.Fatal("options", publicKey)
+	}
+
+	params := authenticator.create(challengeOf(t, options), "none", nil, nil)
+	params["loggedin_user_id"] = userID
+
+	response, err := ngauth.WebAuthnRegister(db, "en", params)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	credential := response["credential"].(ngauth.WebAuthnCredential)
+	if credential.CredentialID != ngauth.WebAuthnEncode(authenticator.credentialID) || credential.AttestationType != "none" {
+		t.Fatalf("credential %+v", credential)
+	}
+
+	//challenges are single use
+	if _, err = ngauth.WebAuthnRegister(db, "en", params); err == nil || err.Code != ngauth.ErrorWebAuthnChallenge {
+		t.Fatal("registration challenge used twice")
+	}
+
+	if _, err = registerPasskey(t, db, userID, authenticator, "none", nil, nil); err == nil || err.Code != ngauth.ErrorWebAuthnCredentialExists {
+		t.Fatal("passkey registered twice")
+	}
+
+	//login with the email, only the user's passkeys are allowed
+	options, err = ngauth.WebAuthnLoginOptions(db, "en", map[string]interface{}{"email": "a@example.com"})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	allowed := options["public_key"].(ngauth.Map)["allowCredentials"].([]ngauth.Map)
+	if len(allowed) != 1 || allowed[0]["id"] != credential.CredentialID {
+		t.Fatal("allowCredentials", allowed)
+	}
+
+	assertion := authenticator.get(challengeOf(t, options))
+	response, err = ngauth.WebAuthnLogin(db, "en", assertion)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["access_token"] == nil || response["refresh_token"] == nil {
+		t.Fatal("tokens not returned", response)
+	}
+
+	//replayed assertion
+	if _, err = ngauth.WebAuthnLogin(db, "en", assertion); err == nil || err.Code != ngauth.ErrorWebAuthnChallenge {
+		t.Fatal("assertion replayed")
+	}
+
+	//discoverable passkey, the user handle identifies the user
+	options, err = ngauth.WebAuthnLoginOptions(db, "en", map[string]interface{}{})
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	assertion = authenticator.get(challengeOf(t, options))
+	assertion["user_handle"] = userHandle
+	if _, err = ngauth.WebAuthnLogin(db, "en", assertion); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	options, _ = ngauth.WebAuthnLoginOptions(db, "en", map[string]interface{}{})
+	assertion = authenticator.get(challengeOf(t, options))
+	assertion["user_handle"] = ngauth.WebAuthnEncode([]byte("other"))
+	if _, err = ngauth.WebAuthnLogin(db, "en", assertion); err == nil || err.Code != ngauth.ErrorWebAuthnFailed {
+		t.Fatal("user handle not checked")
+	}
+
+	//cloned authenticator, the counter went back
+	authenticator.signCount = 0
+	if _, err = loginPasskey(t, db, authenticator, "a@example.com"); err == nil || err.Code != ngauth.ErrorWebAuthnFailed {
+		t.Fatal("signature counter not checked")
+	}
+	authenticator.signCount = 100
+
+	//phishing site
+	authenticator.origin = "https://example.com.evil.io"
+	if _, err = loginPasskey(t, db, authenticator, "a@example.com"); err == nil || err.Code != ngauth.ErrorWebAuthnFailed {
+		t.Fatal("origin not checked")
+	}
+	authenticator.origin = "https://example.com"
+
+	//someone else's passkey
+	other := newSoftAuthenticator(t)
+	if _, err = loginPasskey(t, db, other, "a@example.com"); err == nil || err.Code != ngauth.ErrorWebAuthnFailed {
+		t.Fatal("unknown credential accepted")
+	}
+
+	if _, err = loginPasskey(t, db, authenticator, "a@example.com"); err != nil {
+		t.Fatal(err.Message)
+	}
+}
+
+func TestWebAuthnPackedAttestation(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+
+	//self attestation
+	response, err := registerPasskey(t, db, userID, newSoftAuthenticator(t), "packed", nil, nil)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if credential := response["credential"].(ngauth.WebAuthnCredential); credential.AttestationType != "self" {
+		t.Fatalf("credential %+v", credential)
+	}
+
+	//basic attestation, signed with the attestation certificate key
+	attestationKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	authenticator := newSoftAuthenticator(t)
+	authenticator.aaguid = []byte{0xcb, 0x69, 0x48, 0x1e, 0x8f, 0xf7, 0x40, 0x39, 0x93, 0xec, 0x0a, 0x27, 0x29, 0xa1, 0x54, 0xa8}
+	cert := attestationCertificate(t, attestationKey, "Authenticator Attestation", authenticator.aaguid)
+
+	response, err = registerPasskey(t, db, userID, authenticator, "packed", attestationKey, cert)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	credential := response["credential"].(ngauth.WebAuthnCredential)
+	if credential.AttestationType != "basic" || credential.AAGUID != "cb69481e-8ff7-4039-93ec-0a2729a154a8" {
+		t.Fatalf("credential %+v", credential)
+	}
+
+	if _, err = loginPasskey(t, db, authenticator, "a@example.com"); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//signed with a key other than the certificate's
+	if _, err = registerPasskey(t, db, userID, newSoftAuthenticator(t), "packed", nil, cert); err == nil || err.Code != ngauth.ErrorWebAuthnFailed {
+		t.Fatal("attestation signature not checked")
+	}
+
+	//certificate of another authenticator model
+	authenticator = newSoftAuthenticator(t)
+	if _, err = registerPasskey(t, db, userID, authenticator, "packed", attestationKey, cert); err == nil || err.Code != ngauth.ErrorWebAuthnFailed {
+		t.Fatal("aaguid not checked")
+	}
+
+	//not an attestation certificate
+	cert = attestationCertificate(t, attestationKey, "Web Server", authenticator.aaguid)
+	if _, err = registerPasskey(t, db, userID, authenticator, "packed", attestationKey, cert); err == nil || err.Code != ngauth.ErrorWebAuthnFailed {
+		t.Fatal("certificate subject not checked")
+	}
+
+	if _, err = registerPasskey(t, db, userID, authenticator, "fido-u2f", nil, nil); err == nil || err.Code != ngauth.ErrorWebAuthnFailed {
+		t.Fatal("unsupported format accepted")
+	}
+}
+
+func TestWebAuthnUserVerification(t *testing.T) {
+
+	config := setTestConfig()
+	db := newTestDB(t)
+
+	userID := registerUser(t, db, "a@example.com", "1234")
+
+	//security key without a pin
+	authenticator := newSoftAuthenticator(t)
+	authenticator.userVerified = false
+
+	if _, err := registerPasskey(t, db, userID, authenticator, "none", nil, nil); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//TOTP is still required
+	enroll, _ := ngauth.EnrollTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID})
+	code, _ := ngauth.TOTPCode(enroll["secret"].(string), time.Now())
+	if _, err := ngauth.ConfirmTOTP(db, "en", map[string]interface{}{"loggedin_user_id": userID, "code": code}, hashMake); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	response, err := loginPasskey(t, db, authenticator, "a@example.com")
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["mfa_required"] != true || response["access_token"] != nil {
+		t.Fatal("second factor skipped", response)
+	}
+
+	//user verified passkeys are a second factor
+	authenticator.userVerified = true
+	response, err = loginPasskey(t, db, authenticator, "a@example.com")
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if response["access_token"] == nil {
+		t.Fatal("tokens not returned", response)
+	}
+
+	config.WebAuthnUserVerification = "required"
+	authenticator.userVerified = false
+	if _, err = loginPasskey(t, db, authenticator, "a@example.com"); err == nil || err.Code != ngauth.ErrorWebAuthnFailed {
+		t.Fatal("user verification not required")
+	}
+}
+
+func TestWebAuthnChallengesPurged(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	expired := ngauth.WebAuthnChallenge{Challenge: "expired", Ceremony: "login", ExpiresAt: null.TimeFrom(time.Now().Add(-time.Minute))}
+	if _, err := db.CreateWebAuthnChallenge(expired, "en"); err != nil {
+		t.Fatal(err.Message)
+	}
+	current := ngauth.WebAuthnChallenge{Challenge: "current", Ceremony: "login", ExpiresAt: null.TimeFrom(time.Now().Add(time.Minute))}
+	if _, err := db.CreateWebAuthnChallenge(current, "en"); err != nil {
+		t.Fatal(err.Message)
+	}
+
+	//expired challenges are deleted when a new one is created
+	if challenge, err := db.GetWebAuthnChallenge("expired", "en"); err != nil || challenge != nil {
+		t.Fatal("expired challenge not deleted")
+	}
+	if challenge, err := db.GetWebAuthnChallenge("current", "en"); err != nil || challenge == nil {
+		t.Fatal("current challenge deleted")
+	}
+}
+
+func TestWebAuthnRegisterOAuthToken(t *testing.T) {
+
+	setTestConfig()
+	db := newTestDB(t)
+
+	registerUser(t, db, "a@example.com", "1234")
+	clientID, secret := registerOAuthClient(t, db, false, "read")
+	authenticator := newSoftAuthenticator(t)
+
+	//the /webauthn/register route, the user id of the token
+	registered := false
+	handler := ngauth.RequireAuth(ngauth.RequireFirstParty(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		registered = true
+		if _, err := registerPasskey(t, db, ngauth.UserIDFromContext(r.Context()), authenticator, "none", nil, nil); err != nil {
+			t.Fatal(err.Message)
+		}
+	})))
+
+	register := func(accessToken interface{}) int {
+		r := httptest.NewRequest("POST", "/webauthn/register", nil)
+		r.Header.Set("Authorization", "Bearer "+ngauth.GetStringOrEmpty(accessToken))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	//a client the user authorized cannot add a passkey to the account
+	tokens := oauthTokens(t, db, clientID, secret)
+	if code := register(tokens["access_token"]); code != http.StatusForbidden || registered {
+		t.Fatalf("oauth token: status %d", code)
+	}
+
+	response, err := ngauth.Login(db, "en", map[string]interface{}{"email": "a@example.com", "password": "1234"}, hashCheck)
+	if err != nil {
+		t.Fatal(err.Message)
+	}
+	if code := register(response["access_token"]); code != http.StatusOK || !registered {
+		t.Fatalf("first party token: status %d", code)
+	}
+	if _, err = loginPasskey(t, db, authenticator, "a@example.com"); err != nil {
+		t.Fatal(err.Message)
+	}
+}
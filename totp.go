@@ -0,0 +1,117 @@
+package ngauth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TOTP parameters (RFC 6238), these are the defaults every authenticator app supports
+const (
+	totpPeriod     = 30
+	totpDigits     = 6
+	totpSecretSize = 20
+)
+
+// totpEncoding - base32 without padding, as used in otpauth:// URIs
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret - generates a random base32 encoded TOTP secret
+func GenerateTOTPSecret() (string, error) {
+
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(secret), nil
+}
+
+// TOTPCode - the TOTP code of the base32 secret at time t
+func TOTPCode(secret string, t time.Time) (string, error) {
+	return totpCodeAt(secret, t.Unix()/totpPeriod)
+}
+
+// totpCodeAt - HOTP (RFC 4226) code for the time step counter
+func totpCodeAt(secret string, counter int64) (string, error) {
+
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.TrimRight(secret, "=")))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	//dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	code := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	return fmt.Sprintf("%0*d", totpDigits, code%1000000), nil
+}
+
+// ValidateTOTP - checks the code against the secret at time t,
+// codes of skew steps before/after t are accepted to allow for clock drift
+func ValidateTOTP(secret string, code string, t time.Time, skew int) bool {
+	_, valid := ValidateTOTPStep(secret, code, t, skew)
+	return valid
+}
+
+// ValidateTOTPStep - like ValidateTOTP, also returns the time step of the code.
+// Save it and refuse codes of the same or an earlier step, so a code is accepted once
+func ValidateTOTPStep(secret string, code string, t time.Time, skew int) (int64, bool) {
+
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	counter := t.Unix() / totpPeriod
+	var step int64
+	valid := false
+
+	//check every step, the time taken should not tell which one matched
+	for i := -skew; i <= skew; i++ {
+		expected, err := totpCodeAt(secret, counter+int64(i))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			step = counter + int64(i)
+			valid = true
+		}
+	}
+
+	return step, valid
+}
+
+// TOTPURI - otpauth:// URI for authenticator apps, usually shown as a QR code
+func TOTPURI(secret string, accountName string, issuer string) string {
+
+	label := url.PathEscape(accountName)
+	if !IsEmptyString(issuer) {
+		label = url.PathEscape(issuer) + ":" + label
+	}
+
+	query := url.Values{}
+	query.Set("secret", secret)
+	query.Set("algorithm", "SHA1")
+	query.Set("digits", fmt.Sprint(totpDigits))
+	query.Set("period", fmt.Sprint(totpPeriod))
+	if !IsEmptyString(issuer) {
+		query.Set("issuer", issuer)
+	}
+
+	return "otpauth://totp/" + label + "?" + query.Encode()
+}
@@ -1,14 +1,19 @@
 package ngauth
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/hex"
 	"errors"
-	"fmt"
 	"io"
 	"log"
+	"math/big"
+	"net"
 	"net/http"
 	"net/smtp"
+	"net/url"
 	"os"
 	"regexp"
 	"strings"
@@ -73,6 +78,12 @@ func LogErrorf(format string, v ...interface{}) {
 	log.Printf(format, v...)
 }
 
+// LogFatalf - logs a message to stderr and exits
+func LogFatalf(format string, v ...interface{}) {
+	log.SetOutput(os.Stderr)
+	log.Fatalf(format, v...)
+}
+
 // table - lookup table for the secure number generator
 var table = [...]byte{'1', '2', '3', '4', '5', '6', '7', '8', '9', '0'}
 
@@ -94,6 +105,108 @@ func SecureRandomNumericStringStandard() string {
 	return SecureRandomNumericString(6)
 }
 
+// otpHashPrefix - marks otp codes stored as HMAC-SHA256, codes without it are legacy plaintext rows
+const otpHashPrefix = "h1:"
+
+// deriveKey - key for one purpose, HMAC-SHA256 of the label with Config.OTPHashKey or SignKey.
+// SIGN_KEY also signs the tokens, it is never used as it is
+func deriveKey(label string) []byte {
+
+	key := Config.OTPHashKey
+	if len(key) == 0 {
+		key = Config.SignKey
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label))
+
+	return mac.Sum(nil)
+}
+
+// HashOTPCode - keyed hash of the otp code, stored instead of the code.
+// the email/phone number and otp_for are part of the hash, a hash is only valid for its own otp
+func HashOTPCode(email string, phoneNo string, otpFor string, code string) string {
+
+	mac := hmac.New(sha256.New, deriveKey("otp code"))
+	mac.Write([]byte(otpFor + "\x00" + email + "\x00" + phoneNo + "\x00" + code))
+
+	return otpHashPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// IsValidOTPCode - compares the hash of the code with the stored otp in constant time,
+// codes that are not hashed are rejected (plaintext codes are cleared by the otp_clear_plaintext_codes migration)
+func IsValidOTPCode(otp *OTP, code string) bool {
+
+	if otp == nil || IsEmptyString(code) || !strings.HasPrefix(otp.Code, otpHashPrefix) {
+		return false
+	}
+
+	hash := HashOTPCode(otp.Email, otp.PhoneNumber, otp.OTPFor, code)
+
+	return subtle.ConstantTimeCompare([]byte(otp.Code), []byte(hash)) == 1
+}
+
+// SecureRandomString - generates a random string of length from the alphabet
+func SecureRandomString(length int, alphabet string) string {
+	max := big.NewInt(int64(len(alphabet)))
+	b := make([]byte, length)
+	for i := 0; i < length; i++ {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = alphabet[n.Int64()]
+	}
+	return string(b)
+}
+
+// recoveryCodeAlphabet - lower case letters and digits without look-alikes (0/o, 1/l/i)
+const recoveryCodeAlphabet = "23456789abcdefghjkmnpqrstuvwxyz"
+
+// GenerateRecoveryCode - generates a recovery code eg. 4kx9m-q2hrt
+func GenerateRecoveryCode() string {
+	code := SecureRandomString(10, recoveryCodeAlphabet)
+	return code[:5] + "-" + code[5:]
+}
+
+// NormalizeRecoveryCode - recovery codes are case insensitive, spaces and dashes are ignored
+func NormalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, code)
+}
+
+// userCodeAlphabet - upper case consonants without vowels and look-alikes, easy to type on a phone (RFC 8628 section 6.1)
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// GenerateUserCode - generates a device user code eg. WDJB-MJHT, stored without the dash
+func GenerateUserCode() string {
+	return SecureRandomString(8, userCodeAlphabet)
+}
+
+// FormatUserCode - user code with a dash in the middle, as shown on the device
+func FormatUserCode(code string) string {
+	if len(code) != 8 {
+		return code
+	}
+	return code[:4] + "-" + code[4:]
+}
+
+// NormalizeUserCode - user codes are case insensitive, spaces and dashes are ignored
+func NormalizeUserCode(code string) string {
+	code = strings.ToUpper(code)
+	return strings.Map(func(r rune) rune {
+		if r == '-' || unicode.IsSpace(r) {
+			return -1
+		}
+		return r
+	}, code)
+}
+
 // GetStringOrEmpty - get string or empty
 // to be used in post body submissions, be sure val is a string
 func GetStringOrEmpty(val interface{}) string {
@@ -260,15 +373,71 @@ func IsValidPhoneNumber(phoneNumber string, countryCode string, lang string) (st
 	return phonenumbers.Format(num, phonenumbers.E164), nil
 }
 
-// AsyncSendVerifCode - sends verification code in a goroutine
+// AsyncSendVerifCode - sends verification code in a goroutine, using the english otp template
 func AsyncSendVerifCode(toEmail string, code string) {
-	subject := "Verification Code"
-	body := fmt.Sprintf("<p>Your verification code is <b>%s</b>. </p>", code)
-	go SendEmail(toEmail, subject, body)
+	AsyncSendOTP(OTPMessage{Lang: LanguageEN, Email: toEmail, Code: code, ExpireMins: Config.OTPExpireTime / 60})
+}
+
+// AsyncSendOTP - sends the otp code in a goroutine, by SMS to phone numbers and by email otherwise
+// the message is rendered from the otp template of the language and purpose
+func AsyncSendOTP(message OTPMessage) {
+	go func() {
+		if err := SendOTP(message); err != nil {
+			LogErrorf("OTP: error sending %s code: %s", message.OTPFor, err)
+		}
+	}()
+}
+
+// SendOTP - sends the otp code, by SMS to phone numbers and by email otherwise
+func SendOTP(message OTPMessage) error {
+
+	rendered, err := RenderOTPMessage(message)
+	if err != nil {
+		return err
+	}
+
+	if !IsEmptyString(message.PhoneNumber) {
+		return SendSMS(message.PhoneNumber, rendered.SMS)
+	}
+
+	return SendRenderedEmail(message.Email, rendered)
+}
+
+// AsyncSendLoginAlert - emails the user about a new login in a goroutine
+func AsyncSendLoginAlert(alert LoginAlert) {
+	go func() {
+		rendered, err := emailTemplates().Render(alert.Lang, TemplateLoginAlert, alert)
+		if err == nil {
+			err = SendRenderedEmail(alert.Email, rendered)
+		}
+		if err != nil {
+			LogErrorf("Email: error sending login alert: %s", err)
+		}
+	}()
+}
+
+// SendSMS - sends a text message with Config.SMSSender
+func SendSMS(toPhoneNo string, message string) error {
+
+	if Config.SMSSender == nil {
+		return errors.New("SMS sender not configured")
+	}
+
+	return Config.SMSSender.SendSMS(toPhoneNo, message)
 }
 
 // SendEmail - sends emails
 func SendEmail(toEmail string, subject string, body string) error {
+	return sendEmail(toEmail, subject, body, "")
+}
+
+// SendRenderedEmail - sends a rendered template, with the text body as the plain text alternative
+func SendRenderedEmail(toEmail string, rendered *RenderedEmail) error {
+	return sendEmail(toEmail, rendered.Subject, rendered.HTML, rendered.Text)
+}
+
+// sendEmail - sends an html email, text is the optional plain text alternative
+func sendEmail(toEmail string, subject string, body string, text string) error {
 
 	//Return if email configuration not complete
 	if len(Config.SMTPUsername) == 0 || len(Config.SMTPPassword) == 0 || len(Config.SMTPHost) == 0 || len(Config.SMTPPort) == 0 {
@@ -280,6 +449,9 @@ func SendEmail(toEmail string, subject string, body string) error {
 	e.To = []string{toEmail}
 	e.Subject = subject
 	e.HTML = []byte(body)
+	if !IsEmptyString(text) {
+		e.Text = []byte(text)
+	}
 	return e.Send(Config.SMTPHost+":"+Config.SMTPPort, smtp.PlainAuth("", Config.SMTPUsername, Config.SMTPPassword, Config.SMTPHost))
 }
 
@@ -313,6 +485,21 @@ func BcryptHashCheck(hashedPwd string, plainPwd string) bool {
 
 //############## JWT
 
+// Token types, sent in the token_use claim
+const (
+	TokenUseAccess  = "access"
+	TokenUseRefresh = "refresh"
+
+	//TokenUseMFA - short lived token returned by Login when a second factor is required
+	TokenUseMFA = "mfa"
+
+	//TokenUseMagicLink - sent in the magic link of otp_for LOGIN, see LoginOTP
+	TokenUseMagicLink = "magic_link"
+
+	//TokenUseID - OpenID Connect id token, see GenerateIDToken
+	TokenUseID = "id"
+)
+
 // IsValidToken - check if jwt token is valid
 // if no error then token is valid
 // return: claims map, error
@@ -324,11 +511,12 @@ func IsValidToken(tokenStr string) (map[string]interface{}, *Error) {
 
 	token, err := jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
 		// Don't forget to validate the alg is what you expect
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("Unexpected signing method: %v", token.Header["alg"])
+		key, err := verificationKey(token)
+		if err != nil {
+			return nil, err
 		}
 
-		return Config.SignKey, nil
+		return key.verifyKey, nil
 	})
 
 	if err != nil {
@@ -354,30 +542,147 @@ func IsValidToken(tokenStr string) (map[string]interface{}, *Error) {
 		claims = tokenClaims
 	}
 
+	//issuer, legacy tokens have none
+	if !IsEmptyString(Config.JWTIssuer) && !claims.VerifyIssuer(Config.JWTIssuer, !Config.JWTAcceptLegacyTokens) {
+		return nil, NewErrorWithMessage(ErrorInvalidToken, "Token iss invalid")
+	}
+
+	//audience
+	legacyAudience := Config.JWTAcceptLegacyTokens && claims["aud"] == nil
+	if !IsEmptyString(Config.JWTAudience) && !legacyAudience && !hasAudience(claims["aud"], Config.JWTAudience) {
+		return nil, NewErrorWithMessage(ErrorInvalidToken, "Token aud invalid")
+	}
+
 	return claims, nil
 }
 
+// hasAudience - aud claim is either a string or an array of strings
+func hasAudience(aud interface{}, audience string) bool {
+
+	switch val := aud.(type) {
+	case string:
+		return val == audience
+	case []interface{}:
+		for _, a := range val {
+			if a == audience {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// IsValidAccessToken - check if jwt token is a valid access token
+// refresh tokens are rejected
+func IsValidAccessToken(tokenStr string) (map[string]interface{}, *Error) {
+	return isValidTokenOfType(tokenStr, TokenUseAccess)
+}
+
+// IsValidRefreshToken - check if jwt token is a valid refresh token
+// access tokens are rejected
+func IsValidRefreshToken(tokenStr string) (map[string]interface{}, *Error) {
+	return isValidTokenOfType(tokenStr, TokenUseRefresh)
+}
+
+// isValidTokenOfType - check if jwt token is valid and has the token_use
+func isValidTokenOfType(tokenStr string, tokenUse string) (map[string]interface{}, *Error) {
+
+	claims, err := IsValidToken(tokenStr)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenType := claims["token_use"]
+
+	//tokens issued before the token_use claim had the same claims, refresh tokens live longer
+	if tokenType == nil && Config.JWTAcceptLegacyTokens {
+		tokenType = TokenUseAccess
+		if GetInt64OrZero(claims["exp"])-GetInt64OrZero(claims["iat"]) > int64(Config.JWTAccessExpireMins)*60 {
+			tokenType = TokenUseRefresh
+		}
+	}
+
+	if tokenType != tokenUse {
+		return nil, NewErrorWithMessage(ErrorInvalidToken, "Token type invalid")
+	}
+
+	return claims, nil
+}
+
+// IsValidMFAToken - check if jwt token is a valid mfa token, see Login
+func IsValidMFAToken(tokenStr string) (map[string]interface{}, *Error) {
+	return isValidTokenOfType(tokenStr, TokenUseMFA)
+}
+
+// GenerateMFAToken - generates the token exchanged for access/refresh tokens at /login/2fa
+func GenerateMFAToken(userID interface{}) (string, *Error) {
+	return GenerateToken(userID, Config.MFATokenExpireMins, map[string]interface{}{"token_use": TokenUseMFA})
+}
+
+// IsValidMagicLinkToken - check if jwt token is a valid magic link token
+func IsValidMagicLinkToken(tokenStr string) (map[string]interface{}, *Error) {
+	return isValidTokenOfType(tokenStr, TokenUseMagicLink)
+}
+
+// GenerateMagicLinkToken - generates the token of a magic link, valid as long as the otp
+func GenerateMagicLinkToken(userID interface{}, otpID interface{}) (string, *Error) {
+
+	expireMins := int(Config.OTPExpireTime / 60)
+	if expireMins < 1 {
+		expireMins = 1
+	}
+
+	return GenerateToken(userID, expireMins, map[string]interface{}{"token_use": TokenUseMagicLink, "otp_id": otpID})
+}
+
+// MagicLinkURL - Config.MagicLinkURL with the token query parameter
+func MagicLinkURL(token string) string {
+
+	separator := "?"
+	if strings.Contains(Config.MagicLinkURL, "?") {
+		separator = "&"
+	}
+
+	return Config.MagicLinkURL + separator + "token=" + url.QueryEscape(token)
+}
+
 // GenerateAccessToken - generates access token
 func GenerateAccessToken(userID interface{}) (string, *Error) {
-	return GenerateToken(userID, Config.JWTAccessExpireMins, nil)
+	return GenerateToken(userID, Config.JWTAccessExpireMins, map[string]interface{}{"token_use": TokenUseAccess})
 }
 
 // GenerateRefreshToken - generates refresh token
 func GenerateRefreshToken(userID interface{}) (string, *Error) {
-	return GenerateToken(userID, Config.JWTRefreshExpireMins, nil)
+	return GenerateToken(userID, Config.JWTRefreshExpireMins, map[string]interface{}{"token_use": TokenUseRefresh})
 }
 
 // GenerateToken - generates signed token
+// tokens without a userID (machine clients) have no id claim, their sub is set in params
 func GenerateToken(userID interface{}, expireMins int, params map[string]interface{}) (string, *Error) {
 	//Generate JWT Token
 	// NOTE: Don't add sensitive info to the token, eg. password
 
 	claims := jwt.MapClaims{
-		"id":  userID,
+		"jti": GenerateUUID(),                                       //unique, even if issued within the same second
 		"iat": NowTimestamp(),                                       //issued at NOW!
+		"nbf": NowTimestamp(),                                       //not valid before NOW!
 		"exp": ExpireAtUTC(time.Duration(expireMins) * time.Minute), //expires in n minutes
 	}
 
+	if userID != nil {
+		claims["id"] = userID
+		claims["sub"] = GetStringOrEmpty(userID)
+	}
+
+	if !IsEmptyString(Config.JWTIssuer) {
+		claims["iss"] = Config.JWTIssuer
+	}
+
+	if !IsEmptyString(Config.JWTAudience) {
+		claims["aud"] = Config.JWTAudience
+	}
+
 	//add extra params
 	if params != nil {
 		for k, val := range params {
@@ -387,10 +692,18 @@ func GenerateToken(userID interface{}, expireMins int, params map[string]interfa
 		}
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	key, keyErr := currentSigningKey()
+	if keyErr != nil {
+		return "", NewErrorWithMessage(ErrorInternalServerError, keyErr.Error())
+	}
+
+	token := jwt.NewWithClaims(key.Method, claims)
+	if !IsEmptyString(key.ID) {
+		token.Header["kid"] = key.ID
+	}
 
 	//Sign the Token
-	tokenString, err := token.SignedString(Config.SignKey)
+	tokenString, err := token.SignedString(key.signKey)
 
 	if err != nil {
 		return tokenString, NewErrorWithMessage(ErrorInternalServerError, err.Error())
@@ -410,3 +723,60 @@ func GetTokenFromHeader(r *http.Request) string {
 
 	return strings.TrimSpace(splitToken[1])
 }
+
+// ClientIP - ip address of the request, without the port. X-Forwarded-For and X-Real-IP are
+// only used if the request comes from one of Config.TrustedProxies, any client can send them
+func ClientIP(r *http.Request) string {
+
+	ip := r.RemoteAddr
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		ip = host
+	}
+
+	if !isTrustedProxy(ip) {
+		return ip
+	}
+
+	//the last address not added by a trusted proxy, the ones before it can be forged
+	if forwarded := strings.Join(r.Header["X-Forwarded-For"], ","); !IsEmptyString(forwarded) {
+		addrs := strings.Split(forwarded, ",")
+		for i := len(addrs) - 1; i >= 0; i-- {
+			addr := strings.TrimSpace(addrs[i])
+			if net.ParseIP(addr) == nil {
+				break
+			}
+			ip = addr
+			if !isTrustedProxy(addr) {
+				break
+			}
+		}
+		return ip
+	}
+
+	if realIP := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+
+	return ip
+}
+
+// isTrustedProxy - ip is one of Config.TrustedProxies, ip addresses or CIDRs
+func isTrustedProxy(ip string) bool {
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+
+	for _, proxy := range Config.TrustedProxies {
+		if _, network, err := net.ParseCIDR(proxy); err == nil {
+			if network.Contains(parsed) {
+				return true
+			}
+		} else if proxyIP := net.ParseIP(proxy); proxyIP != nil && proxyIP.Equal(parsed) {
+			return true
+		}
+	}
+
+	return false
+}
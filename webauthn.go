@@ -0,0 +1,715 @@
+package ngauth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"strings"
+)
+
+// WebAuthn (passkeys), https://www.w3.org/TR/webauthn-2/
+// attestation formats none and packed are supported, credential keys can be ES256, EdDSA or RS256.
+// Attestation certificates are not checked against a trust store, the attestation type is saved with the credential
+
+// client data types, also saved as the ceremony of the challenge
+const (
+	webAuthnTypeCreate = "webauthn.create"
+	webAuthnTypeGet    = "webauthn.get"
+)
+
+// COSE algorithms (RFC 8152) of credential keys
+const (
+	coseAlgES256 = -7
+	coseAlgEdDSA = -8
+	coseAlgRS256 = -257
+)
+
+// webAuthnAlgs - pubKeyCredParams, in order of preference
+var webAuthnAlgs = []int64{coseAlgES256, coseAlgEdDSA, coseAlgRS256}
+
+// authenticator data flags
+const (
+	webAuthnFlagUP = 0x01 //user present
+	webAuthnFlagUV = 0x04 //user verified
+	webAuthnFlagAT = 0x40 //attested credential data included
+	webAuthnFlagED = 0x80 //extension data included
+)
+
+// webAuthnMaxCredentialIDLength - credential ids are saved base64url encoded in a VARCHAR(512)
+const webAuthnMaxCredentialIDLength = 384
+
+// oidAAGUID - id-fido-gen-ce-aaguid, aaguid extension of attestation certificates
+var oidAAGUID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 45724, 1, 1, 4}
+
+// webAuthnEncoding - base64url without padding, as used by the WebAuthn JSON serialization
+var webAuthnEncoding = base64.RawURLEncoding
+
+// WebAuthnEncode - base64url encodes binary WebAuthn values, eg credential ids
+func WebAuthnEncode(data []byte) string {
+	return webAuthnEncoding.EncodeToString(data)
+}
+
+// WebAuthnDecode - decodes base64url values sent by clients, with or without padding
+func WebAuthnDecode(s string) ([]byte, error) {
+	return webAuthnEncoding.DecodeString(strings.TrimRight(s, "="))
+}
+
+// GenerateWebAuthnChallenge - random base64url challenge of a ceremony
+func GenerateWebAuthnChallenge() (string, error) {
+
+	challenge := make([]byte, 32)
+	if _, err := rand.Read(challenge); err != nil {
+		return "", err
+	}
+
+	return WebAuthnEncode(challenge), nil
+}
+
+// webAuthnUserHandle - user.id of the credential, the base64url user id
+func webAuthnUserHandle(userID interface{}) string {
+	return WebAuthnEncode([]byte(GetStringOrEmpty(userID)))
+}
+
+//######## CBOR
+
+// errCBORTruncated - data ends in the middle of an item
+var errCBORTruncated = errors.New("cbor: unexpected end of data")
+
+// cborMaxDepth - nested arrays/maps, attestation objects need 4
+const cborMaxDepth = 16
+
+// cborDecode - decodes one CBOR (RFC 7049) data item and returns the data after it.
+// Integers decode to int64, byte strings to []byte, text to string, arrays to []interface{}
+// and maps to map[interface{}]interface{}. Tags are skipped, indefinite lengths are not supported
+func cborDecode(data []byte) (interface{}, []byte, error) {
+	return cborDecodeItem(data, 0)
+}
+
+// cborDecodeItem - decodes the item at depth
+func cborDecodeItem(data []byte, depth int) (interface{}, []byte, error) {
+
+	if depth > cborMaxDepth {
+		return nil, nil, errors.New("cbor: nested too deep")
+	}
+	if len(data) == 0 {
+		return nil, nil, errCBORTruncated
+	}
+
+	major := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	//simple values and floats
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, data, nil
+		case 21:
+			return true, data, nil
+		case 22, 23:
+			return nil, data, nil
+		case 25:
+			if len(data) < 2 {
+				return nil, nil, errCBORTruncated
+			}
+			return cborHalfFloat(binary.BigEndian.Uint16(data)), data[2:], nil
+		case 26:
+			if len(data) < 4 {
+				return nil, nil, errCBORTruncated
+			}
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(data))), data[4:], nil
+		case 27:
+			if len(data) < 8 {
+				return nil, nil, errCBORTruncated
+			}
+			return math.Float64frombits(binary.BigEndian.Uint64(data)), data[8:], nil
+		}
+		return nil, nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+
+	n, data, err := cborArgument(info, data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch major {
+
+	//unsigned and negative integers
+	case 0, 1:
+		if n > math.MaxInt64 {
+			return nil, nil, errors.New("cbor: integer overflows int64")
+		}
+		if major == 1 {
+			return -1 - int64(n), data, nil
+		}
+		return int64(n), data, nil
+
+	//byte and text strings
+	case 2, 3:
+		if uint64(len(data)) < n {
+			return nil, nil, errCBORTruncated
+		}
+		if major == 3 {
+			return string(data[:n]), data[n:], nil
+		}
+		value := make([]byte, n)
+		copy(value, data[:n])
+		return value, data[n:], nil
+
+	//arrays, every item takes at least a byte
+	case 4:
+		if uint64(len(data)) < n {
+			return nil, nil, errCBORTruncated
+		}
+		items := make([]interface{}, 0, n)
+		for i := uint64(0); i < n; i++ {
+			var item interface{}
+			item, data, err = cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items = append(items, item)
+		}
+		return items, data, nil
+
+	//maps
+	case 5:
+		if n > uint64(len(data))/2 {
+			return nil, nil, errCBORTruncated
+		}
+		items := make(map[interface{}]interface{}, n)
+		for i := uint64(0); i < n; i++ {
+			var key, value interface{}
+			key, data, err = cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, fmt.Errorf("cbor: unsupported map key type %T", key)
+			}
+			if _, ok := items[key]; ok {
+				return nil, nil, fmt.Errorf("cbor: duplicate map key %v", key)
+			}
+
+			value, data, err = cborDecodeItem(data, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			items[key] = value
+		}
+		return items, data, nil
+
+	//tags, the tagged item is returned
+	case 6:
+		return cborDecodeItem(data, depth+1)
+	}
+
+	return nil, nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// cborArgument - length/value that follows the initial byte
+func cborArgument(info byte, data []byte) (uint64, []byte, error) {
+
+	switch {
+	case info < 24:
+		return uint64(info), data, nil
+	case info == 24 && len(data) >= 1:
+		return uint64(data[0]), data[1:], nil
+	case info == 25 && len(data) >= 2:
+		return uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26 && len(data) >= 4:
+		return uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27 && len(data) >= 8:
+		return binary.BigEndian.Uint64(data), data[8:], nil
+	case info == 31:
+		return 0, nil, errors.New("cbor: indefinite length not supported")
+	case info > 27:
+		return 0, nil, fmt.Errorf("cbor: reserved additional information %d", info)
+	}
+
+	return 0, nil, errCBORTruncated
+}
+
+// cborHalfFloat - IEEE 754 half precision float
+func cborHalfFloat(bits uint16) float64 {
+
+	exp := int(bits>>10) & 0x1f
+	mant := float64(bits & 0x3ff)
+
+	var value float64
+	switch exp {
+	case 0:
+		value = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			value = math.Inf(1)
+		} else {
+			value = math.NaN()
+		}
+	default:
+		value = math.Ldexp(mant+1024, exp-25)
+	}
+
+	if bits&0x8000 != 0 {
+		return -value
+	}
+	return value
+}
+
+//######## COSE KEYS
+
+// parseCOSEKey - public key and algorithm of a COSE_Key (RFC 8152), EC2 P-256, OKP Ed25519 and RSA keys are supported
+func parseCOSEKey(data []byte) (crypto.PublicKey, int64, error) {
+
+	decoded, rest, err := cborDecode(data)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(rest) > 0 {
+		return nil, 0, errors.New("cose: trailing data after key")
+	}
+
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, 0, errors.New("cose: key is not a map")
+	}
+
+	kty, _ := key[int64(1)].(int64)
+	alg, _ := key[int64(3)].(int64)
+
+	switch alg {
+
+	case coseAlgES256:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		y, _ := key[int64(-3)].([]byte)
+		if kty != 2 || crv != 1 || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("cose: invalid ES256 key")
+		}
+
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, 0, errors.New("cose: ES256 key is not on the curve")
+		}
+		return publicKey, alg, nil
+
+	case coseAlgEdDSA:
+		crv, _ := key[int64(-1)].(int64)
+		x, _ := key[int64(-2)].([]byte)
+		if kty != 1 || crv != 6 || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("cose: invalid EdDSA key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+
+	case coseAlgRS256:
+		n, _ := key[int64(-1)].([]byte)
+		e, _ := key[int64(-2)].([]byte)
+		if kty != 3 || len(n) < 256 || len(e) == 0 || len(e) > 4 {
+			return nil, 0, errors.New("cose: invalid RS256 key")
+		}
+
+		exponent := 0
+		for _, b := range e {
+			exponent = exponent<<8 | int(b)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, alg, nil
+	}
+
+	return nil, 0, fmt.Errorf("cose: unsupported algorithm %d", alg)
+}
+
+// verifyCOSESignature - verifies the signature of data with the key, for the COSE algorithm
+func verifyCOSESignature(alg int64, publicKey crypto.PublicKey, data []byte, signature []byte) error {
+
+	switch alg {
+
+	case coseAlgES256:
+		key, ok := publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match the ES256 algorithm")
+		}
+
+		//ASN.1 DER encoded signature
+		var sig struct {
+			R, S *big.Int
+		}
+		rest, err := asn1.Unmarshal(signature, &sig)
+		if err != nil || len(rest) > 0 {
+			return errors.New("malformed ES256 signature")
+		}
+
+		digest := sha256.Sum256(data)
+		if !ecdsa.Verify(key, digest[:], sig.R, sig.S) {
+			return errors.New("invalid signature")
+		}
+		return nil
+
+	case coseAlgEdDSA:
+		key, ok := publicKey.(ed25519.PublicKey)
+		if !ok {
+			return errors.New("key does not match the EdDSA algorithm")
+		}
+		if !ed25519.Verify(key, data, signature) {
+			return errors.New("invalid signature")
+		}
+		return nil
+
+	case coseAlgRS256:
+		key, ok := publicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("key does not match the RS256 algorithm")
+		}
+
+		digest := sha256.Sum256(data)
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("invalid signature")
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unsupported algorithm %d", alg)
+}
+
+//######## CEREMONIES
+
+// webAuthnClientData - CollectedClientData, signed by the authenticator as a hash
+type webAuthnClientData struct {
+	Type        string `json:"type"`
+	Challenge   string `json:"challenge"`
+	Origin      string `json:"origin"`
+	CrossOrigin bool   `json:"crossOrigin"`
+}
+
+// webAuthnAuthData - authenticator data, the attested credential is only in registrations
+type webAuthnAuthData struct {
+	raw       []byte
+	rpIDHash  []byte
+	flags     byte
+	signCount uint32
+
+	aaguid       []byte
+	credentialID []byte
+	publicKey    []byte
+}
+
+// webAuthnAttestation - verified registration
+type webAuthnAttestation struct {
+	authData *webAuthnAuthData
+
+	//attestationType - none, self or basic
+	attestationType string
+}
+
+// webAuthnOrigins - allowed client origins, defaults to https://<rp id>
+func webAuthnOrigins() []string {
+	if len(Config.WebAuthnOrigins) > 0 {
+		return Config.WebAuthnOrigins
+	}
+	return []string{"https://" + Config.WebAuthnRPID}
+}
+
+// parseWebAuthnClientData - parses the client data json and checks the type and origin,
+// the challenge is checked by the caller
+func parseWebAuthnClientData(clientDataJSON []byte, clientDataType string) (*webAuthnClientData, error) {
+
+	var clientData webAuthnClientData
+	if err := json.Unmarshal(clientDataJSON, &clientData); err != nil {
+		return nil, errors.New("malformed client data")
+	}
+
+	if clientData.Type != clientDataType {
+		return nil, fmt.Errorf("client data type is %q, expected %q", clientData.Type, clientDataType)
+	}
+
+	if !ArrayContains(clientData.Origin, webAuthnOrigins()) {
+		return nil, fmt.Errorf("origin %q not allowed", clientData.Origin)
+	}
+
+	if IsEmptyString(clientData.Challenge) {
+		return nil, errors.New("challenge missing from client data")
+	}
+
+	return &clientData, nil
+}
+
+// parseWebAuthnAuthData - parses authenticator data and checks the rp id hash and user presence
+func parseWebAuthnAuthData(data []byte) (*webAuthnAuthData, error) {
+
+	if len(data) < 37 {
+		return nil, errors.New("authenticator data too short")
+	}
+
+	authData := &webAuthnAuthData{
+		raw:       data,
+		rpIDHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	rest := data[37:]
+
+	//attested credential data
+	if authData.flags&webAuthnFlagAT != 0 {
+		if len(rest) < 18 {
+			return nil, errors.New("attested credential data too short")
+		}
+
+		authData.aaguid = rest[:16]
+		idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+		rest = rest[18:]
+
+		if idLength == 0 || idLength > webAuthnMaxCredentialIDLength || len(rest) < idLength {
+			return nil, errors.New("invalid credential id length")
+		}
+		authData.credentialID = rest[:idLength]
+		rest = rest[idLength:]
+
+		//the key is followed by the extensions, if any
+		_, afterKey, err := cborDecode(rest)
+		if err != nil {
+			return nil, err
+		}
+		authData.publicKey = rest[:len(rest)-len(afterKey)]
+		rest = afterKey
+	}
+
+	if authData.flags&webAuthnFlagED != 0 {
+		_, afterExtensions, err := cborDecode(rest)
+		if err != nil {
+			return nil, err
+		}
+		rest = afterExtensions
+	}
+
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after authenticator data")
+	}
+
+	rpIDHash := sha256.Sum256([]byte(Config.WebAuthnRPID))
+	if !bytes.Equal(authData.rpIDHash, rpIDHash[:]) {
+		return nil, errors.New("rp id hash does not match")
+	}
+
+	if authData.flags&webAuthnFlagUP == 0 {
+		return nil, errors.New("user not present")
+	}
+
+	if Config.WebAuthnUserVerification == "required" && authData.flags&webAuthnFlagUV == 0 {
+		return nil, errors.New("user not verified")
+	}
+
+	return authData, nil
+}
+
+// verifyWebAuthnAttestation - verifies the attestation object of a registration,
+// returns the new credential in the authenticator data
+func verifyWebAuthnAttestation(attestationObject []byte, clientDataJSON []byte) (*webAuthnAttestation, error) {
+
+	decoded, rest, err := cborDecode(attestationObject)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.New("trailing data after attestation object")
+	}
+
+	object, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return nil, errors.New("attestation object is not a map")
+	}
+
+	format, _ := object["fmt"].(string)
+	attStmt, okStmt := object["attStmt"].(map[interface{}]interface{})
+	rawAuthData, okAuthData := object["authData"].([]byte)
+	if !okStmt || !okAuthData {
+		return nil, errors.New("malformed attestation object")
+	}
+
+	authData, err := parseWebAuthnAuthData(rawAuthData)
+	if err != nil {
+		return nil, err
+	}
+
+	if authData.flags&webAuthnFlagAT == 0 {
+		return nil, errors.New("attested credential data missing")
+	}
+
+	credentialKey, credentialAlg, err := parseCOSEKey(authData.publicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+
+	attestation := &webAuthnAttestation{authData: authData}
+
+	switch format {
+
+	case "none":
+		if len(attStmt) > 0 {
+			return nil, errors.New("none attestation with a statement")
+		}
+		attestation.attestationType = "none"
+
+	case "packed":
+		attestationType, err := verifyPackedAttestation(attStmt, authData, clientDataHash[:], credentialKey, credentialAlg)
+		if err != nil {
+			return nil, err
+		}
+		attestation.attestationType = attestationType
+
+	default:
+		return nil, fmt.Errorf("unsupported attestation format %q", format)
+	}
+
+	return attestation, nil
+}
+
+// verifyPackedAttestation - packed attestation statement, self attestation is signed
+// with the credential key and basic attestation with the attestation certificate (x5c)
+func verifyPackedAttestation(attStmt map[interface{}]interface{}, authData *webAuthnAuthData, clientDataHash []byte, credentialKey crypto.PublicKey, credentialAlg int64) (string, error) {
+
+	alg, okAlg := attStmt["alg"].(int64)
+	sig, okSig := attStmt["sig"].([]byte)
+	if !okAlg || !okSig {
+		return "", errors.New("malformed packed attestation statement")
+	}
+
+	signed := make([]byte, 0, len(authData.raw)+len(clientDataHash))
+	signed = append(signed, authData.raw...)
+	signed = append(signed, clientDataHash...)
+
+	x5c, hasX5C := attStmt["x5c"]
+
+	//self attestation
+	if !hasX5C {
+		if alg != credentialAlg {
+			return "", errors.New("self attestation algorithm does not match the credential")
+		}
+		if err := verifyCOSESignature(alg, credentialKey, signed, sig); err != nil {
+			return "", fmt.Errorf("attestation: %s", err)
+		}
+		return "self", nil
+	}
+
+	chain, _ := x5c.([]interface{})
+	if len(chain) == 0 {
+		return "", errors.New("empty attestation certificate chain")
+	}
+	der, ok := chain[0].([]byte)
+	if !ok {
+		return "", errors.New("malformed attestation certificate")
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return "", fmt.Errorf("attestation certificate: %s", err)
+	}
+
+	if err = verifyCOSESignature(alg, cert.PublicKey, signed, sig); err != nil {
+		return "", fmt.Errorf("attestation: %s", err)
+	}
+
+	if err = checkPackedCertificate(cert, authData.aaguid); err != nil {
+		return "", err
+	}
+
+	return "basic", nil
+}
+
+// checkPackedCertificate - requirements of packed attestation certificates
+func checkPackedCertificate(cert *x509.Certificate, aaguid []byte) error {
+
+	if cert.Version != 3 {
+		return errors.New("attestation certificate is not version 3")
+	}
+
+	if !ArrayContains("Authenticator Attestation", cert.Subject.OrganizationalUnit) || len(cert.Subject.Country) == 0 ||
+		len(cert.Subject.Organization) == 0 || IsEmptyString(cert.Subject.CommonName) {
+		return errors.New("invalid attestation certificate subject")
+	}
+
+	if cert.BasicConstraintsValid && cert.IsCA {
+		return errors.New("attestation certificate is a CA")
+	}
+
+	//aaguid extension, optional
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidAAGUID) {
+			continue
+		}
+
+		var value []byte
+		if _, err := asn1.Unmarshal(ext.Value, &value); err != nil || ext.Critical {
+			return errors.New("invalid aaguid extension")
+		}
+		if !bytes.Equal(value, aaguid) {
+			return errors.New("attestation certificate aaguid does not match")
+		}
+	}
+
+	return nil
+}
+
+// verifyWebAuthnAssertion - verifies the signature of a login with the saved credential key,
+// the signature counter must increase unless the authenticator does not count
+func verifyWebAuthnAssertion(credential *WebAuthnCredential, authenticatorData []byte, clientDataJSON []byte, signature []byte) (*webAuthnAuthData, error) {
+
+	authData, err := parseWebAuthnAuthData(authenticatorData)
+	if err != nil {
+		return nil, err
+	}
+
+	rawKey, err := WebAuthnDecode(credential.PublicKey)
+	if err != nil {
+		return nil, errors.New("malformed credential key")
+	}
+
+	publicKey, alg, err := parseCOSEKey(rawKey)
+	if err != nil {
+		return nil, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+
+	signed := make([]byte, 0, len(authenticatorData)+len(clientDataHash))
+	signed = append(signed, authenticatorData...)
+	signed = append(signed, clientDataHash[:]...)
+
+	if err = verifyCOSESignature(alg, publicKey, signed, signature); err != nil {
+		return nil, err
+	}
+
+	//a counter that did not increase means a cloned authenticator
+	if (authData.signCount != 0 || credential.SignCount != 0) && int64(authData.signCount) <= credential.SignCount {
+		return nil, errors.New("signature counter did not increase")
+	}
+
+	return authData, nil
+}
+
+// formatAAGUID - aaguid in the uuid format
+func formatAAGUID(aaguid []byte) string {
+	if len(aaguid) != 16 {
+		return ""
+	}
+	s := hex.EncodeToString(aaguid)
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}